@@ -0,0 +1,170 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/cloudflare/opaque-core/opaquenet"
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint"
+)
+
+// clientFlags are the flags of the register and login commands.
+type clientFlags struct {
+	commonFlags
+	username string
+	password string
+	internal bool
+}
+
+func newClientFlagSet(name string, stderr io.Writer, f *clientFlags) *flag.FlagSet {
+	fs := newFlagSet(name, stderr, &f.commonFlags)
+	fs.StringVar(&f.username, "user", "", "username (required)")
+	fs.StringVar(&f.password, "password", "", "password; read from stdin if empty")
+	fs.BoolVar(&f.internal, "internal", false, "register with an internal mode envelope, deriving the client key from the password")
+
+	return fs
+}
+
+// dial parses args, connects to the server and returns a new OPAQUE client
+// and the password.
+func dial(name string, args []string, stdin io.Reader, stderr io.Writer) (*opaquenet.Conn, *opaque.Client, []byte, error) {
+	var f clientFlags
+
+	fs := newClientFlagSet(name, stderr, &f)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if f.username == "" {
+		return nil, nil, nil, errors.New("-user is required")
+	}
+
+	suite, err := f.suiteID()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	password := []byte(f.password)
+	if len(password) == 0 {
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return nil, nil, nil, errors.Wrap(err, "read password")
+		}
+
+		password = []byte(strings.TrimRight(line, "\r\n"))
+	}
+
+	var signer opaque.PrivateKey
+	if !f.internal {
+		if signer, err = mint.NewSigningKey(mint.ECDSA_P256_SHA256); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	oc, err := opaque.NewClient(f.username, f.serverID, suite, signer)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	conn, err := opaquenet.Dial(f.network, f.address)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if f.verbose {
+		conn.MessageHook = dumpMessage(stderr)
+	}
+
+	return conn, oc, password, nil
+}
+
+// dumpMessage returns a MessageHook writing each message as JSON to w.
+func dumpMessage(w io.Writer) func(bool, opaque.ProtocolMessageBody) {
+	return func(sent bool, body opaque.ProtocolMessageBody) {
+		direction := "<"
+		if sent {
+			direction = ">"
+		}
+
+		data, err := json.MarshalIndent(body, "", "  ")
+		if err != nil {
+			fmt.Fprintf(w, "%s %v: %v\n", direction, body.Type(), err)
+			return
+		}
+
+		fmt.Fprintf(w, "%s %v\n%s\n", direction, body.Type(), data)
+	}
+}
+
+// register registers a user with the server.
+func register(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	conn, oc, password, err := dial("register", args, stdin, stderr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	exporterKey, err := conn.Register(oc, password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "registered %s\nexport key: %s\n", oc.UserID, hex.EncodeToString(exporterKey))
+
+	return nil
+}
+
+// login logs in and prints the export key and the recovered credentials.
+func login(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	conn, oc, password, err := dial("login", args, stdin, stderr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	creds, exportKey, err := conn.Login(oc, password)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "logged in as %s\nexport key: %s\ncredentials: %s\n", oc.UserID, hex.EncodeToString(exportKey), data)
+
+	return nil
+}
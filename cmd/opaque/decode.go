@@ -0,0 +1,454 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/cloudflare/opaque-core/opaquenet"
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint/syntax"
+)
+
+// Message encodings accepted by decode and produced by encode.
+const (
+	formatAuto   = "auto"
+	formatBinary = "binary"
+	formatBase64 = "base64"
+	formatHex    = "hex"
+)
+
+// readInput reads the file named by the first argument, or stdin if there is
+// none or it is "-".
+func readInput(fs *flag.FlagSet, stdin io.Reader) ([]byte, error) {
+	if fs.NArg() > 1 {
+		return nil, errors.New("too many arguments")
+	}
+
+	if fs.NArg() == 0 || fs.Arg(0) == "-" {
+		return ioutil.ReadAll(stdin)
+	}
+
+	return ioutil.ReadFile(fs.Arg(0))
+}
+
+// decode pretty-prints the protocol messages in the input.
+func decode(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: opaque decode [flags] [file]")
+		fs.PrintDefaults()
+	}
+
+	format := fs.String("format", formatAuto, "input encoding: auto, binary, base64 or hex")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	input, err := readInput(fs, stdin)
+	if err != nil {
+		return err
+	}
+
+	data, err := decodeInput(input, *format)
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		return errors.New("no input")
+	}
+
+	// The input may hold several messages, e.g. a capture of a connection.
+	for len(data) > 0 {
+		msg := new(opaque.ProtocolMessage)
+
+		n, err := msg.Unmarshal(data)
+		if err != nil {
+			return common.ErrorUnrecognizedMessage.Wrap(err)
+		}
+
+		data = data[n:]
+
+		if err := printMessage(stdout, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeInput returns the raw bytes of input in the given format.
+// In auto mode, input which is not a framed message is tried as hex, then
+// base64.
+func decodeInput(input []byte, format string) ([]byte, error) {
+	switch format {
+	case formatBinary:
+		return input, nil
+	case formatHex:
+		return hex.DecodeString(stripSpace(input))
+	case formatBase64:
+		return decodeBase64(stripSpace(input))
+	case formatAuto:
+		if looksFramed(input) {
+			return input, nil
+		}
+
+		text := stripSpace(input)
+		if data, err := hex.DecodeString(text); err == nil {
+			return data, nil
+		}
+
+		if data, err := decodeBase64(text); err == nil {
+			return data, nil
+		}
+
+		return nil, errors.New("input is not a binary, hex or base64 message")
+	}
+
+	return nil, errors.Errorf("unknown format %q", format)
+}
+
+// looksFramed returns whether data starts with a known message type and a
+// length which fits in data.
+func looksFramed(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+
+	t := opaque.ProtocolMessageType(data[0])
+	if _, ok := opaque.ProtocolMessageTypeToStringMap[t]; !ok && t != opaquenet.ProtocolMessageTypeAlert {
+		return false
+	}
+
+	length := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+
+	return 4+length <= len(data)
+}
+
+func stripSpace(data []byte) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+
+		return r
+	}, string(data))
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if data, err := enc.DecodeString(s); err == nil {
+			return data, nil
+		}
+	}
+
+	return nil, errors.New("invalid base64")
+}
+
+// printer writes indented fields.
+type printer struct {
+	w      io.Writer
+	indent int
+}
+
+func (p *printer) field(name, format string, args ...interface{}) {
+	fmt.Fprintf(p.w, "%s%s: %s\n", strings.Repeat("  ", p.indent), name, fmt.Sprintf(format, args...))
+}
+
+func (p *printer) bytes(name string, data []byte) {
+	p.field(name, "%s", formatBytes(data))
+}
+
+func (p *printer) section(name string, f func()) {
+	p.field(name, "")
+	p.indent++
+	f()
+	p.indent--
+}
+
+func formatBytes(data []byte) string {
+	if len(data) == 0 {
+		return "(empty)"
+	}
+
+	return fmt.Sprintf("%x (%d bytes)", data, len(data))
+}
+
+// formatText formats an identity, quoting it if it is printable.
+func formatText(data []byte) string {
+	for _, r := range string(data) {
+		if !unicode.IsPrint(r) {
+			return formatBytes(data)
+		}
+	}
+
+	return fmt.Sprintf("%q", data)
+}
+
+// formatKey describes a public key and its SHA-256 fingerprint.
+func formatKey(key crypto.PublicKey) string {
+	var desc string
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		desc = "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		desc = "Ed25519"
+	case opaque.X25519PublicKey:
+		desc = "X25519"
+	case *rsa.PublicKey:
+		desc = fmt.Sprintf("RSA %d", k.N.BitLen())
+	default:
+		desc = fmt.Sprintf("%T", key)
+	}
+
+	der, err := opaque.MarshalPublicKey(key)
+	if err != nil {
+		return desc
+	}
+
+	fingerprint := sha256.Sum256(der)
+
+	return fmt.Sprintf("%s, sha256:%x", desc, fingerprint)
+}
+
+// printMessage pretty-prints msg.
+func printMessage(w io.Writer, msg *opaque.ProtocolMessage) error {
+	p := &printer{w: w}
+
+	if msg.MessageType == opaquenet.ProtocolMessageTypeAlert {
+		p.field("Alert", "%d bytes", len(msg.MessageBodyRaw))
+		p.indent++
+
+		if len(msg.MessageBodyRaw) == 1 {
+			code := common.Error(msg.MessageBodyRaw[0])
+			if code == common.ErrorNoError {
+				p.field("Error", "0 (success)")
+			} else {
+				p.field("Error", "%d (%v)", code, code)
+			}
+		} else {
+			p.bytes("Body", msg.MessageBodyRaw)
+		}
+
+		fmt.Fprintln(w)
+
+		return nil
+	}
+
+	body, err := msg.Body()
+	if err != nil {
+		return err
+	}
+
+	p.field(msg.MessageType.String(), "%d bytes", len(msg.MessageBodyRaw))
+	p.indent++
+
+	switch body := body.(type) {
+	case *opaque.RegistrationRequest:
+		p.field("UserID", "%s", formatText(body.UserID))
+		p.bytes("OprfData", body.OprfData)
+	case *opaque.RegistrationResponse:
+		p.bytes("OprfData", body.OprfData)
+		p.field("ServerPublicKey", "%s", formatKey(body.ServerPublicKey))
+		p.section("CredentialEncodingPolicy", func() { printPolicy(p, body.CredentialEncodingPolicy) })
+	case *opaque.RegistrationUpload:
+		p.section("Envelope", func() { printEnvelope(p, body.Envelope) })
+		p.field("ClientPublicKey", "%s", formatKey(body.ClientPublicKey))
+	case *opaque.CredentialRequest:
+		p.field("UserID", "%s", formatText(body.UserID))
+		p.bytes("OprfData", body.OprfData)
+	case *opaque.CredentialResponse:
+		p.bytes("OprfData", body.OprfData)
+		p.section("Envelope", func() { printEnvelope(p, body.Envelope) })
+		p.field("ServerPublicKey", "%s", formatKey(body.ServerPublicKey()))
+		p.bytes("Challenge", body.Challenge)
+
+		if body.UpgradePolicy == nil {
+			p.field("UpgradePolicy", "none")
+		} else {
+			p.section("UpgradePolicy", func() { printPolicy(p, body.UpgradePolicy) })
+		}
+	case *opaque.LoginProof:
+		p.bytes("Proof", body.Proof)
+	}
+
+	fmt.Fprintln(w)
+
+	return nil
+}
+
+func printPolicy(p *printer, policy *opaque.CredentialEncodingPolicy) {
+	p.field("Version", "%d", policy.Version)
+	p.field("SecretTypes", "%s", formatTypes(policy.SecretTypes))
+	p.field("CleartextTypes", "%s", formatTypes(policy.CleartextTypes))
+}
+
+func formatTypes(types []opaque.CredentialType) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.String()
+	}
+
+	return "[" + strings.Join(names, ", ") + "]"
+}
+
+// printEnvelope prints the sizes of the envelope fields, and the cleartext
+// credentials it authenticates.
+func printEnvelope(p *printer, e *opaque.Envelope) {
+	p.field("Mode", "%v", e.Mode)
+	p.bytes("Nonce", e.Nonce)
+	p.field("EncryptedCreds", "%d bytes", len(e.EncryptedCreds))
+	p.bytes("AuthTag", e.AuthTag)
+
+	var list struct {
+		List []*opaque.CredentialExtension `tls:"head=2"`
+	}
+
+	n, err := syntax.Unmarshal(e.AuthenticatedCreds, &list)
+	if err != nil || n != len(e.AuthenticatedCreds) {
+		p.bytes("AuthenticatedCreds", e.AuthenticatedCreds)
+		return
+	}
+
+	p.section("AuthenticatedCreds", func() {
+		p.field("Length", "%d bytes", len(e.AuthenticatedCreds))
+
+		for _, ext := range list.List {
+			p.field(ext.CredentialType.String(), "%s", formatCredential(ext))
+		}
+	})
+}
+
+// formatCredential formats the value of a cleartext credential.
+func formatCredential(ext *opaque.CredentialExtension) string {
+	switch ext.CredentialType {
+	case opaque.CredentialTypeUserPublicKey, opaque.CredentialTypeServerPublicKey:
+		if key, err := opaque.ParsePublicKey(ext.CredentialData); err == nil {
+			return formatKey(key)
+		}
+	case opaque.CredentialTypeUserIdentity, opaque.CredentialTypeServerIdentity:
+		return formatText(ext.CredentialData)
+	}
+
+	return formatBytes(ext.CredentialData)
+}
+
+// encoders decode each message type from its JSON encoding.
+var encoders = map[string]func([]byte) (opaque.ProtocolMessageBody, error){
+	"registration-request": func(b []byte) (opaque.ProtocolMessageBody, error) {
+		return opaque.UnmarshalRegistrationRequestJSON(b)
+	},
+	"registration-response": func(b []byte) (opaque.ProtocolMessageBody, error) {
+		return opaque.UnmarshalRegistrationResponseJSON(b)
+	},
+	"registration-upload": func(b []byte) (opaque.ProtocolMessageBody, error) {
+		return opaque.UnmarshalRegistrationUploadJSON(b)
+	},
+	"credential-request": func(b []byte) (opaque.ProtocolMessageBody, error) {
+		return opaque.UnmarshalCredentialRequestJSON(b)
+	},
+	"credential-response": func(b []byte) (opaque.ProtocolMessageBody, error) {
+		return opaque.UnmarshalCredentialResponseJSON(b)
+	},
+	"login-proof": func(b []byte) (opaque.ProtocolMessageBody, error) {
+		return opaque.UnmarshalLoginProofJSON(b)
+	},
+}
+
+// encode converts a message from its JSON encoding to a framed message.
+func encode(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("encode", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: opaque encode -type <type> [flags] [file]")
+		fs.PrintDefaults()
+	}
+
+	msgType := fs.String("type", "", "message type: registration-request, registration-response,\n"+
+		"registration-upload, credential-request, credential-response or login-proof (required)")
+	format := fs.String("format", formatBase64, "output encoding: binary, base64 or hex")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	unmarshal, ok := encoders[*msgType]
+	if !ok {
+		return errors.Errorf("unknown message type %q", *msgType)
+	}
+
+	input, err := readInput(fs, stdin)
+	if err != nil {
+		return err
+	}
+
+	body, err := unmarshal(bytes.TrimSpace(input))
+	if err != nil {
+		return errors.Wrap(err, "decode JSON")
+	}
+
+	msg, err := opaque.ProtocolMessageFromBody(body)
+	if err != nil {
+		return err
+	}
+
+	data, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case formatBinary:
+		_, err = stdout.Write(data)
+	case formatBase64:
+		_, err = fmt.Fprintln(stdout, base64.StdEncoding.EncodeToString(data))
+	case formatHex:
+		_, err = fmt.Fprintln(stdout, hex.EncodeToString(data))
+	default:
+		return errors.Errorf("unknown format %q", *format)
+	}
+
+	return err
+}
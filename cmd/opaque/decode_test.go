@@ -0,0 +1,265 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint"
+)
+
+// testMessages runs a registration and a login, and returns the exchanged
+// messages. The policy changes in between, so that the login carries an
+// upgrade policy.
+func testMessages() ([]opaque.ProtocolMessageBody, error) {
+	cfg, err := opaque.NewServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := opaque.NewClient("alice", "example.com", oprf.OPRFP256, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := opaque.NewServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.CredentialEncodingPolicy.Version = 1
+
+	regRequest, err := c.CreateRegistrationRequest("password")
+	if err != nil {
+		return nil, err
+	}
+
+	regResponse, err := s.CreateRegistrationResponse(regRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	upload, _, err := c.FinalizeRegistrationRequest(regResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.StoreUserRecord(upload); err != nil {
+		return nil, err
+	}
+
+	policy := *cfg.CredentialEncodingPolicy
+	policy.Version = 2
+	cfg.CredentialEncodingPolicy = &policy
+
+	credRequest, err := c.CreateCredentialRequest([]byte("password"))
+	if err != nil {
+		return nil, err
+	}
+
+	credResponse, err := s.CreateCredentialResponse(credRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := c.RecoverCredentials(credResponse); err != nil {
+		return nil, err
+	}
+
+	proof, err := c.ProveLogin()
+	if err != nil {
+		return nil, err
+	}
+
+	return []opaque.ProtocolMessageBody{regRequest, regResponse, upload, credRequest, credResponse, proof}, nil
+}
+
+func marshalMessages(bodies []opaque.ProtocolMessageBody) ([]byte, error) {
+	var data []byte
+
+	for _, body := range bodies {
+		msg, err := opaque.ProtocolMessageFromBody(body)
+		if err != nil {
+			return nil, err
+		}
+
+		raw, err := msg.Marshal()
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, raw...)
+	}
+
+	return data, nil
+}
+
+func TestDecode(t *testing.T) {
+	bodies, err := testMessages()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := marshalMessages(bodies)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// A success alert, as sent by the opaquenet server.
+	data = append(data, 255, 0, 0, 1, 0)
+
+	expected := []string{
+		"OPAQUE Registration Request: ",
+		`  UserID: "alice"`,
+		"OPAQUE Registration Response: ",
+		"  ServerPublicKey: ECDSA P-521, sha256:",
+		"  CredentialEncodingPolicy: \n    Version: 1\n",
+		"    SecretTypes: [User Private Key]",
+		"    CleartextTypes: [Server Public Key, Server Identity]",
+		"OPAQUE Registration Upload: ",
+		"    Nonce: ",
+		"    EncryptedCreds: ",
+		"      Server Public Key: ECDSA P-521, sha256:",
+		`      Server Identity: "example.com"`,
+		"  ClientPublicKey: ECDSA P-256, sha256:",
+		"OPAQUE Credential Request: ",
+		"OPAQUE Credential Response: ",
+		"  Challenge: ",
+		"  UpgradePolicy: \n    Version: 2\n",
+		"OPAQUE Login Proof: ",
+		"  Proof: ",
+		"Alert: 1 bytes\n  Error: 0 (success)",
+	}
+
+	inputs := map[string][]byte{
+		formatBinary: data,
+		formatHex:    []byte(hex.EncodeToString(data) + "\n"),
+		formatBase64: []byte(base64.StdEncoding.EncodeToString(data) + "\n"),
+	}
+
+	for format, input := range inputs {
+		for _, f := range []string{format, formatAuto} {
+			var stdout, stderr bytes.Buffer
+
+			err := run(context.Background(), []string{"decode", "-format", f}, bytes.NewReader(input), &stdout, &stderr)
+			if err != nil {
+				t.Errorf("%s as %s: %v", format, f, err)
+				continue
+			}
+
+			for _, s := range expected {
+				if !strings.Contains(stdout.String(), s) {
+					t.Errorf("%s as %s: missing %q in output:\n%s", format, f, s, stdout.String())
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		input    []byte
+		expected common.Error
+	}{
+		{[]byte{9, 0, 0, 1, 0}, common.ErrorUnrecognizedMessage}, // unknown type
+		{[]byte{4, 0, 0, 9, 0}, common.ErrorUnrecognizedMessage}, // truncated
+		{[]byte{4, 0, 0, 1, 0}, common.ErrorUnrecognizedMessage}, // bad body
+	}
+
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+
+		err := run(context.Background(), []string{"decode", "-format", formatBinary}, bytes.NewReader(test.input), &stdout, &stderr)
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%x: expected err %v to contain %v", test.input, err, test.expected)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := run(context.Background(), []string{"decode"}, strings.NewReader("not a message!"), &stdout, &stderr); err == nil {
+		t.Error("expected an error for garbage input")
+	}
+}
+
+func TestEncode(t *testing.T) {
+	bodies, err := testMessages()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	types := []string{"registration-request", "registration-response", "registration-upload",
+		"credential-request", "credential-response", "login-proof"}
+
+	for i, body := range bodies {
+		input, err := json.Marshal(body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		expected, err := marshalMessages(bodies[i : i+1])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var stdout, stderr bytes.Buffer
+
+		err = run(context.Background(), []string{"encode", "-type", types[i], "-format", formatBinary}, bytes.NewReader(input), &stdout, &stderr)
+		if err != nil {
+			t.Errorf("%s: %v", types[i], err)
+			continue
+		}
+
+		if !bytes.Equal(stdout.Bytes(), expected) {
+			t.Errorf("%s: got %x, expected %x", types[i], stdout.Bytes(), expected)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := run(context.Background(), []string{"encode", "-type", "alert"}, strings.NewReader("{}"), &stdout, &stderr); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/opaque"
+)
+
+// Flag defaults.
+const (
+	defaultNetwork  = "unix"
+	defaultServerID = "localhost"
+	defaultSuite    = "P256"
+)
+
+var defaultAddress = filepath.Join(os.TempDir(), "opaque.sock")
+
+// commonFlags are the flags shared by all commands.
+type commonFlags struct {
+	network  string
+	address  string
+	serverID string
+	suite    string
+	verbose  bool
+}
+
+func newFlagSet(name string, stderr io.Writer, f *commonFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	fs.StringVar(&f.network, "network", defaultNetwork, "network of the server socket: unix or tcp")
+	fs.StringVar(&f.address, "addr", defaultAddress, "address of the server socket")
+	fs.StringVar(&f.serverID, "server-id", defaultServerID, "server identity")
+	fs.StringVar(&f.suite, "suite", defaultSuite, "OPRF suite: P256, P384 or P521")
+	fs.BoolVar(&f.verbose, "v", false, "dump protocol messages or events as JSON to stderr")
+
+	return fs
+}
+
+// suiteID returns the OPRF suite named by the -suite flag.
+func (f *commonFlags) suiteID() (oprf.SuiteID, error) {
+	return opaque.SuiteByName(f.suite)
+}
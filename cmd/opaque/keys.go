@@ -0,0 +1,384 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+)
+
+var keysUsage = `usage: opaque keys <command> [flags]
+
+commands:
+  init      write a server config file with a new signing key and OPRF seed
+  generate  write a new PKCS#8 signing key
+  seed      write a new OPRF seed
+  export    print a signing key, or its public key, as PEM or raw hex
+  import    convert a PEM signing key to PKCS#8
+  rotate    replace the signing key or OPRF seed of a config file
+`
+
+// keys runs a key management command.
+func keys(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, keysUsage)
+		return errors.New("no keys command")
+	}
+
+	switch args[0] {
+	case "init":
+		return keysInit(args[1:], stdout, stderr)
+	case "generate":
+		return keysGenerate(args[1:], stderr)
+	case "seed":
+		return keysSeed(args[1:], stderr)
+	case "export":
+		return keysExport(args[1:], stdout, stderr)
+	case "import":
+		return keysImport(args[1:], stderr)
+	case "rotate":
+		return keysRotate(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, keysUsage)
+		return nil
+	}
+
+	fmt.Fprint(stderr, keysUsage)
+
+	return errors.Errorf("unknown keys command %q", args[0])
+}
+
+func newKeysFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("keys "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	return fs
+}
+
+// writeKeyFile writes a private key file readable only by its owner, failing
+// if it exists unless force is set.
+func writeKeyFile(path string, data []byte, force bool) error {
+	if path == "" {
+		return errors.New("-out is required")
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return errors.Errorf("%s exists, use -force to overwrite", path)
+		}
+
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func generateSigningKeyPEM(algorithm string) ([]byte, error) {
+	key, err := opaque.GeneratePrivateKey(nil, algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	return opaque.MarshalPrivateKeyPEM(key)
+}
+
+func generateOPRFSeedPEM() ([]byte, error) {
+	seed, err := opaque.GenerateOPRFSeed(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return opaque.MarshalOPRFSeedPEM(seed), nil
+}
+
+func keysGenerate(args []string, stderr io.Writer) error {
+	fs := newKeysFlagSet("generate", stderr)
+	alg := fs.String("alg", opaque.KeyAlgorithmP256, "key algorithm: P256, P384, P521, Ed25519 or X25519")
+	out := fs.String("out", "", "file to write the key to (required)")
+	force := fs.Bool("force", false, "overwrite an existing file")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := generateSigningKeyPEM(*alg)
+	if err != nil {
+		return err
+	}
+
+	return writeKeyFile(*out, data, *force)
+}
+
+func keysSeed(args []string, stderr io.Writer) error {
+	fs := newKeysFlagSet("seed", stderr)
+	out := fs.String("out", "", "file to write the seed to (required)")
+	force := fs.Bool("force", false, "overwrite an existing file")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	data, err := generateOPRFSeedPEM()
+	if err != nil {
+		return err
+	}
+
+	return writeKeyFile(*out, data, *force)
+}
+
+// readSigningKey reads a PEM signing key file.
+func readSigningKey(path string) (opaque.PrivateKey, error) {
+	if path == "" {
+		return nil, errors.New("-in is required")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := opaque.ParsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	return key, nil
+}
+
+func keysExport(args []string, stdout, stderr io.Writer) error {
+	fs := newKeysFlagSet("export", stderr)
+	in := fs.String("in", "", "signing key file (required)")
+	public := fs.Bool("public", false, "export the public key only")
+	raw := fs.Bool("raw", false, "print the raw fixed-length key in hex instead of PEM")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	key, err := readSigningKey(*in)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch {
+	case *public && *raw:
+		data, err = opaque.MarshalRawPublicKey(key.Public())
+	case *public:
+		data, err = opaque.MarshalPublicKeyPEM(key.Public())
+	case *raw:
+		data, err = opaque.MarshalRawPrivateKey(key)
+	default:
+		data, err = opaque.MarshalPrivateKeyPEM(key)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if *raw {
+		data = []byte(hex.EncodeToString(data) + "\n")
+	}
+
+	_, err = stdout.Write(data)
+
+	return err
+}
+
+func keysImport(args []string, stderr io.Writer) error {
+	fs := newKeysFlagSet("import", stderr)
+	in := fs.String("in", "", "PKCS#8 or SEC 1 PEM signing key file (required)")
+	out := fs.String("out", "", "file to write the PKCS#8 key to (required)")
+	force := fs.Bool("force", false, "overwrite an existing file")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	key, err := readSigningKey(*in)
+	if err != nil {
+		return err
+	}
+
+	data, err := opaque.MarshalPrivateKeyPEM(key)
+	if err != nil {
+		return err
+	}
+
+	return writeKeyFile(*out, data, *force)
+}
+
+func keysRotate(args []string, stdout, stderr io.Writer) error {
+	fs := newKeysFlagSet("rotate", stderr)
+	configPath := fs.String("config", "", "server config file (required)")
+	alg := fs.String("alg", opaque.KeyAlgorithmP256, "algorithm of the new signing key")
+	seed := fs.Bool("seed", false, "rotate the OPRF seed instead of the signing key")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *configPath == "" {
+		return errors.New("-config is required")
+	}
+
+	f, err := opaque.ReadServerConfigFile(*configPath)
+	if err != nil {
+		return err
+	}
+
+	var archive string
+
+	if *seed {
+		if f.OPRFSeedFile == "" {
+			return errors.Errorf("%s: oprf_seed_file not set", *configPath)
+		}
+
+		archive, err = opaque.RotateOPRFSeed(f.Path(*configPath, f.OPRFSeedFile))
+	} else {
+		archive, err = rotateSigningKey(*configPath, f, *alg)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "previous key kept in %s\n", archive)
+
+	return nil
+}
+
+// rotateSigningKey rotates the signing key of the config file f at configPath,
+// and lists the archived key in the config so that users registered with it
+// can still log in. Returns the archive path.
+func rotateSigningKey(configPath string, f *opaque.ServerConfigFile, alg string) (string, error) {
+	archive, err := opaque.RotateSigningKey(f.Path(configPath, f.SigningKeyFile), alg)
+	if err != nil {
+		return "", err
+	}
+
+	name, err := filepath.Rel(filepath.Dir(configPath), archive)
+	if err != nil {
+		name = archive
+	}
+
+	f.PreviousSigningKeyFiles = append(f.PreviousSigningKeyFiles, name)
+
+	if err := opaque.WriteServerConfigFile(configPath, f); err != nil {
+		return "", errors.Wrapf(err, "previous key kept in %s but not added to the config", archive)
+	}
+
+	return archive, nil
+}
+
+// Names of the files written by keys init, next to the config file.
+const (
+	signingKeyFile = "signing_key.pem"
+	oprfSeedFile   = "oprf_seed.pem"
+)
+
+func keysInit(args []string, stdout, stderr io.Writer) error {
+	var cf commonFlags
+
+	fs := newKeysFlagSet("init", stderr)
+	fs.StringVar(&cf.serverID, "server-id", defaultServerID, "server identity")
+	fs.StringVar(&cf.suite, "suite", defaultSuite, "OPRF suite: P256, P384 or P521")
+	configPath := fs.String("config", "", "server config file to write (required)")
+	alg := fs.String("alg", opaque.KeyAlgorithmP256, "signing key algorithm")
+	force := fs.Bool("force", false, "overwrite existing files")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *configPath == "" {
+		return errors.New("-config is required")
+	}
+
+	if _, err := cf.suiteID(); err != nil {
+		return err
+	}
+
+	key, err := generateSigningKeyPEM(*alg)
+	if err != nil {
+		return err
+	}
+
+	seed, err := generateOPRFSeedPEM()
+	if err != nil {
+		return err
+	}
+
+	f := &opaque.ServerConfigFile{
+		ServerID:       cf.serverID,
+		Suite:          cf.suite,
+		SigningKeyFile: signingKeyFile,
+		OPRFSeedFile:   oprfSeedFile,
+	}
+
+	config, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(*configPath)
+
+	if err := writeKeyFile(filepath.Join(dir, signingKeyFile), key, *force); err != nil {
+		return err
+	}
+
+	if err := writeKeyFile(filepath.Join(dir, oprfSeedFile), seed, *force); err != nil {
+		return err
+	}
+
+	if err := writeKeyFile(*configPath, append(config, '\n'), *force); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "wrote %s\n", *configPath)
+
+	return nil
+}
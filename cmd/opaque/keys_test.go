@@ -0,0 +1,195 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/opaque-core/opaque"
+)
+
+func TestKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opaque-cli")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	configPath := filepath.Join(dir, "server.json")
+
+	var stdout, stderr bytes.Buffer
+
+	if err := run(ctx, []string{"keys", "init", "-config", configPath, "-server-id", "example.com"}, nil, &stdout, &stderr); err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg, err := opaque.LoadServerConfig(configPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if cfg.ServerID != "example.com" || cfg.OPRFSeed == nil {
+		t.Errorf("incorrect config %+v", cfg)
+	}
+
+	// Files are not overwritten by accident.
+	if err := run(ctx, []string{"keys", "init", "-config", configPath}, nil, &stdout, &stderr); err == nil {
+		t.Error("expected an error overwriting the config")
+	}
+
+	stdout.Reset()
+
+	if err := run(ctx, []string{"keys", "rotate", "-config", configPath}, nil, &stdout, &stderr); err != nil {
+		t.Error(err)
+		return
+	}
+
+	archive := strings.TrimPrefix(strings.TrimSpace(stdout.String()), "previous key kept in ")
+	if _, err := os.Stat(archive); err != nil {
+		t.Error(err)
+		return
+	}
+
+	rotated, err := opaque.LoadServerConfig(configPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if reflect.DeepEqual(cfg.Signer, rotated.Signer) || !bytes.Equal(cfg.OPRFSeed, rotated.OPRFSeed) {
+		t.Error("signing key not rotated")
+	}
+
+	if len(rotated.PreviousSigners) != 1 || !reflect.DeepEqual(cfg.Signer, rotated.PreviousSigners[0]) {
+		t.Error("previous signing key not kept in the config")
+	}
+
+	// Import an OpenSSL-style key, then export it and its public key.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sec1 := filepath.Join(dir, "sec1.pem")
+	if err := ioutil.WriteFile(sec1, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Error(err)
+		return
+	}
+
+	pkcs8 := filepath.Join(dir, "pkcs8.pem")
+	if err := run(ctx, []string{"keys", "import", "-in", sec1, "-out", pkcs8}, nil, &stdout, &stderr); err != nil {
+		t.Error(err)
+		return
+	}
+
+	stdout.Reset()
+
+	if err := run(ctx, []string{"keys", "export", "-in", pkcs8, "-public"}, nil, &stdout, &stderr); err != nil {
+		t.Error(err)
+		return
+	}
+
+	block, _ := pem.Decode(stdout.Bytes())
+	if block == nil {
+		t.Errorf("no PEM output: %s", stdout.Bytes())
+		return
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(pub, key.Public()) {
+		t.Error("incorrect exported public key")
+	}
+
+	for _, public := range []bool{false, true} {
+		stdout.Reset()
+
+		args := []string{"keys", "export", "-in", pkcs8, "-raw"}
+		if public {
+			args = append(args, "-public")
+		}
+
+		if err := run(ctx, args, nil, &stdout, &stderr); err != nil {
+			t.Error(err)
+			return
+		}
+
+		expected, err := opaque.MarshalRawPrivateKey(key)
+		if public {
+			expected, err = opaque.MarshalRawPublicKey(key.Public())
+		}
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if stdout.String() != hex.EncodeToString(expected)+"\n" {
+			t.Errorf("public %v: incorrect raw key %q", public, stdout.String())
+		}
+	}
+
+	for _, args := range [][]string{
+		{"keys"},
+		{"keys", "unknown"},
+		{"keys", "generate"},
+		{"keys", "generate", "-alg", "P999", "-out", filepath.Join(dir, "new.pem")},
+		{"keys", "export"},
+		{"keys", "rotate", "-config", configPath, "-seed", "-bad-flag"},
+	} {
+		if err := run(ctx, args, nil, &stdout, &stderr); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
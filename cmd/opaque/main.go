@@ -0,0 +1,119 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Command opaque runs OPAQUE registration and login against a local server,
+// for experimenting with the protocol without writing Go.
+//
+// Start a server on a socket, then register and log in:
+//
+//	opaque serve
+//	opaque register -user alice
+//	opaque login -user alice -v
+//
+// Decode captured messages, or encode them from JSON:
+//
+//	opaque decode capture.bin
+//	opaque encode -type credential-request request.json | opaque decode
+//
+// Keep the server keys in files, and serve with them:
+//
+//	opaque keys init -config server.json
+//	opaque serve -config server.json
+//
+// The server keeps user records in memory. Run "opaque help" for the flags of
+// each subcommand.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+var usage = `usage: opaque <command> [flags]
+
+commands:
+  serve     run a server with an in-memory record table on a socket
+  register  register a user with the server
+  login     log in and print the recovered credentials
+  decode    pretty-print binary, base64 or hex protocol messages
+  encode    encode a protocol message from its JSON encoding
+  keys      generate, import, export and rotate server keys
+  help      print this message
+
+Run "opaque <command> -h" for the flags of a command.
+`
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "opaque:", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command given by args.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return errors.New("no command")
+	}
+
+	switch args[0] {
+	case "serve":
+		return serve(ctx, args[1:], stdout, stderr)
+	case "register":
+		return register(args[1:], stdin, stdout, stderr)
+	case "login":
+		return login(args[1:], stdin, stdout, stderr)
+	case "decode":
+		return decode(args[1:], stdin, stdout, stderr)
+	case "encode":
+		return encode(args[1:], stdin, stdout, stderr)
+	case "keys":
+		return keys(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return nil
+	}
+
+	fmt.Fprint(stderr, usage)
+
+	return errors.Errorf("unknown command %q", args[0])
+}
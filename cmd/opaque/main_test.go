@@ -0,0 +1,199 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use. The server keeps
+// writing events from its connections after the clients return.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestServeRegisterLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opaque-cli")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	addr := filepath.Join(dir, "opaque.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var serveOut, serveErr syncBuffer
+
+	served := make(chan error, 1)
+	go func() {
+		served <- run(ctx, []string{"serve", "-addr", addr, "-v"}, nil, &serveOut, &serveErr)
+	}()
+
+	// Wait for the server to listen.
+	for i := 0; ; i++ {
+		c, err := net.Dial("unix", addr)
+		if err == nil {
+			c.Close()
+			break
+		}
+
+		if i == 100 {
+			t.Errorf("server not listening: %v", err)
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	err = run(ctx, []string{"register", "-addr", addr, "-user", "alice", "-password", "password"}, nil, &stdout, &stderr)
+	if err != nil {
+		t.Errorf("register: %v", err)
+		return
+	}
+
+	if !strings.HasPrefix(stdout.String(), "registered alice\nexport key: ") {
+		t.Errorf("incorrect register output %q", stdout.String())
+		return
+	}
+
+	exportKey := strings.Split(stdout.String(), "\n")[1]
+
+	stdout.Reset()
+
+	err = run(ctx, []string{"register", "-addr", addr, "-user", "carol", "-password", "password", "-internal"}, nil, &stdout, &stderr)
+	if err != nil {
+		t.Errorf("register internal: %v", err)
+		return
+	}
+
+	err = run(ctx, []string{"login", "-addr", addr, "-user", "carol", "-password", "password"}, nil, &stdout, &stderr)
+	if err != nil {
+		t.Errorf("login internal: %v", err)
+		return
+	}
+
+	// Password from stdin, and message dumps.
+	stdout.Reset()
+	stderr.Reset()
+
+	err = run(ctx, []string{"login", "-addr", addr, "-user", "alice", "-v"}, strings.NewReader("password\n"), &stdout, &stderr)
+	if err != nil {
+		t.Errorf("login: %v", err)
+		return
+	}
+
+	if !strings.HasPrefix(stdout.String(), "logged in as alice\n"+exportKey+"\n") || !strings.Contains(stdout.String(), `"Server Identity"`) {
+		t.Errorf("incorrect login output %q", stdout.String())
+		return
+	}
+
+	for _, dump := range []string{"> OPAQUE Credential Request\n{", "< OPAQUE Credential Response\n{"} {
+		if !strings.Contains(stderr.String(), dump) {
+			t.Errorf("missing %q in dump %q", dump, stderr.String())
+			return
+		}
+	}
+
+	err = run(ctx, []string{"login", "-addr", addr, "-user", "alice", "-password", "wrong"}, nil, &stdout, &stderr)
+	if !errors.Is(err, common.ErrorBadEnvelope) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorBadEnvelope)
+		return
+	}
+
+	err = run(ctx, []string{"login", "-addr", addr, "-user", "bob", "-password", "password"}, nil, &stdout, &stderr)
+	if !errors.Is(err, common.ErrorUserNotRegistered) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUserNotRegistered)
+		return
+	}
+
+	cancel()
+
+	if err := <-served; err != nil {
+		t.Errorf("serve: %v", err)
+		return
+	}
+
+	if !strings.Contains(serveErr.String(), `"type":"login_attempt"`) {
+		t.Errorf("missing events in %q", serveErr.String())
+		return
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	ctx := context.Background()
+
+	var stdout, stderr bytes.Buffer
+
+	tests := [][]string{
+		{},
+		{"unknown"},
+		{"login", "-password", "password"},
+		{"register", "-user", "alice", "-suite", "P999"},
+		{"serve", "-bad-flag"},
+	}
+
+	for _, args := range tests {
+		if err := run(ctx, args, nil, &stdout, &stderr); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+
+	if err := run(ctx, []string{"help"}, nil, &stdout, &stderr); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/cloudflare/opaque-core/opaquenet"
+)
+
+// serve runs an OPAQUE server until ctx is done.
+func serve(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	var f commonFlags
+
+	fs := newFlagSet("serve", stderr, &f)
+	configPath := fs.String("config", "", "server config file; overrides -server-id and -suite")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := newServerConfig(&f, *configPath)
+	if err != nil {
+		return err
+	}
+
+	cfg.RecordTable = opaque.NewLockedUserRecordTable(cfg.RecordTable)
+
+	if f.verbose {
+		cfg.EventSink = opaque.NewJSONLinesSink(stderr)
+	}
+
+	srv, err := opaquenet.NewServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	if f.network == "unix" {
+		// Remove the socket left by a server that did not exit cleanly.
+		if info, err := os.Stat(f.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(f.address)
+		}
+	}
+
+	l, err := net.Listen(f.network, f.address)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "serving %s on %s %s\n", cfg.ServerID, l.Addr().Network(), l.Addr())
+
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Serve(l) }()
+
+	select {
+	case <-ctx.Done():
+		return l.Close()
+	case err := <-errs:
+		l.Close()
+		return err
+	}
+}
+
+// newServerConfig loads the config file at configPath, or returns a config
+// with a fresh signing key if configPath is empty.
+func newServerConfig(f *commonFlags, configPath string) (*opaque.ServerConfig, error) {
+	if configPath != "" {
+		return opaque.LoadServerConfig(configPath)
+	}
+
+	suite, err := f.suiteID()
+	if err != nil {
+		return nil, err
+	}
+
+	return opaque.NewServerConfig(f.serverID, suite)
+}
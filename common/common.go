@@ -29,6 +29,8 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/x509"
+	"io"
+	"net"
 
 	"github.com/pkg/errors"
 
@@ -36,19 +38,31 @@ import (
 	"golang.org/x/crypto/cryptobyte"
 )
 
-// GetRandomBytes returns n random bytes.
-func GetRandomBytes(n int) []byte {
-	var key []byte
-	for success := false; !success; {
-		key = make([]byte, n)
-		if _, err := rand.Read(key); err != nil {
-			continue
-		}
+// GetRandomBytes returns n random bytes read from r, or from crypto/rand if r
+// is nil. Errors if fewer than n bytes can be read.
+func GetRandomBytes(r io.Reader, n int) ([]byte, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errors.Wrap(err, "read random bytes")
+	}
 
-		success = true
+	return b, nil
+}
+
+// RemoteHost returns the host part of a remote address, identifying the
+// client to audit sinks and attempt limiters. Returns addr unchanged if it has
+// no port, e.g. for Unix sockets.
+func RemoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
 	}
 
-	return key
+	return host
 }
 
 // Marshaler is the interface implemented by types that can be marshaled
@@ -60,6 +60,24 @@ const (
 
 	// ErrorOtherError represents other kinds of errors not previously covered.
 	ErrorOtherError
+
+	// ErrorInvalidState represents error when a protocol step is called out of order.
+	ErrorInvalidState
+	// ErrorRateLimited represents error when too many login attempts were made.
+	ErrorRateLimited
+
+	// ErrorMalformedEnvelope represents error when an uploaded envelope is not well formed.
+	ErrorMalformedEnvelope
+	// ErrorPolicyMismatch represents error when uploaded credentials do not match the credential encoding policy.
+	ErrorPolicyMismatch
+	// ErrorServerKeyMismatch represents error when an uploaded server public key is not the server's.
+	ErrorServerKeyMismatch
+	// ErrorClientKeyMismatch represents error when an uploaded user public key is not the one registered.
+	ErrorClientKeyMismatch
+	// ErrorIdentityMismatch represents error when an uploaded user or server identity is not the expected one.
+	ErrorIdentityMismatch
+	// ErrorServerNotTrusted represents error when the server a client logs in to is not the one it registered with or pinned.
+	ErrorServerNotTrusted
 )
 
 // Error returns the corresponding string to the error.
@@ -69,7 +87,8 @@ func (e Error) Error() string {
 
 // Is compares two errors.
 func (e Error) Is(target error) bool {
-	return e == target.(Error)
+	t, ok := target.(Error)
+	return ok && e == t
 }
 
 // Wrap coverts an stdlib error to a library one.
@@ -121,6 +140,30 @@ func (we *withError) MarshalJSON() ([]byte, error) {
 	return json.Marshal(ErrorOtherError)
 }
 
+// ErrorCode returns the library Error carried by err, walking the chain of
+// wrapped errors. Returns ErrorNoError for a nil error and ErrorOtherError if
+// no library Error is found.
+func ErrorCode(err error) Error {
+	if err == nil {
+		return ErrorNoError
+	}
+
+	for err != nil {
+		switch t := err.(type) {
+		case Error:
+			return t
+		case *withError:
+			if e, ok := t.err.(Error); ok {
+				return e
+			}
+		}
+
+		err = errors.Unwrap(err)
+	}
+
+	return ErrorOtherError
+}
+
 // Causer is an interface for the cause of an error.
 type Causer interface {
 	Cause() error
@@ -148,6 +191,15 @@ var alertToString = map[Error]string{
 	ErrorUnexpectedData:        "unexpected data",
 	ErrorBadEnvelope:           "decrypt envelope failed",
 	ErrorNotFound:              "not found",
+	ErrorOtherError:            "other error",
+	ErrorInvalidState:          "protocol step called out of order",
+	ErrorRateLimited:           "too many login attempts",
+	ErrorMalformedEnvelope:     "malformed envelope",
+	ErrorPolicyMismatch:        "credentials do not match the credential encoding policy",
+	ErrorServerKeyMismatch:     "server public key mismatch",
+	ErrorClientKeyMismatch:     "user public key mismatch",
+	ErrorIdentityMismatch:      "identity mismatch",
+	ErrorServerNotTrusted:      "server not trusted",
 }
 
 // Test strings
@@ -4,7 +4,10 @@ go 1.15
 
 require (
 	github.com/cloudflare/circl v1.0.1-0.20201119175735-683660a23121
+	github.com/golang/protobuf v1.4.2
 	github.com/pkg/errors v0.9.1
 	github.com/tatianab/mint v0.0.0-20200819182909-0544d841078f
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
+	google.golang.org/grpc v1.36.0
+	google.golang.org/protobuf v1.25.0
 )
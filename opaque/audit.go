@@ -0,0 +1,226 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+// EventType identifies the server step an audit Event reports on.
+type EventType int
+
+const (
+	// EventRegistrationRequest reports a call to CreateRegistrationResponse.
+	EventRegistrationRequest EventType = 1 + iota
+	// EventRegistrationUpload reports a call to StoreUserRecord.
+	EventRegistrationUpload
+	// EventPolicyViolation reports a registration or upgrade upload rejected
+	// for not following the credential encoding policy.
+	EventPolicyViolation
+	// EventLoginAttempt reports a call to CreateCredentialResponse for a
+	// registered user.
+	EventLoginAttempt
+	// EventUnknownUser reports a call to CreateCredentialResponse for a user
+	// who is not registered.
+	EventUnknownUser
+	// EventLoginResult reports a call to RecordLoginFailure or
+	// RecordLoginSuccess.
+	EventLoginResult
+	// EventRecordUpgrade reports a call to UpgradeUserRecord.
+	EventRecordUpgrade
+	// EventLoginProof reports a call to VerifyLoginProof.
+	EventLoginProof
+)
+
+var eventTypeToString = map[EventType]string{
+	EventRegistrationRequest: "registration_request",
+	EventRegistrationUpload:  "registration_upload",
+	EventPolicyViolation:     "policy_violation",
+	EventLoginAttempt:        "login_attempt",
+	EventUnknownUser:         "unknown_user",
+	EventLoginResult:         "login_result",
+	EventRecordUpgrade:       "record_upgrade",
+	EventLoginProof:          "login_proof",
+}
+
+func (t EventType) String() string {
+	return eventTypeToString[t]
+}
+
+// MarshalText encodes the event type as its name.
+func (t EventType) MarshalText() ([]byte, error) {
+	s, ok := eventTypeToString[t]
+	if !ok {
+		return nil, errors.Errorf("unknown event type %d", int(t))
+	}
+
+	return []byte(s), nil
+}
+
+// Outcome is the result of the step an audit Event reports on.
+type Outcome bool
+
+// Outcomes of a step.
+const (
+	OutcomeFailure Outcome = false
+	OutcomeSuccess Outcome = true
+)
+
+func (o Outcome) String() string {
+	if o {
+		return "success"
+	}
+
+	return "failure"
+}
+
+// MarshalText encodes the outcome as "success" or "failure".
+func (o Outcome) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+// Event is an audit record of a server protocol step. Usernames are not
+// recorded, only their SHA-256 hash.
+type Event struct {
+	Type         EventType    `json:"type"`
+	UsernameHash string       `json:"username_hash"` // hex encoded
+	ClientKey    string       `json:"client_key,omitempty"`
+	Outcome      Outcome      `json:"outcome"`
+	Error        common.Error `json:"error"` // ErrorNoError if none
+	Time         time.Time    `json:"time"`
+}
+
+// EventSink receives audit events from the Server. Implementations must be
+// safe for concurrent use, and should not block the protocol for long.
+type EventSink interface {
+	Event(e *Event)
+}
+
+// HashUsername returns the username hash recorded in audit events.
+func HashUsername(username []byte) string {
+	h := sha256.Sum256(username)
+	return hex.EncodeToString(h[:])
+}
+
+// audit sends an event for a step by username that ended with err to the
+// EventSink, if any.
+func (s *Server) audit(t EventType, username []byte, err error) {
+	s.auditOutcome(t, username, Outcome(err == nil), err)
+}
+
+// auditOutcome sends an event with an explicit outcome to the EventSink, if
+// any.
+func (s *Server) auditOutcome(t EventType, username []byte, outcome Outcome, err error) {
+	if s.Config.EventSink == nil {
+		return
+	}
+
+	s.Config.EventSink.Event(&Event{
+		Type:         t,
+		UsernameHash: HashUsername(username),
+		ClientKey:    s.ClientKey,
+		Outcome:      outcome,
+		Error:        common.ErrorCode(err),
+		Time:         time.Now(),
+	})
+}
+
+// JSONLinesSink is an EventSink which writes each event as a line of JSON.
+type JSONLinesSink struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewJSONLinesSink returns a new JSONLinesSink writing to w.
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{w: w}
+}
+
+// OpenJSONLinesFile returns a new JSONLinesSink appending to the file at path,
+// which is created if needed.
+func OpenJSONLinesFile(path string) (*JSONLinesSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewJSONLinesSink(f), nil
+}
+
+// Event writes e. Write errors are kept and returned by Err.
+func (s *JSONLinesSink) Event(e *Event) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		s.setErr(err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.w.Write(append(line, '\n')); err != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *JSONLinesSink) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Err returns the first error encountered writing events, if any.
+func (s *JSONLinesSink) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (s *JSONLinesSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,303 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+type expectedEvent struct {
+	Type     EventType
+	Username string
+	Outcome  Outcome
+	Error    common.Error
+}
+
+func checkEvents(events []*Event, expected []expectedEvent) error {
+	if len(events) != len(expected) {
+		return errors.Errorf("got %v events, expected %v", len(events), len(expected))
+	}
+
+	for i, e := range events {
+		x := expected[i]
+		if e.Type != x.Type || e.UsernameHash != HashUsername([]byte(x.Username)) ||
+			e.Outcome != x.Outcome || e.Error != x.Error {
+			return errors.Errorf("event %v: got %v %v %v %v, expected %v %v %v %v", i,
+				e.Type, e.UsernameHash, e.Outcome, e.Error,
+				x.Type, HashUsername([]byte(x.Username)), x.Outcome, x.Error)
+		}
+
+		if e.Time.IsZero() {
+			return errors.Errorf("event %v: no time", i)
+		}
+	}
+
+	return nil
+}
+
+func TestServerEvents(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sink := &TestEventSink{}
+	cfg.EventSink = sink
+
+	// Registration then login for a new user.
+	h, err := newStateHarness(cfg, "new user", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, step := range []string{"CreateRegistrationResponse", "StoreUserRecord", "CreateCredentialResponse"} {
+		if err := h.runServerStep(step); err != nil {
+			t.Errorf("%s: %v", step, err)
+			return
+		}
+	}
+
+	if err := h.server.RecordLoginFailure(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Success needs a login proof.
+	if err := h.server.RecordLoginSuccess(); !errors.Is(err, common.ErrorInvalidState) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorInvalidState)
+		return
+	}
+
+	if err := h.runServerStep("VerifyLoginProof"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := h.server.RecordLoginSuccess(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = checkEvents(sink.Events(), []expectedEvent{
+		{EventRegistrationRequest, "new user", OutcomeSuccess, common.ErrorNoError},
+		{EventRegistrationUpload, "new user", OutcomeSuccess, common.ErrorNoError},
+		{EventLoginAttempt, "new user", OutcomeSuccess, common.ErrorNoError},
+		{EventLoginResult, "new user", OutcomeFailure, common.ErrorNoError},
+		{EventLoginResult, "new user", OutcomeFailure, common.ErrorInvalidState},
+		{EventLoginProof, "new user", OutcomeSuccess, common.ErrorNoError},
+		{EventLoginResult, "new user", OutcomeSuccess, common.ErrorNoError},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Failures.
+	h, err = newStateHarness(cfg, "new user", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := h.runServerStep("CreateRegistrationResponse"); !errors.Is(err, common.ErrorUserAlreadyRegistered) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUserAlreadyRegistered)
+		return
+	}
+
+	if err := h.server.RecordLoginSuccess(); !errors.Is(err, common.ErrorInvalidState) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorInvalidState)
+		return
+	}
+
+	h, err = newStateHarness(cfg, "not a user", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := h.runServerStep("CreateCredentialResponse"); !errors.Is(err, common.ErrorUserNotRegistered) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUserNotRegistered)
+		return
+	}
+
+	err = checkEvents(sink.Events(), []expectedEvent{
+		{EventRegistrationRequest, "new user", OutcomeFailure, common.ErrorUserAlreadyRegistered},
+		{EventLoginResult, "", OutcomeFailure, common.ErrorInvalidState},
+		{EventUnknownUser, "not a user", OutcomeFailure, common.ErrorUserNotRegistered},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestJSONLinesSink(t *testing.T) {
+	events := []*Event{
+		{
+			Type:         EventLoginAttempt,
+			UsernameHash: HashUsername([]byte("user1")),
+			ClientKey:    "192.0.2.1",
+			Outcome:      OutcomeSuccess,
+			Time:         time.Unix(1600000000, 0).UTC(),
+		},
+		{
+			Type:         EventUnknownUser,
+			UsernameHash: HashUsername([]byte("not a user")),
+			Outcome:      OutcomeFailure,
+			Error:        common.ErrorUserNotRegistered,
+			Time:         time.Unix(1600000001, 0).UTC(),
+		},
+	}
+
+	var buf bytes.Buffer
+
+	sink := NewJSONLinesSink(&buf)
+	for _, e := range events {
+		sink.Event(e)
+	}
+
+	if err := sink.Err(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	scanner := bufio.NewScanner(&buf)
+
+	var lines []map[string]interface{}
+
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Error(err)
+			return
+		}
+
+		lines = append(lines, line)
+	}
+
+	if len(lines) != len(events) {
+		t.Errorf("got %v lines, expected %v", len(lines), len(events))
+		return
+	}
+
+	expected := []map[string]interface{}{
+		{
+			"type":          "login_attempt",
+			"username_hash": HashUsername([]byte("user1")),
+			"client_key":    "192.0.2.1",
+			"outcome":       "success",
+			"error":         float64(common.ErrorNoError),
+			"time":          "2020-09-13T12:26:40Z",
+		},
+		{
+			"type":          "unknown_user",
+			"username_hash": HashUsername([]byte("not a user")),
+			"outcome":       "failure",
+			"error":         float64(common.ErrorUserNotRegistered),
+			"time":          "2020-09-13T12:26:41Z",
+		},
+	}
+
+	for i := range lines {
+		if len(lines[i]) != len(expected[i]) {
+			t.Errorf("line %v: got %v, expected %v", i, lines[i], expected[i])
+			continue
+		}
+
+		for k, v := range expected[i] {
+			if lines[i][k] != v {
+				t.Errorf("line %v: got %v=%v, expected %v", i, k, lines[i][k], v)
+			}
+		}
+	}
+}
+
+func TestOpenJSONLinesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opaque-audit")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.jsonl")
+
+	// Events are appended across opens.
+	for i := 0; i < 2; i++ {
+		sink, err := OpenJSONLinesFile(path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		sink.Event(&Event{Type: EventLoginAttempt, Time: time.Now()})
+
+		if err := sink.Err(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err := sink.Close(); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n := bytes.Count(data, []byte("\n")); n != 2 {
+		t.Errorf("got %v lines, expected 2", n)
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("incorrect permissions %v", perm)
+		return
+	}
+}
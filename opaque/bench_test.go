@@ -0,0 +1,352 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"crypto"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/tatianab/mint"
+)
+
+// Run the benchmarks with, for example:
+//
+//	go test ./opaque -run '^$' -bench . -benchmem
+
+var benchSuites = []struct {
+	name  string
+	suite oprf.SuiteID
+}{
+	{"P256", oprf.OPRFP256},
+	{"P384", oprf.OPRFP384},
+	{"P521", oprf.OPRFP521},
+}
+
+// benchUsers makes the usernames registered by the benchmarks unique.
+var benchUsers int64
+
+func newBenchUsername() string {
+	return fmt.Sprintf("bench user %d", atomic.AddInt64(&benchUsers, 1))
+}
+
+// benchFlow is a registration or login by one client.
+type benchFlow struct {
+	cfg      *ServerConfig
+	password string
+	client   *Client
+	server   *Server
+
+	regRequest   *RegistrationRequest
+	regResponse  *RegistrationResponse
+	upload       *RegistrationUpload
+	credRequest  *CredentialRequest
+	credResponse *CredentialResponse
+}
+
+type benchStep func(f *benchFlow) error
+
+var registrationSteps = []benchStep{
+	func(f *benchFlow) (err error) {
+		f.regRequest, err = f.client.CreateRegistrationRequest(f.password)
+		return err
+	},
+	func(f *benchFlow) (err error) {
+		f.regResponse, err = f.server.CreateRegistrationResponse(f.regRequest)
+		return err
+	},
+	func(f *benchFlow) (err error) {
+		f.upload, _, err = f.client.FinalizeRegistrationRequest(f.regResponse)
+		return err
+	},
+	func(f *benchFlow) error {
+		return f.server.StoreUserRecord(f.upload)
+	},
+}
+
+var loginSteps = []benchStep{
+	func(f *benchFlow) (err error) {
+		f.credRequest, err = f.client.CreateCredentialRequest([]byte(f.password))
+		return err
+	},
+	func(f *benchFlow) (err error) {
+		f.credResponse, err = f.server.CreateCredentialResponse(f.credRequest)
+		return err
+	},
+	func(f *benchFlow) error {
+		_, _, err := f.client.RecoverCredentials(f.credResponse)
+		return err
+	},
+}
+
+// newBenchFlow returns a registration of a new user by a client with the
+// given key, or a login by a test user if signer is nil.
+func newBenchFlow(cfg *ServerConfig, signer crypto.Signer) (*benchFlow, error) {
+	username, password := "user1", "password1"
+	if signer != nil {
+		username, password = newBenchUsername(), "password"
+	}
+
+	c, err := NewClient(username, cfg.ServerID, cfg.Suite, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &benchFlow{cfg: cfg, password: password, client: c, server: s}, nil
+}
+
+// benchFlowSteps benchmarks steps[from:to] of a registration, or of a login
+// if register is false, for each suite. The earlier steps are run untimed.
+func benchFlowSteps(b *testing.B, register bool, from, to int) {
+	steps := loginSteps
+	if register {
+		steps = registrationSteps
+	}
+
+	for _, s := range benchSuites {
+		b.Run(s.name, func(b *testing.B) {
+			cfg, err := NewTestServerConfig("example.com", s.suite)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var signer crypto.Signer
+			if register {
+				if signer, err = mint.NewSigningKey(mint.ECDSA_P256_SHA256); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+
+				f, err := newBenchFlow(cfg, signer)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				for _, step := range steps[:from] {
+					if err := step(f); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.StartTimer()
+
+				for _, step := range steps[from:to] {
+					if err := step(f); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCreateRegistrationRequest(b *testing.B)   { benchFlowSteps(b, true, 0, 1) }
+func BenchmarkCreateRegistrationResponse(b *testing.B)  { benchFlowSteps(b, true, 1, 2) }
+func BenchmarkFinalizeRegistrationRequest(b *testing.B) { benchFlowSteps(b, true, 2, 3) }
+func BenchmarkStoreUserRecord(b *testing.B)             { benchFlowSteps(b, true, 3, 4) }
+func BenchmarkRegistration(b *testing.B)                { benchFlowSteps(b, true, 0, 4) }
+
+func BenchmarkCreateCredentialRequest(b *testing.B)  { benchFlowSteps(b, false, 0, 1) }
+func BenchmarkCreateCredentialResponse(b *testing.B) { benchFlowSteps(b, false, 1, 2) }
+func BenchmarkRecoverCredentials(b *testing.B)       { benchFlowSteps(b, false, 2, 3) }
+func BenchmarkLogin(b *testing.B)                    { benchFlowSteps(b, false, 0, 3) }
+
+// BenchmarkServerLoginParallel measures the throughput of the server side of
+// logins, with a server per request as in the transports. The requests are
+// made in advance; the record table is only read.
+func BenchmarkServerLoginParallel(b *testing.B) {
+	for _, s := range benchSuites {
+		b.Run(s.name, func(b *testing.B) {
+			cfg, err := NewTestServerConfig("example.com", s.suite)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			f, err := newBenchFlow(cfg, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if err := loginSteps[0](f); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					server, err := NewServer(cfg)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+
+					if _, err := server.CreateCredentialResponse(f.credRequest); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkServerRegistrationParallel measures the throughput of registration
+// responses, the server step of registration which evaluates the OPRF.
+func BenchmarkServerRegistrationParallel(b *testing.B) {
+	for _, s := range benchSuites {
+		b.Run(s.name, func(b *testing.B) {
+			cfg, err := NewTestServerConfig("example.com", s.suite)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			c, err := NewClient("new user", cfg.ServerID, cfg.Suite, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			request, err := c.CreateRegistrationRequest("password")
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					server, err := NewServer(cfg)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+
+					if _, err := server.CreateRegistrationResponse(request); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+var benchStretchers = []struct {
+	name      string
+	stretcher KeyStretcher
+}{
+	{"PBKDF2/iterations=1024", PBKDF2{Iterations: 1024}},
+	{"PBKDF2/iterations=4096", PBKDF2{Iterations: 4096}},
+	{"PBKDF2/iterations=16384", PBKDF2{Iterations: 16384}},
+	{"PBKDF2/iterations=65536", PBKDF2{Iterations: 65536}},
+	{"Argon2id/time=1,memory=16MiB,threads=1", Argon2id{Time: 1, Memory: 16 * 1024, Threads: 1}},
+	{"Argon2id/time=1,memory=64MiB,threads=4", Argon2id{Time: 1, Memory: 64 * 1024, Threads: 4}},
+	{"Argon2id/time=3,memory=64MiB,threads=4", Argon2id{Time: 3, Memory: 64 * 1024, Threads: 4}},
+}
+
+// newStretchFlow returns a flow by an internal mode client of username using
+// stretcher.
+func newStretchFlow(cfg *ServerConfig, username string, stretcher KeyStretcher) (*benchFlow, error) {
+	c, err := NewClient(username, cfg.ServerID, cfg.Suite, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c.KeyStretcher = stretcher
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &benchFlow{cfg: cfg, password: "password", client: c, server: s}, nil
+}
+
+// BenchmarkKeyStretching measures RecoverCredentials, whose cost is mostly
+// that of hardening the OPRF output, for candidate KeyStretcher settings.
+// Each client step after the OPRF costs one hardening.
+func BenchmarkKeyStretching(b *testing.B) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, s := range benchStretchers {
+		b.Run(s.name, func(b *testing.B) {
+			username := newBenchUsername()
+
+			f, err := newStretchFlow(cfg, username, s.stretcher)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for _, step := range registrationSteps {
+				if err := step(f); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+
+				f, err := newStretchFlow(cfg, username, s.stretcher)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				for _, step := range loginSteps[:2] {
+					if err := step(f); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.StartTimer()
+
+				if err := loginSteps[2](f); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
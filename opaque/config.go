@@ -0,0 +1,186 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/pkg/errors"
+)
+
+var suiteNames = map[string]oprf.SuiteID{
+	"P256": oprf.OPRFP256,
+	"P384": oprf.OPRFP384,
+	"P521": oprf.OPRFP521,
+}
+
+// SuiteByName returns the OPRF suite with the given name: P256, P384 or P521.
+func SuiteByName(name string) (oprf.SuiteID, error) {
+	suite, ok := suiteNames[name]
+	if !ok {
+		return 0, errors.Errorf("unknown suite %q", name)
+	}
+
+	return suite, nil
+}
+
+// ServerConfigFile is the on-disk JSON form of a ServerConfig. Key file paths
+// are relative to the directory of the config file.
+type ServerConfigFile struct {
+	ServerID       string           `json:"server_id"`
+	Suite          string           `json:"suite"`
+	SigningKeyFile string           `json:"signing_key_file"`
+	OPRFSeedFile   string           `json:"oprf_seed_file,omitempty"`
+	SecretTypes    []CredentialType `json:"secret_types,omitempty"`
+	CleartextTypes []CredentialType `json:"cleartext_types,omitempty"`
+	PolicyVersion  uint16           `json:"policy_version,omitempty"`
+
+	// PreviousSigningKeyFiles are the signing keys rotated out, kept to answer
+	// the users registered with them.
+	PreviousSigningKeyFiles []string `json:"previous_signing_key_files,omitempty"`
+}
+
+// ReadServerConfigFile reads a JSON config file.
+func ReadServerConfigFile(path string) (*ServerConfigFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &ServerConfigFile{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	return f, nil
+}
+
+// WriteServerConfigFile writes f as a JSON config file to path, replacing any
+// existing file.
+func WriteServerConfigFile(path string, f *ServerConfigFile) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append(data, '\n'), 0600)
+}
+
+// Path returns the path of a file named in the config file at configPath.
+func (f *ServerConfigFile) Path(configPath, name string) string {
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+
+	return filepath.Join(filepath.Dir(configPath), name)
+}
+
+// LoadServerConfig reads the config file at path and the keys it names. The
+// returned config has an empty in-memory record table, which callers
+// persisting records should replace.
+func LoadServerConfig(path string) (*ServerConfig, error) {
+	f, err := ReadServerConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.ServerID == "" {
+		return nil, errors.Errorf("%s: server_id not set", path)
+	}
+
+	suite, err := SuiteByName(f.Suite)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	if f.SigningKeyFile == "" {
+		return nil, errors.Errorf("%s: signing_key_file not set", path)
+	}
+
+	signer, err := f.readSigningKey(path, f.SigningKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &ServerConfig{
+		ServerID:    f.ServerID,
+		Signer:      signer,
+		RecordTable: NewInMemoryUserRecordTable(),
+		Suite:       suite,
+	}
+
+	for _, name := range f.PreviousSigningKeyFiles {
+		key, err := f.readSigningKey(path, name)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.PreviousSigners = append(cfg.PreviousSigners, key)
+	}
+
+	if f.OPRFSeedFile != "" {
+		data, err := ioutil.ReadFile(f.Path(path, f.OPRFSeedFile))
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.OPRFSeed, err = ParseOPRFSeedPEM(data)
+		if err != nil {
+			return nil, errors.Wrap(err, f.OPRFSeedFile)
+		}
+	}
+
+	if f.SecretTypes != nil || f.CleartextTypes != nil {
+		cfg.CredentialEncodingPolicy = &CredentialEncodingPolicy{
+			Version:        f.PolicyVersion,
+			SecretTypes:    f.SecretTypes,
+			CleartextTypes: f.CleartextTypes,
+		}
+	} else if f.PolicyVersion != 0 {
+		return nil, errors.Errorf("%s: policy_version set without secret_types or cleartext_types", path)
+	}
+
+	return cfg, nil
+}
+
+// readSigningKey reads the PEM signing key file named in the config file at
+// configPath.
+func (f *ServerConfigFile) readSigningKey(configPath, name string) (PrivateKey, error) {
+	data, err := ioutil.ReadFile(f.Path(configPath, name))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ParsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, errors.Wrap(err, name)
+	}
+
+	return key, nil
+}
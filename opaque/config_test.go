@@ -0,0 +1,135 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+)
+
+func TestLoadServerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opaque-config")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := GeneratePrivateKey(nil, KeyAlgorithmP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	keyPEM, err := MarshalPrivateKeyPEM(key)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	seed, err := GenerateOPRFSeed(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	files := map[string][]byte{
+		"key.pem":  keyPEM,
+		"seed.pem": MarshalOPRFSeedPEM(seed),
+		"server.json": []byte(`{
+			"server_id": "example.com",
+			"suite": "P384",
+			"signing_key_file": "key.pem",
+			"oprf_seed_file": "seed.pem",
+			"secret_types": ["User Private Key"],
+			"cleartext_types": ["Server Public Key", "Server Identity"],
+			"policy_version": 2
+		}`),
+		"no-seed.json":     []byte(`{"server_id": "example.com", "suite": "P256", "signing_key_file": "key.pem"}`),
+		"bad-suite.json":   []byte(`{"server_id": "example.com", "suite": "P999", "signing_key_file": "key.pem"}`),
+		"bad-type.json":    []byte(`{"server_id": "example.com", "suite": "P256", "signing_key_file": "key.pem", "secret_types": ["Password"]}`),
+		"bad-version.json": []byte(`{"server_id": "example.com", "suite": "P256", "signing_key_file": "key.pem", "policy_version": 2}`),
+		"no-key.json":      []byte(`{"server_id": "example.com", "suite": "P256"}`),
+		"missing-key.json": []byte(`{"server_id": "example.com", "suite": "P256", "signing_key_file": "missing.pem"}`),
+		"bad-key.json":     []byte(`{"server_id": "example.com", "suite": "P256", "signing_key_file": "seed.pem"}`),
+	}
+
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	cfg, err := LoadServerConfig(filepath.Join(dir, "server.json"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if cfg.ServerID != "example.com" || cfg.Suite != oprf.OPRFP384 || cfg.RecordTable == nil {
+		t.Errorf("incorrect config %+v", cfg)
+	}
+
+	if !reflect.DeepEqual(cfg.Signer, key) {
+		t.Error("incorrect signing key")
+	}
+
+	if !bytes.Equal(cfg.OPRFSeed, seed) {
+		t.Error("incorrect OPRF seed")
+	}
+
+	policy := &CredentialEncodingPolicy{
+		Version:        2,
+		SecretTypes:    []CredentialType{CredentialTypeUserPrivateKey},
+		CleartextTypes: []CredentialType{CredentialTypeServerPublicKey, CredentialTypeServerIdentity},
+	}
+	if !reflect.DeepEqual(cfg.CredentialEncodingPolicy, policy) {
+		t.Errorf("incorrect policy %+v", cfg.CredentialEncodingPolicy)
+	}
+
+	cfg, err = LoadServerConfig(filepath.Join(dir, "no-seed.json"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if cfg.OPRFSeed != nil || cfg.CredentialEncodingPolicy != nil {
+		t.Errorf("unexpected optional settings %+v", cfg)
+	}
+
+	for _, name := range []string{"bad-suite.json", "bad-type.json", "bad-version.json", "no-key.json", "missing-key.json", "bad-key.json", "missing.json"} {
+		if _, err := LoadServerConfig(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -39,6 +39,7 @@ import (
 // 	registration_upload(3),
 // 	credential_request(4),
 // 	credential_response(5),
+// 	login_proof(6),
 // 	(255)
 // } ProtocolMessageType;.
 type ProtocolMessageType byte
@@ -50,6 +51,7 @@ const (
 	ProtocolMessageTypeRegistrationUpload
 	ProtocolMessageTypeCredentialRequest
 	ProtocolMessageTypeCredentialResponse
+	ProtocolMessageTypeLoginProof
 )
 
 // A ProtocolMessage is a bundle containing all OPAQUE data sent in a flow
@@ -64,6 +66,7 @@ const (
 // 		case registration_upload: RegistrationUpload;
 // 		case credential_request: CredentialRequest;
 // 		case credential_response: CredentialResponse;
+// 		case login_proof: LoginProof;
 // 	};
 // } ProtocolMessage;
 //
@@ -99,6 +102,8 @@ func (msg *ProtocolMessage) ToBody() (ProtocolMessageBody, error) {
 		body = new(CredentialRequest)
 	case ProtocolMessageTypeCredentialResponse:
 		body = new(CredentialResponse)
+	case ProtocolMessageTypeLoginProof:
+		body = new(LoginProof)
 	default:
 		return body, errors.Wrapf(common.ErrorUnrecognizedMessage, "message type %s", msg.MessageType)
 	}
@@ -106,6 +111,26 @@ func (msg *ProtocolMessage) ToBody() (ProtocolMessageBody, error) {
 	return body, nil
 }
 
+// Body decodes the message body.
+// Errors if the type is not recognized or the body has trailing data.
+func (msg *ProtocolMessage) Body() (ProtocolMessageBody, error) {
+	body, err := msg.ToBody()
+	if err != nil {
+		return nil, err
+	}
+
+	bytesRead, err := body.Unmarshal(msg.MessageBodyRaw)
+	if err != nil {
+		return nil, common.ErrorUnrecognizedMessage.Wrap(err)
+	}
+
+	if bytesRead != len(msg.MessageBodyRaw) {
+		return nil, errors.Wrapf(common.ErrorUnexpectedData, "%d trailing bytes in %v", len(msg.MessageBodyRaw)-bytesRead, msg.MessageType)
+	}
+
+	return body, nil
+}
+
 // ProtocolMessageFromBody reconstructs a ProtocolMessage from its body.
 func ProtocolMessageFromBody(body ProtocolMessageBody) (*ProtocolMessage, error) {
 	bodyRaw, err := body.Marshal()
@@ -27,7 +27,11 @@ package opaque
 
 import (
 	"crypto/rand"
+	"reflect"
 	"testing"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
 )
 
 func TestMarshalUnmarshalProtocolMessage(t *testing.T) {
@@ -52,3 +56,35 @@ func TestMarshalUnmarshalProtocolMessage(t *testing.T) {
 		return
 	}
 }
+
+func TestProtocolMessageBody(t *testing.T) {
+	oprfData := make([]byte, 32)
+	_, _ = rand.Read(oprfData)
+
+	cr1 := &CredentialRequest{
+		UserID:   []byte("username"),
+		OprfData: oprfData,
+	}
+
+	msg, err := ProtocolMessageFromBody(cr1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cr2, err := msg.Body()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(cr1, cr2) {
+		t.Errorf("bodies not equal: %v, %v", cr1, cr2)
+		return
+	}
+
+	msg.MessageBodyRaw = append(msg.MessageBodyRaw, 0)
+	if _, err := msg.Body(); !errors.Is(err, common.ErrorUnexpectedData) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUnexpectedData)
+	}
+}
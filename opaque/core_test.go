@@ -26,9 +26,11 @@
 package opaque
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
 	"github.com/pkg/errors"
 	"github.com/tatianab/mint"
 )
@@ -40,6 +42,231 @@ func TestOPAQUECore(t *testing.T) {
 	}
 }
 
+func TestInternalModeClient(t *testing.T) {
+	for _, suite := range []oprf.SuiteID{oprf.OPRFP256, oprf.OPRFP384, oprf.OPRFP521} {
+		if err := runInternalMode(suite); err != nil {
+			t.Errorf("suite %d: %v", suite, err)
+		}
+	}
+}
+
+func runInternalMode(suite oprf.SuiteID) error {
+	signer, err := mint.NewSigningKey(mint.ECDSA_P521_SHA512)
+	if err != nil {
+		return err
+	}
+
+	cfg := &ServerConfig{
+		ServerID:    "example.com",
+		Signer:      signer,
+		RecordTable: make(InMemoryUserRecordTable),
+		Suite:       suite,
+	}
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	c, err := NewClient("user", cfg.ServerID, suite, nil)
+	if err != nil {
+		return err
+	}
+
+	regRequest, err := c.CreateRegistrationRequest("password")
+	if err != nil {
+		return errors.Wrap(err, "create reg request")
+	}
+
+	regResponse, err := s.CreateRegistrationResponse(regRequest)
+	if err != nil {
+		return errors.Wrap(err, "create reg response")
+	}
+
+	regUpload, _, err := c.FinalizeRegistrationRequest(regResponse)
+	if err != nil {
+		return errors.Wrap(err, "finalize request")
+	}
+
+	if regUpload.Envelope.Mode != EnvelopeModeInternal {
+		return errors.Errorf("got envelope mode %v", regUpload.Envelope.Mode)
+	}
+
+	// Under the default policy, the envelope stores nothing but two empty lists.
+	if n := len(regUpload.Envelope.EncryptedCreds) + len(regUpload.Envelope.AuthenticatedCreds); n != 4 {
+		return errors.Errorf("got %d bytes of credentials in internal mode envelope", n)
+	}
+
+	if err := s.StoreUserRecord(regUpload); err != nil {
+		return errors.Wrap(err, "store user record")
+	}
+
+	// A new client, with no key of its own, recovers the derived key.
+	for _, password := range []string{"wrong password", "password"} {
+		s, err = NewServer(cfg)
+		if err != nil {
+			return err
+		}
+
+		c, err = NewClient("user", cfg.ServerID, suite, nil)
+		if err != nil {
+			return err
+		}
+
+		loginRequest, err := c.CreateCredentialRequest([]byte(password))
+		if err != nil {
+			return errors.Wrap(err, "create cred request")
+		}
+
+		loginResponse, err := s.CreateCredentialResponse(loginRequest)
+		if err != nil {
+			return errors.Wrap(err, "create cred response")
+		}
+
+		creds, _, err := c.RecoverCredentials(loginResponse)
+		if password != "password" {
+			if !errors.Is(err, common.ErrorBadEnvelope) {
+				return errors.Errorf("expected bad envelope with wrong password, got %v", err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "recover creds")
+		}
+
+		key, ok := creds.Find(CredentialTypeUserPrivateKey)
+		if !ok {
+			return errors.New("no user private key recovered")
+		}
+
+		if !reflect.DeepEqual(key.(PrivateKey).Public(), s.UserRecord.UserPublicKey) {
+			return errors.New("recovered key does not match the registered public key")
+		}
+	}
+
+	return nil
+}
+
+func TestEnvelopeModes(t *testing.T) {
+	signer, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg := &ServerConfig{
+		ServerID:    "example.com",
+		Signer:      signer,
+		RecordTable: make(InMemoryUserRecordTable),
+		Suite:       oprf.OPRFP256,
+	}
+
+	modes := []EnvelopeMode{EnvelopeModeInternal, EnvelopeModeExternal, EnvelopeModeAESGCM, EnvelopeModeChaCha20Poly1305}
+
+	// Records of every mode are kept in the same table.
+	for _, mode := range modes {
+		var key PrivateKey
+		if mode != EnvelopeModeInternal {
+			key = signer
+		}
+
+		c, err := NewClient(mode.String(), cfg.ServerID, cfg.Suite, key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		c.EnvelopeMode = mode
+
+		if err := registerWith(cfg, c, "password"); err != nil {
+			t.Errorf("%v: %v", mode, err)
+			return
+		}
+	}
+
+	for _, mode := range modes {
+		s, err := NewServer(cfg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// The client learns the mode from the envelope.
+		c, err := NewClient(mode.String(), cfg.ServerID, cfg.Suite, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		request, err := c.CreateCredentialRequest([]byte("password"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		response, err := s.CreateCredentialResponse(request)
+		if err != nil {
+			t.Errorf("%v: %v", mode, err)
+			return
+		}
+
+		if response.Envelope.Mode != mode {
+			t.Errorf("%v: got envelope mode %v", mode, response.Envelope.Mode)
+		}
+
+		if _, _, err := c.RecoverCredentials(response); err != nil {
+			t.Errorf("%v: %v", mode, err)
+		}
+	}
+
+	// Modes other than internal need a client key, and internal mode none.
+	for _, mode := range modes {
+		var key PrivateKey
+		if mode == EnvelopeModeInternal {
+			key = signer
+		}
+
+		c, err := NewClient("mismatched", cfg.ServerID, cfg.Suite, key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		c.EnvelopeMode = mode
+
+		if err := registerWith(cfg, c, "password"); err == nil {
+			t.Errorf("%v: expected error registering with mismatched key", mode)
+		}
+	}
+}
+
+// registerWith registers the user of c with a new server for cfg.
+func registerWith(cfg *ServerConfig, c *Client, password string) error {
+	s, err := NewServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	request, err := c.CreateRegistrationRequest(password)
+	if err != nil {
+		return errors.Wrap(err, "create reg request")
+	}
+
+	response, err := s.CreateRegistrationResponse(request)
+	if err != nil {
+		return errors.Wrap(err, "create reg response")
+	}
+
+	upload, _, err := c.FinalizeRegistrationRequest(response)
+	if err != nil {
+		return errors.Wrap(err, "finalize request")
+	}
+
+	return errors.Wrap(s.StoreUserRecord(upload), "store user record")
+}
+
 func RegisterAndRunOPAQUE(suite oprf.SuiteID) error {
 	domain := "example.com"
 
@@ -103,7 +330,7 @@ func RegisterAndRunOPAQUE(suite oprf.SuiteID) error {
 	}
 
 	// C - finish OPRF and decrypt
-	rCreds, err := c.RecoverCredentials(loginResponse)
+	rCreds, _, err := c.RecoverCredentials(loginResponse)
 	if err != nil {
 		return errors.Wrap(err, "recover creds")
 	}
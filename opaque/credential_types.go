@@ -0,0 +1,161 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"sync"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+// CredentialTypeApplicationMin is the smallest value of an application-defined
+// credential type. Lower values are reserved for the protocol.
+const CredentialTypeApplicationMin CredentialType = 128
+
+// A CredentialCodec encodes and decodes the values of an application-defined
+// credential type.
+type CredentialCodec interface {
+	// EncodeCredential returns the credential data of val.
+	EncodeCredential(val interface{}) ([]byte, error)
+	// DecodeCredential returns the value of the credential data.
+	DecodeCredential(data []byte) (interface{}, error)
+}
+
+// BytesCodec stores []byte values as they are.
+type BytesCodec struct{}
+
+// EncodeCredential returns val, which must be a []byte.
+func (BytesCodec) EncodeCredential(val interface{}) ([]byte, error) {
+	data, ok := val.([]byte)
+	if !ok {
+		return nil, errors.Errorf("expected []byte, got %T", val)
+	}
+
+	return data, nil
+}
+
+// DecodeCredential returns data.
+func (BytesCodec) DecodeCredential(data []byte) (interface{}, error) {
+	return data, nil
+}
+
+type credentialTypeInfo struct {
+	name  string
+	codec CredentialCodec
+}
+
+var credentialTypes = struct {
+	sync.RWMutex
+	m map[CredentialType]*credentialTypeInfo
+}{m: make(map[CredentialType]*credentialTypeInfo)}
+
+// RegisterCredentialType registers an application-defined credential type,
+// which may then be listed in a CredentialEncodingPolicy and given a value
+// with Client.SetCredential. Clients and servers must register the same
+// types. Errors if t is below CredentialTypeApplicationMin, or if t or name
+// is already in use.
+func RegisterCredentialType(t CredentialType, name string, codec CredentialCodec) error {
+	if t < CredentialTypeApplicationMin {
+		return errors.Errorf("credential type %d is reserved", t)
+	}
+
+	if name == "" || codec == nil {
+		return errors.New("credential type needs a name and a codec")
+	}
+
+	credentialTypes.Lock()
+	defer credentialTypes.Unlock()
+
+	if _, ok := credentialTypes.m[t]; ok {
+		return errors.Errorf("credential type %d already registered", t)
+	}
+
+	for u := CredentialTypeUserPrivateKey; u <= CredentialTypeServerIdentity; u++ {
+		if u.String() == name {
+			return errors.Errorf("credential type name %q already in use", name)
+		}
+	}
+
+	for _, info := range credentialTypes.m {
+		if info.name == name {
+			return errors.Errorf("credential type name %q already in use", name)
+		}
+	}
+
+	credentialTypes.m[t] = &credentialTypeInfo{name: name, codec: codec}
+
+	return nil
+}
+
+// UnregisterCredentialType removes an application-defined credential type.
+func UnregisterCredentialType(t CredentialType) {
+	credentialTypes.Lock()
+	defer credentialTypes.Unlock()
+
+	delete(credentialTypes.m, t)
+}
+
+// lookupCredentialType returns the registration of t, if any.
+func lookupCredentialType(t CredentialType) (*credentialTypeInfo, bool) {
+	credentialTypes.RLock()
+	defer credentialTypes.RUnlock()
+
+	info, ok := credentialTypes.m[t]
+
+	return info, ok
+}
+
+// credentialTypeByName returns the registered credential type named name.
+func credentialTypeByName(name string) (CredentialType, bool) {
+	credentialTypes.RLock()
+	defer credentialTypes.RUnlock()
+
+	for t, info := range credentialTypes.m {
+		if info.name == name {
+			return t, true
+		}
+	}
+
+	return 0, false
+}
+
+// SetCredential sets the value of an application-defined credential, which is
+// stored in the envelope at registration if the server's policy lists its
+// type. Errors if t is not registered.
+func (c *Client) SetCredential(t CredentialType, val interface{}) error {
+	if _, ok := lookupCredentialType(t); !ok {
+		return errors.Wrapf(common.ErrorForbiddenPolicy, "credential type %d not registered", t)
+	}
+
+	if c.credentials == nil {
+		c.credentials = make(map[CredentialType]interface{})
+	}
+
+	c.credentials[t] = val
+
+	return nil
+}
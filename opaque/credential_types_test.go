@@ -0,0 +1,218 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+const (
+	testCredentialTypeToken CredentialType = CredentialTypeApplicationMin + iota
+	testCredentialTypeProfile
+)
+
+type testProfile struct {
+	Name  string
+	Email string
+}
+
+// profileCodec encodes testProfile values as JSON.
+type profileCodec struct{}
+
+func (profileCodec) EncodeCredential(val interface{}) ([]byte, error) {
+	p, ok := val.(*testProfile)
+	if !ok {
+		return nil, errors.Errorf("expected *testProfile, got %T", val)
+	}
+
+	return json.Marshal(p)
+}
+
+func (profileCodec) DecodeCredential(data []byte) (interface{}, error) {
+	p := &testProfile{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func registerTestCredentialTypes() error {
+	if err := RegisterCredentialType(testCredentialTypeToken, "API Token", BytesCodec{}); err != nil {
+		return err
+	}
+
+	return RegisterCredentialType(testCredentialTypeProfile, "Profile", profileCodec{})
+}
+
+func unregisterTestCredentialTypes() {
+	UnregisterCredentialType(testCredentialTypeToken)
+	UnregisterCredentialType(testCredentialTypeProfile)
+}
+
+func TestRegisterCredentialType(t *testing.T) {
+	if err := registerTestCredentialTypes(); err != nil {
+		t.Error(err)
+		return
+	}
+	defer unregisterTestCredentialTypes()
+
+	for _, test := range []struct {
+		t    CredentialType
+		name string
+	}{
+		{CredentialTypeServerIdentity + 1, "Reserved"},
+		{testCredentialTypeToken, "Another Token"},
+		{testCredentialTypeProfile + 1, "API Token"},
+		{testCredentialTypeProfile + 1, "User Identity"},
+		{testCredentialTypeProfile + 1, ""},
+	} {
+		if err := RegisterCredentialType(test.t, test.name, BytesCodec{}); err == nil {
+			t.Errorf("%d %q: expected an error", test.t, test.name)
+		}
+	}
+
+	if testCredentialTypeToken.String() != "API Token" {
+		t.Errorf("incorrect name %q", testCredentialTypeToken.String())
+	}
+
+	var ct CredentialType
+	if err := ct.UnmarshalText([]byte("Profile")); err != nil || ct != testCredentialTypeProfile {
+		t.Errorf("incorrect type %v: %v", ct, err)
+	}
+}
+
+func TestApplicationCredentials(t *testing.T) {
+	if err := registerTestCredentialTypes(); err != nil {
+		t.Error(err)
+		return
+	}
+	defer unregisterTestCredentialTypes()
+
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg.CredentialEncodingPolicy = &CredentialEncodingPolicy{
+		SecretTypes:    []CredentialType{CredentialTypeUserPrivateKey, testCredentialTypeToken},
+		CleartextTypes: []CredentialType{CredentialTypeServerPublicKey, testCredentialTypeProfile},
+	}
+
+	token := []byte("secret token")
+	profile := &testProfile{Name: "Alice", Email: "alice@example.com"}
+
+	h, err := newStateHarness(cfg, "new user", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Values must be set for every type in the policy.
+	if err := h.client.SetCredential(testCredentialTypeToken, token); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := h.runClientStep("CreateRegistrationRequest"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := h.runClientStep("FinalizeRegistrationRequest"); !errors.Is(err, common.ErrorForbiddenPolicy) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorForbiddenPolicy)
+		return
+	}
+
+	if err := h.client.SetCredential(testCredentialTypeProfile, profile); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if h.server, err = NewServer(cfg); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, step := range []string{"CreateRegistrationRequest", "FinalizeRegistrationRequest", "CreateCredentialRequest"} {
+		if err := h.runClientStep(step); err != nil {
+			t.Errorf("%s: %v", step, err)
+			return
+		}
+	}
+
+	creds, _, err := h.client.RecoverCredentials(h.credResponse)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if val, ok := creds.SecretCredentials.Find(testCredentialTypeToken); !ok || !reflect.DeepEqual(val, token) {
+		t.Errorf("incorrect token %v", val)
+	}
+
+	if val, ok := creds.CleartextCredentials.Find(testCredentialTypeProfile); !ok || !reflect.DeepEqual(val, profile) {
+		t.Errorf("incorrect profile %v", val)
+	}
+}
+
+func TestUnregisteredCredentialType(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg.CredentialEncodingPolicy = &CredentialEncodingPolicy{
+		SecretTypes: []CredentialType{CredentialTypeUserPrivateKey, testCredentialTypeToken},
+	}
+
+	h, err := newStateHarness(cfg, "new user", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := h.client.SetCredential(testCredentialTypeToken, []byte("token")); !errors.Is(err, common.ErrorForbiddenPolicy) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorForbiddenPolicy)
+	}
+
+	if err := h.runClientStep("CreateRegistrationRequest"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := h.runClientStep("FinalizeRegistrationRequest"); !errors.Is(err, common.ErrorForbiddenPolicy) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorForbiddenPolicy)
+	}
+}
@@ -27,7 +27,7 @@ package opaque
 
 import (
 	"crypto"
-	"crypto/x509"
+	"io"
 
 	"github.com/cloudflare/opaque-core/common"
 	"github.com/pkg/errors"
@@ -85,20 +85,40 @@ func newCredentialExtension(t CredentialType, val interface{}) (*CredentialExten
 
 	switch t {
 	case CredentialTypeServerIdentity, CredentialTypeUserIdentity:
+		// Identities are parsed as strings, and may be given as either.
+		if id, isString := val.(string); isString {
+			val = []byte(id)
+		}
+
 		data, ok = val.([]byte)
 		if !ok {
 			return nil, errors.New("expected array of bytes")
 		}
 	case CredentialTypeServerPublicKey, CredentialTypeUserPublicKey:
-		data, err = x509.MarshalPKIXPublicKey(val)
+		data, err = MarshalPublicKey(val)
 		if err != nil {
 			return nil, err
 		}
 	case CredentialTypeUserPrivateKey:
-		data, err = x509.MarshalPKCS8PrivateKey(val)
+		key, ok := val.(PrivateKey)
+		if !ok {
+			return nil, errors.New("expected a private key")
+		}
+
+		data, err = MarshalPrivateKey(key)
 		if err != nil {
 			return nil, err
 		}
+	default:
+		info, ok := lookupCredentialType(t)
+		if !ok {
+			return nil, errors.Wrapf(common.ErrorForbiddenPolicy, "credential type %d not registered", t)
+		}
+
+		data, err = info.codec.EncodeCredential(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encode %v", t)
+		}
 	}
 
 	return &CredentialExtension{
@@ -116,24 +136,23 @@ func (ce *CredentialExtension) parseToValue(t CredentialType) (interface{}, erro
 	case CredentialTypeServerIdentity, CredentialTypeUserIdentity:
 		return string(ce.CredentialData), nil
 	case CredentialTypeServerPublicKey, CredentialTypeUserPublicKey:
-		val, err := x509.ParsePKIXPublicKey(ce.CredentialData)
+		val, err := ParsePublicKey(ce.CredentialData)
 		if err != nil {
 			return nil, err
 		}
 
 		return val, nil
 	case CredentialTypeUserPrivateKey:
-		val, err := x509.ParsePKCS8PrivateKey(ce.CredentialData)
+		val, err := ParsePrivateKey(ce.CredentialData)
 		if err != nil {
 			return nil, err
 		}
 
-		signer, ok := val.(crypto.Signer)
-		if !ok {
-			return nil, errors.New("credential data is not a Signer")
-		}
+		return val, nil
+	}
 
-		return signer, nil
+	if info, ok := lookupCredentialType(t); ok {
+		return info.codec.DecodeCredential(ce.CredentialData)
 	}
 
 	return nil, errors.New("unrecognized credential type")
@@ -142,16 +161,18 @@ func (ce *CredentialExtension) parseToValue(t CredentialType) (interface{}, erro
 // Credentials holds the decrypted user-specific envelope contents.
 //
 // struct {
-// 	CredentialExtension secret_credentials<1..2^16-1>;
+// 	CredentialExtension secret_credentials<0..2^16-1>;
 // 	CredentialExtension cleartext_credentials<0..2^16-1>;
 // } Credentials;
 //
 //             2                              2
 //  | secretCredsLen | secretCreds | cleartextCredsLen | cleartextCreds |
-// SecretCredentials MUST contain the skU. It can contain the pkS.
-// CleartextCredentials MUST contain the pkS
+// SecretCredentials MUST contain the skU, except in internal mode envelopes,
+// where it is derived. It can contain the pkS.
+// CleartextCredentials MUST contain the pkS, except in internal mode envelopes,
+// whose tag covers it instead.
 type Credentials struct {
-	SecretCredentials    CredentialExtensionList `tls:"head=2,min=1"`
+	SecretCredentials    CredentialExtensionList `tls:"head=2"`
 	CleartextCredentials CredentialExtensionList `tls:"head=2"`
 }
 
@@ -169,6 +190,111 @@ func (creds *Credentials) Find(t CredentialType) (interface{}, bool) {
 	return nil, false
 }
 
+// UserPrivateKey returns the user private key as a crypto.Signer.
+// Errors if it is not present, or is an X25519 key, which cannot sign; use
+// UserKey for those.
+func (creds *Credentials) UserPrivateKey() (crypto.Signer, error) {
+	key, err := creds.UserKey()
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Wrapf(common.ErrorUnexpectedData, "%T user private key cannot sign", key)
+	}
+
+	return signer, nil
+}
+
+// UserKey returns the user private key, which may be an ECDSA, Ed25519 or
+// X25519 key.
+func (creds *Credentials) UserKey() (PrivateKey, error) {
+	val, err := creds.value(CredentialTypeUserPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return val.(PrivateKey), nil
+}
+
+// UserPublicKey returns the user public key.
+func (creds *Credentials) UserPublicKey() (crypto.PublicKey, error) {
+	return creds.value(CredentialTypeUserPublicKey)
+}
+
+// ServerPublicKey returns the server public key.
+func (creds *Credentials) ServerPublicKey() (crypto.PublicKey, error) {
+	return creds.value(CredentialTypeServerPublicKey)
+}
+
+// UserIdentity returns the user identity, as given at registration.
+func (creds *Credentials) UserIdentity() ([]byte, error) {
+	return creds.data(CredentialTypeUserIdentity)
+}
+
+// ServerIdentity returns the server identity, as given at registration.
+func (creds *Credentials) ServerIdentity() ([]byte, error) {
+	return creds.data(CredentialTypeServerIdentity)
+}
+
+// extension returns the credential extension of type t, or an error wrapping
+// common.ErrorNotFound if there is none.
+func (creds *Credentials) extension(t CredentialType) (*CredentialExtension, error) {
+	for _, list := range []CredentialExtensionList{creds.SecretCredentials, creds.CleartextCredentials} {
+		for _, ext := range list {
+			if ext.CredentialType == t {
+				return ext, nil
+			}
+		}
+	}
+
+	return nil, errors.Wrapf(common.ErrorNotFound, "%v", t)
+}
+
+// value returns the parsed value of the credential of type t.
+func (creds *Credentials) value(t CredentialType) (interface{}, error) {
+	ext, err := creds.extension(t)
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := ext.parseToValue(t)
+	if err != nil {
+		return nil, common.ErrorUnexpectedData.Wrap(err)
+	}
+
+	return val, nil
+}
+
+// data returns a copy of the raw data of the credential of type t.
+func (creds *Credentials) data(t CredentialType) ([]byte, error) {
+	ext, err := creds.extension(t)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{}, ext.CredentialData...), nil
+}
+
+// checkDuplicates returns an error wrapping common.ErrorUnexpectedData if a
+// credential type is present more than once.
+func (creds *Credentials) checkDuplicates() error {
+	seen := make(map[CredentialType]bool)
+
+	for _, list := range []CredentialExtensionList{creds.SecretCredentials, creds.CleartextCredentials} {
+		for _, ext := range list {
+			if seen[ext.CredentialType] {
+				return errors.Wrapf(common.ErrorUnexpectedData, "%v present twice", ext.CredentialType)
+			}
+
+			seen[ext.CredentialType] = true
+		}
+	}
+
+	return nil
+}
+
 // Marshal returns the raw form of the struct.
 func (creds *Credentials) Marshal() ([]byte, error) {
 	return syntax.Marshal(creds)
@@ -187,8 +313,18 @@ func (creds *Credentials) MarshalSplit() (secret, cleartext []byte, err error) {
 }
 
 // Unmarshal puts raw data into fields of a struct.
+// Errors if a credential type is present more than once.
 func (creds *Credentials) Unmarshal(data []byte) (int, error) {
-	return syntax.Unmarshal(data, creds)
+	n, err := syntax.Unmarshal(data, creds)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := creds.checkDuplicates(); err != nil {
+		return 0, err
+	}
+
+	return n, nil
 }
 
 // UnmarshalSplit decodes the Credential into its secret and clear parts.
@@ -224,24 +360,132 @@ func (cel CredentialExtensionList) Marshal() ([]byte, error) {
 // EncryptCredentials encrypts the given Credentials
 // under a key derived from rwd, the randomized password.
 func EncryptCredentials(rwd []byte, creds *Credentials) (*Envelope, []byte, error) {
-	nonce := common.GetRandomBytes(32)
+	return EncryptCredentialsWithRand(rwd, creds, nil)
+}
+
+// EncryptCredentialsWithRand is EncryptCredentials with the envelope nonce
+// read from r, or from crypto/rand if r is nil.
+func EncryptCredentialsWithRand(rwd []byte, creds *Credentials, r io.Reader) (*Envelope, []byte, error) {
+	nonce, err := common.GetRandomBytes(r, EnvelopeNonceLength)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return EncryptCredentialsWithNonce(rwd, nonce, creds)
+}
+
+// EnvelopeNonceLength is the length of the nonces of envelopes made by
+// EncryptCredentials.
+const EnvelopeNonceLength = 32
+
+// EncryptCredentialsWithNonce is EncryptCredentials with a given nonce. The
+// pad and auth key are derived from rwd and the nonce, so a nonce must not be
+// reused with the same rwd. It is used for test vectors.
+func EncryptCredentialsWithNonce(rwd, nonce []byte, creds *Credentials) (*Envelope, []byte, error) {
+	return encryptEnvelope(EnvelopeModeExternal, rwd, nonce, creds, nil)
+}
+
+// EncryptCredentialsWithMode encrypts the given Credentials in an envelope of
+// the given mode, under a key derived from rwd and the nonce. Internal mode
+// envelopes are made by EncryptCredentialsInternal.
+func EncryptCredentialsWithMode(mode EnvelopeMode, rwd, nonce []byte, creds *Credentials) (*Envelope, []byte, error) {
+	switch mode {
+	case EnvelopeModeInternal:
+		return nil, nil, errors.New("internal mode envelopes bind the server public key and identity")
+	case EnvelopeModeExternal:
+		return encryptEnvelope(mode, rwd, nonce, creds, nil)
+	case EnvelopeModeAESGCM, EnvelopeModeChaCha20Poly1305:
+		return sealEnvelopeAEAD(mode, rwd, nonce, creds)
+	}
+
+	return nil, nil, errors.Errorf("unknown envelope mode %d", mode)
+}
+
+// EncryptCredentialsInternal encrypts the given Credentials in an internal
+// mode envelope. It leaves out the user private key, which is derived from rwd
+// and the nonce instead, and the server public key and identity, which the
+// client gets from the server and its configuration: the auth tag covers
+// serverPublicKey and serverID without the envelope storing them.
+func EncryptCredentialsInternal(rwd, nonce []byte, creds *Credentials,
+	serverPublicKey crypto.PublicKey, serverID []byte) (*Envelope, []byte, error) {
+	bound, err := internalBoundData(serverPublicKey, serverID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stored := &Credentials{
+		SecretCredentials:    internalStoredCredentials(creds.SecretCredentials),
+		CleartextCredentials: internalStoredCredentials(creds.CleartextCredentials),
+	}
+
+	return encryptEnvelope(EnvelopeModeInternal, rwd, nonce, stored, bound)
+}
+
+// internalStoredCredentials returns the credentials of list that an internal
+// mode envelope stores.
+func internalStoredCredentials(list CredentialExtensionList) CredentialExtensionList {
+	var stored CredentialExtensionList
+
+	for _, cred := range list {
+		if internalStoredType(cred.CredentialType) {
+			stored = append(stored, cred)
+		}
+	}
+
+	return stored
+}
+
+// internalStoredType reports whether internal mode envelopes store credentials
+// of type t. The user private key is derived, and the server public key and
+// identity are bound by the auth tag.
+func internalStoredType(t CredentialType) bool {
+	switch t {
+	case CredentialTypeUserPrivateKey, CredentialTypeServerPublicKey, CredentialTypeServerIdentity:
+		return false
+	}
+
+	return true
+}
+
+type internalBoundDataInner struct {
+	ServerPublicKey []byte `tls:"head=2"`
+	ServerIdentity  []byte `tls:"head=2"`
+}
+
+// internalBoundData returns the encoding of the server public key and
+// identity authenticated by internal mode envelopes.
+func internalBoundData(serverPublicKey crypto.PublicKey, serverID []byte) ([]byte, error) {
+	rawPublicKey, err := MarshalPublicKey(serverPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return syntax.Marshal(internalBoundDataInner{
+		ServerPublicKey: rawPublicKey,
+		ServerIdentity:  serverID,
+	})
+}
+
+// encryptEnvelope seals creds in a one-time pad envelope. The tag also covers
+// bound, which the envelope does not store.
+func encryptEnvelope(mode EnvelopeMode, rwd, nonce []byte, creds *Credentials, bound []byte) (*Envelope, []byte, error) {
 	plaintext, authData, err := creds.MarshalSplit()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// TODO: the nonce is not needed here
 	otp, err := NewAuthenticatedOneTimePad(rwd, nonce, len(plaintext))
 	if err != nil {
 		return nil, nil, err
 	}
 
-	ciphertext, tag, err := otp.Seal(plaintext, authData)
+	ciphertext, tag, err := otp.Seal(plaintext, append(envelopeAuthData(mode, authData), bound...))
 	if err != nil {
 		return nil, nil, err
 	}
 
 	return &Envelope{
+		Mode:               mode,
 		Nonce:              nonce,
 		EncryptedCreds:     ciphertext,
 		AuthenticatedCreds: authData,
@@ -249,23 +493,80 @@ func EncryptCredentials(rwd []byte, creds *Credentials) (*Envelope, []byte, erro
 	}, otp.exporterKey, nil
 }
 
+// envelopeAuthData returns the data authenticated with the cleartext
+// credentials, which binds the envelope mode.
+func envelopeAuthData(mode EnvelopeMode, authData []byte) []byte {
+	return append([]byte{byte(mode)}, authData...)
+}
+
+// openEnvelope decrypts a one-time pad envelope whose tag also covers bound,
+// returning the secret credentials.
+func openEnvelope(rwd []byte, envelope *Envelope, bound []byte) ([]byte, error) {
+	otp, err := NewAuthenticatedOneTimePad(rwd, envelope.Nonce, len(envelope.EncryptedCreds))
+	if err != nil {
+		return nil, err
+	}
+
+	authData := append(envelopeAuthData(envelope.Mode, envelope.AuthenticatedCreds), bound...)
+
+	return otp.Open(envelope.EncryptedCreds, authData, envelope.AuthTag)
+}
+
 // DecryptCredentials decrypts the encrypted envelope.
 // Returns the decrypted Credentials struct, or an error if decryption fails.
+// Internal mode envelopes are decrypted by DecryptCredentialsInternal.
 func DecryptCredentials(rwd []byte, envelope *Envelope) (*Credentials, error) {
-	otp, err := NewAuthenticatedOneTimePad(rwd, envelope.Nonce, len(envelope.EncryptedCreds))
+	var plaintext []byte
+
+	var err error
+
+	switch envelope.Mode {
+	case EnvelopeModeInternal:
+		return nil, errors.New("internal mode envelopes bind the server public key and identity")
+	case EnvelopeModeExternal:
+		plaintext, err = openEnvelope(rwd, envelope, nil)
+	case EnvelopeModeAESGCM, EnvelopeModeChaCha20Poly1305:
+		plaintext, err = openEnvelopeAEAD(rwd, envelope)
+	default:
+		return nil, errors.Errorf("unknown envelope mode %d", envelope.Mode)
+	}
+
 	if err != nil {
 		return nil, err
 	}
 
-	plaintext, err := otp.Open(envelope.EncryptedCreds, envelope.AuthenticatedCreds, envelope.AuthTag)
+	return unmarshalEnvelopeCredentials(plaintext, envelope)
+}
+
+// DecryptCredentialsInternal decrypts an internal mode envelope made for
+// serverPublicKey and serverID. The Credentials hold neither the user private
+// key, which Client.RecoverCredentials derives, nor the server public key and
+// identity.
+func DecryptCredentialsInternal(rwd []byte, envelope *Envelope,
+	serverPublicKey crypto.PublicKey, serverID []byte) (*Credentials, error) {
+	if envelope.Mode != EnvelopeModeInternal {
+		return nil, errors.Errorf("envelope mode %v is not internal", envelope.Mode)
+	}
+
+	bound, err := internalBoundData(serverPublicKey, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := openEnvelope(rwd, envelope, bound)
 	if err != nil {
 		return nil, err
 	}
 
+	return unmarshalEnvelopeCredentials(plaintext, envelope)
+}
+
+// unmarshalEnvelopeCredentials returns the Credentials of the decrypted secret
+// credentials and the cleartext credentials of envelope.
+func unmarshalEnvelopeCredentials(plaintext []byte, envelope *Envelope) (*Credentials, error) {
 	// Make credentials
 	creds := &Credentials{}
-	_, err = creds.UnmarshalSplit(plaintext, envelope.AuthenticatedCreds)
-	if err != nil {
+	if _, err := creds.UnmarshalSplit(plaintext, envelope.AuthenticatedCreds); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,126 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"crypto"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+// A CredentialsBuilder constructs Credentials outside of the registration
+// flow, e.g. to encrypt with EncryptCredentialsWithMode. Values are encoded as
+// they are added; the first error is returned by Build.
+//
+//	creds, err := NewCredentialsBuilder().
+//		UserPrivateKey(key).
+//		ServerPublicKey(serverKey).
+//		ServerIdentity([]byte("example.com")).
+//		Build()
+type CredentialsBuilder struct {
+	creds *Credentials
+	err   error
+}
+
+// NewCredentialsBuilder returns a builder of empty Credentials.
+func NewCredentialsBuilder() *CredentialsBuilder {
+	return &CredentialsBuilder{creds: &Credentials{}}
+}
+
+// Secret adds a credential of type t with value val to the secret
+// credentials. The value has the type returned by Credentials.Find.
+func (b *CredentialsBuilder) Secret(t CredentialType, val interface{}) *CredentialsBuilder {
+	b.add(&b.creds.SecretCredentials, t, val)
+	return b
+}
+
+// Cleartext adds a credential of type t with value val to the cleartext
+// credentials. The user private key may not be added in cleartext.
+func (b *CredentialsBuilder) Cleartext(t CredentialType, val interface{}) *CredentialsBuilder {
+	if t == CredentialTypeUserPrivateKey {
+		b.fail(errors.Wrap(common.ErrorForbiddenPolicy, "user private key stored in cleartext"))
+		return b
+	}
+
+	b.add(&b.creds.CleartextCredentials, t, val)
+
+	return b
+}
+
+// UserPrivateKey adds the user private key to the secret credentials.
+func (b *CredentialsBuilder) UserPrivateKey(key PrivateKey) *CredentialsBuilder {
+	return b.Secret(CredentialTypeUserPrivateKey, key)
+}
+
+// ServerPublicKey adds the server public key to the cleartext credentials.
+func (b *CredentialsBuilder) ServerPublicKey(key crypto.PublicKey) *CredentialsBuilder {
+	return b.Cleartext(CredentialTypeServerPublicKey, key)
+}
+
+// ServerIdentity adds the server identity to the cleartext credentials.
+func (b *CredentialsBuilder) ServerIdentity(id []byte) *CredentialsBuilder {
+	return b.Cleartext(CredentialTypeServerIdentity, id)
+}
+
+// UserIdentity adds the user identity to the cleartext credentials.
+func (b *CredentialsBuilder) UserIdentity(id []byte) *CredentialsBuilder {
+	return b.Cleartext(CredentialTypeUserIdentity, id)
+}
+
+// Build returns the Credentials, or the first error met adding to them.
+func (b *CredentialsBuilder) Build() (*Credentials, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	return b.creds, nil
+}
+
+func (b *CredentialsBuilder) add(list *CredentialExtensionList, t CredentialType, val interface{}) {
+	if b.err != nil {
+		return
+	}
+
+	if _, err := b.creds.extension(t); err == nil {
+		b.fail(errors.Wrapf(common.ErrorUnexpectedData, "%v added twice", t))
+		return
+	}
+
+	ext, err := newCredentialExtension(t, val)
+	if err != nil {
+		b.fail(errors.Wrapf(err, "add %v", t))
+		return
+	}
+
+	*list = append(*list, ext)
+}
+
+func (b *CredentialsBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
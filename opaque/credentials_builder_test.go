@@ -0,0 +1,171 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint"
+)
+
+func TestCredentialsBuilder(t *testing.T) {
+	userKey, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	serverKey, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	creds, err := NewCredentialsBuilder().
+		UserPrivateKey(userKey).
+		Secret(CredentialTypeUserIdentity, "alice").
+		ServerPublicKey(serverKey.Public()).
+		ServerIdentity([]byte("example.com")).
+		Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := creds.Marshal()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	parsed := &Credentials{}
+	if _, err := parsed.Unmarshal(data); err != nil {
+		t.Error(err)
+		return
+	}
+
+	signer, err := parsed.UserPrivateKey()
+	if err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(signer, userKey) {
+		t.Error("incorrect user private key")
+	}
+
+	if pkS, err := parsed.ServerPublicKey(); err != nil || !reflect.DeepEqual(pkS, serverKey.Public()) {
+		t.Errorf("incorrect server public key: %v", err)
+	}
+
+	if idU, err := parsed.UserIdentity(); err != nil || !bytes.Equal(idU, []byte("alice")) {
+		t.Errorf("incorrect user identity %q: %v", idU, err)
+	}
+
+	if idS, err := parsed.ServerIdentity(); err != nil || !bytes.Equal(idS, []byte("example.com")) {
+		t.Errorf("incorrect server identity %q: %v", idS, err)
+	}
+
+	if _, err := parsed.UserPublicKey(); !errors.Is(err, common.ErrorNotFound) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorNotFound)
+	}
+
+	bad := map[string]*CredentialsBuilder{
+		"duplicate":             NewCredentialsBuilder().ServerIdentity([]byte("a")).Secret(CredentialTypeServerIdentity, []byte("b")),
+		"cleartext private key": NewCredentialsBuilder().Cleartext(CredentialTypeUserPrivateKey, userKey),
+		"bad value":             NewCredentialsBuilder().ServerPublicKey("example.com"),
+	}
+
+	for name, b := range bad {
+		if _, err := b.Build(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCredentialsDuplicates(t *testing.T) {
+	ext, err := newCredentialExtension(CredentialTypeServerIdentity, []byte("example.com"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	creds := &Credentials{
+		SecretCredentials:    CredentialExtensionList{ext},
+		CleartextCredentials: CredentialExtensionList{ext},
+	}
+
+	data, err := creds.Marshal()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := (&Credentials{}).Unmarshal(data); !errors.Is(err, common.ErrorUnexpectedData) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUnexpectedData)
+	}
+}
+
+func TestUserPrivateKeyTypes(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	xKey, err := GenerateX25519Key(rand.Reader)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	creds, err := NewCredentialsBuilder().UserPrivateKey(edKey).Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := creds.UserPrivateKey(); err != nil {
+		t.Error(err)
+	}
+
+	creds, err = NewCredentialsBuilder().UserPrivateKey(xKey).Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := creds.UserPrivateKey(); !errors.Is(err, common.ErrorUnexpectedData) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUnexpectedData)
+	}
+
+	if key, err := creds.UserKey(); err != nil || !reflect.DeepEqual(key, xKey) {
+		t.Errorf("incorrect X25519 user key: %v", err)
+	}
+}
@@ -88,8 +88,18 @@ func TestMarshalUnmarshalCredentialExtension(t *testing.T) {
 	}
 }
 
+// randomBytes returns n bytes from crypto/rand, which does not fail in tests.
+func randomBytes(n int) []byte {
+	b, err := common.GetRandomBytes(nil, n)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
 func TestEncryptDecryptCredentials(t *testing.T) {
-	key := common.GetRandomBytes(32)
+	key := randomBytes(32)
 
 	creds1, err := getDummyCredentials() // user record does not matter for this test
 	if err != nil {
@@ -120,6 +130,162 @@ func TestEncryptDecryptCredentials(t *testing.T) {
 	}
 }
 
+func TestEncryptCredentialsInternal(t *testing.T) {
+	key := randomBytes(32)
+	nonce := randomBytes(EnvelopeNonceLength)
+
+	creds1, err := getDummyCredentials()
+	if err != nil {
+		t.Errorf("FAIL: get dummy creds failed: %v", err)
+		return
+	}
+
+	serverPublicKey, err := creds1.ServerPublicKey()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	serverID, err := creds1.ServerIdentity()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	envelope, _, err := EncryptCredentialsInternal(key, nonce, creds1, serverPublicKey, serverID)
+	if err != nil {
+		t.Errorf("encryption error: %v", err)
+		return
+	}
+
+	// The default policy leaves nothing to store but the two list lengths.
+	if envelope.Mode != EnvelopeModeInternal || len(envelope.EncryptedCreds) != 2 || len(envelope.AuthenticatedCreds) != 2 {
+		t.Errorf("expected an internal mode envelope of empty lists, got %v", envelope)
+		return
+	}
+
+	creds2, err := DecryptCredentialsInternal(key, envelope, serverPublicKey, serverID)
+	if err != nil {
+		t.Errorf("decryption error: %v", err)
+		return
+	}
+
+	for _, credType := range []CredentialType{
+		CredentialTypeUserPrivateKey, CredentialTypeServerPublicKey, CredentialTypeServerIdentity,
+	} {
+		if _, ok := creds2.Find(credType); ok {
+			t.Errorf("%v stored in internal mode envelope", credType)
+		}
+	}
+
+	// The server public key and identity are authenticated.
+	other, err := getDummyCredentials()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	otherPublicKey, err := other.ServerPublicKey()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := DecryptCredentialsInternal(key, envelope, otherPublicKey, serverID); !errors.Is(err, common.ErrorHmacTagInvalid) {
+		t.Errorf("expected HMAC error decrypting for another server key, got %v", err)
+	}
+
+	if _, err := DecryptCredentialsInternal(key, envelope, serverPublicKey, []byte("other.com")); !errors.Is(err, common.ErrorHmacTagInvalid) {
+		t.Errorf("expected HMAC error decrypting for another server identity, got %v", err)
+	}
+
+	if _, err := DecryptCredentials(key, envelope); err == nil {
+		t.Error("expected error decrypting internal mode envelope without the server key")
+	}
+
+	// The mode is authenticated.
+	envelope.Mode = EnvelopeModeExternal
+	if _, err := DecryptCredentials(key, envelope); !errors.Is(err, common.ErrorHmacTagInvalid) {
+		t.Errorf("expected HMAC error decrypting with another mode, got %v", err)
+	}
+
+	envelope.Mode = 0
+	if _, err := DecryptCredentials(key, envelope); err == nil {
+		t.Error("expected error decrypting unknown envelope mode")
+	}
+}
+
+func TestEncryptCredentialsAEAD(t *testing.T) {
+	key := randomBytes(32)
+	nonce := randomBytes(EnvelopeNonceLength)
+
+	creds1, err := getDummyCredentials()
+	if err != nil {
+		t.Errorf("FAIL: get dummy creds failed: %v", err)
+		return
+	}
+
+	_, otpExporterKey, err := EncryptCredentialsWithNonce(key, nonce, creds1)
+	if err != nil {
+		t.Errorf("encryption error: %v", err)
+		return
+	}
+
+	for _, mode := range []EnvelopeMode{EnvelopeModeAESGCM, EnvelopeModeChaCha20Poly1305} {
+		envelope, exporterKey, err := EncryptCredentialsWithMode(mode, key, nonce, creds1)
+		if err != nil {
+			t.Errorf("%v: encryption error: %v", mode, err)
+			return
+		}
+
+		if envelope.Mode != mode || len(envelope.AuthTag) != 16 {
+			t.Errorf("%v: unexpected envelope %v", mode, envelope)
+		}
+
+		if !reflect.DeepEqual(exporterKey, otpExporterKey) {
+			t.Errorf("%v: exporter key differs from the one-time pad's", mode)
+		}
+
+		creds2, err := DecryptCredentials(key, envelope)
+		if err != nil {
+			t.Errorf("%v: decryption error: %v", mode, err)
+			return
+		}
+
+		if !reflect.DeepEqual(creds1, creds2) {
+			t.Errorf("%v: original/decrypted creds are different %v, %v ", mode, creds1, creds2)
+		}
+
+		for name, tamper := range map[string]func(e *Envelope){
+			"ciphertext": func(e *Envelope) { e.EncryptedCreds[0] ^= 1 },
+			"auth data":  func(e *Envelope) { e.AuthenticatedCreds[0] ^= 1 },
+			"nonce":      func(e *Envelope) { e.Nonce[0] ^= 1 },
+			"tag":        func(e *Envelope) { e.AuthTag = e.AuthTag[1:] },
+			"mode": func(e *Envelope) {
+				e.Mode = EnvelopeModeAESGCM + EnvelopeModeChaCha20Poly1305 - e.Mode
+			},
+		} {
+			e := *envelope
+			e.Nonce = append([]byte{}, envelope.Nonce...)
+			e.EncryptedCreds = append([]byte{}, envelope.EncryptedCreds...)
+			e.AuthenticatedCreds = append([]byte{}, envelope.AuthenticatedCreds...)
+			tamper(&e)
+
+			if _, err := DecryptCredentials(key, &e); !errors.Is(err, common.ErrorHmacTagInvalid) {
+				t.Errorf("%v: expected error with tampered %s, got %v", mode, name, err)
+			}
+		}
+
+		if _, err := DecryptCredentials(randomBytes(32), envelope); err == nil {
+			t.Errorf("%v: expected error decrypting with another key", mode)
+		}
+	}
+
+	if _, _, err := EncryptCredentialsWithMode(0, key, nonce, creds1); err == nil {
+		t.Error("expected error with unknown envelope mode")
+	}
+}
+
 func TestCredentialEncryptionPolicy(t *testing.T) {
 	clientSigner, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
 	if err != nil {
@@ -172,7 +338,7 @@ func TestCredentialEncryptionPolicy(t *testing.T) {
 }
 
 func checkPolicy(client *Client, serverPublicKey crypto.PublicKey, policy *CredentialEncodingPolicy) error {
-	creds, err := client.credentialsFromPolicy(policy, serverPublicKey)
+	creds, err := client.credentialsFromPolicy(policy, client.signer, serverPublicKey, nil)
 	if err != nil {
 		return errors.Wrap(err, "get creds")
 	}
@@ -187,7 +353,7 @@ func checkPolicy(client *Client, serverPublicKey crypto.PublicKey, policy *Crede
 		return errors.Wrap(err, "check cleartext creds")
 	}
 
-	key := common.GetRandomBytes(32)
+	key := randomBytes(32)
 
 	encrypted, _, err := EncryptCredentials(key, creds)
 	if err != nil {
@@ -29,23 +29,47 @@ import (
 	"github.com/tatianab/mint/syntax"
 )
 
+// EnvelopeMode says how the client key is held in an Envelope, and how the
+// envelope is encrypted.
+type EnvelopeMode uint8
+
+// Envelope modes.
+const (
+	// EnvelopeModeInternal envelopes hold no client private key: it is
+	// derived from the randomized password and the envelope nonce.
+	EnvelopeModeInternal EnvelopeMode = 1
+
+	// EnvelopeModeExternal envelopes hold the client private key, encrypted.
+	EnvelopeModeExternal EnvelopeMode = 2
+
+	// EnvelopeModeAESGCM envelopes hold the client private key, encrypted
+	// with AES-256-GCM instead of the one-time pad.
+	EnvelopeModeAESGCM EnvelopeMode = 3
+
+	// EnvelopeModeChaCha20Poly1305 envelopes hold the client private key,
+	// encrypted with ChaCha20-Poly1305 instead of the one-time pad.
+	EnvelopeModeChaCha20Poly1305 EnvelopeMode = 4
+)
+
 // Envelope is the data encrypted under the randomized password
 // which is stored encrypted and sent to to the user.
 //
 // struct {
+// 	EnvelopeMode mode;
 // 	opaque nonce[Nn];
-// 	opaque ct<1..2^16-1>;
+// 	opaque ct<0..2^16-1>;
 // 	opaque auth_data<0..2^16-1>;
 // 	opaque auth_tag<1..2^16-1>;
 // } Envelope;
 //
-//      1                   2                         2                         2
-// | nonceLen | nonce | encCredsLen | encCreds | authCredsLen | authCreds | authTagLen | authTag |.
+//    1        1                   2                         2                         2
+// | mode | nonceLen | nonce | encCredsLen | encCreds | authCredsLen | authCreds | authTagLen | authTag |.
 type Envelope struct {
-	Nonce              []byte `tls:"head=1"`       // unique value, which must be 32 byte long.
-	EncryptedCreds     []byte `tls:"head=2,min=1"` // raw encrypted and authenticated credential extensions list.
-	AuthenticatedCreds []byte `tls:"head=2"`       // raw authenticated credential extensions list.
-	AuthTag            []byte `tls:"head=2,min=1"` // tag authenticating the envelope contents.
+	Mode               EnvelopeMode // how the client private key is held.
+	Nonce              []byte       `tls:"head=1"`       // unique value, which must be 32 byte long.
+	EncryptedCreds     []byte       `tls:"head=2"`       // raw encrypted and authenticated credential extensions list.
+	AuthenticatedCreds []byte       `tls:"head=2"`       // raw authenticated credential extensions list.
+	AuthTag            []byte       `tls:"head=2,min=1"` // tag authenticating the envelope contents.
 }
 
 // Marshal returns the raw form of the struct.
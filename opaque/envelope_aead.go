@@ -0,0 +1,136 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"io"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// envelopeKeyLength is the length of the AEAD keys of envelopes, and of
+// their exporter keys.
+const envelopeKeyLength = 32
+
+// newEnvelopeAEAD returns the AEAD of an AEAD mode envelope, keyed by
+// HKDF-Expand(rwdU, concat(nonce, "EnvelopeKey"), 32).
+func newEnvelopeAEAD(mode EnvelopeMode, rwd, nonce []byte) (cipher.AEAD, error) {
+	key := make([]byte, envelopeKeyLength)
+
+	info := append(append([]byte{}, nonce...), "EnvelopeKey"...)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, rwd, info), key); err != nil {
+		return nil, err
+	}
+
+	switch mode {
+	case EnvelopeModeAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return cipher.NewGCM(block)
+	case EnvelopeModeChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+
+	return nil, errors.Errorf("envelope mode %v is not an AEAD mode", mode)
+}
+
+// envelopeExporterKey returns HKDF-Expand(rwdU, "ExportKey", 32), as the
+// one-time pad does.
+func envelopeExporterKey(rwd []byte) ([]byte, error) {
+	exporterKey := make([]byte, envelopeKeyLength)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, rwd, []byte("ExportKey")), exporterKey); err != nil {
+		return nil, err
+	}
+
+	return exporterKey, nil
+}
+
+// sealEnvelopeAEAD encrypts creds in an AEAD mode envelope. The AEAD nonce is
+// the start of the envelope nonce, and the cleartext credentials and the mode
+// are the additional data.
+func sealEnvelopeAEAD(mode EnvelopeMode, rwd, nonce []byte, creds *Credentials) (*Envelope, []byte, error) {
+	aead, err := newEnvelopeAEAD(mode, rwd, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(nonce) < aead.NonceSize() {
+		return nil, nil, errors.Errorf("envelope nonce shorter than %d bytes", aead.NonceSize())
+	}
+
+	plaintext, authData, err := creds.MarshalSplit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sealed := aead.Seal(nil, nonce[:aead.NonceSize()], plaintext, envelopeAuthData(mode, authData))
+	split := len(sealed) - aead.Overhead()
+
+	exporterKey, err := envelopeExporterKey(rwd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &Envelope{
+		Mode:               mode,
+		Nonce:              nonce,
+		EncryptedCreds:     sealed[:split],
+		AuthenticatedCreds: authData,
+		AuthTag:            sealed[split:],
+	}, exporterKey, nil
+}
+
+// openEnvelopeAEAD decrypts an AEAD mode envelope, returning the secret
+// credentials.
+func openEnvelopeAEAD(rwd []byte, envelope *Envelope) ([]byte, error) {
+	aead, err := newEnvelopeAEAD(envelope.Mode, rwd, envelope.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(envelope.Nonce) < aead.NonceSize() || len(envelope.AuthTag) != aead.Overhead() {
+		return nil, common.ErrorHmacTagInvalid
+	}
+
+	sealed := append(append([]byte{}, envelope.EncryptedCreds...), envelope.AuthTag...)
+
+	plaintext, err := aead.Open(nil, envelope.Nonce[:aead.NonceSize()], sealed,
+		envelopeAuthData(envelope.Mode, envelope.AuthenticatedCreds))
+	if err != nil {
+		return nil, common.ErrorHmacTagInvalid
+	}
+
+	return plaintext, nil
+}
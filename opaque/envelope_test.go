@@ -27,16 +27,15 @@ package opaque
 
 import (
 	"testing"
-
-	"github.com/cloudflare/opaque-core/common"
 )
 
 func getDummyEnvelope() *Envelope {
 	return &Envelope{
-		Nonce:              common.GetRandomBytes(32),
-		EncryptedCreds:     common.GetRandomBytes(32),
-		AuthenticatedCreds: common.GetRandomBytes(32),
-		AuthTag:            common.GetRandomBytes(32),
+		Mode:               EnvelopeModeExternal,
+		Nonce:              randomBytes(32),
+		EncryptedCreds:     randomBytes(32),
+		AuthenticatedCreds: randomBytes(32),
+		AuthTag:            randomBytes(32),
 	}
 }
 
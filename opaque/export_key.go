@@ -0,0 +1,81 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint/syntax"
+	"golang.org/x/crypto/hkdf"
+)
+
+// An ExportKey is a key known only to the client, derived from the
+// randomized password. Registration and every later login with the same
+// password give the same export key, so applications can use it to encrypt
+// data the server stores for the client.
+type ExportKey []byte
+
+// maxExportLength is the most HKDF-Expand with SHA-256 can derive.
+const maxExportLength = 255 * sha256.Size
+
+// exportInfo is the HKDF info of Export.
+//
+// struct {
+// 	opaque label<1..255>;
+// 	opaque context<0..2^16-1>;
+// } ExportInfo;
+type exportInfo struct {
+	Label   []byte `tls:"head=1,min=1"`
+	Context []byte `tls:"head=2"`
+}
+
+// Export derives length bytes from the export key for label and context,
+// with HKDF-Expand(exportKey, "OPAQUE-Export" || ExportInfo, length). Keys
+// derived with different labels or contexts are independent, and reveal
+// nothing about the export key.
+func (k ExportKey) Export(label string, context []byte, length int) ([]byte, error) {
+	if len(k) == 0 {
+		return nil, errors.New("empty export key")
+	}
+
+	if length <= 0 || length > maxExportLength {
+		return nil, errors.Errorf("export length %d not in 1..%d", length, maxExportLength)
+	}
+
+	info, err := syntax.Marshal(exportInfo{Label: []byte(label), Context: context})
+	if err != nil {
+		return nil, errors.Wrapf(err, "export label %q", label)
+	}
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, k, append([]byte("OPAQUE-Export"), info...)), out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	key := ExportKey(randomBytes(32))
+
+	derive := func(k ExportKey, label, context string, length int) []byte {
+		out, err := k.Export(label, []byte(context), length)
+		if err != nil {
+			t.Errorf("%q %q %d: %v", label, context, length, err)
+		}
+
+		return out
+	}
+
+	backup := derive(key, "backup", "", 32)
+
+	if len(backup) != 32 {
+		t.Errorf("got %d bytes, expected 32", len(backup))
+	}
+
+	if !bytes.Equal(backup, derive(key, "backup", "", 32)) {
+		t.Error("export is not deterministic")
+	}
+
+	if !bytes.Equal(derive(key, "backup", "", 16), backup[:16]) {
+		t.Error("shorter export is not a prefix")
+	}
+
+	distinct := [][]byte{
+		backup,
+		key,
+		derive(key, "sync", "", 32),
+		derive(key, "backup", "device", 32),
+		derive(key, "backupdevice", "", 32),
+		derive(key, "back", "updevice", 32),
+		derive(ExportKey(randomBytes(32)), "backup", "", 32),
+	}
+
+	for i := range distinct {
+		for j := i + 1; j < len(distinct); j++ {
+			if bytes.Equal(distinct[i], distinct[j]) {
+				t.Errorf("exports %d and %d are equal", i, j)
+			}
+		}
+	}
+
+	bad := []struct {
+		key    ExportKey
+		label  string
+		length int
+	}{
+		{nil, "backup", 32},
+		{key, "", 32},
+		{key, "backup", 0},
+		{key, "backup", maxExportLength + 1},
+		{key, string(make([]byte, 256)), 32},
+	}
+
+	for _, b := range bad {
+		if _, err := b.key.Export(b.label, nil, b.length); err == nil {
+			t.Errorf("%d byte label, length %d: expected an error", len(b.label), b.length)
+		}
+	}
+}
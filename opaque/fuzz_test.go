@@ -0,0 +1,345 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+//go:build go1.18
+// +build go1.18
+
+package opaque
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cloudflare/opaque-core/common"
+)
+
+// Run a target with, for example:
+//
+//	go test ./opaque -run '^$' -fuzz FuzzRegistrationResponse
+
+// vectorMessages returns the messages of the test vectors by type.
+func vectorMessages(f *testing.F) map[ProtocolMessageType][][]byte {
+	vectors, err := readVectors()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	messages := make(map[ProtocolMessageType][][]byte)
+
+	for _, v := range vectors {
+		messages[ProtocolMessageTypeRegistrationRequest] = append(messages[ProtocolMessageTypeRegistrationRequest], v.RegistrationRequest)
+		messages[ProtocolMessageTypeRegistrationResponse] = append(messages[ProtocolMessageTypeRegistrationResponse], v.RegistrationResponse)
+		messages[ProtocolMessageTypeRegistrationUpload] = append(messages[ProtocolMessageTypeRegistrationUpload], v.RegistrationUpload)
+		messages[ProtocolMessageTypeCredentialRequest] = append(messages[ProtocolMessageTypeCredentialRequest], v.CredentialRequest)
+		messages[ProtocolMessageTypeCredentialResponse] = append(messages[ProtocolMessageTypeCredentialResponse], v.CredentialResponse)
+	}
+
+	return messages
+}
+
+// vectorBodies returns the decoded messages of the test vectors.
+func vectorBodies(f *testing.F) []ProtocolMessageBody {
+	var bodies []ProtocolMessageBody
+
+	for t, messages := range vectorMessages(f) {
+		for _, data := range messages {
+			body, err := (&ProtocolMessage{MessageType: t}).ToBody()
+			if err != nil {
+				f.Fatal(err)
+			}
+
+			if _, err := body.Unmarshal(data); err != nil {
+				f.Fatal(err)
+			}
+
+			bodies = append(bodies, body)
+		}
+	}
+
+	return bodies
+}
+
+// fuzzUnmarshal checks that decoding arbitrary data does not panic, and that
+// anything decoded encodes to data which decodes and encodes to the same.
+func fuzzUnmarshal(f *testing.F, seeds [][]byte, empty func() common.MarshalUnmarshaler) {
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg := empty()
+
+		n, err := msg.Unmarshal(data)
+		if err != nil {
+			return
+		}
+
+		if n > len(data) {
+			t.Fatalf("read %d bytes of %d", n, len(data))
+		}
+
+		encoded, err := msg.Marshal()
+		if err != nil {
+			t.Fatalf("encode %x: %v", data, err)
+		}
+
+		checkRoundTrip(t, encoded, empty)
+	})
+}
+
+func checkRoundTrip(t *testing.T, encoded []byte, empty func() common.MarshalUnmarshaler) {
+	msg := empty()
+
+	n, err := msg.Unmarshal(encoded)
+	if err != nil {
+		t.Fatalf("decode %x: %v", encoded, err)
+	}
+
+	if n != len(encoded) {
+		t.Fatalf("decode %x: read %d bytes of %d", encoded, n, len(encoded))
+	}
+
+	reencoded, err := msg.Marshal()
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	if !bytes.Equal(encoded, reencoded) {
+		t.Fatalf("encoding not stable: %x, %x", encoded, reencoded)
+	}
+}
+
+func FuzzProtocolMessage(f *testing.F) {
+	var seeds [][]byte
+
+	for _, body := range vectorBodies(f) {
+		msg, err := ProtocolMessageFromBody(body)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		data, err := msg.Marshal()
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		seeds = append(seeds, data)
+	}
+
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg := &ProtocolMessage{}
+		if _, err := msg.Unmarshal(data); err != nil {
+			return
+		}
+
+		body, err := msg.Body()
+		if err != nil {
+			return
+		}
+
+		encoded, err := body.Marshal()
+		if err != nil {
+			return
+		}
+
+		checkRoundTrip(t, encoded, func() common.MarshalUnmarshaler {
+			body, _ := msg.ToBody()
+			return body
+		})
+	})
+}
+
+func FuzzRegistrationRequest(f *testing.F) {
+	fuzzUnmarshal(f, vectorMessages(f)[ProtocolMessageTypeRegistrationRequest],
+		func() common.MarshalUnmarshaler { return &RegistrationRequest{} })
+}
+
+func FuzzRegistrationResponse(f *testing.F) {
+	fuzzUnmarshal(f, vectorMessages(f)[ProtocolMessageTypeRegistrationResponse],
+		func() common.MarshalUnmarshaler { return &RegistrationResponse{} })
+}
+
+func FuzzRegistrationUpload(f *testing.F) {
+	fuzzUnmarshal(f, vectorMessages(f)[ProtocolMessageTypeRegistrationUpload],
+		func() common.MarshalUnmarshaler { return &RegistrationUpload{} })
+}
+
+func FuzzCredentialRequest(f *testing.F) {
+	fuzzUnmarshal(f, vectorMessages(f)[ProtocolMessageTypeCredentialRequest],
+		func() common.MarshalUnmarshaler { return &CredentialRequest{} })
+}
+
+func FuzzCredentialResponse(f *testing.F) {
+	fuzzUnmarshal(f, vectorMessages(f)[ProtocolMessageTypeCredentialResponse],
+		func() common.MarshalUnmarshaler { return &CredentialResponse{} })
+}
+
+func FuzzLoginProof(f *testing.F) {
+	seed, err := (&LoginProof{Proof: randomBytes(64)}).Marshal()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	fuzzUnmarshal(f, [][]byte{seed}, func() common.MarshalUnmarshaler { return &LoginProof{} })
+}
+
+func FuzzEnvelope(f *testing.F) {
+	envelopes := []*Envelope{getDummyEnvelope()}
+
+	for _, body := range vectorBodies(f) {
+		if upload, ok := body.(*RegistrationUpload); ok {
+			envelopes = append(envelopes, upload.Envelope)
+		}
+	}
+
+	var seeds [][]byte
+
+	for _, e := range envelopes {
+		data, err := e.Marshal()
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		seeds = append(seeds, data)
+	}
+
+	fuzzUnmarshal(f, seeds, func() common.MarshalUnmarshaler { return &Envelope{} })
+}
+
+func FuzzCredentials(f *testing.F) {
+	creds, err := getDummyCredentials()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	data, err := creds.Marshal()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	fuzzUnmarshal(f, [][]byte{data}, func() common.MarshalUnmarshaler { return &Credentials{} })
+}
+
+func FuzzCredentialExtension(f *testing.F) {
+	creds, err := getDummyCredentials()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	var seeds [][]byte
+
+	for _, ext := range append(creds.SecretCredentials, creds.CleartextCredentials...) {
+		data, err := ext.Marshal()
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		seeds = append(seeds, data)
+	}
+
+	fuzzUnmarshal(f, seeds, func() common.MarshalUnmarshaler { return &CredentialExtension{} })
+}
+
+// jsonMessage is a message decoded from JSON.
+type jsonMessage interface {
+	MarshalJSON() ([]byte, error)
+}
+
+// fuzzUnmarshalJSON checks that decoding arbitrary JSON does not panic, and
+// that anything decoded encodes to JSON which decodes and encodes to the same.
+func fuzzUnmarshalJSON(f *testing.F, t ProtocolMessageType, decode func([]byte) (jsonMessage, error)) {
+	for _, body := range vectorBodies(f) {
+		if body.Type() != t {
+			continue
+		}
+
+		data, err := body.(jsonMessage).MarshalJSON()
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := decode(data)
+		if err != nil {
+			return
+		}
+
+		encoded, err := msg.MarshalJSON()
+		if err != nil {
+			t.Fatalf("encode %s: %v", data, err)
+		}
+
+		msg, err = decode(encoded)
+		if err != nil {
+			t.Fatalf("decode %s: %v", encoded, err)
+		}
+
+		reencoded, err := msg.MarshalJSON()
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+
+		if !bytes.Equal(encoded, reencoded) {
+			t.Fatalf("encoding not stable: %s, %s", encoded, reencoded)
+		}
+	})
+}
+
+func FuzzRegistrationRequestJSON(f *testing.F) {
+	fuzzUnmarshalJSON(f, ProtocolMessageTypeRegistrationRequest, func(data []byte) (jsonMessage, error) {
+		return UnmarshalRegistrationRequestJSON(data)
+	})
+}
+
+func FuzzRegistrationResponseJSON(f *testing.F) {
+	fuzzUnmarshalJSON(f, ProtocolMessageTypeRegistrationResponse, func(data []byte) (jsonMessage, error) {
+		return UnmarshalRegistrationResponseJSON(data)
+	})
+}
+
+func FuzzRegistrationUploadJSON(f *testing.F) {
+	fuzzUnmarshalJSON(f, ProtocolMessageTypeRegistrationUpload, func(data []byte) (jsonMessage, error) {
+		return UnmarshalRegistrationUploadJSON(data)
+	})
+}
+
+func FuzzCredentialRequestJSON(f *testing.F) {
+	fuzzUnmarshalJSON(f, ProtocolMessageTypeCredentialRequest, func(data []byte) (jsonMessage, error) {
+		return UnmarshalCredentialRequestJSON(data)
+	})
+}
+
+func FuzzCredentialResponseJSON(f *testing.F) {
+	fuzzUnmarshalJSON(f, ProtocolMessageTypeCredentialResponse, func(data []byte) (jsonMessage, error) {
+		return UnmarshalCredentialResponseJSON(data)
+	})
+}
@@ -1,8 +1,10 @@
 package opaque
 
 import (
-	"crypto/x509"
 	"encoding/json"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
 )
 
 func (pmt ProtocolMessageType) String() string {
@@ -16,6 +18,7 @@ var ProtocolMessageTypeToStringMap = map[ProtocolMessageType]string{
 	ProtocolMessageTypeRegistrationUpload:   "OPAQUE Registration Upload",
 	ProtocolMessageTypeCredentialRequest:    "OPAQUE Credential Request",
 	ProtocolMessageTypeCredentialResponse:   "OPAQUE Credential Response",
+	ProtocolMessageTypeLoginProof:           "OPAQUE Login Proof",
 }
 
 type registrationRequestJSON struct {
@@ -49,11 +52,12 @@ type registrationResponseJSON struct {
 	ServerPublicKey []byte
 	SecretTypes     []byte
 	CleartextTypes  []byte
+	PolicyVersion   uint16
 }
 
 // MarshalJSON encodes the RegistrationResponse.
 func (rr *RegistrationResponse) MarshalJSON() ([]byte, error) {
-	rawPubKey, err := x509.MarshalPKIXPublicKey(rr.ServerPublicKey)
+	rawPubKey, err := MarshalPublicKey(rr.ServerPublicKey)
 	if err != nil {
 		return nil, err
 	}
@@ -72,6 +76,7 @@ func (rr *RegistrationResponse) MarshalJSON() ([]byte, error) {
 		ServerPublicKey: rawPubKey,
 		SecretTypes:     secTypes,
 		CleartextTypes:  clearTypes,
+		PolicyVersion:   rr.CredentialEncodingPolicy.Version,
 	}
 
 	return json.Marshal(rrJSON)
@@ -85,7 +90,7 @@ func UnmarshalRegistrationResponseJSON(b []byte) (*RegistrationResponse, error)
 		return nil, err
 	}
 
-	pubKey, err := x509.ParsePKIXPublicKey(rrJSON.ServerPublicKey)
+	pubKey, err := ParsePublicKey(rrJSON.ServerPublicKey)
 	if err != nil {
 		return nil, err
 	}
@@ -101,6 +106,7 @@ func UnmarshalRegistrationResponseJSON(b []byte) (*RegistrationResponse, error)
 	}
 
 	cred := &CredentialEncodingPolicy{
+		Version:        rrJSON.PolicyVersion,
 		SecretTypes:    secTypes,
 		CleartextTypes: clearTypes,
 	}
@@ -116,6 +122,7 @@ func UnmarshalRegistrationResponseJSON(b []byte) (*RegistrationResponse, error)
 
 type registrationUploadJSON struct {
 	UserPublicKey      []byte
+	Mode               EnvelopeMode
 	Nonce              []byte
 	EncryptedCreds     []byte
 	AuthenticatedCreds []byte
@@ -124,13 +131,14 @@ type registrationUploadJSON struct {
 
 // MarshalJSON encodes the RegistrationUpload.
 func (rr *RegistrationUpload) MarshalJSON() ([]byte, error) {
-	rawPubKey, err := x509.MarshalPKIXPublicKey(rr.ClientPublicKey)
+	rawPubKey, err := MarshalPublicKey(rr.ClientPublicKey)
 	if err != nil {
 		return nil, err
 	}
 
 	rrJSON := &registrationUploadJSON{
 		UserPublicKey:      rawPubKey,
+		Mode:               rr.Envelope.Mode,
 		Nonce:              rr.Envelope.Nonce,
 		EncryptedCreds:     rr.Envelope.EncryptedCreds,
 		AuthenticatedCreds: rr.Envelope.AuthenticatedCreds,
@@ -148,12 +156,13 @@ func UnmarshalRegistrationUploadJSON(b []byte) (*RegistrationUpload, error) {
 		return nil, err
 	}
 
-	pubKey, err := x509.ParsePKIXPublicKey(rrJSON.UserPublicKey)
+	pubKey, err := ParsePublicKey(rrJSON.UserPublicKey)
 	if err != nil {
 		return nil, err
 	}
 
 	env := &Envelope{
+		Mode:               rrJSON.Mode,
 		Nonce:              rrJSON.Nonce,
 		EncryptedCreds:     rrJSON.EncryptedCreds,
 		AuthenticatedCreds: rrJSON.AuthenticatedCreds,
@@ -195,27 +204,33 @@ func UnmarshalCredentialRequestJSON(b []byte) (*CredentialRequest, error) {
 
 type credentialResponseJSON struct {
 	OprfData           []byte
+	Mode               EnvelopeMode
 	Nonce              []byte
 	EncryptedCreds     []byte
 	AuthenticatedCreds []byte
 	AuthTag            []byte
 	ServerPublicKey    []byte
+	Challenge          []byte
+	UpgradePolicy      *CredentialEncodingPolicy `json:",omitempty"`
 }
 
 // MarshalJSON encodes the CredentialResponse.
 func (cr *CredentialResponse) MarshalJSON() ([]byte, error) {
-	rawPubKey, err := x509.MarshalPKIXPublicKey(cr.serverPublicKey)
+	rawPubKey, err := MarshalPublicKey(cr.serverPublicKey)
 	if err != nil {
 		return nil, err
 	}
 
 	crJSON := &credentialResponseJSON{
 		OprfData:           cr.OprfData,
+		Mode:               cr.Envelope.Mode,
 		Nonce:              cr.Envelope.Nonce,
 		EncryptedCreds:     cr.Envelope.EncryptedCreds,
 		AuthenticatedCreds: cr.Envelope.AuthenticatedCreds,
 		AuthTag:            cr.Envelope.AuthTag,
 		ServerPublicKey:    rawPubKey,
+		Challenge:          cr.Challenge,
+		UpgradePolicy:      cr.UpgradePolicy,
 	}
 
 	return json.Marshal(crJSON)
@@ -229,12 +244,13 @@ func UnmarshalCredentialResponseJSON(b []byte) (*CredentialResponse, error) {
 		return nil, err
 	}
 
-	pubKey, err := x509.ParsePKIXPublicKey(crJSON.ServerPublicKey)
+	pubKey, err := ParsePublicKey(crJSON.ServerPublicKey)
 	if err != nil {
 		return nil, err
 	}
 
 	env := &Envelope{
+		Mode:               crJSON.Mode,
 		Nonce:              crJSON.Nonce,
 		EncryptedCreds:     crJSON.EncryptedCreds,
 		AuthenticatedCreds: crJSON.AuthenticatedCreds,
@@ -243,12 +259,50 @@ func UnmarshalCredentialResponseJSON(b []byte) (*CredentialResponse, error) {
 	cr := &CredentialResponse{
 		OprfData:        crJSON.OprfData,
 		Envelope:        env,
+		Challenge:       crJSON.Challenge,
 		serverPublicKey: pubKey,
+		UpgradePolicy:   crJSON.UpgradePolicy,
 	}
 
 	return cr, nil
 }
 
+type loginProofJSON struct {
+	Proof []byte
+}
+
+// MarshalJSON encodes the LoginProof.
+func (lp *LoginProof) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&loginProofJSON{Proof: lp.Proof})
+}
+
+// UnmarshalLoginProofJSON decodes to a LoginProof.
+func UnmarshalLoginProofJSON(b []byte) (*LoginProof, error) {
+	lp := &LoginProof{}
+	err := json.Unmarshal(b, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	return lp, nil
+}
+
+// String returns the string equivalent of the Envelope Mode.
+func (m EnvelopeMode) String() string {
+	switch m {
+	case EnvelopeModeInternal:
+		return "Internal"
+	case EnvelopeModeExternal:
+		return "External"
+	case EnvelopeModeAESGCM:
+		return "External AES-GCM"
+	case EnvelopeModeChaCha20Poly1305:
+		return "External ChaCha20-Poly1305"
+	}
+
+	return "Unrecognized Envelope Mode"
+}
+
 // String returns the string equivalent of the Credential Type.
 func (ct CredentialType) String() string {
 	switch ct {
@@ -264,6 +318,10 @@ func (ct CredentialType) String() string {
 		return "Server Identity"
 	}
 
+	if info, ok := lookupCredentialType(ct); ok {
+		return info.name
+	}
+
 	return "Unrecognized Credential Type"
 }
 
@@ -271,3 +329,20 @@ func (ct CredentialType) String() string {
 func (ct CredentialType) MarshalText() ([]byte, error) {
 	return []byte(ct.String()), nil
 }
+
+// UnmarshalText decodes a Credential Type from its string equivalent.
+func (ct *CredentialType) UnmarshalText(text []byte) error {
+	for t := CredentialTypeUserPrivateKey; t <= CredentialTypeServerIdentity; t++ {
+		if t.String() == string(text) {
+			*ct = t
+			return nil
+		}
+	}
+
+	if t, ok := credentialTypeByName(string(text)); ok {
+		*ct = t
+		return nil
+	}
+
+	return errors.Wrapf(common.ErrorUnrecognizedMessage, "credential type %q", text)
+}
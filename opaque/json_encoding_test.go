@@ -141,6 +141,24 @@ func TestMarshalUnmarshalJSONCredentialRequest(t *testing.T) {
 	}
 }
 
+func TestMarshalUnmarshalJSONLoginProof(t *testing.T) {
+	proof1 := &LoginProof{Proof: randomBytes(64)}
+
+	raw, err := proof1.MarshalJSON()
+	if err != nil {
+		t.Error(err)
+	}
+
+	proof2, err := UnmarshalLoginProofJSON(raw)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !reflect.DeepEqual(proof1, proof2) {
+		t.Error("values not equal")
+	}
+}
+
 func TestMarshalUnmarshalJSONCredentialResponse(t *testing.T) {
 	oprfData := make([]byte, 32)
 	_, _ = rand.Read(oprfData)
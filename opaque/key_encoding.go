@@ -0,0 +1,354 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+)
+
+// A PrivateKey is a user or server key: a crypto.Signer such as an
+// *ecdsa.PrivateKey or ed25519.PrivateKey, or an X25519PrivateKey.
+type PrivateKey interface {
+	Public() crypto.PublicKey
+}
+
+// X25519KeySize is the size of X25519 private and public keys.
+const X25519KeySize = curve25519.ScalarSize
+
+// X25519PrivateKey is an X25519 Diffie-Hellman private key.
+type X25519PrivateKey []byte
+
+// X25519PublicKey is an X25519 Diffie-Hellman public key.
+type X25519PublicKey []byte
+
+// GenerateX25519Key returns a new X25519 key read from r, or from crypto/rand
+// if r is nil.
+func GenerateX25519Key(r io.Reader) (X25519PrivateKey, error) {
+	key, err := common.GetRandomBytes(r, X25519KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	return X25519PrivateKey(key), nil
+}
+
+// Public returns the X25519PublicKey of k.
+func (k X25519PrivateKey) Public() crypto.PublicKey {
+	pub, err := curve25519.X25519(k, curve25519.Basepoint)
+	if err != nil {
+		return nil
+	}
+
+	return X25519PublicKey(pub)
+}
+
+// SharedSecret returns the X25519 shared secret of k and peer.
+// Errors if peer is a low order point.
+func (k X25519PrivateKey) SharedSecret(peer X25519PublicKey) ([]byte, error) {
+	return curve25519.X25519(k, peer)
+}
+
+// Equal reports whether k and x are the same key.
+func (k X25519PrivateKey) Equal(x crypto.PrivateKey) bool {
+	other, ok := x.(X25519PrivateKey)
+	return ok && bytes.Equal(k, other)
+}
+
+// Equal reports whether k and x are the same key.
+func (k X25519PublicKey) Equal(x crypto.PublicKey) bool {
+	other, ok := x.(X25519PublicKey)
+	return ok && bytes.Equal(k, other)
+}
+
+// oidX25519 identifies X25519 keys, from RFC 8410.
+var oidX25519 = asn1.ObjectIdentifier{1, 3, 101, 110}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+type oneAsymmetricKey struct {
+	Version    int
+	Algorithm  pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+// MarshalPublicKey encodes a public key as a DER SubjectPublicKeyInfo, as
+// x509.MarshalPKIXPublicKey does, with X25519 keys encoded as in RFC 8410.
+func MarshalPublicKey(pub crypto.PublicKey) ([]byte, error) {
+	k, ok := pub.(X25519PublicKey)
+	if !ok {
+		return x509.MarshalPKIXPublicKey(pub)
+	}
+
+	if len(k) != X25519KeySize {
+		return nil, errors.Errorf("invalid X25519 public key length %d", len(k))
+	}
+
+	return asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidX25519},
+		PublicKey: asn1.BitString{Bytes: k, BitLength: 8 * len(k)},
+	})
+}
+
+// ParsePublicKey decodes a DER SubjectPublicKeyInfo, as
+// x509.ParsePKIXPublicKey does, and X25519 keys.
+func ParsePublicKey(der []byte) (crypto.PublicKey, error) {
+	var info subjectPublicKeyInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil || len(rest) != 0 || !info.Algorithm.Algorithm.Equal(oidX25519) {
+		return x509.ParsePKIXPublicKey(der)
+	}
+
+	if len(info.PublicKey.Bytes) != X25519KeySize || info.PublicKey.BitLength != 8*X25519KeySize {
+		return nil, errors.New("invalid X25519 public key")
+	}
+
+	return X25519PublicKey(info.PublicKey.Bytes), nil
+}
+
+// MarshalPrivateKey encodes a private key as DER PKCS#8, as
+// x509.MarshalPKCS8PrivateKey does, with X25519 keys encoded as in RFC 8410.
+func MarshalPrivateKey(key PrivateKey) ([]byte, error) {
+	k, ok := key.(X25519PrivateKey)
+	if !ok {
+		return x509.MarshalPKCS8PrivateKey(key)
+	}
+
+	if len(k) != X25519KeySize {
+		return nil, errors.Errorf("invalid X25519 private key length %d", len(k))
+	}
+
+	inner, err := asn1.Marshal([]byte(k))
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(oneAsymmetricKey{
+		Algorithm:  pkix.AlgorithmIdentifier{Algorithm: oidX25519},
+		PrivateKey: inner,
+	})
+}
+
+// ParsePrivateKey decodes a DER PKCS#8 private key, as
+// x509.ParsePKCS8PrivateKey does, and X25519 keys.
+func ParsePrivateKey(der []byte) (PrivateKey, error) {
+	var info oneAsymmetricKey
+	if rest, err := asn1.Unmarshal(der, &info); err != nil || len(rest) != 0 || !info.Algorithm.Algorithm.Equal(oidX25519) {
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+
+		k, ok := key.(PrivateKey)
+		if !ok {
+			return nil, errors.Errorf("unsupported private key type %T", key)
+		}
+
+		return k, nil
+	}
+
+	var k []byte
+	if rest, err := asn1.Unmarshal(info.PrivateKey, &k); err != nil || len(rest) != 0 || len(k) != X25519KeySize {
+		return nil, errors.New("invalid X25519 private key")
+	}
+
+	return X25519PrivateKey(k), nil
+}
+
+// rawKeyLength holds the lengths of the raw encodings of the public and private
+// keys of an algorithm, Npk and Nsk in the OPAQUE draft.
+type rawKeyLength struct {
+	public, private int
+}
+
+var rawKeyLengths = map[string]rawKeyLength{
+	KeyAlgorithmP256:    {33, 32},
+	KeyAlgorithmP384:    {49, 48},
+	KeyAlgorithmP521:    {67, 66},
+	KeyAlgorithmEd25519: {ed25519.PublicKeySize, ed25519.SeedSize},
+	KeyAlgorithmX25519:  {X25519KeySize, X25519KeySize},
+}
+
+// RawKeyLengths returns the lengths of the raw encodings of the public and
+// private keys of the named algorithm.
+func RawKeyLengths(algorithm string) (npk, nsk int, err error) {
+	l, ok := rawKeyLengths[algorithm]
+	if !ok {
+		return 0, 0, errors.Errorf("unknown key algorithm %q", algorithm)
+	}
+
+	return l.public, l.private, nil
+}
+
+// KeyAlgorithm returns the name of the algorithm of the public key pub, as
+// accepted by GeneratePrivateKey.
+func KeyAlgorithm(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		for name, curve := range curves {
+			if k.Curve == curve {
+				return name, nil
+			}
+		}
+	case ed25519.PublicKey:
+		return KeyAlgorithmEd25519, nil
+	case X25519PublicKey:
+		return KeyAlgorithmX25519, nil
+	}
+
+	return "", errors.Errorf("unsupported public key type %T", pub)
+}
+
+// MarshalRawPublicKey encodes a public key in its raw fixed-length form: a
+// compressed SEC 1 point for ECDSA keys, and the key itself for Ed25519 and
+// X25519 keys.
+func MarshalRawPublicKey(pub crypto.PublicKey) ([]byte, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if _, err := KeyAlgorithm(k); err != nil {
+			return nil, err
+		}
+
+		return elliptic.MarshalCompressed(k.Curve, k.X, k.Y), nil
+	case ed25519.PublicKey:
+		if len(k) != ed25519.PublicKeySize {
+			return nil, errors.Errorf("invalid Ed25519 public key length %d", len(k))
+		}
+
+		return append([]byte(nil), k...), nil
+	case X25519PublicKey:
+		if len(k) != X25519KeySize {
+			return nil, errors.Errorf("invalid X25519 public key length %d", len(k))
+		}
+
+		return append([]byte(nil), k...), nil
+	}
+
+	return nil, errors.Errorf("unsupported public key type %T", pub)
+}
+
+// ParseRawPublicKey decodes the raw encoding of a public key of the named
+// algorithm, as written by MarshalRawPublicKey.
+func ParseRawPublicKey(algorithm string, data []byte) (crypto.PublicKey, error) {
+	npk, _, err := RawKeyLengths(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) != npk {
+		return nil, errors.Errorf("invalid %s public key length %d", algorithm, len(data))
+	}
+
+	switch algorithm {
+	case KeyAlgorithmEd25519:
+		return ed25519.PublicKey(append([]byte(nil), data...)), nil
+	case KeyAlgorithmX25519:
+		return X25519PublicKey(append([]byte(nil), data...)), nil
+	}
+
+	curve := curves[algorithm]
+
+	x, y := elliptic.UnmarshalCompressed(curve, data)
+	if x == nil {
+		return nil, errors.Errorf("invalid %s public key", algorithm)
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// MarshalRawPrivateKey encodes a private key in its raw fixed-length form: the
+// big-endian scalar for ECDSA keys, the seed for Ed25519 keys, and the key
+// itself for X25519 keys.
+func MarshalRawPrivateKey(key PrivateKey) ([]byte, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		alg, err := KeyAlgorithm(&k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return k.D.FillBytes(make([]byte, rawKeyLengths[alg].private)), nil
+	case ed25519.PrivateKey:
+		if len(k) != ed25519.PrivateKeySize {
+			return nil, errors.Errorf("invalid Ed25519 private key length %d", len(k))
+		}
+
+		return k.Seed(), nil
+	case X25519PrivateKey:
+		if len(k) != X25519KeySize {
+			return nil, errors.Errorf("invalid X25519 private key length %d", len(k))
+		}
+
+		return append([]byte(nil), k...), nil
+	}
+
+	return nil, errors.Errorf("unsupported private key type %T", key)
+}
+
+// ParseRawPrivateKey decodes the raw encoding of a private key of the named
+// algorithm, as written by MarshalRawPrivateKey.
+func ParseRawPrivateKey(algorithm string, data []byte) (PrivateKey, error) {
+	_, nsk, err := RawKeyLengths(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) != nsk {
+		return nil, errors.Errorf("invalid %s private key length %d", algorithm, len(data))
+	}
+
+	switch algorithm {
+	case KeyAlgorithmEd25519:
+		return ed25519.NewKeyFromSeed(data), nil
+	case KeyAlgorithmX25519:
+		return X25519PrivateKey(append([]byte(nil), data...)), nil
+	}
+
+	curve := curves[algorithm]
+
+	d := new(big.Int).SetBytes(data)
+	if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.Errorf("invalid %s private key", algorithm)
+	}
+
+	x, y := curve.ScalarBaseMult(data)
+
+	return &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y}, D: d}, nil
+}
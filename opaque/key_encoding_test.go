@@ -0,0 +1,355 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/pkg/errors"
+)
+
+var keyAlgorithms = []string{
+	KeyAlgorithmP256,
+	KeyAlgorithmP384,
+	KeyAlgorithmP521,
+	KeyAlgorithmEd25519,
+	KeyAlgorithmX25519,
+}
+
+type publicKeyEqualer interface {
+	Equal(crypto.PublicKey) bool
+}
+
+type privateKeyEqualer interface {
+	Equal(crypto.PrivateKey) bool
+}
+
+func TestKeyEncoding(t *testing.T) {
+	for _, alg := range keyAlgorithms {
+		key, err := GeneratePrivateKey(nil, alg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		der, err := MarshalPrivateKey(key)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		parsed, err := ParsePrivateKey(der)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		if !parsed.(privateKeyEqualer).Equal(key) {
+			t.Errorf("%s: private key changed in round trip", alg)
+		}
+
+		der, err = MarshalPublicKey(key.Public())
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		pub, err := ParsePublicKey(der)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		if !pub.(publicKeyEqualer).Equal(key.Public()) {
+			t.Errorf("%s: public key changed in round trip", alg)
+		}
+	}
+}
+
+func TestRawKeyEncoding(t *testing.T) {
+	for _, alg := range keyAlgorithms {
+		key, err := GeneratePrivateKey(nil, alg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if name, err := KeyAlgorithm(key.Public()); err != nil || name != alg {
+			t.Errorf("%s: got algorithm %q, %v", alg, name, err)
+		}
+
+		npk, nsk, err := RawKeyLengths(alg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		raw, err := MarshalRawPrivateKey(key)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		if len(raw) != nsk {
+			t.Errorf("%s: private key length %d, expected %d", alg, len(raw), nsk)
+		}
+
+		parsed, err := ParseRawPrivateKey(alg, raw)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		if !parsed.(privateKeyEqualer).Equal(key) {
+			t.Errorf("%s: private key changed in round trip", alg)
+		}
+
+		if _, err := ParseRawPrivateKey(alg, raw[1:]); err == nil {
+			t.Errorf("%s: expected error parsing short private key", alg)
+		}
+
+		raw, err = MarshalRawPublicKey(key.Public())
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		if len(raw) != npk {
+			t.Errorf("%s: public key length %d, expected %d", alg, len(raw), npk)
+		}
+
+		pub, err := ParseRawPublicKey(alg, raw)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		if !pub.(publicKeyEqualer).Equal(key.Public()) {
+			t.Errorf("%s: public key changed in round trip", alg)
+		}
+
+		if _, err := ParseRawPublicKey(alg, append(raw, 0)); err == nil {
+			t.Errorf("%s: expected error parsing long public key", alg)
+		}
+	}
+
+	// Out of range ECDSA keys
+	_, nsk, _ := RawKeyLengths(KeyAlgorithmP256)
+	if _, err := ParseRawPrivateKey(KeyAlgorithmP256, make([]byte, nsk)); err == nil {
+		t.Error("expected error parsing zero scalar")
+	}
+
+	if _, err := ParseRawPrivateKey(KeyAlgorithmP256, bytes.Repeat([]byte{0xff}, nsk)); err == nil {
+		t.Error("expected error parsing scalar above the group order")
+	}
+
+	npk, _, _ := RawKeyLengths(KeyAlgorithmP256)
+	if _, err := ParseRawPublicKey(KeyAlgorithmP256, make([]byte, npk)); err == nil {
+		t.Error("expected error parsing invalid point")
+	}
+
+	if _, _, err := RawKeyLengths("RSA"); err == nil {
+		t.Error("expected error for unknown algorithm")
+	}
+}
+
+func TestX25519Encoding(t *testing.T) {
+	key, err := GenerateX25519Key(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The fixed prefixes of RFC 8410 X25519 keys.
+	der, err := MarshalPrivateKey(key)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	prefix, _ := hex.DecodeString("302e020100300506032b656e04220420")
+	if !bytes.Equal(der, append(prefix, key...)) {
+		t.Errorf("private key encoding %x", der)
+	}
+
+	der, err = MarshalPublicKey(key.Public())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	prefix, _ = hex.DecodeString("302a300506032b656e032100")
+	if !bytes.Equal(der, append(prefix, key.Public().(X25519PublicKey)...)) {
+		t.Errorf("public key encoding %x", der)
+	}
+
+	if _, err := MarshalPublicKey(X25519PublicKey(make([]byte, 31))); err == nil {
+		t.Error("expected error encoding short X25519 key")
+	}
+
+	if _, err := ParsePrivateKey(append(prefix, 1, 2, 3)); err == nil {
+		t.Error("expected error parsing truncated X25519 key")
+	}
+}
+
+func TestX25519SharedSecret(t *testing.T) {
+	a, err := GenerateX25519Key(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	b, err := GenerateX25519Key(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ab, err := a.SharedSecret(b.Public().(X25519PublicKey))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ba, err := b.SharedSecret(a.Public().(X25519PublicKey))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(ab, ba) {
+		t.Error("shared secrets differ")
+	}
+
+	if _, err := a.SharedSecret(make(X25519PublicKey, X25519KeySize)); err == nil {
+		t.Error("expected error with low order point")
+	}
+}
+
+func TestKeyAlgorithmsEndToEnd(t *testing.T) {
+	for _, serverAlg := range keyAlgorithms {
+		for _, userAlg := range keyAlgorithms {
+			if err := runKeyAlgorithms(serverAlg, userAlg); err != nil {
+				t.Errorf("server %s, user %s: %v", serverAlg, userAlg, err)
+			}
+		}
+	}
+}
+
+func runKeyAlgorithms(serverAlg, userAlg string) error {
+	serverKey, err := GeneratePrivateKey(nil, serverAlg)
+	if err != nil {
+		return err
+	}
+
+	userKey, err := GeneratePrivateKey(nil, userAlg)
+	if err != nil {
+		return err
+	}
+
+	cfg := &ServerConfig{
+		ServerID:    "example.com",
+		Signer:      serverKey,
+		RecordTable: make(InMemoryUserRecordTable),
+		Suite:       oprf.OPRFP256,
+	}
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	c, err := NewClient("user", cfg.ServerID, cfg.Suite, userKey)
+	if err != nil {
+		return err
+	}
+
+	regRequest, err := c.CreateRegistrationRequest("password")
+	if err != nil {
+		return err
+	}
+
+	regResponse, err := s.CreateRegistrationResponse(regRequest)
+	if err != nil {
+		return err
+	}
+
+	regUpload, _, err := c.FinalizeRegistrationRequest(regResponse)
+	if err != nil {
+		return err
+	}
+
+	if err := s.StoreUserRecord(regUpload); err != nil {
+		return err
+	}
+
+	s, err = NewServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Send the messages through their encodings, as a transport would.
+	loginRequest, err := c.CreateCredentialRequest([]byte("password"))
+	if err != nil {
+		return err
+	}
+
+	loginResponse, err := s.CreateCredentialResponse(loginRequest)
+	if err != nil {
+		return err
+	}
+
+	raw, err := loginResponse.Marshal()
+	if err != nil {
+		return err
+	}
+
+	decoded := &CredentialResponse{}
+	if _, err := decoded.Unmarshal(raw); err != nil {
+		return err
+	}
+
+	creds, _, err := c.RecoverCredentials(decoded)
+	if err != nil {
+		return err
+	}
+
+	userPrivateKey, ok := creds.Find(CredentialTypeUserPrivateKey)
+	if !ok || !userPrivateKey.(privateKeyEqualer).Equal(userKey) {
+		return errors.New("user private key not recovered")
+	}
+
+	serverPublicKey, ok := creds.Find(CredentialTypeServerPublicKey)
+	if !ok || !serverPublicKey.(publicKeyEqualer).Equal(serverKey.Public()) {
+		return errors.New("server public key not recovered")
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"crypto/sha256"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// A KeyStretcher hardens the OPRF output of the client, so that guessing the
+// password of a stolen user record costs one stretch per guess. A user must
+// log in with the KeyStretcher they registered with.
+type KeyStretcher interface {
+	Stretch(rwd []byte) []byte
+}
+
+// DefaultKeyStretcher is used by clients without a KeyStretcher.
+var DefaultKeyStretcher KeyStretcher = PBKDF2{Iterations: 4096}
+
+// Length of the stretched OPRF output.
+const stretchedLength = 32
+
+// "We note that the salt value typically input into the KDF can be set to a
+// constant, e.g., all zeros."
+var stretchSalt = []byte{0, 0, 0, 0}
+
+// PBKDF2 is a KeyStretcher running PBKDF2-SHA256.
+type PBKDF2 struct {
+	Iterations int
+}
+
+// Stretch implements KeyStretcher.
+func (p PBKDF2) Stretch(rwd []byte) []byte {
+	return pbkdf2.Key(rwd, stretchSalt, p.Iterations, stretchedLength, sha256.New)
+}
+
+// Argon2id is a KeyStretcher running Argon2id. Zero parameters take the
+// defaults below, so that the zero value is usable.
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+}
+
+// Defaults for Argon2id, the second recommended option of RFC 9106.
+const (
+	DefaultArgon2idTime    = 3
+	DefaultArgon2idMemory  = 64 * 1024
+	DefaultArgon2idThreads = 4
+)
+
+// Stretch implements KeyStretcher.
+func (a Argon2id) Stretch(rwd []byte) []byte {
+	if a.Time == 0 {
+		a.Time = DefaultArgon2idTime
+	}
+
+	if a.Memory == 0 {
+		a.Memory = DefaultArgon2idMemory
+	}
+
+	if a.Threads == 0 {
+		a.Threads = DefaultArgon2idThreads
+	}
+
+	return argon2.IDKey(rwd, stretchSalt, a.Time, a.Memory, a.Threads, stretchedLength)
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Key algorithms accepted by GeneratePrivateKey.
+const (
+	KeyAlgorithmP256    = "P256"
+	KeyAlgorithmP384    = "P384"
+	KeyAlgorithmP521    = "P521"
+	KeyAlgorithmEd25519 = "Ed25519"
+	KeyAlgorithmX25519  = "X25519"
+)
+
+// PEM block types of the files written by this package.
+const (
+	pemTypePrivateKey   = "PRIVATE KEY"
+	pemTypeECPrivateKey = "EC PRIVATE KEY"
+	pemTypePublicKey    = "PUBLIC KEY"
+	pemTypeOPRFSeed     = "OPAQUE OPRF SEED"
+)
+
+// OPRFSeedLength is the length of the seeds made by GenerateOPRFSeed.
+const OPRFSeedLength = 32
+
+var curves = map[string]elliptic.Curve{
+	KeyAlgorithmP256: elliptic.P256(),
+	KeyAlgorithmP384: elliptic.P384(),
+	KeyAlgorithmP521: elliptic.P521(),
+}
+
+// GeneratePrivateKey returns a new private key using the named algorithm,
+// read from r or from crypto/rand if r is nil.
+func GeneratePrivateKey(r io.Reader, algorithm string) (PrivateKey, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+
+	switch algorithm {
+	case KeyAlgorithmEd25519:
+		_, key, err := ed25519.GenerateKey(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return key, nil
+	case KeyAlgorithmX25519:
+		return GenerateX25519Key(r)
+	}
+
+	curve, ok := curves[algorithm]
+	if !ok {
+		return nil, errors.Errorf("unknown key algorithm %q", algorithm)
+	}
+
+	return ecdsa.GenerateKey(curve, r)
+}
+
+// MarshalPrivateKeyPEM encodes a private key as a PEM PKCS#8 private key.
+func MarshalPrivateKeyPEM(key PrivateKey) ([]byte, error) {
+	der, err := MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: pemTypePrivateKey, Bytes: der}), nil
+}
+
+// ParsePrivateKeyPEM decodes a PEM PKCS#8 private key, or a PEM SEC 1 EC
+// private key as written by OpenSSL.
+func ParsePrivateKeyPEM(data []byte) (PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case pemTypePrivateKey:
+		return ParsePrivateKey(block.Bytes)
+	case pemTypeECPrivateKey:
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	return nil, errors.Errorf("unexpected PEM block %q", block.Type)
+}
+
+// MarshalPublicKeyPEM encodes a public key as a PEM PKIX public key.
+func MarshalPublicKeyPEM(key crypto.PublicKey) ([]byte, error) {
+	der, err := MarshalPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: pemTypePublicKey, Bytes: der}), nil
+}
+
+// GenerateOPRFSeed returns a new OPRF seed read from r, or from crypto/rand
+// if r is nil.
+func GenerateOPRFSeed(r io.Reader) ([]byte, error) {
+	return common.GetRandomBytes(r, OPRFSeedLength)
+}
+
+// MarshalOPRFSeedPEM encodes an OPRF seed as PEM.
+func MarshalOPRFSeedPEM(seed []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: pemTypeOPRFSeed, Bytes: seed})
+}
+
+// ParseOPRFSeedPEM decodes a PEM OPRF seed.
+func ParseOPRFSeedPEM(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	if block.Type != pemTypeOPRFSeed {
+		return nil, errors.Errorf("unexpected PEM block %q", block.Type)
+	}
+
+	if len(block.Bytes) < OPRFSeedLength {
+		return nil, errors.Errorf("OPRF seed too short: %d bytes", len(block.Bytes))
+	}
+
+	return block.Bytes, nil
+}
+
+// deriveOPRFKey derives the OPRF key of username from seed, so that the
+// server does not need fresh randomness per user and the key for a given
+// username is stable.
+func deriveOPRFKey(suite oprf.SuiteID, seed, username []byte) (*oprf.PrivateKey, error) {
+	s, err := getOPRFSuite(suite)
+	if err != nil {
+		return nil, err
+	}
+
+	info := append([]byte("OPAQUE OPRF key"), username...)
+
+	scalar, err := deriveScalar(s, hkdf.New(sha256.New, seed, nil, info))
+	if err != nil {
+		return nil, err
+	}
+
+	key := new(oprf.PrivateKey)
+	if err := key.Deserialize(suite, scalar); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// deriveClientKey derives the client key pair of an internal mode envelope
+// from the randomized password and the envelope nonce, on the curve of the
+// OPRF suite.
+func deriveClientKey(s *oprfSuite, rwd, nonce []byte) (*ecdsa.PrivateKey, error) {
+	info := append(append([]byte{}, nonce...), "PrivateKey"...)
+
+	scalar, err := deriveScalar(s, hkdf.Expand(sha256.New, rwd, info))
+	if err != nil {
+		return nil, err
+	}
+
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(scalar)}
+	key.Curve = s.curve
+	key.X, key.Y = s.curve.ScalarBaseMult(scalar)
+
+	return key, nil
+}
+
+// deriveScalar reads a non-zero scalar of the suite's group from r.
+func deriveScalar(s *oprfSuite, r io.Reader) ([]byte, error) {
+	n := s.curve.Params().N
+	length := s.scalarLength()
+
+	// Reduce 128 bits more than the order, so that the bias is negligible.
+	okm := make([]byte, length+16)
+	if _, err := io.ReadFull(r, okm); err != nil {
+		return nil, err
+	}
+
+	k := new(big.Int).SetBytes(okm)
+	k.Mod(k, new(big.Int).Sub(n, big.NewInt(1)))
+	k.Add(k, big.NewInt(1))
+
+	scalar := make([]byte, length)
+	k.FillBytes(scalar)
+
+	return scalar, nil
+}
+
+// writeFileAtomic writes data to path with the given permissions, replacing
+// any existing file only once the new contents are on disk.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmp)
+
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// rotateFile archives the file at path under a name suffixed with the
+// current time, and a counter if that name is taken, and replaces it with
+// data. Returns the archive path.
+func rotateFile(path string, data []byte) (string, error) {
+	base := path + "." + time.Now().UTC().Format("20060102T150405Z")
+	archive := base
+
+	for i := 1; ; i++ {
+		err := os.Link(path, archive)
+		if err == nil {
+			break
+		}
+
+		if !os.IsExist(err) {
+			return "", errors.Wrap(err, "archive")
+		}
+
+		archive = fmt.Sprintf("%s.%d", base, i)
+	}
+
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return "", err
+	}
+
+	return archive, nil
+}
+
+// RotateSigningKey replaces the PEM server key at path with a new key using
+// the named algorithm, keeping the old key in an archive file whose path is
+// returned. User records hold the public key they were registered with in
+// their envelopes, so the archived key must be loaded as one of the
+// PreviousSigners, e.g. by listing it in PreviousSigningKeyFiles, until every
+// user has registered again.
+func RotateSigningKey(path, algorithm string) (string, error) {
+	key, err := GeneratePrivateKey(nil, algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := MarshalPrivateKeyPEM(key)
+	if err != nil {
+		return "", err
+	}
+
+	return rotateFile(path, data)
+}
+
+// RotateOPRFSeed replaces the PEM OPRF seed at path with a new seed, keeping
+// the old seed in an archive file whose path is returned. The seed is only
+// used when registering, so existing users are not affected.
+func RotateOPRFSeed(path string) (string, error) {
+	seed, err := GenerateOPRFSeed(nil)
+	if err != nil {
+		return "", err
+	}
+
+	return rotateFile(path, MarshalOPRFSeedPEM(seed))
+}
@@ -0,0 +1,382 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+func TestPrivateKeyPEM(t *testing.T) {
+	for _, alg := range keyAlgorithms {
+		key, err := GeneratePrivateKey(nil, alg)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		data, err := MarshalPrivateKeyPEM(key)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		parsed, err := ParsePrivateKeyPEM(data)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		if !reflect.DeepEqual(key, parsed) {
+			t.Errorf("%s: keys not equal", alg)
+		}
+
+		data, err = MarshalPublicKeyPEM(key.Public())
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PUBLIC KEY" {
+			t.Errorf("%s: bad public key PEM %s", alg, data)
+			return
+		}
+
+		pub, err := ParsePublicKey(block.Bytes)
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+			return
+		}
+
+		if !reflect.DeepEqual(key.Public(), pub) {
+			t.Errorf("%s: public keys not equal", alg)
+		}
+	}
+
+	if _, err := GeneratePrivateKey(nil, "P999"); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
+
+func TestParsePrivateKeyPEMSEC1(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	parsed, err := ParsePrivateKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(key, parsed) {
+		t.Error("keys not equal")
+	}
+
+	for _, data := range [][]byte{
+		nil,
+		[]byte("not PEM"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+	} {
+		if _, err := ParsePrivateKeyPEM(data); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
+
+func TestOPRFSeedPEM(t *testing.T) {
+	seed, err := GenerateOPRFSeed(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	parsed, err := ParseOPRFSeedPEM(MarshalOPRFSeedPEM(seed))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(seed, parsed) {
+		t.Error("seeds not equal")
+	}
+
+	if _, err := ParseOPRFSeedPEM(MarshalOPRFSeedPEM(seed[:16])); err == nil {
+		t.Error("expected an error for a short seed")
+	}
+}
+
+func TestDeriveOPRFKey(t *testing.T) {
+	seed1 := bytes.Repeat([]byte{1}, OPRFSeedLength)
+	seed2 := bytes.Repeat([]byte{2}, OPRFSeedLength)
+
+	for _, suite := range []oprf.SuiteID{oprf.OPRFP256, oprf.OPRFP384, oprf.OPRFP521} {
+		serialize := func(seed []byte, username string) []byte {
+			key, err := deriveOPRFKey(suite, seed, []byte(username))
+			if err != nil {
+				t.Errorf("%v: %v", suite, err)
+				return nil
+			}
+
+			data, err := key.Serialize()
+			if err != nil {
+				t.Errorf("%v: %v", suite, err)
+				return nil
+			}
+
+			return data
+		}
+
+		k := serialize(seed1, "alice")
+		if k == nil {
+			return
+		}
+
+		if !bytes.Equal(k, serialize(seed1, "alice")) {
+			t.Errorf("%v: derivation is not deterministic", suite)
+		}
+
+		if bytes.Equal(k, serialize(seed1, "bob")) || bytes.Equal(k, serialize(seed2, "alice")) {
+			t.Errorf("%v: keys not distinct", suite)
+		}
+	}
+}
+
+func TestRegisterWithOPRFSeed(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg.OPRFSeed, err = GenerateOPRFSeed(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	h, err := newStateHarness(cfg, "seeded user", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, step := range []string{"CreateRegistrationRequest", "FinalizeRegistrationRequest"} {
+		if err := h.runClientStep(step); err != nil {
+			t.Errorf("%s: %v", step, err)
+			return
+		}
+	}
+
+	record, err := cfg.RecordTable.LookupUserRecord("seeded user")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected, err := deriveOPRFKey(cfg.Suite, cfg.OPRFSeed, []byte("seeded user"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(record.OprfServer.GetPublicKey(), expected.Public()) {
+		t.Error("record does not use the derived OPRF key")
+		return
+	}
+
+	// Records keep their OPRF key, so logins survive seed rotation.
+	cfg.OPRFSeed, err = GenerateOPRFSeed(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, step := range []string{"CreateCredentialRequest", "RecoverCredentials"} {
+		if err := h.runClientStep(step); err != nil {
+			t.Errorf("%s: %v", step, err)
+			return
+		}
+	}
+}
+
+func TestRotateSigningKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opaque-keys")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key.pem")
+
+	key, err := GeneratePrivateKey(nil, KeyAlgorithmP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	old, err := MarshalPrivateKeyPEM(key)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := ioutil.WriteFile(path, old, 0600); err != nil {
+		t.Error(err)
+		return
+	}
+
+	archive, err := RotateSigningKey(path, KeyAlgorithmP384)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	archived, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(old, archived) {
+		t.Error("archive does not hold the old key")
+	}
+
+	// A second rotation within the same second does not clobber the archive.
+	second, err := RotateSigningKey(path, KeyAlgorithmP384)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if second == archive {
+		t.Errorf("rotations share archive %s", archive)
+	}
+
+	if archived, err = ioutil.ReadFile(archive); err != nil || !bytes.Equal(old, archived) {
+		t.Error("first archive overwritten")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rotated, err := ParsePrivateKeyPEM(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if pub, ok := rotated.Public().(*ecdsa.PublicKey); !ok || pub.Curve != elliptic.P384() {
+		t.Errorf("unexpected rotated key %T", rotated.Public())
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("incorrect permissions %v", info.Mode().Perm())
+	}
+}
+
+func TestLoginAfterSigningKeyRotation(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	h, err := newStateHarness(cfg, "old user", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, step := range []string{"CreateRegistrationRequest", "FinalizeRegistrationRequest"} {
+		if err := h.runClientStep(step); err != nil {
+			t.Errorf("%s: %v", step, err)
+			return
+		}
+	}
+
+	old := cfg.Signer
+
+	cfg.Signer, err = GeneratePrivateKey(nil, KeyAlgorithmP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Without the old key, the user cannot be answered.
+	if err := h.runClientStep("CreateCredentialRequest"); !errors.Is(err, common.ErrorServerKeyMismatch) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorServerKeyMismatch)
+		return
+	}
+
+	cfg.PreviousSigners = []PrivateKey{old}
+
+	h, err = newStateHarness(cfg, "old user", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, step := range []string{"CreateCredentialRequest", "RecoverCredentials"} {
+		if err := h.runClientStep(step); err != nil {
+			t.Errorf("%s: %v", step, err)
+			return
+		}
+	}
+}
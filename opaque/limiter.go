@@ -0,0 +1,348 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+// AttemptLimiter limits online password guessing. The server consults it
+// before evaluating the OPRF for a credential request, once for the client
+// ("client:<ClientKey>") if the server has a ClientKey set, and once for the
+// username ("user:<username>"). Implementations must be safe for concurrent use.
+type AttemptLimiter interface {
+	// Allow returns an error wrapping common.ErrorRateLimited if a login
+	// attempt for key must not proceed now, and records the attempt
+	// otherwise.
+	Allow(key string) error
+
+	// Fail records a failed login for key.
+	Fail(key string)
+
+	// Succeed records a successful login for key.
+	Succeed(key string)
+}
+
+// limiterKeys returns the AttemptLimiter keys for a login by username. The
+// client comes first, so that a client which is already limited does not
+// use up attempts for the user.
+func (s *Server) limiterKeys(username []byte) []string {
+	var keys []string
+	if s.ClientKey != "" {
+		keys = append(keys, "client:"+s.ClientKey)
+	}
+
+	return append(keys, "user:"+string(username))
+}
+
+// allowAttempt consults the AttemptLimiter, if any, for a login by username.
+func (s *Server) allowAttempt(username []byte) error {
+	if s.Config.AttemptLimiter == nil {
+		return nil
+	}
+
+	for _, key := range s.limiterKeys(username) {
+		if err := s.Config.AttemptLimiter.Allow(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RecordLoginFailure records a failed login in the audit log and with the
+// AttemptLimiter, for instance once the AKE finds that the client failed to
+// authenticate. Must be called after CreateCredentialResponse.
+func (s *Server) RecordLoginFailure() error {
+	if err := s.checkState("RecordLoginFailure", serverStateCredentialResponded); err != nil {
+		s.audit(EventLoginResult, s.UserRecord.UserID, err)
+		return err
+	}
+
+	s.auditOutcome(EventLoginResult, s.UserRecord.UserID, OutcomeFailure, nil)
+	s.failAttempt()
+
+	return nil
+}
+
+// failAttempt reports a failed login by the user of the record to the
+// AttemptLimiter, if any.
+func (s *Server) failAttempt() {
+	if s.Config.AttemptLimiter == nil {
+		return
+	}
+
+	for _, key := range s.limiterKeys(s.UserRecord.UserID) {
+		s.Config.AttemptLimiter.Fail(key)
+	}
+}
+
+// RecordLoginSuccess records a successful login in the audit log and with the
+// AttemptLimiter. Must be called after VerifyLoginProof has authenticated the
+// client, as responding to a login proves nothing about it.
+func (s *Server) RecordLoginSuccess() error {
+	if err := s.checkState("RecordLoginSuccess", serverStateLoginSucceeded); err != nil {
+		s.audit(EventLoginResult, s.UserRecord.UserID, err)
+		return err
+	}
+
+	s.auditOutcome(EventLoginResult, s.UserRecord.UserID, OutcomeSuccess, nil)
+
+	if s.Config.AttemptLimiter == nil {
+		return nil
+	}
+
+	for _, key := range s.limiterKeys(s.UserRecord.UserID) {
+		s.Config.AttemptLimiter.Succeed(key)
+	}
+
+	return nil
+}
+
+// TokenBucketLimiter is an in-memory AttemptLimiter which limits the rate of
+// login attempts per key. Each key has a bucket of Burst tokens, refilled at
+// Rate tokens per second, and each attempt takes a token. Login outcomes are
+// ignored.
+type TokenBucketLimiter struct {
+	Rate  float64
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucketLimiter returns a new TokenBucketLimiter allowing burst
+// attempts at once and rate attempts per second after that.
+// Errors if rate or burst is not positive.
+func NewTokenBucketLimiter(rate float64, burst int) (*TokenBucketLimiter, error) {
+	if !(rate > 0) || math.IsInf(rate, 1) {
+		return nil, errors.Errorf("token bucket rate %v is not a positive number", rate)
+	}
+
+	if burst <= 0 {
+		return nil, errors.Errorf("token bucket burst %d is not positive", burst)
+	}
+
+	return &TokenBucketLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}, nil
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (l *TokenBucketLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+}
+
+// Allow takes a token from the bucket for key. Errors if there is none.
+func (l *TokenBucketLimiter) Allow(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	l.refill(b, now)
+
+	if b.tokens < 1 {
+		return errors.Wrap(common.ErrorRateLimited, key)
+	}
+
+	b.tokens--
+
+	return nil
+}
+
+// Fail does nothing: every attempt is already counted by Allow.
+func (l *TokenBucketLimiter) Fail(key string) {}
+
+// Succeed does nothing: every attempt is already counted by Allow.
+func (l *TokenBucketLimiter) Succeed(key string) {}
+
+// prune drops full buckets, which are equivalent to missing ones, so that the
+// map does not grow without bound. Runs at most once per refill period.
+func (l *TokenBucketLimiter) prune(now time.Time) {
+	period := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	if now.Sub(l.lastPrune) < period {
+		return
+	}
+
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastPrune = now
+}
+
+// BackoffLimiter is an in-memory AttemptLimiter which locks a key out for an
+// exponentially growing delay after failed logins. Allow counts each attempt
+// as a failure until it succeeds, so that concurrent attempts are limited
+// before their outcome is known. The first Free failures are not penalized;
+// after that, the n-th further failure locks the key out for Base * 2^(n-1),
+// capped at Max. A successful login, or Max passing without attempts once the
+// lockout ends, resets the key.
+type BackoffLimiter struct {
+	Free int
+	Base time.Duration
+	Max  time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*backoffEntry
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type backoffEntry struct {
+	failures int
+	until    time.Time
+}
+
+// NewBackoffLimiter returns a new BackoffLimiter allowing free failures before
+// locking keys out for base, doubling up to max.
+// Errors if free is negative, base is not positive or max is less than base.
+func NewBackoffLimiter(free int, base, max time.Duration) (*BackoffLimiter, error) {
+	if free < 0 {
+		return nil, errors.Errorf("backoff free failures %d is negative", free)
+	}
+
+	if base <= 0 {
+		return nil, errors.Errorf("backoff base %v is not positive", base)
+	}
+
+	if max < base {
+		return nil, errors.Errorf("backoff max %v is less than base %v", max, base)
+	}
+
+	return &BackoffLimiter{
+		Free:    free,
+		Base:    base,
+		Max:     max,
+		entries: make(map[string]*backoffEntry),
+		now:     time.Now,
+	}, nil
+}
+
+// expired returns whether e should be forgotten.
+func (l *BackoffLimiter) expired(e *backoffEntry, now time.Time) bool {
+	return now.After(e.until.Add(l.Max))
+}
+
+// Allow errors if key is locked out. Otherwise it records the attempt as a
+// failure, locking the key out if it is over Free, until Succeed is called.
+func (l *BackoffLimiter) Allow(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	e, ok := l.entries[key]
+	if ok && now.Before(e.until) {
+		return errors.Wrapf(common.ErrorRateLimited, "%s locked out for %v", key, e.until.Sub(now))
+	}
+
+	if !ok || l.expired(e, now) {
+		e = &backoffEntry{until: now}
+		l.entries[key] = e
+	}
+
+	e.failures++
+
+	if n := e.failures - l.Free; n > 0 {
+		e.until = now.Add(l.delay(n))
+	}
+
+	return nil
+}
+
+// Fail does nothing: every attempt is already counted as a failure by Allow.
+func (l *BackoffLimiter) Fail(key string) {}
+
+// delay returns the lockout after the n-th penalized failure.
+func (l *BackoffLimiter) delay(n int) time.Duration {
+	delay := l.Base
+	for i := 1; i < n; i++ {
+		if delay >= l.Max/2 {
+			return l.Max
+		}
+
+		delay *= 2
+	}
+
+	if delay > l.Max {
+		return l.Max
+	}
+
+	return delay
+}
+
+// Succeed resets key, forgiving its failed attempts.
+func (l *BackoffLimiter) Succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, key)
+}
+
+// prune drops expired entries so that the map does not grow without bound.
+// Runs at most once per Max.
+func (l *BackoffLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.Max {
+		return
+	}
+
+	for key, e := range l.entries {
+		if l.expired(e, now) {
+			delete(l.entries, key)
+		}
+	}
+
+	l.lastPrune = now
+}
@@ -0,0 +1,338 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+// fakeClock is a settable clock for limiter tests.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l, err := NewTokenBucketLimiter(0.5, 3)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	l.now = clock.now
+
+	for i := 0; i < 3; i++ {
+		if err := l.Allow("a"); err != nil {
+			t.Errorf("attempt %v: %v", i, err)
+			return
+		}
+	}
+
+	if err := l.Allow("a"); !errors.Is(err, common.ErrorRateLimited) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorRateLimited)
+		return
+	}
+
+	// Other keys are not affected.
+	if err := l.Allow("b"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// One token is refilled every two seconds.
+	clock.advance(time.Second)
+
+	if err := l.Allow("a"); !errors.Is(err, common.ErrorRateLimited) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorRateLimited)
+		return
+	}
+
+	clock.advance(time.Second)
+
+	if err := l.Allow("a"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Full buckets are pruned.
+	clock.advance(time.Minute)
+
+	if err := l.Allow("c"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(l.buckets) != 1 {
+		t.Errorf("expected 1 bucket after pruning, got %v", len(l.buckets))
+		return
+	}
+
+	for _, bad := range []struct {
+		rate  float64
+		burst int
+	}{{0, 3}, {-1, 3}, {math.NaN(), 3}, {math.Inf(1), 3}, {0.5, 0}} {
+		if _, err := NewTokenBucketLimiter(bad.rate, bad.burst); err == nil {
+			t.Errorf("rate %v, burst %v: expected an error", bad.rate, bad.burst)
+		}
+	}
+}
+
+func TestBackoffLimiter(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l, err := NewBackoffLimiter(2, time.Second, 8*time.Second)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	l.now = clock.now
+
+	// Free attempts.
+	for i := 0; i < 2; i++ {
+		if err := l.Allow("a"); err != nil {
+			t.Errorf("attempt %v: %v", i, err)
+			return
+		}
+	}
+
+	// Each further attempt is counted before its outcome is known, and locks
+	// the key out for delays doubling up to Max.
+	for _, delay := range []time.Duration{1, 2, 4, 8, 8} {
+		if err := l.Allow("a"); err != nil {
+			t.Errorf("before %v: %v", delay*time.Second, err)
+			return
+		}
+
+		clock.advance(delay*time.Second - time.Millisecond)
+
+		if err := l.Allow("a"); !errors.Is(err, common.ErrorRateLimited) {
+			t.Errorf("expected err %v to contain %v", err, common.ErrorRateLimited)
+			return
+		}
+
+		clock.advance(time.Millisecond)
+	}
+
+	// Success resets the key.
+	l.Succeed("a")
+
+	for i := 0; i < 3; i++ {
+		if err := l.Allow("a"); err != nil {
+			t.Errorf("attempt %v after success: %v", i, err)
+			return
+		}
+	}
+
+	if err := l.Allow("a"); !errors.Is(err, common.ErrorRateLimited) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorRateLimited)
+		return
+	}
+
+	// So does Max passing without attempts once the lockout ends.
+	clock.advance(time.Second + 8*time.Second + time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if err := l.Allow("a"); err != nil {
+			t.Errorf("attempt %v after expiry: %v", i, err)
+			return
+		}
+	}
+
+	if delay := l.delay(1000); delay != l.Max {
+		t.Errorf("expected delay %v, got %v", l.Max, delay)
+		return
+	}
+
+	for _, bad := range []struct {
+		free      int
+		base, max time.Duration
+	}{{-1, time.Second, time.Second}, {0, 0, time.Second}, {0, -time.Second, time.Second}, {0, time.Second, 0}, {0, 2 * time.Second, time.Second}} {
+		if _, err := NewBackoffLimiter(bad.free, bad.base, bad.max); err == nil {
+			t.Errorf("free %v, base %v, max %v: expected an error", bad.free, bad.base, bad.max)
+		}
+	}
+}
+
+// recordingLimiter records the keys it is called with.
+type recordingLimiter struct {
+	allowed, failed, succeeded []string
+	deny                       string
+}
+
+func (l *recordingLimiter) Allow(key string) error {
+	if key == l.deny {
+		return errors.Wrap(common.ErrorRateLimited, key)
+	}
+
+	l.allowed = append(l.allowed, key)
+
+	return nil
+}
+
+func (l *recordingLimiter) Fail(key string) {
+	l.failed = append(l.failed, key)
+}
+
+func (l *recordingLimiter) Succeed(key string) {
+	l.succeeded = append(l.succeeded, key)
+}
+
+func TestServerAttemptLimiter(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	limiter := &recordingLimiter{deny: "client:192.0.2.1"}
+	cfg.AttemptLimiter = limiter
+
+	login := func(clientKey string) (*Server, error) {
+		c, err := NewClient("user1", cfg.ServerID, cfg.Suite, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		request, err := c.CreateCredentialRequest([]byte("password1"))
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := NewServer(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		s.ClientKey = clientKey
+		_, err = s.CreateCredentialResponse(request)
+
+		return s, err
+	}
+
+	// Denied before evaluation, and the server can be used again.
+	s, err := login("192.0.2.1")
+	if !errors.Is(err, common.ErrorRateLimited) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorRateLimited)
+		return
+	}
+
+	if err := s.RecordLoginFailure(); !errors.Is(err, common.ErrorInvalidState) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorInvalidState)
+		return
+	}
+
+	limiter.allowed = nil
+
+	s, err = login("192.0.2.2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := []string{"client:192.0.2.2", "user:user1"}
+	if !stringsEqual(limiter.allowed, expected) {
+		t.Errorf("expected allowed keys %v, got %v", expected, limiter.allowed)
+		return
+	}
+
+	if err := s.RecordLoginFailure(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !stringsEqual(limiter.failed, expected) {
+		t.Errorf("expected failed keys %v, got %v", expected, limiter.failed)
+		return
+	}
+
+	// Without a client key only the username is limited. Success needs a
+	// login proof.
+	s, err = NewServer(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	c, err := startLogin(s, "user1", "password1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := s.RecordLoginSuccess(); !errors.Is(err, common.ErrorInvalidState) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorInvalidState)
+		return
+	}
+
+	proof, err := c.ProveLogin()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := s.VerifyLoginProof(proof); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := s.RecordLoginSuccess(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !stringsEqual(limiter.succeeded, expected[1:]) {
+		t.Errorf("expected succeeded keys %v, got %v", expected[1:], limiter.succeeded)
+		return
+	}
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
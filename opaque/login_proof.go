@@ -0,0 +1,236 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"time"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint/syntax"
+)
+
+// LoginChallengeLength is the length of the random challenge in credential
+// responses, which makes each login transcript unique.
+const LoginChallengeLength = 32
+
+// loginProofContext separates login proofs from other signatures by the user
+// private key.
+const loginProofContext = "OPAQUE login proof"
+
+// A loginTranscript is what a login proof signs. It binds the proof to the
+// user, to both OPRF messages of the login and to a fresh challenge drawn by
+// the server, so that a proof is only valid for the server session it answers
+// and cannot be replayed. It does not bind the envelope, the server identity
+// or the channel the login runs over: a proof shows that the client recovered
+// the user private key in this session, and nothing more. It is not a key
+// exchange.
+//
+// struct {
+// 	opaque context<1..255>;
+// 	opaque user_id<0..2^16-1>;
+// 	opaque request<1..2^16-1>;
+// 	opaque response<1..2^16-1>;
+// 	opaque challenge<0..255>;
+// } LoginTranscript;
+type loginTranscript struct {
+	Context   []byte `tls:"head=1,min=1"`
+	UserID    []byte `tls:"head=2"`
+	Request   []byte `tls:"head=2,min=1"`
+	Response  []byte `tls:"head=2,min=1"`
+	Challenge []byte `tls:"head=1"`
+}
+
+// newLoginTranscript returns the transcript of a login by userID with the
+// given OPRF request and response data and server challenge.
+func newLoginTranscript(userID, request, response, challenge []byte) ([]byte, error) {
+	return syntax.Marshal(&loginTranscript{
+		Context:   []byte(loginProofContext),
+		UserID:    userID,
+		Request:   request,
+		Response:  response,
+		Challenge: challenge,
+	})
+}
+
+// A LoginProof is the message sent by the client after RecoverCredentials to
+// prove its login to the server.
+// Implements ProtocolMessageBody.
+//
+// struct {
+// 	opaque proof<1..2^16-1>;
+// } LoginProof;
+//
+//       2
+// | proofLen | proof |
+type LoginProof struct {
+	Proof []byte `tls:"head=2,min=1"` // signature of the login transcript by the user private key
+}
+
+var _ ProtocolMessageBody = (*LoginProof)(nil)
+
+// Marshal returns the raw form of the struct.
+func (lp *LoginProof) Marshal() ([]byte, error) {
+	return syntax.Marshal(lp)
+}
+
+// Unmarshal puts raw data into fields of a struct.
+func (lp *LoginProof) Unmarshal(data []byte) (int, error) {
+	return syntax.Unmarshal(data, lp)
+}
+
+// Type returns the type of this struct.
+func (*LoginProof) Type() ProtocolMessageType {
+	return ProtocolMessageTypeLoginProof
+}
+
+// loginSession holds what a client needs to prove its last login.
+type loginSession struct {
+	transcript []byte
+	creds      *Credentials
+}
+
+// ProveLogin is called by the client after RecoverCredentials. Returns a
+// proof holding a signature of the login transcript by the recovered user
+// private key, which the server checks with VerifyLoginProof.
+// Errors if the user private key is an X25519 key, which cannot sign, so
+// users with X25519 keys can neither prove a login nor upgrade their record.
+func (c *Client) ProveLogin() (*LoginProof, error) {
+	start := time.Now()
+	sp := c.startSpan("ProveLogin")
+	proof, err := c.proveLogin()
+	sp.end(err)
+	measure(c.Metrics, "ProveLogin", start, err)
+
+	return proof, err
+}
+
+func (c *Client) proveLogin() (*LoginProof, error) {
+	if err := c.checkState("ProveLogin", clientStateDone); err != nil {
+		return nil, err
+	}
+
+	if c.login == nil {
+		return nil, errors.Wrap(common.ErrorInvalidState, "no login to prove")
+	}
+
+	key, err := c.login.creds.UserPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	proof, err := signLoginTranscript(c.Rand, key, c.login.transcript)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginProof{Proof: proof}, nil
+}
+
+// VerifyLoginProof is called by the server on receiving a proof from
+// Client.ProveLogin, after CreateCredentialResponse. It authenticates the
+// client by the user public key of its record, after which the record may be
+// upgraded with UpgradeUserRecord. A proof that is not valid counts as a
+// failed login with the AttemptLimiter; a valid one does not count as a
+// success until RecordLoginSuccess is called.
+// Errors wrapping common.ErrorClientKeyMismatch if the proof is not valid, as
+// is always the case for records with an X25519 user key.
+func (s *Server) VerifyLoginProof(msg *LoginProof) error {
+	username := s.UserRecord.UserID
+
+	start := time.Now()
+	sp := s.startSpan("VerifyLoginProof")
+	err := s.verifyLoginProof(msg)
+	sp.end(err)
+	measure(s.Config.Metrics, "VerifyLoginProof", start, err)
+
+	s.audit(EventLoginProof, username, err)
+
+	return err
+}
+
+func (s *Server) verifyLoginProof(msg *LoginProof) error {
+	if err := s.checkState("VerifyLoginProof", serverStateCredentialResponded); err != nil {
+		return err
+	}
+
+	if msg == nil {
+		s.failAttempt()
+		return errors.Wrap(common.ErrorUnexpectedData, "no login proof")
+	}
+
+	if !verifyLoginTranscript(s.UserRecord.UserPublicKey, s.transcript, msg.Proof) {
+		s.failAttempt()
+		return errors.Wrap(common.ErrorClientKeyMismatch, "login proof not valid")
+	}
+
+	s.state = serverStateLoginSucceeded
+
+	return nil
+}
+
+// signLoginTranscript signs transcript with an ECDSA key over its SHA-256
+// digest, or with an Ed25519 key, using randomness from r or crypto/rand if r
+// is nil.
+func signLoginTranscript(r io.Reader, key crypto.Signer, transcript []byte) ([]byte, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+
+	switch key.Public().(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(transcript)
+		return key.Sign(r, digest[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		return key.Sign(r, transcript, crypto.Hash(0))
+	}
+
+	return nil, errors.Wrapf(common.ErrorUnexpectedData, "%T user key cannot sign", key.Public())
+}
+
+// verifyLoginTranscript reports whether proof is a signature of transcript
+// by key, as made by signLoginTranscript.
+func verifyLoginTranscript(key crypto.PublicKey, transcript, proof []byte) bool {
+	if len(transcript) == 0 {
+		return false
+	}
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(transcript)
+		return ecdsa.VerifyASN1(key, digest[:], proof)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, transcript, proof)
+	}
+
+	return false
+}
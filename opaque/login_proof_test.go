@@ -0,0 +1,211 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+// startLogin logs in as username to s, returning the client once it has
+// recovered its credentials.
+func startLogin(s *Server, username, password string) (*Client, error) {
+	c, err := NewClient(username, s.Config.ServerID, s.Config.Suite, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := c.CreateCredentialRequest([]byte(password))
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.CreateCredentialResponse(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := c.RecoverCredentials(response); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func TestLoginProof(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	newLogin := func(username, password string) (*Server, *LoginProof, error) {
+		s, err := NewServer(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		c, err := startLogin(s, username, password)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		proof, err := c.ProveLogin()
+
+		return s, proof, err
+	}
+
+	s, proof, err := newLogin("user1", "password1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Proofs are bound to the challenge of their login, and to the user key.
+	replayed, _, err := newLogin("user1", "password1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	other, otherProof, err := newLogin("user2", "password2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, bad := range []struct {
+		name  string
+		s     *Server
+		proof *LoginProof
+		err   common.Error
+	}{
+		{"replayed", replayed, proof, common.ErrorClientKeyMismatch},
+		{"other user", other, proof, common.ErrorClientKeyMismatch},
+		{"other user's proof", s, otherProof, common.ErrorClientKeyMismatch},
+		{"empty", s, &LoginProof{}, common.ErrorClientKeyMismatch},
+		{"nil", s, nil, common.ErrorUnexpectedData},
+	} {
+		if err := bad.s.VerifyLoginProof(bad.proof); !errors.Is(err, bad.err) {
+			t.Errorf("%s: expected err %v to contain %v", bad.name, err, bad.err)
+		}
+
+		if bad.s.state != serverStateCredentialResponded {
+			t.Errorf("%s: in state %v after a failed proof", bad.name, bad.s.state)
+		}
+	}
+
+	if err := s.VerifyLoginProof(proof); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if s.state != serverStateLoginSucceeded {
+		t.Errorf("in state %v, expected %v", s.state, serverStateLoginSucceeded)
+	}
+}
+
+func TestUpgradeUserRecordRequiresLoginProof(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	c, err := NewClient("user1", cfg.ServerID, cfg.Suite, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	request, err := c.CreateCredentialRequest([]byte("password1"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := s.CreateCredentialResponse(request); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Responding to a login does not authenticate the client.
+	if err := checkStateError(s.UpgradeUserRecord(&RegistrationUpload{})); err != nil {
+		t.Error(err)
+	}
+
+	// Nor can it be declared to.
+	if err := checkStateError(s.RecordLoginSuccess()); err != nil {
+		t.Error(err)
+	}
+
+	if err := checkStateError(s.UpgradeUserRecord(&RegistrationUpload{})); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFailedLoginProofIsRecorded(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	limiter := &recordingLimiter{}
+	cfg.AttemptLimiter = limiter
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := startLogin(s, "user1", "password1"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := s.VerifyLoginProof(&LoginProof{Proof: []byte("not a proof")}); !errors.Is(err, common.ErrorClientKeyMismatch) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorClientKeyMismatch)
+	}
+
+	if len(limiter.failed) != 1 || limiter.failed[0] != "user:user1" {
+		t.Errorf("recorded failures %v, expected [user:user1]", limiter.failed)
+	}
+
+	if len(limiter.succeeded) != 0 {
+		t.Errorf("recorded successes %v", limiter.succeeded)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/opaque-core/common"
+)
+
+// Metrics collects counters and latency histograms for protocol operations.
+// Protocol steps are named after the Client and Server methods running them,
+// e.g. "CreateCredentialResponse"; the operations inside them are named by
+// the Op constants. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Count records that step ended with code, ErrorNoError on success.
+	Count(step string, code common.Error)
+
+	// Observe records that the step or operation name took d.
+	Observe(name string, d time.Duration)
+}
+
+// Operations timed inside protocol steps.
+const (
+	OpOPRFEvaluate = "oprf_evaluate" // server OPRF evaluation
+	OpOPRFFinalize = "oprf_finalize" // client OPRF finalization
+	OpHarden       = "harden"        // client PBKDF hardening of the OPRF output
+	OpTableLookup  = "table_lookup"  // UserRecordTable lookup
+	OpTableInsert  = "table_insert"  // UserRecordTable insert
+	OpTableUpdate  = "table_update"  // UserRecordUpdater update
+)
+
+// observe records the time since start for name, if m is set.
+func observe(m Metrics, name string, start time.Time) {
+	if m != nil {
+		m.Observe(name, time.Since(start))
+	}
+}
+
+// measure records the duration and outcome of step, if m is set.
+func measure(m Metrics, step string, start time.Time, err error) {
+	if m != nil {
+		m.Observe(step, time.Since(start))
+		m.Count(step, common.ErrorCode(err))
+	}
+}
+
+// DefaultBuckets are the default upper bounds of InMemoryMetrics histogram
+// buckets.
+var DefaultBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// Histogram is a snapshot of the observations for a step or operation.
+type Histogram struct {
+	Buckets []time.Duration // upper bounds, ascending
+	Counts  []uint64        // observations per bucket, then above the last
+	Count   uint64
+	Sum     time.Duration
+}
+
+type counterKey struct {
+	step string
+	code common.Error
+}
+
+// InMemoryMetrics is a Metrics implementation which keeps counters and
+// histograms in memory. It can be read directly, e.g. from tests, or written
+// out in the Prometheus text format.
+type InMemoryMetrics struct {
+	mu         sync.Mutex
+	buckets    []time.Duration
+	counters   map[counterKey]uint64
+	histograms map[string]*Histogram
+}
+
+// NewInMemoryMetrics returns a new InMemoryMetrics with histogram buckets
+// bounded by buckets, which must be ascending, or DefaultBuckets if none are
+// given.
+func NewInMemoryMetrics(buckets ...time.Duration) *InMemoryMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	return &InMemoryMetrics{
+		buckets:    buckets,
+		counters:   make(map[counterKey]uint64),
+		histograms: make(map[string]*Histogram),
+	}
+}
+
+// Count increments the counter for step and code.
+func (m *InMemoryMetrics) Count(step string, code common.Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[counterKey{step, code}]++
+}
+
+// Observe adds d to the histogram for name.
+func (m *InMemoryMetrics) Observe(name string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.histograms[name]
+	if !ok {
+		h = &Histogram{
+			Buckets: m.buckets,
+			Counts:  make([]uint64, len(m.buckets)+1),
+		}
+		m.histograms[name] = h
+	}
+
+	i := sort.Search(len(h.Buckets), func(i int) bool { return d <= h.Buckets[i] })
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// Counter returns the number of times step ended with code.
+func (m *InMemoryMetrics) Counter(step string, code common.Error) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.counters[counterKey{step, code}]
+}
+
+// Histogram returns a snapshot of the histogram for name, which is empty if
+// nothing was observed.
+func (m *InMemoryMetrics) Histogram(name string) Histogram {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.histograms[name]
+	if !ok {
+		return Histogram{Buckets: m.buckets, Counts: make([]uint64, len(m.buckets)+1)}
+	}
+
+	snapshot := *h
+	snapshot.Counts = append([]uint64{}, h.Counts...)
+
+	return snapshot
+}
+
+// WritePrometheus writes all counters and histograms to w in the Prometheus
+// text exposition format, as opaque_steps_total and
+// opaque_duration_seconds.
+func (m *InMemoryMetrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	keys := make([]counterKey, 0, len(m.counters))
+	for k := range m.counters {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].step != keys[j].step {
+			return keys[i].step < keys[j].step
+		}
+
+		return keys[i].code < keys[j].code
+	})
+
+	fmt.Fprintln(bw, "# TYPE opaque_steps_total counter")
+
+	for _, k := range keys {
+		fmt.Fprintf(bw, "opaque_steps_total{step=%q,code=\"%d\"} %d\n", k.step, k.code, m.counters[k])
+	}
+
+	names := make([]string, 0, len(m.histograms))
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	fmt.Fprintln(bw, "# TYPE opaque_duration_seconds histogram")
+
+	for _, name := range names {
+		h := m.histograms[name]
+
+		var cumulative uint64
+		for i, le := range h.Buckets {
+			cumulative += h.Counts[i]
+			fmt.Fprintf(bw, "opaque_duration_seconds_bucket{name=%q,le=\"%g\"} %d\n", name, le.Seconds(), cumulative)
+		}
+
+		fmt.Fprintf(bw, "opaque_duration_seconds_bucket{name=%q,le=\"+Inf\"} %d\n", name, h.Count)
+		fmt.Fprintf(bw, "opaque_duration_seconds_sum{name=%q} %g\n", name, h.Sum.Seconds())
+		fmt.Fprintf(bw, "opaque_duration_seconds_count{name=%q} %d\n", name, h.Count)
+	}
+
+	return bw.Flush()
+}
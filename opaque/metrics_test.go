@@ -0,0 +1,175 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+func TestInMemoryMetrics(t *testing.T) {
+	m := NewInMemoryMetrics(time.Millisecond, time.Second)
+
+	m.Count("CreateCredentialResponse", common.ErrorNoError)
+	m.Count("CreateCredentialResponse", common.ErrorUserNotRegistered)
+	m.Count("CreateCredentialResponse", common.ErrorNoError)
+
+	if n := m.Counter("CreateCredentialResponse", common.ErrorNoError); n != 2 {
+		t.Errorf("incorrect counter %v", n)
+		return
+	}
+
+	if n := m.Counter("StoreUserRecord", common.ErrorNoError); n != 0 {
+		t.Errorf("incorrect counter %v", n)
+		return
+	}
+
+	for _, d := range []time.Duration{time.Millisecond, 2 * time.Millisecond, 2 * time.Second} {
+		m.Observe(OpHarden, d)
+	}
+
+	expected := Histogram{
+		Buckets: []time.Duration{time.Millisecond, time.Second},
+		Counts:  []uint64{1, 1, 1},
+		Count:   3,
+		Sum:     2003 * time.Millisecond,
+	}
+
+	if h := m.Histogram(OpHarden); !reflect.DeepEqual(h, expected) {
+		t.Errorf("incorrect histogram %+v, expected %+v", h, expected)
+		return
+	}
+
+	if h := m.Histogram(OpTableLookup); h.Count != 0 || len(h.Counts) != 3 {
+		t.Errorf("incorrect empty histogram %+v", h)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := m.WritePrometheus(&buf); err != nil {
+		t.Error(err)
+		return
+	}
+
+	expectedText := `# TYPE opaque_steps_total counter
+opaque_steps_total{step="CreateCredentialResponse",code="0"} 2
+opaque_steps_total{step="CreateCredentialResponse",code="3"} 1
+# TYPE opaque_duration_seconds histogram
+opaque_duration_seconds_bucket{name="harden",le="0.001"} 1
+opaque_duration_seconds_bucket{name="harden",le="1"} 2
+opaque_duration_seconds_bucket{name="harden",le="+Inf"} 3
+opaque_duration_seconds_sum{name="harden"} 2.003
+opaque_duration_seconds_count{name="harden"} 3
+`
+	if buf.String() != expectedText {
+		t.Errorf("incorrect output:\n%s\nexpected:\n%s", buf.String(), expectedText)
+		return
+	}
+}
+
+func TestProtocolMetrics(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	serverMetrics := NewInMemoryMetrics()
+	clientMetrics := NewInMemoryMetrics()
+	cfg.Metrics = serverMetrics
+
+	h, err := newStateHarness(cfg, "new user", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	h.client.Metrics = clientMetrics
+
+	steps := []string{"CreateRegistrationRequest", "FinalizeRegistrationRequest", "CreateCredentialRequest", "RecoverCredentials"}
+	for _, step := range steps {
+		if err := h.runClientStep(step); err != nil {
+			t.Errorf("%s: %v", step, err)
+			return
+		}
+	}
+
+	// A failed step is counted with its error.
+	if _, err := h.client.CreateCredentialRequest([]byte("password")); !errors.Is(err, common.ErrorInvalidState) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorInvalidState)
+		return
+	}
+
+	for _, step := range steps {
+		if n := clientMetrics.Counter(step, common.ErrorNoError); n != 1 {
+			t.Errorf("%s: incorrect counter %v", step, n)
+		}
+
+		// Failed steps are timed too.
+		count := uint64(1)
+		if step == "CreateCredentialRequest" {
+			count = 2
+		}
+
+		if h := clientMetrics.Histogram(step); h.Count != count {
+			t.Errorf("%s: incorrect histogram count %v", step, h.Count)
+		}
+	}
+
+	if n := clientMetrics.Counter("CreateCredentialRequest", common.ErrorInvalidState); n != 1 {
+		t.Errorf("incorrect error counter %v", n)
+	}
+
+	for _, op := range []string{OpOPRFFinalize, OpHarden} {
+		if h := clientMetrics.Histogram(op); h.Count != 2 {
+			t.Errorf("%s: incorrect histogram count %v", op, h.Count)
+		}
+	}
+
+	// The server for the login is a fresh one with the same config.
+	for _, step := range []string{"CreateRegistrationResponse", "StoreUserRecord", "CreateCredentialResponse"} {
+		if n := serverMetrics.Counter(step, common.ErrorNoError); n != 1 {
+			t.Errorf("%s: incorrect counter %v", step, n)
+		}
+	}
+
+	expectedOps := map[string]uint64{
+		OpOPRFEvaluate: 2,
+		OpTableLookup:  2,
+		OpTableInsert:  1,
+	}
+	for op, count := range expectedOps {
+		if h := serverMetrics.Histogram(op); h.Count != count {
+			t.Errorf("%s: incorrect histogram count %v, expected %v", op, h.Count, count)
+		}
+	}
+}
@@ -48,18 +48,21 @@ type AuthenticatedOneTimePad struct {
 // It calculates:
 // pseudorandom_pad = HKDF-Expand(rwdU, concat(nonce, "Pad"), len(pt))
 // auth_key = HKDF-Expand(rwdU, concat(nonce, "AuthKey"), Nh)
-// export_key = HKDF-Expand(rwdU, concat(nonce, "ExportKey"), Nh)
+// export_key = HKDF-Expand(rwdU, "ExportKey", Nh)
+// The pad depends on the nonce, so envelopes sealed under the same rwdU with
+// different nonces never share a keystream. The export key does not, so that
+// it is the same for every envelope of a password.
 func NewAuthenticatedOneTimePad(key, nonce []byte, l int) (*AuthenticatedOneTimePad, error) {
 	hash := sha256.New // should be the same as the OPRF suite
 
 	pad := make([]byte, l)
-	_, err := hkdf.Expand(hash, key, []byte("Pad")).Read(pad)
+	_, err := hkdf.Expand(hash, key, nonceInfo(nonce, "Pad")).Read(pad)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	authKey := make([]byte, 32)
-	_, err = hkdf.Expand(hash, key, []byte("AuthKey")).Read(authKey)
+	_, err = hkdf.Expand(hash, key, nonceInfo(nonce, "AuthKey")).Read(authKey)
 	if err != nil {
 		return nil, err
 	}
@@ -78,6 +81,13 @@ func NewAuthenticatedOneTimePad(key, nonce []byte, l int) (*AuthenticatedOneTime
 	}, nil
 }
 
+// nonceInfo returns the HKDF info concat(nonce, label).
+func nonceInfo(nonce []byte, label string) []byte {
+	info := make([]byte, 0, len(nonce)+len(label))
+	info = append(info, nonce...)
+	return append(info, label...)
+}
+
 // Seal encrypts and HMACs the given plaintext.
 // MUST only be called once (it is a one-time pad after all).
 // It calculates:
@@ -28,13 +28,11 @@ package opaque
 import (
 	"bytes"
 	"testing"
-
-	"github.com/cloudflare/opaque-core/common"
 )
 
 func TestOTPEncryptDecrypt(t *testing.T) {
-	key := common.GetRandomBytes(32)
-	nonce := common.GetRandomBytes(32)
+	key := randomBytes(32)
+	nonce := randomBytes(32)
 
 	plaintext := []byte("plaintext")
 	authData := []byte("authdata")
@@ -63,3 +61,57 @@ func TestOTPEncryptDecrypt(t *testing.T) {
 		t.Errorf("incorrect decrypted plaintext")
 	}
 }
+
+func TestOTPKeystreamDependsOnNonce(t *testing.T) {
+	key := randomBytes(32)
+
+	plaintext1 := []byte("first plaintext")
+	plaintext2 := []byte("other plaintext")
+
+	otp1, err := NewAuthenticatedOneTimePad(key, randomBytes(32), len(plaintext1))
+	if err != nil {
+		t.Fatalf("otp init: %v", err)
+	}
+
+	ciphertext1, _, err := otp1.Seal(plaintext1, nil)
+	if err != nil {
+		t.Fatalf("encryption error: %v", err)
+	}
+
+	otp2, err := NewAuthenticatedOneTimePad(key, randomBytes(32), len(plaintext2))
+	if err != nil {
+		t.Fatalf("otp init: %v", err)
+	}
+
+	ciphertext2, _, err := otp2.Seal(plaintext2, nil)
+	if err != nil {
+		t.Fatalf("encryption error: %v", err)
+	}
+
+	// Under a shared keystream, the ciphertexts XOR to the plaintexts XOR.
+	for i := range plaintext1 {
+		if ciphertext1[i]^ciphertext2[i] != plaintext1[i]^plaintext2[i] {
+			return
+		}
+	}
+
+	t.Error("seals under different nonces share a keystream")
+}
+
+func TestOTPExporterKeyIgnoresNonce(t *testing.T) {
+	key := randomBytes(32)
+
+	otp1, err := NewAuthenticatedOneTimePad(key, randomBytes(32), 1)
+	if err != nil {
+		t.Fatalf("otp init: %v", err)
+	}
+
+	otp2, err := NewAuthenticatedOneTimePad(key, randomBytes(32), 1)
+	if err != nil {
+		t.Fatalf("otp init: %v", err)
+	}
+
+	if !bytes.Equal(otp1.exporterKey, otp2.exporterKey) {
+		t.Error("exporter key depends on the nonce")
+	}
+}
@@ -26,25 +26,137 @@
 package opaque
 
 import (
+	"crypto"
+	"crypto/elliptic"
 	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"time"
 
+	"github.com/cloudflare/circl/group"
 	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/hkdf"
-	"golang.org/x/crypto/pbkdf2"
 )
 
+// The client side of the OPRF is computed here rather than by circl, whose
+// client always draws its blinds from crypto/rand. It follows
+// draft-irtf-cfrg-voprf-06 in base mode, as the circl server does.
+const (
+	oprfVersion        = "VOPRF06-"
+	oprfHashToGroupDST = "HashToGroup-"
+	oprfFinalizeDST    = "Finalize-"
+)
+
+// oprfSuite is the group and hash of an OPRF suite.
+type oprfSuite struct {
+	id    oprf.SuiteID
+	g     group.Group
+	curve elliptic.Curve
+	hash  crypto.Hash
+}
+
+func getOPRFSuite(id oprf.SuiteID) (*oprfSuite, error) {
+	switch id {
+	case oprf.OPRFP256:
+		return &oprfSuite{id, group.P256, elliptic.P256(), crypto.SHA256}, nil
+	case oprf.OPRFP384:
+		return &oprfSuite{id, group.P384, elliptic.P384(), crypto.SHA512}, nil
+	case oprf.OPRFP521:
+		return &oprfSuite{id, group.P521, elliptic.P521(), crypto.SHA512}, nil
+	}
+
+	return nil, oprf.ErrUnsupportedSuite
+}
+
+// dst returns the domain separation tag with the given name.
+func (s *oprfSuite) dst(name string) []byte {
+	dst := append([]byte(oprfVersion), name...)
+	return append(dst, oprf.BaseMode, 0, byte(s.id))
+}
+
+// randomScalar returns a scalar read from r the way circl generates them, so
+// that blinds and keys can be reproduced from the bytes read.
+func (s *oprfSuite) randomScalar(r io.Reader) (group.Scalar, error) {
+	b, err := common.GetRandomBytes(r, s.scalarLength())
+	if err != nil {
+		return nil, err
+	}
+
+	return s.g.HashToScalar(b, nil), nil
+}
+
+func (s *oprfSuite) scalarLength() int {
+	return (s.curve.Params().BitSize + 7) / 8
+}
+
+// finalizeHash returns the OPRF output for input and its unblinded element.
+func (s *oprfSuite) finalizeHash(input, element, info []byte) []byte {
+	h := s.hash.New()
+
+	for _, b := range [][]byte{input, element, info, s.dst(oprfFinalizeDST)} {
+		var length [2]byte
+
+		binary.BigEndian.PutUint16(length[:], uint16(len(b)))
+		h.Write(length[:])
+		h.Write(b)
+	}
+
+	return h.Sum(nil)
+}
+
+// oprfRequest holds the client's state between blinding and finalizing.
+type oprfRequest struct {
+	input   []byte
+	blind   group.Scalar
+	blinded []byte // the request sent to the server
+}
+
+// randomOPRFKey returns an OPRF key read from r, or from crypto/rand if r is
+// nil.
+func randomOPRFKey(id oprf.SuiteID, r io.Reader) (*oprf.PrivateKey, error) {
+	suite, err := getOPRFSuite(id)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := suite.randomScalar(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := k.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	key := new(oprf.PrivateKey)
+	if err := key.Deserialize(id, data); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
 // blind returns OPRF_1 (client OPRF msg) and remembers randomness used to generate it.
 func (c *Client) blind(password string) ([]byte, error) {
-	blind := [][]byte{}
-	blind = append(blind, []byte(password))
-	cRequest, err := c.oprfState.Request(blind)
+	blind, err := c.oprfSuite.randomScalar(c.Rand)
+	if err != nil {
+		return nil, err
+	}
+
+	input := []byte(password)
+	p := c.oprfSuite.g.HashToElement(input, c.oprfSuite.dst(oprfHashToGroupDST))
+
+	blinded, err := c.oprfSuite.g.NewElement().Mul(p, blind).MarshalBinaryCompress()
 	if err != nil {
 		return nil, err
 	}
 
-	c.oprf1 = cRequest
+	c.oprf1 = &oprfRequest{input: input, blind: blind, blinded: blinded}
 
-	return cRequest.BlindedElements[0], nil
+	return blinded, nil
 }
 
 // evaluate returns OPRF_2 (server OPRF msg).
@@ -52,7 +164,12 @@ func (s *Server) evaluate(clientMessage []byte) ([]byte, error) {
 	var blinded [][]byte
 	blinded = append(blinded, []byte(clientMessage))
 
+	sp := s.startSpan("evaluate")
+	start := time.Now()
 	evaluation, err := s.UserRecord.OprfServer.Evaluate(blinded)
+	observe(s.Config.Metrics, OpOPRFEvaluate, start)
+	sp.end(err)
+
 	if err != nil {
 		return nil, err
 	}
@@ -62,24 +179,52 @@ func (s *Server) evaluate(clientMessage []byte) ([]byte, error) {
 
 // finalizeHarden returns RwdPass (randomized password).
 func (c *Client) finalizeHarden(serverMessage []byte) ([]byte, error) {
-	var element [][]byte
-	element = append(element, []byte(serverMessage))
+	sp := c.startSpan("finalizeHarden")
+
+	start := time.Now()
+	rwd, err := c.unblind(serverMessage)
+	observe(c.Metrics, OpOPRFFinalize, start)
 
-	eval := &oprf.Evaluation{Elements: element}
-	rwd, err := c.oprfState.Finalize(c.oprf1, eval, []byte("OPAQUE"))
 	if err != nil {
+		sp.end(err)
 		return nil, err
 	}
 
+	stretcher := c.KeyStretcher
+	if stretcher == nil {
+		stretcher = DefaultKeyStretcher
+	}
+
 	// Harden the rwd.
-	// "We note that the salt value typically input into the KDF can be set to a
-	// constant, e.g., all zeros."
-	OPAQUEPBKDFOutLength := int(32)
-	OPAQUEPBKDFIters := int(4096)
-	salt := []byte{0, 0, 0, 0}
-	hardenedRwd := pbkdf2.Key(rwd[0], salt, OPAQUEPBKDFIters, OPAQUEPBKDFOutLength, sha256.New)
+	start = time.Now()
+	hardenedRwd := stretcher.Stretch(rwd)
+	observe(c.Metrics, OpHarden, start)
 
 	rwdU := hkdf.Extract(sha256.New, hardenedRwd, []byte("rwdU"))
+	sp.end(nil)
 
 	return rwdU, nil
 }
+
+// unblind returns the OPRF output from OPRF_2 (server OPRF msg).
+func (c *Client) unblind(serverMessage []byte) ([]byte, error) {
+	if c.oprf1 == nil {
+		return nil, errors.New("no OPRF request")
+	}
+
+	g := c.oprfSuite.g
+
+	evaluated := g.NewElement()
+	if err := evaluated.UnmarshalBinary(serverMessage); err != nil {
+		return nil, err
+	}
+
+	inverse := g.NewScalar().Inv(c.oprf1.blind)
+
+	element, err := g.NewElement().Mul(evaluated, inverse).MarshalBinaryCompress()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.oprfSuite.finalizeHash(c.oprf1.input, element, []byte("OPAQUE")), nil
+}
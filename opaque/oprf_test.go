@@ -30,6 +30,8 @@ import (
 	"testing"
 
 	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
 	"github.com/tatianab/mint"
 )
 
@@ -82,3 +84,117 @@ func TestOPRFFlow(t *testing.T) {
 		t.Errorf("incorrect rwd: expected %v, got %v", expectedRwd, rwd)
 	}
 }
+
+// TestOPRFClientMatchesCircl checks the client OPRF against the output the
+// circl server computes without blinding.
+func TestOPRFClientMatchesCircl(t *testing.T) {
+	for _, suite := range []oprf.SuiteID{oprf.OPRFP256, oprf.OPRFP384, oprf.OPRFP521} {
+		server, err := oprf.NewServer(suite, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		c, err := NewClient("alice", "example.com", suite, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		blinded, err := c.blind("password")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		eval, err := server.Evaluate([][]byte{blinded})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		output, err := c.unblind(eval.Elements[0])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		expected, err := server.FullEvaluate([]byte("password"), []byte("OPAQUE"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !bytes.Equal(output, expected) {
+			t.Errorf("%#x: OPRF outputs differ", suite)
+		}
+	}
+}
+
+func TestKeyStretcher(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	stretcher := Argon2id{Time: 1, Memory: 64, Threads: 1}
+
+	newHarness := func(stretcher KeyStretcher) (*stateHarness, error) {
+		h, err := newStateHarness(cfg, "stretched user", "password")
+		if err != nil {
+			return nil, err
+		}
+
+		h.client.KeyStretcher = stretcher
+
+		return h, nil
+	}
+
+	h, err := newHarness(stretcher)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, step := range []string{"CreateRegistrationRequest", "FinalizeRegistrationRequest", "CreateCredentialRequest", "RecoverCredentials"} {
+		if err := h.runClientStep(step); err != nil {
+			t.Errorf("%s: %v", step, err)
+			return
+		}
+	}
+
+	// Logging in with another KeyStretcher gives another randomized password.
+	if h, err = newHarness(nil); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := h.runClientStep("CreateCredentialRequest"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := h.runClientStep("RecoverCredentials"); !errors.Is(err, common.ErrorBadEnvelope) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorBadEnvelope)
+	}
+}
+
+func TestArgon2idZeroValue(t *testing.T) {
+	tests := []struct {
+		stretcher, expected Argon2id
+	}{
+		{Argon2id{}, Argon2id{Time: DefaultArgon2idTime, Memory: DefaultArgon2idMemory, Threads: DefaultArgon2idThreads}},
+		{Argon2id{Memory: 64, Threads: 1}, Argon2id{Time: DefaultArgon2idTime, Memory: 64, Threads: 1}},
+		{Argon2id{Time: 1, Threads: 1}, Argon2id{Time: 1, Memory: DefaultArgon2idMemory, Threads: 1}},
+		{Argon2id{Time: 1, Memory: 64}, Argon2id{Time: 1, Memory: 64, Threads: DefaultArgon2idThreads}},
+	}
+
+	rwd := []byte("randomized password")
+
+	for _, test := range tests {
+		if !bytes.Equal(test.stretcher.Stretch(rwd), test.expected.Stretch(rwd)) {
+			t.Errorf("%+v: output differs from %+v", test.stretcher, test.expected)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"crypto"
+	"time"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+// A PolicyAcceptor decides whether a client accepts the credential encoding
+// policy sent by a server. Errors if it does not.
+type PolicyAcceptor interface {
+	AcceptPolicy(policy *CredentialEncodingPolicy) error
+}
+
+// PolicyRequirements is a PolicyAcceptor checking a policy against minimum
+// requirements.
+type PolicyRequirements struct {
+	MinVersion uint16 // lowest accepted policy version
+
+	RequireSecret   []CredentialType // types that must be stored encrypted
+	RequireStored   []CredentialType // types that must be stored, encrypted or not
+	ForbidCleartext []CredentialType // types that must not be stored in cleartext
+
+	// Require the server identity in the envelope, binding it to the server.
+	BindServerIdentity bool
+	// Require the user identity in the envelope, binding it to the user.
+	BindUserIdentity bool
+}
+
+// AcceptPolicy returns an error wrapping common.ErrorForbiddenPolicy if policy
+// does not meet the requirements.
+func (r *PolicyRequirements) AcceptPolicy(policy *CredentialEncodingPolicy) error {
+	if policy.Version < r.MinVersion {
+		return errors.Wrapf(common.ErrorForbiddenPolicy, "policy version %d below %d", policy.Version, r.MinVersion)
+	}
+
+	for _, t := range r.RequireSecret {
+		if !containsType(policy.SecretTypes, t) {
+			return errors.Wrapf(common.ErrorForbiddenPolicy, "%v not stored encrypted", t)
+		}
+	}
+
+	stored := append(r.RequireStored[:len(r.RequireStored):len(r.RequireStored)], r.bindings()...)
+	for _, t := range stored {
+		if !containsType(policy.SecretTypes, t) && !containsType(policy.CleartextTypes, t) {
+			return errors.Wrapf(common.ErrorForbiddenPolicy, "%v not stored", t)
+		}
+	}
+
+	for _, t := range r.ForbidCleartext {
+		if containsType(policy.CleartextTypes, t) {
+			return errors.Wrapf(common.ErrorForbiddenPolicy, "%v stored in cleartext", t)
+		}
+	}
+
+	return nil
+}
+
+func (r *PolicyRequirements) bindings() []CredentialType {
+	var types []CredentialType
+
+	if r.BindServerIdentity {
+		types = append(types, CredentialTypeServerIdentity)
+	}
+
+	if r.BindUserIdentity {
+		types = append(types, CredentialTypeUserIdentity)
+	}
+
+	return types
+}
+
+func containsType(types []CredentialType, t CredentialType) bool {
+	for _, u := range types {
+		if u == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validatePolicy returns an error wrapping common.ErrorForbiddenPolicy if
+// policy is not one any client should follow: if it lists a type twice or a
+// type that is not known, or stores the user private key in cleartext.
+func validatePolicy(policy *CredentialEncodingPolicy) error {
+	if policy == nil {
+		return errors.Wrap(common.ErrorForbiddenPolicy, "no policy")
+	}
+
+	seen := make(map[CredentialType]bool)
+	types := append(policy.SecretTypes[:len(policy.SecretTypes):len(policy.SecretTypes)], policy.CleartextTypes...)
+
+	for _, t := range types {
+		if seen[t] {
+			return errors.Wrapf(common.ErrorForbiddenPolicy, "%v listed twice", t)
+		}
+
+		seen[t] = true
+
+		if _, ok := lookupCredentialType(t); !ok && !isBuiltinCredentialType(t) {
+			return errors.Wrapf(common.ErrorForbiddenPolicy, "credential type %d not registered", t)
+		}
+	}
+
+	if containsType(policy.CleartextTypes, CredentialTypeUserPrivateKey) {
+		return errors.Wrap(common.ErrorForbiddenPolicy, "user private key stored in cleartext")
+	}
+
+	return nil
+}
+
+func isBuiltinCredentialType(t CredentialType) bool {
+	return t >= CredentialTypeUserPrivateKey && t <= CredentialTypeServerIdentity
+}
+
+// acceptPolicy has the client's PolicyAcceptor, if any, accept a policy sent
+// by the server.
+func (c *Client) acceptPolicy(policy *CredentialEncodingPolicy) error {
+	if c.PolicyAcceptor == nil {
+		return nil
+	}
+
+	return c.PolicyAcceptor.AcceptPolicy(policy)
+}
+
+// A UserRecordUpdater is a UserRecordTable that can replace records, as
+// needed to upgrade them to a new credential encoding policy.
+type UserRecordUpdater interface {
+	UpdateUserRecord(string, *UserRecord) error
+}
+
+// recordUpgrade holds what a client needs to upgrade its record after login.
+type recordUpgrade struct {
+	policy          *CredentialEncodingPolicy
+	rwd             []byte
+	mode            EnvelopeMode
+	creds           *Credentials
+	serverPublicKey crypto.PublicKey
+}
+
+// NeedsUpgrade reports whether the last recovered credentials were stored
+// under an older policy than the server's, so that UpgradeRegistration should
+// be called.
+func (c *Client) NeedsUpgrade() bool {
+	return c.state == clientStateDone && c.upgrade != nil
+}
+
+// UpgradeRegistration is called by the client after RecoverCredentials when
+// NeedsUpgrade is true. Returns a registration upload holding the recovered
+// credentials encoded under the server's current policy, to be stored with
+// Server.UpgradeUserRecord. The randomized password, and so the exporter key,
+// are unchanged.
+func (c *Client) UpgradeRegistration() (*RegistrationUpload, error) {
+	start := time.Now()
+	sp := c.startSpan("UpgradeRegistration")
+	upload, err := c.upgradeRegistration()
+	sp.end(err)
+	measure(c.Metrics, "UpgradeRegistration", start, err)
+
+	return upload, err
+}
+
+func (c *Client) upgradeRegistration() (*RegistrationUpload, error) {
+	if err := c.checkState("UpgradeRegistration", clientStateDone); err != nil {
+		return nil, err
+	}
+
+	u := c.upgrade
+	if u == nil {
+		return nil, errors.Wrap(common.ErrorInvalidState, "no upgrade pending")
+	}
+
+	if err := validatePolicy(u.policy); err != nil {
+		return nil, err
+	}
+
+	if err := c.acceptPolicy(u.policy); err != nil {
+		return nil, err
+	}
+
+	nonce, err := common.GetRandomBytes(c.Rand, EnvelopeNonceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	var key PrivateKey
+
+	if u.mode == EnvelopeModeInternal {
+		if key, err = deriveClientKey(c.oprfSuite, u.rwd, nonce); err != nil {
+			return nil, err
+		}
+	} else {
+		if key, err = u.creds.UserKey(); err != nil {
+			return nil, common.ErrorBadEnvelope.Wrap(err)
+		}
+	}
+
+	creds, err := c.credentialsFromPolicy(u.policy, key, u.serverPublicKey, u.creds)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope, _, err := c.encryptCredentials(u.mode, u.rwd, nonce, creds, u.serverPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c.upgrade = nil
+
+	return &RegistrationUpload{
+		Envelope:        envelope,
+		ClientPublicKey: key.Public(),
+	}, nil
+}
+
+// NeedsUpgrade reports whether the client proved a login to a record stored
+// under an older policy than the server's, so that the server should accept an
+// upload for UpgradeUserRecord.
+func (s *Server) NeedsUpgrade() bool {
+	return s.state == serverStateLoginSucceeded && s.recordOutdated()
+}
+
+// UpgradeUserRecord is called by the server to replace the record of the user
+// who just logged in with an upload from Client.UpgradeRegistration, encoded
+// under the current policy. The record table must be a UserRecordUpdater.
+//
+// The client must first have proven its login with VerifyLoginProof. Unless
+// AllowKeyChange is set, the upload must keep the user public key of the
+// record, except when both envelopes are internal mode ones, whose keys are
+// derived anew from the password.
+// Errors wrapping common.ErrorClientKeyMismatch if the user public key changes.
+func (s *Server) UpgradeUserRecord(msg *RegistrationUpload) error {
+	username := s.UserRecord.UserID
+
+	start := time.Now()
+	sp := s.startSpan("UpgradeUserRecord")
+	err := s.upgradeUserRecord(msg)
+	sp.end(err)
+	measure(s.Config.Metrics, "UpgradeUserRecord", start, err)
+
+	if code := common.ErrorCode(err); code == common.ErrorForbiddenPolicy || code == common.ErrorPolicyMismatch {
+		s.audit(EventPolicyViolation, username, err)
+	} else {
+		s.audit(EventRecordUpgrade, username, err)
+	}
+
+	return err
+}
+
+func (s *Server) upgradeUserRecord(msg *RegistrationUpload) error {
+	if err := s.checkState("UpgradeUserRecord", serverStateLoginSucceeded); err != nil {
+		return err
+	}
+
+	if !s.recordOutdated() {
+		return errors.Wrap(common.ErrorUnexpectedData, "record does not need an upgrade")
+	}
+
+	table, ok := s.Config.RecordTable.(UserRecordUpdater)
+	if !ok {
+		return errors.Wrap(common.ErrorNoPasswordTable, "record table cannot update records")
+	}
+
+	policy := s.Config.CredentialEncodingPolicy
+	if err := s.validateUpload(msg, policy); err != nil {
+		return err
+	}
+
+	if err := s.checkKeyChange(msg); err != nil {
+		return err
+	}
+
+	// The OPRF key is kept, so that the randomized password is unchanged.
+	record := &UserRecord{
+		UserID:        s.UserRecord.UserID,
+		UserPublicKey: msg.ClientPublicKey,
+		OprfServer:    s.UserRecord.OprfServer,
+		Envelope:      msg.Envelope,
+		PolicyVersion: policy.Version,
+
+		ServerPublicKey: s.UserRecord.ServerPublicKey,
+	}
+
+	start := time.Now()
+	err := table.UpdateUserRecord(string(record.UserID), record)
+	observe(s.Config.Metrics, OpTableUpdate, start)
+
+	if err != nil {
+		return err
+	}
+
+	s.UserRecord = record
+	s.state = serverStateRecordUpgraded
+
+	return nil
+}
+
+// checkKeyChange errors if msg replaces the user public key of the record,
+// unless AllowKeyChange is set or both envelopes derive their key from the
+// password.
+func (s *Server) checkKeyChange(msg *RegistrationUpload) error {
+	if s.AllowKeyChange {
+		return nil
+	}
+
+	if s.UserRecord.Envelope.Mode == EnvelopeModeInternal && msg.Envelope.Mode == EnvelopeModeInternal {
+		return nil
+	}
+
+	old, err := MarshalPublicKey(s.UserRecord.UserPublicKey)
+	if err != nil {
+		return err
+	}
+
+	if !samePublicKey(old, msg.ClientPublicKey) {
+		return errors.Wrap(common.ErrorClientKeyMismatch, "upgrade changes the user public key")
+	}
+
+	return nil
+}
+
+// recordOutdated reports whether the user record was stored under another
+// version of the policy than the server's.
+func (s *Server) recordOutdated() bool {
+	return s.UserRecord.PolicyVersion != s.Config.CredentialEncodingPolicy.Version
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint"
+)
+
+func TestPolicyRequirements(t *testing.T) {
+	policy := &CredentialEncodingPolicy{
+		Version:        2,
+		SecretTypes:    []CredentialType{CredentialTypeUserPrivateKey, CredentialTypeUserIdentity},
+		CleartextTypes: []CredentialType{CredentialTypeServerPublicKey},
+	}
+
+	cases := []struct {
+		name   string
+		req    *PolicyRequirements
+		accept bool
+	}{
+		{"none", &PolicyRequirements{}, true},
+		{"version", &PolicyRequirements{MinVersion: 2}, true},
+		{"newer version", &PolicyRequirements{MinVersion: 3}, false},
+		{"secret", &PolicyRequirements{RequireSecret: []CredentialType{CredentialTypeUserIdentity}}, true},
+		{"secret in cleartext", &PolicyRequirements{RequireSecret: []CredentialType{CredentialTypeServerPublicKey}}, false},
+		{"stored", &PolicyRequirements{RequireStored: []CredentialType{CredentialTypeServerPublicKey}}, true},
+		{"not stored", &PolicyRequirements{RequireStored: []CredentialType{CredentialTypeUserPublicKey}}, false},
+		{"forbidden cleartext", &PolicyRequirements{ForbidCleartext: []CredentialType{CredentialTypeServerPublicKey}}, false},
+		{"user binding", &PolicyRequirements{BindUserIdentity: true}, true},
+		{"server binding", &PolicyRequirements{BindServerIdentity: true}, false},
+	}
+
+	for _, c := range cases {
+		err := c.req.AcceptPolicy(policy)
+		if c.accept && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !c.accept && !errors.Is(err, common.ErrorForbiddenPolicy) {
+			t.Errorf("%s: expected err %v to contain %v", c.name, err, common.ErrorForbiddenPolicy)
+		}
+	}
+}
+
+func TestValidatePolicy(t *testing.T) {
+	bad := map[string]*CredentialEncodingPolicy{
+		"nil": nil,
+		"duplicate": {
+			SecretTypes:    []CredentialType{CredentialTypeUserPrivateKey},
+			CleartextTypes: []CredentialType{CredentialTypeServerIdentity, CredentialTypeServerIdentity},
+		},
+		"secret and cleartext": {
+			SecretTypes:    []CredentialType{CredentialTypeUserPrivateKey, CredentialTypeServerIdentity},
+			CleartextTypes: []CredentialType{CredentialTypeServerIdentity},
+		},
+		"cleartext private key": {
+			SecretTypes:    []CredentialType{CredentialTypeServerIdentity},
+			CleartextTypes: []CredentialType{CredentialTypeUserPrivateKey},
+		},
+		"unregistered": {
+			SecretTypes: []CredentialType{CredentialTypeUserPrivateKey, 200},
+		},
+	}
+
+	for name, policy := range bad {
+		if err := validatePolicy(policy); !errors.Is(err, common.ErrorForbiddenPolicy) {
+			t.Errorf("%s: expected err %v to contain %v", name, err, common.ErrorForbiddenPolicy)
+		}
+	}
+}
+
+func TestPolicyAcceptorRegistration(t *testing.T) {
+	signer, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg := &ServerConfig{
+		ServerID:    "example.com",
+		Signer:      signer,
+		RecordTable: make(InMemoryUserRecordTable),
+		Suite:       oprf.OPRFP256,
+	}
+
+	c, err := NewClient("user", cfg.ServerID, cfg.Suite, signer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The default policy stores the server identity in cleartext only.
+	c.PolicyAcceptor = &PolicyRequirements{BindUserIdentity: true}
+
+	if err := registerWith(cfg, c, "password"); !errors.Is(err, common.ErrorForbiddenPolicy) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorForbiddenPolicy)
+	}
+}
+
+func TestRecordUpgrade(t *testing.T) {
+	for _, mode := range []EnvelopeMode{EnvelopeModeInternal, EnvelopeModeExternal, EnvelopeModeAESGCM} {
+		if err := runRecordUpgrade(mode); err != nil {
+			t.Errorf("%v: %v", mode, err)
+		}
+	}
+}
+
+func runRecordUpgrade(mode EnvelopeMode) error {
+	signer, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		return err
+	}
+
+	cfg := &ServerConfig{
+		ServerID:    "example.com",
+		Signer:      signer,
+		RecordTable: make(InMemoryUserRecordTable),
+		Suite:       oprf.OPRFP256,
+		CredentialEncodingPolicy: &CredentialEncodingPolicy{
+			Version:        1,
+			SecretTypes:    []CredentialType{CredentialTypeUserPrivateKey},
+			CleartextTypes: []CredentialType{CredentialTypeServerPublicKey},
+		},
+	}
+
+	var key PrivateKey
+	if mode != EnvelopeModeInternal {
+		if key, err = mint.NewSigningKey(mint.ECDSA_P256_SHA256); err != nil {
+			return err
+		}
+	}
+
+	c, err := NewClient("user", cfg.ServerID, cfg.Suite, key)
+	if err != nil {
+		return err
+	}
+
+	c.EnvelopeMode = mode
+
+	if err := registerWith(cfg, c, "password"); err != nil {
+		return err
+	}
+
+	cfg.CredentialEncodingPolicy = &CredentialEncodingPolicy{
+		Version:        2,
+		SecretTypes:    []CredentialType{CredentialTypeUserPrivateKey, CredentialTypeUserIdentity},
+		CleartextTypes: []CredentialType{CredentialTypeServerPublicKey, CredentialTypeServerIdentity},
+	}
+
+	s, c, response, err := loginWith(cfg, &PolicyRequirements{MinVersion: 3})
+	if err != nil {
+		return err
+	}
+
+	if response.UpgradePolicy == nil || response.UpgradePolicy.Version != 2 {
+		return errors.Errorf("got upgrade policy %v", response.UpgradePolicy)
+	}
+
+	if !c.NeedsUpgrade() {
+		return errors.New("client does not need an upgrade")
+	}
+
+	if _, err := c.UpgradeRegistration(); !errors.Is(err, common.ErrorForbiddenPolicy) {
+		return errors.Errorf("expected err %v to contain %v", err, common.ErrorForbiddenPolicy)
+	}
+
+	c.PolicyAcceptor = &PolicyRequirements{MinVersion: 2, BindUserIdentity: true}
+
+	upload, err := c.UpgradeRegistration()
+	if err != nil {
+		return errors.Wrap(err, "upgrade registration")
+	}
+
+	if upload.Envelope.Mode != mode {
+		return errors.Errorf("got envelope mode %v", upload.Envelope.Mode)
+	}
+
+	// The client must prove its login first.
+	if s.NeedsUpgrade() {
+		return errors.New("server needs an upgrade before the login proof")
+	}
+
+	if err := checkStateError(s.UpgradeUserRecord(upload)); err != nil {
+		return errors.Wrap(err, "upgrade before login proof")
+	}
+
+	proof, err := c.ProveLogin()
+	if err != nil {
+		return errors.Wrap(err, "prove login")
+	}
+
+	if err := s.VerifyLoginProof(proof); err != nil {
+		return errors.Wrap(err, "verify login proof")
+	}
+
+	if !s.NeedsUpgrade() {
+		return errors.New("server does not need an upgrade")
+	}
+
+	// Keys which are not derived from the password are kept.
+	if mode != EnvelopeModeInternal {
+		other, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+		if err != nil {
+			return err
+		}
+
+		changed := *upload
+		changed.ClientPublicKey = other.Public()
+
+		if err := s.UpgradeUserRecord(&changed); !errors.Is(err, common.ErrorClientKeyMismatch) {
+			return errors.Errorf("expected err %v to contain %v", err, common.ErrorClientKeyMismatch)
+		}
+	}
+
+	if err := s.UpgradeUserRecord(upload); err != nil {
+		return errors.Wrap(err, "upgrade user record")
+	}
+
+	if s.NeedsUpgrade() {
+		return errors.New("server needs an upgrade after upgrading")
+	}
+
+	if err := checkStateError(s.UpgradeUserRecord(upload)); err != nil {
+		return errors.Wrap(err, "second upgrade")
+	}
+
+	_, c, response, err = loginWith(cfg, nil)
+	if err != nil {
+		return errors.Wrap(err, "login after upgrade")
+	}
+
+	if response.UpgradePolicy != nil || c.NeedsUpgrade() {
+		return errors.New("upgraded record needs an upgrade")
+	}
+
+	return nil
+}
+
+// loginWith logs in as "user" to a new server for cfg, sending the credential
+// response over the wire, and checks the recovered user identity against the
+// policy.
+func loginWith(cfg *ServerConfig, acceptor PolicyAcceptor) (*Server, *Client, *CredentialResponse, error) {
+	s, err := NewServer(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	c, err := NewClient("user", cfg.ServerID, cfg.Suite, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	c.PolicyAcceptor = acceptor
+
+	request, err := c.CreateCredentialRequest([]byte("password"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	response, err := s.CreateCredentialResponse(request)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	data, err := response.Marshal()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	received := &CredentialResponse{}
+	if _, err := received.Unmarshal(data); err != nil {
+		return nil, nil, nil, err
+	}
+
+	creds, _, err := c.RecoverCredentials(received)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	_, stored := creds.Find(CredentialTypeUserIdentity)
+	if upgraded := s.UserRecord.PolicyVersion == 2; stored != upgraded {
+		return nil, nil, nil, errors.Errorf("user identity stored: %v, policy version %d", stored, s.UserRecord.PolicyVersion)
+	}
+
+	return s, c, received, nil
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/pkg/errors"
+)
+
+var errEntropy = errors.New("entropy source failed")
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errEntropy }
+
+// scalarLength returns the number of random bytes read per blind or key.
+func scalarLength(t *testing.T, suite oprf.SuiteID) int {
+	s, err := getOPRFSuite(suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s.scalarLength()
+}
+
+func TestFailingRandomness(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Blinding
+	c, err := NewClientWithRand("new user", "example.com", oprf.OPRFP256, nil, failingReader{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := c.CreateRegistrationRequest("password"); !errors.Is(err, errEntropy) {
+		t.Errorf("expected err %v to contain %v", err, errEntropy)
+	}
+
+	if c.state != clientStateStart {
+		t.Errorf("in state %v, expected %v", c.state, clientStateStart)
+	}
+
+	// Envelope nonce: the reader fails after the blind.
+	h, err := newStateHarness(cfg, "new user", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	h.client.Rand = io.MultiReader(bytes.NewReader(make([]byte, scalarLength(t, oprf.OPRFP256))), failingReader{})
+	if err := h.runClientStep("CreateRegistrationRequest"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := h.runClientStep("FinalizeRegistrationRequest"); !errors.Is(err, errEntropy) {
+		t.Errorf("expected err %v to contain %v", err, errEntropy)
+	}
+
+	if h.client.state != clientStateStart {
+		t.Errorf("in state %v, expected %v", h.client.state, clientStateStart)
+	}
+
+	// OPRF key
+	c, err = NewClient("new user", "example.com", oprf.OPRFP256, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	request, err := c.CreateRegistrationRequest("password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg.Rand = failingReader{}
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := s.CreateRegistrationResponse(request); !errors.Is(err, errEntropy) {
+		t.Errorf("expected err %v to contain %v", err, errEntropy)
+	}
+
+	// Key generation
+	if _, err := GenerateOPRFSeed(failingReader{}); !errors.Is(err, errEntropy) {
+		t.Errorf("expected err %v to contain %v", err, errEntropy)
+	}
+
+	if _, err := GeneratePrivateKey(failingReader{}, KeyAlgorithmP256); err == nil {
+		t.Error("expected an error generating a signing key")
+	}
+
+	if _, err := NewServerConfigWithRand("example.com", oprf.OPRFP256, failingReader{}); err == nil {
+		t.Error("expected an error generating the server signing key")
+	}
+
+	// Envelope nonce outside of the registration flow
+	creds, err := newTestCredentials(cfg.Signer.(crypto.Signer), cfg.Signer.Public(), cfg.ServerID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, _, err := EncryptCredentialsWithRand(make([]byte, 32), creds, failingReader{}); !errors.Is(err, errEntropy) {
+		t.Errorf("expected err %v to contain %v", err, errEntropy)
+	}
+}
+
+func TestDeterministicRandomness(t *testing.T) {
+	random := bytes.Repeat([]byte{7}, 1024)
+
+	var requests []*RegistrationRequest
+
+	for i := 0; i < 2; i++ {
+		c, err := NewClientWithRand("alice", "example.com", oprf.OPRFP384, nil, bytes.NewReader(random))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		request, err := c.CreateRegistrationRequest("password")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		requests = append(requests, request)
+	}
+
+	if !reflect.DeepEqual(requests[0], requests[1]) {
+		t.Error("requests differ with the same randomness")
+	}
+
+	for i := 0; i < 2; i++ {
+		seed, err := GenerateOPRFSeed(bytes.NewReader(random))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !bytes.Equal(seed, random[:OPRFSeedLength]) {
+			t.Error("seed not read from the given reader")
+		}
+	}
+
+	r := bytes.NewReader(random)
+
+	cfg, err := NewServerConfigWithRand("example.com", oprf.OPRFP256, r)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if cfg.Rand != r {
+		t.Error("config does not keep the given reader")
+	}
+
+	creds, err := newTestCredentials(cfg.Signer.(crypto.Signer), cfg.Signer.Public(), cfg.ServerID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	envelope, _, err := EncryptCredentialsWithRand(make([]byte, 32), creds, bytes.NewReader(random))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(envelope.Nonce, random[:EnvelopeNonceLength]) {
+		t.Error("envelope nonce not read from the given reader")
+	}
+}
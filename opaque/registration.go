@@ -27,20 +27,39 @@ package opaque
 
 import (
 	"crypto"
+	"time"
 
 	"github.com/cloudflare/circl/oprf"
 	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
 )
 
 // CreateRegistrationRequest is called by the client for registration.
 // This function creates the first OPAQUE registration message.
 // Errors if the OPRF message cannot be created.
 func (c *Client) CreateRegistrationRequest(password string) (*RegistrationRequest, error) {
+	start := time.Now()
+	sp := c.startSpan("CreateRegistrationRequest")
+	request, err := c.createRegistrationRequest(password)
+	sp.end(err)
+	measure(c.Metrics, "CreateRegistrationRequest", start, err)
+
+	return request, err
+}
+
+func (c *Client) createRegistrationRequest(password string) (*RegistrationRequest, error) {
+	if err := c.checkState("CreateRegistrationRequest", clientStateStart); err != nil {
+		return nil, err
+	}
+
 	blinded, err := c.blind(password)
 	if err != nil {
 		return nil, err
 	}
 
+	c.prevState = c.state
+	c.state = clientStateRegistrationRequested
+
 	return &RegistrationRequest{
 		UserID:   c.UserID,
 		OprfData: blinded,
@@ -51,11 +70,30 @@ func (c *Client) CreateRegistrationRequest(password string) (*RegistrationReques
 // client's registration request.
 // It fails is an OPRF message cannot be created or if a user is already registered.
 func (s *Server) CreateRegistrationResponse(msg *RegistrationRequest) (*RegistrationResponse, error) {
+	start := time.Now()
+	sp := s.startSpan("CreateRegistrationResponse")
+	response, err := s.createRegistrationResponse(msg)
+	sp.end(err)
+	measure(s.Config.Metrics, "CreateRegistrationResponse", start, err)
+	s.audit(EventRegistrationRequest, requestUserID(msg), err)
+
+	return response, err
+}
+
+func (s *Server) createRegistrationResponse(msg *RegistrationRequest) (*RegistrationResponse, error) {
+	if err := s.checkState("CreateRegistrationResponse", serverStateStart); err != nil {
+		return nil, err
+	}
+
+	if msg == nil {
+		return nil, errors.Wrap(common.ErrorUnexpectedData, "no registration request")
+	}
+
 	if err := s.SetUserID(msg.UserID); err != nil {
 		return nil, err
 	}
 
-	oprfServer, err := oprf.NewServer(s.Config.Suite, nil)
+	oprfServer, err := s.newOPRFServer()
 	if err != nil {
 		s.UserRecord.UserID = nil
 		return nil, err
@@ -69,62 +107,222 @@ func (s *Server) CreateRegistrationResponse(msg *RegistrationRequest) (*Registra
 		return nil, err
 	}
 
+	s.policy = s.Config.CredentialEncodingPolicy
+	s.state = serverStateRegistrationResponded
+
 	return &RegistrationResponse{
 		OprfData:                 eval,
 		ServerPublicKey:          s.Config.Signer.Public(),
-		CredentialEncodingPolicy: s.Config.CredentialEncodingPolicy,
+		CredentialEncodingPolicy: s.policy,
 	}, nil
 }
 
 // FinalizeRegistrationRequest is called by the client to respond to the
 // server's response to its registration request (registration response).
-// Returns a registration upload message and an exporter key.
+// Returns a registration upload message and the export key.
 // Errors if the OPRF cannot be completed or there is a problem encrypting the
 // envelope.
-func (c *Client) FinalizeRegistrationRequest(msg *RegistrationResponse) (*RegistrationUpload, []byte, error) {
+func (c *Client) FinalizeRegistrationRequest(msg *RegistrationResponse) (*RegistrationUpload, ExportKey, error) {
+	start := time.Now()
+	sp := c.startSpan("FinalizeRegistrationRequest")
+	upload, exporterKey, err := c.finalizeRegistrationRequest(msg)
+	sp.end(err)
+	measure(c.Metrics, "FinalizeRegistrationRequest", start, err)
+
+	return upload, exporterKey, err
+}
+
+func (c *Client) finalizeRegistrationRequest(msg *RegistrationResponse) (*RegistrationUpload, ExportKey, error) {
+	if err := c.checkState("FinalizeRegistrationRequest", clientStateRegistrationRequested); err != nil {
+		return nil, nil, err
+	}
+
+	if msg == nil {
+		return nil, nil, errors.Wrap(common.ErrorUnexpectedData, "no registration response")
+	}
+
 	rwd, err := c.finalizeHarden(msg.OprfData)
 	if err != nil {
-		c.oprf1 = nil
+		c.resetFlow()
 		return nil, nil, err
 	}
 
-	creds, err := c.credentialsFromPolicy(msg.CredentialEncodingPolicy, msg.ServerPublicKey)
+	nonce, err := common.GetRandomBytes(c.Rand, EnvelopeNonceLength)
 	if err != nil {
-		c.oprf1 = nil
+		c.resetFlow()
 		return nil, nil, err
 	}
 
-	envelope, exporterKey, err := EncryptCredentials(rwd, creds)
+	mode, key, err := c.envelopeKey(rwd, nonce)
 	if err != nil {
-		c.oprf1 = nil
+		c.resetFlow()
 		return nil, nil, err
 	}
 
+	if err := c.acceptPolicy(msg.CredentialEncodingPolicy); err != nil {
+		c.resetFlow()
+		return nil, nil, err
+	}
+
+	creds, err := c.credentialsFromPolicy(msg.CredentialEncodingPolicy, key, msg.ServerPublicKey, nil)
+	if err != nil {
+		c.resetFlow()
+		return nil, nil, err
+	}
+
+	envelope, exporterKey, err := c.encryptCredentials(mode, rwd, nonce, creds, msg.ServerPublicKey)
+	if err != nil {
+		c.resetFlow()
+		return nil, nil, err
+	}
+
+	c.oprf1 = nil
+	c.state = clientStateRegistered
+
 	return &RegistrationUpload{
 		Envelope:        envelope,
-		ClientPublicKey: c.signer.Public(),
+		ClientPublicKey: key.Public(),
 	}, exporterKey, nil
 }
 
+// encryptCredentials encrypts creds in an envelope of the given mode. Internal
+// mode envelopes bind serverPublicKey and the client's ServerID.
+func (c *Client) encryptCredentials(mode EnvelopeMode, rwd, nonce []byte, creds *Credentials,
+	serverPublicKey crypto.PublicKey) (*Envelope, []byte, error) {
+	if mode == EnvelopeModeInternal {
+		return EncryptCredentialsInternal(rwd, nonce, creds, serverPublicKey, c.ServerID)
+	}
+
+	return EncryptCredentialsWithMode(mode, rwd, nonce, creds)
+}
+
+// envelopeKey returns the envelope mode of the client and its key. Without a
+// key of its own, the client uses an internal mode envelope and derives its
+// key from rwd and the nonce.
+func (c *Client) envelopeKey(rwd, nonce []byte) (EnvelopeMode, PrivateKey, error) {
+	mode := c.EnvelopeMode
+	if mode == 0 {
+		mode = EnvelopeModeExternal
+		if c.signer == nil {
+			mode = EnvelopeModeInternal
+		}
+	}
+
+	if mode != EnvelopeModeInternal {
+		if c.signer == nil {
+			return 0, nil, errors.Errorf("envelope mode %v needs a client key", mode)
+		}
+
+		return mode, c.signer, nil
+	}
+
+	if c.signer != nil {
+		return 0, nil, errors.New("internal mode envelopes derive the client key, but one was given")
+	}
+
+	key, err := deriveClientKey(c.oprfSuite, rwd, nonce)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return mode, key, nil
+}
+
 // StoreUserRecord is called by the Server to add the new client identity
 // to it's records, ending the registration process.
-// Errors if the record cannot be added, e.g. because the username has already
-// been registered.
+// Errors if the upload does not match the credential encoding policy and keys
+// the server sent, or if the record cannot be added, e.g. because the username
+// has already been registered.
 func (s *Server) StoreUserRecord(msg *RegistrationUpload) error {
+	username := s.UserRecord.UserID
+
+	start := time.Now()
+	sp := s.startSpan("StoreUserRecord")
+	err := s.storeUserRecord(msg)
+	sp.end(err)
+	measure(s.Config.Metrics, "StoreUserRecord", start, err)
+
+	if code := common.ErrorCode(err); code == common.ErrorForbiddenPolicy || code == common.ErrorPolicyMismatch {
+		s.audit(EventPolicyViolation, username, err)
+	} else {
+		s.audit(EventRegistrationUpload, username, err)
+	}
+
+	return err
+}
+
+func (s *Server) storeUserRecord(msg *RegistrationUpload) error {
+	if err := s.checkState("StoreUserRecord", serverStateRegistrationResponded); err != nil {
+		return err
+	}
+
+	if err := s.validateUpload(msg, s.policy); err != nil {
+		s.UserRecord = &UserRecord{}
+		s.state = serverStateStart
+
+		return err
+	}
+
+	s.UserRecord.PolicyVersion = s.policy.Version
+	s.UserRecord.ServerPublicKey = s.Config.Signer.Public()
+
 	record, err := s.InsertNewUserRecord(msg.ClientPublicKey, msg.Envelope)
+	if err != nil {
+		s.UserRecord = &UserRecord{}
+		s.state = serverStateStart
+
+		return err
+	}
 
 	s.UserRecord = record
+	s.state = serverStateRegistered
 
-	return err
+	return nil
+}
+
+// newOPRFServer returns an OPRF server for the user being registered, with a
+// key derived from the configured seed if there is one, or a random key.
+func (s *Server) newOPRFServer() (*oprf.Server, error) {
+	var key *oprf.PrivateKey
+
+	var err error
+
+	if s.Config.OPRFSeed == nil {
+		key, err = randomOPRFKey(s.Config.Suite, s.Config.Rand)
+	} else {
+		key, err = deriveOPRFKey(s.Config.Suite, s.Config.OPRFSeed, s.UserRecord.UserID)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return oprf.NewServer(s.Config.Suite, key)
 }
 
-func (c *Client) credentialsFromPolicy(policy *CredentialEncodingPolicy,
-	serverPublicKey crypto.PublicKey) (*Credentials, error) {
+// requestUserID returns the user ID of msg, allowing for a nil msg.
+func requestUserID(msg *RegistrationRequest) []byte {
+	if msg == nil {
+		return nil
+	}
+
+	return msg.UserID
+}
+
+// credentialsFromPolicy returns the credentials listed in policy. Values of
+// application-defined types not set on the client are taken from recovered,
+// if not nil.
+func (c *Client) credentialsFromPolicy(policy *CredentialEncodingPolicy, key PrivateKey,
+	serverPublicKey crypto.PublicKey, recovered *Credentials) (*Credentials, error) {
+	if err := validatePolicy(policy); err != nil {
+		return nil, err
+	}
+
 	secretCreds := make(CredentialExtensionList, len(policy.SecretTypes))
 	cleartextCreds := make(CredentialExtensionList, len(policy.CleartextTypes))
 
 	for i, credType := range policy.SecretTypes {
-		cred, err := c.getCredentialFromType(credType, serverPublicKey)
+		cred, err := c.getCredentialFromType(credType, key, serverPublicKey, recovered)
 		if err != nil {
 			return nil, err
 		}
@@ -133,11 +331,7 @@ func (c *Client) credentialsFromPolicy(policy *CredentialEncodingPolicy,
 	}
 
 	for i, credType := range policy.CleartextTypes {
-		if credType == CredentialTypeUserPrivateKey {
-			return nil, common.ErrorForbiddenPolicy
-		}
-
-		cred, err := c.getCredentialFromType(credType, serverPublicKey)
+		cred, err := c.getCredentialFromType(credType, key, serverPublicKey, recovered)
 		if err != nil {
 			return nil, err
 		}
@@ -151,7 +345,8 @@ func (c *Client) credentialsFromPolicy(policy *CredentialEncodingPolicy,
 	}, nil
 }
 
-func (c *Client) getCredentialFromType(t CredentialType, serverPublicKey crypto.PublicKey) (*CredentialExtension, error) {
+func (c *Client) getCredentialFromType(t CredentialType, key PrivateKey, serverPublicKey crypto.PublicKey,
+	recovered *Credentials) (*CredentialExtension, error) {
 	var val interface{}
 
 	switch t {
@@ -162,9 +357,18 @@ func (c *Client) getCredentialFromType(t CredentialType, serverPublicKey crypto.
 	case CredentialTypeServerPublicKey:
 		val = serverPublicKey
 	case CredentialTypeUserPublicKey:
-		val = c.signer.Public()
+		val = key.Public()
 	case CredentialTypeUserPrivateKey:
-		val = c.signer
+		val = key
+	default:
+		var ok bool
+		if val, ok = c.credentials[t]; !ok && recovered != nil {
+			val, ok = recovered.Find(t)
+		}
+
+		if !ok {
+			return nil, errors.Wrapf(common.ErrorForbiddenPolicy, "no value for credential type %v", t)
+		}
 	}
 
 	cred, err := newCredentialExtension(t, val)
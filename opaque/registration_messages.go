@@ -27,7 +27,6 @@ package opaque
 
 import (
 	"crypto"
-	"crypto/x509"
 
 	"github.com/tatianab/mint/syntax"
 )
@@ -71,10 +70,11 @@ func (*RegistrationRequest) Type() ProtocolMessageType {
 // 	opaque pkS<0..2^16-1>;
 // 	CredentialType secret_types<1..254>;
 // 	CredentialType cleartext_types<0..254>;
+// 	uint16 policy_version;
 // } RegistrationResponse;
 //
-//       2                       2                 1                                1
-// | oprfDataLen | oprfData | pkSLen | pkS | secretTypesLen | secretTypes | cleartextTypesLen | cleartextTypes |.
+//       2                       2                 1                                1                                      2
+// | oprfDataLen | oprfData | pkSLen | pkS | secretTypesLen | secretTypes | cleartextTypesLen | cleartextTypes | policyVersion |.
 type RegistrationResponse struct {
 	OprfData                 []byte
 	ServerPublicKey          crypto.PublicKey
@@ -86,11 +86,12 @@ type registrationResponseInner struct {
 	ServerPublicKey []byte           `tls:"head=2"`
 	SecretTypes     []CredentialType `tls:"head=1, min=1"`
 	CleartextTypes  []CredentialType `tls:"head=1"`
+	PolicyVersion   uint16
 }
 
 // Marshal returns the raw form of a RegistrationResponse.
 func (rr *RegistrationResponse) Marshal() ([]byte, error) {
-	rawServerPublicKey, err := x509.MarshalPKIXPublicKey(rr.ServerPublicKey)
+	rawServerPublicKey, err := MarshalPublicKey(rr.ServerPublicKey)
 	if err != nil {
 		return nil, err
 	}
@@ -100,6 +101,7 @@ func (rr *RegistrationResponse) Marshal() ([]byte, error) {
 		ServerPublicKey: rawServerPublicKey,
 		SecretTypes:     rr.CredentialEncodingPolicy.SecretTypes,
 		CleartextTypes:  rr.CredentialEncodingPolicy.CleartextTypes,
+		PolicyVersion:   rr.CredentialEncodingPolicy.Version,
 	}
 
 	return syntax.Marshal(inner)
@@ -115,7 +117,7 @@ func (rr *RegistrationResponse) Unmarshal(data []byte) (int, error) {
 		return 0, err
 	}
 
-	serverPublicKey, err := x509.ParsePKIXPublicKey(inner.ServerPublicKey)
+	serverPublicKey, err := ParsePublicKey(inner.ServerPublicKey)
 	if err != nil {
 		return 0, err
 	}
@@ -124,6 +126,7 @@ func (rr *RegistrationResponse) Unmarshal(data []byte) (int, error) {
 		OprfData:        inner.OprfData,
 		ServerPublicKey: serverPublicKey,
 		CredentialEncodingPolicy: &CredentialEncodingPolicy{
+			Version:        inner.PolicyVersion,
 			SecretTypes:    inner.SecretTypes,
 			CleartextTypes: inner.CleartextTypes,
 		},
@@ -159,7 +162,7 @@ type registrationUploadInner struct {
 
 // Marshal returns the raw form of a RegistrationUpload.
 func (ru *RegistrationUpload) Marshal() ([]byte, error) {
-	rawPublicKey, err := x509.MarshalPKIXPublicKey(ru.ClientPublicKey)
+	rawPublicKey, err := MarshalPublicKey(ru.ClientPublicKey)
 	if err != nil {
 		return nil, err
 	}
@@ -182,7 +185,7 @@ func (ru *RegistrationUpload) Unmarshal(data []byte) (int, error) {
 		return 0, err
 	}
 
-	userPublicKey, err := x509.ParsePKIXPublicKey(inner.UserPublicKey)
+	userPublicKey, err := ParsePublicKey(inner.UserPublicKey)
 	if err != nil {
 		return 0, err
 	}
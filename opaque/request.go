@@ -26,18 +26,38 @@
 package opaque
 
 import (
+	"time"
+
 	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
 )
 
 // CreateCredentialRequest is called by the client on a password to initiate the
 // online OPAQUE protocol.
 // Returns a credential request, which will be sent to the server.
 func (c *Client) CreateCredentialRequest(password []byte) (*CredentialRequest, error) {
+	start := time.Now()
+	sp := c.startSpan("CreateCredentialRequest")
+	request, err := c.createCredentialRequest(password)
+	sp.end(err)
+	measure(c.Metrics, "CreateCredentialRequest", start, err)
+
+	return request, err
+}
+
+func (c *Client) createCredentialRequest(password []byte) (*CredentialRequest, error) {
+	if err := c.checkState("CreateCredentialRequest", clientStateStart, clientStateRegistered); err != nil {
+		return nil, err
+	}
+
 	blinded, err := c.blind(string(password))
 	if err != nil {
 		return nil, err
 	}
 
+	c.prevState = c.state
+	c.state = clientStateCredentialRequested
+
 	return &CredentialRequest{
 		UserID:   c.UserID,
 		OprfData: blinded,
@@ -48,38 +68,201 @@ func (c *Client) CreateCredentialRequest(password []byte) (*CredentialRequest, e
 // request from the client.
 // Returns a credential response, which will be sent to the server.
 func (s *Server) CreateCredentialResponse(request *CredentialRequest) (*CredentialResponse, error) {
+	var username []byte
+	if request != nil {
+		username = request.UserID
+	}
+
+	start := time.Now()
+	sp := s.startSpan("CreateCredentialResponse")
+	response, err := s.createCredentialResponse(request)
+	sp.end(err)
+	measure(s.Config.Metrics, "CreateCredentialResponse", start, err)
+
+	if common.ErrorCode(err) == common.ErrorUserNotRegistered {
+		s.audit(EventUnknownUser, username, err)
+	} else {
+		s.audit(EventLoginAttempt, username, err)
+	}
+
+	return response, err
+}
+
+func (s *Server) createCredentialResponse(request *CredentialRequest) (*CredentialResponse, error) {
+	if err := s.checkState("CreateCredentialResponse", serverStateStart, serverStateRegistered); err != nil {
+		return nil, err
+	}
+
+	if request == nil {
+		return nil, errors.Wrap(common.ErrorUnexpectedData, "no credential request")
+	}
+
+	if err := s.allowAttempt(request.UserID); err != nil {
+		return nil, err
+	}
+
 	record, err := s.GetUserRecordFromUsername(request.UserID)
 	if err != nil {
 		return nil, err
 	}
 
+	prevRecord := s.UserRecord
 	s.UserRecord = record
+
+	serverKey, err := s.serverKey()
+	if err != nil {
+		s.UserRecord = prevRecord
+		return nil, err
+	}
+
 	eval, err := s.evaluate(request.OprfData)
 	if err != nil {
-		s.UserRecord = nil
+		s.UserRecord = prevRecord
+		return nil, err
+	}
+
+	challenge, err := common.GetRandomBytes(s.Config.Rand, LoginChallengeLength)
+	if err != nil {
+		s.UserRecord = prevRecord
+		return nil, err
+	}
+
+	transcript, err := newLoginTranscript(request.UserID, request.OprfData, eval, challenge)
+	if err != nil {
+		s.UserRecord = prevRecord
 		return nil, err
 	}
 
-	return &CredentialResponse{
+	s.transcript = transcript
+	s.state = serverStateCredentialResponded
+
+	response := &CredentialResponse{
 		OprfData:        eval,
 		Envelope:        record.Envelope,
-		serverPublicKey: s.Config.Signer.Public(),
-	}, nil
+		Challenge:       challenge,
+		serverPublicKey: serverKey.Public(),
+	}
+
+	if s.recordOutdated() {
+		response.UpgradePolicy = s.Config.CredentialEncodingPolicy
+	}
+
+	return response, nil
 }
 
 // RecoverCredentials is called by the client on receiving an OPAQUE credential
 // response from the server.
-// Returns the credentials that the client uploaded during the registration phase.
-func (c *Client) RecoverCredentials(response *CredentialResponse) (*Credentials, error) {
+// Returns the credentials that the client uploaded during the registration phase,
+// and the export key, which is the one returned at registration.
+// Errors wrapping common.ErrorServerNotTrusted if the server public key or
+// identity recovered do not match the response and the client's ServerID, or
+// the server public key is not the one pinned in ServerKeys.
+func (c *Client) RecoverCredentials(response *CredentialResponse) (*Credentials, ExportKey, error) {
+	start := time.Now()
+	sp := c.startSpan("RecoverCredentials")
+	creds, exportKey, err := c.recoverCredentials(response)
+	sp.end(err)
+	measure(c.Metrics, "RecoverCredentials", start, err)
+
+	return creds, exportKey, err
+}
+
+func (c *Client) recoverCredentials(response *CredentialResponse) (*Credentials, ExportKey, error) {
+	if err := c.checkState("RecoverCredentials", clientStateCredentialRequested); err != nil {
+		return nil, nil, err
+	}
+
+	if response == nil {
+		return nil, nil, errors.Wrap(common.ErrorUnexpectedData, "no credential response")
+	}
+
 	rwd, err := c.finalizeHarden(response.OprfData)
 	if err != nil {
-		return nil, err
+		c.resetFlow()
+		return nil, nil, err
+	}
+
+	sp := c.startSpan("DecryptCredentials")
+	creds, err := c.decryptCredentials(rwd, response)
+	sp.end(err)
+
+	if err != nil {
+		c.resetFlow()
+		return nil, nil, common.ErrorBadEnvelope.Wrap(err)
+	}
+
+	if response.Envelope.Mode == EnvelopeModeInternal {
+		if err := c.restoreClientKey(rwd, response.Envelope.Nonce, creds); err != nil {
+			c.resetFlow()
+			return nil, nil, err
+		}
+	}
+
+	if err := c.verifyServer(creds, response); err != nil {
+		c.resetFlow()
+		return nil, nil, err
+	}
+
+	exportKey, err := envelopeExporterKey(rwd)
+	if err != nil {
+		c.resetFlow()
+		return nil, nil, err
+	}
+
+	transcript, err := newLoginTranscript(c.UserID, c.oprf1.blinded, response.OprfData, response.Challenge)
+	if err != nil {
+		c.resetFlow()
+		return nil, nil, err
+	}
+
+	c.login = &loginSession{transcript: transcript, creds: creds}
+
+	c.upgrade = nil
+	if response.UpgradePolicy != nil {
+		c.upgrade = &recordUpgrade{
+			policy:          response.UpgradePolicy,
+			rwd:             rwd,
+			mode:            response.Envelope.Mode,
+			creds:           creds,
+			serverPublicKey: response.ServerPublicKey(),
+		}
+	}
+
+	c.oprf1 = nil
+	c.state = clientStateDone
+
+	return creds, exportKey, nil
+}
+
+// decryptCredentials decrypts the envelope of response. Internal mode
+// envelopes are checked against the server public key of response and the
+// client's ServerID.
+func (c *Client) decryptCredentials(rwd []byte, response *CredentialResponse) (*Credentials, error) {
+	if response.Envelope == nil {
+		return nil, errors.New("no envelope")
+	}
+
+	if response.Envelope.Mode == EnvelopeModeInternal {
+		return DecryptCredentialsInternal(rwd, response.Envelope, response.ServerPublicKey(), c.ServerID)
+	}
+
+	return DecryptCredentials(rwd, response.Envelope)
+}
+
+// restoreClientKey adds the user private key of an internal mode envelope,
+// derived from rwd and the envelope nonce, to creds.
+func (c *Client) restoreClientKey(rwd, nonce []byte, creds *Credentials) error {
+	key, err := deriveClientKey(c.oprfSuite, rwd, nonce)
+	if err != nil {
+		return err
 	}
 
-	creds, err := DecryptCredentials(rwd, response.Envelope)
+	cred, err := newCredentialExtension(CredentialTypeUserPrivateKey, key)
 	if err != nil {
-		return nil, common.ErrorBadEnvelope.Wrap(err)
+		return err
 	}
 
-	return creds, nil
+	creds.SecretCredentials = append(CredentialExtensionList{cred}, creds.SecretCredentials...)
+
+	return nil
 }
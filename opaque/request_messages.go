@@ -27,7 +27,6 @@ package opaque
 
 import (
 	"crypto"
-	"crypto/x509"
 
 	"github.com/tatianab/mint/syntax"
 )
@@ -73,14 +72,30 @@ func (*CredentialRequest) Type() ProtocolMessageType {
 // 	opaque data<1..2^16-1>;
 // 	opaque envelope<1..2^16-1>;
 // 	opaque pkS<0..2^16-1;
+// 	opaque challenge<0..255>;
+// 	optional<UpgradePolicy> upgrade_policy;
 // } CredentialResponse;
 //
-//        2                                2
-// | oprfDataLen | oprfData | envelope | pkSLen | pkS |
+// struct {
+// 	uint16 version;
+// 	CredentialType secret_types<0..254>;
+// 	CredentialType cleartext_types<0..254>;
+// } UpgradePolicy;
+//
+//        2                                2              1                      1                    1                                1
+// | oprfDataLen | oprfData | envelope | pkSLen | pkS | challengeLen | challenge | present | version | secretTypesLen | secretTypes | cleartextTypesLen | cleartextTypes |
+//
+// The upgrade policy is preceded by a byte which is 1 if it is present and 0
+// otherwise, with no further bytes.
 type CredentialResponse struct {
 	OprfData        []byte           // an encoded element in the OPRF group
 	Envelope        *Envelope        // an authenticated encoding of a Credentials structure
+	Challenge       []byte           // random data making the login transcript unique, signed by Client.ProveLogin
 	serverPublicKey crypto.PublicKey // OPTIONAL: an encoded public key that will be used for the online authenticated key exchange stage.
+
+	// UpgradePolicy is the server's current credential encoding policy, set if
+	// the envelope was stored under another version of it.
+	UpgradePolicy *CredentialEncodingPolicy
 }
 
 // Type returns the type of this struct.
@@ -88,23 +103,45 @@ func (*CredentialResponse) Type() ProtocolMessageType {
 	return ProtocolMessageTypeCredentialResponse
 }
 
+// ServerPublicKey returns the server public key carried by the response.
+func (cr *CredentialResponse) ServerPublicKey() crypto.PublicKey {
+	return cr.serverPublicKey
+}
+
 type credentialResponseInner struct {
 	OprfData        []byte `tls:"head=2,min=1"`
 	Envelope        *Envelope
-	ServerPublicKey []byte `tls:"head=2"`
+	ServerPublicKey []byte              `tls:"head=2"`
+	Challenge       []byte              `tls:"head=1"`
+	UpgradePolicy   *upgradePolicyInner `tls:"optional"`
+}
+
+type upgradePolicyInner struct {
+	Version        uint16
+	SecretTypes    []CredentialType `tls:"head=1"`
+	CleartextTypes []CredentialType `tls:"head=1"`
 }
 
 // Marshal encodes a Credential Response.
 func (cr *CredentialResponse) Marshal() ([]byte, error) {
-	rawPublicKey, err := x509.MarshalPKIXPublicKey(cr.serverPublicKey)
+	rawPublicKey, err := MarshalPublicKey(cr.serverPublicKey)
 	if err != nil {
 		return nil, err
 	}
 
 	toMarshal := &credentialResponseInner{
-		cr.OprfData,
-		cr.Envelope,
-		rawPublicKey,
+		OprfData:        cr.OprfData,
+		Envelope:        cr.Envelope,
+		ServerPublicKey: rawPublicKey,
+		Challenge:       cr.Challenge,
+	}
+
+	if cr.UpgradePolicy != nil {
+		toMarshal.UpgradePolicy = &upgradePolicyInner{
+			Version:        cr.UpgradePolicy.Version,
+			SecretTypes:    cr.UpgradePolicy.SecretTypes,
+			CleartextTypes: cr.UpgradePolicy.CleartextTypes,
+		}
 	}
 
 	return syntax.Marshal(toMarshal)
@@ -119,13 +156,27 @@ func (cr *CredentialResponse) Unmarshal(data []byte) (int, error) {
 		return 0, err
 	}
 
-	publicKey, err := x509.ParsePKIXPublicKey(cri.ServerPublicKey)
+	publicKey, err := ParsePublicKey(cri.ServerPublicKey)
 	if err != nil {
 		return 0, err
 	}
 
 	*cr = CredentialResponse{
-		cri.OprfData, cri.Envelope, publicKey,
+		OprfData:        cri.OprfData,
+		Envelope:        cri.Envelope,
+		serverPublicKey: publicKey,
+	}
+
+	if len(cri.Challenge) > 0 {
+		cr.Challenge = cri.Challenge
+	}
+
+	if cri.UpgradePolicy != nil {
+		cr.UpgradePolicy = &CredentialEncodingPolicy{
+			Version:        cri.UpgradePolicy.Version,
+			SecretTypes:    cri.UpgradePolicy.SecretTypes,
+			CleartextTypes: cri.UpgradePolicy.CleartextTypes,
+		}
 	}
 
 	return bytesRead, nil
@@ -48,6 +48,16 @@ func TestMarshalUnmarshalCredentialRequest(t *testing.T) {
 	}
 }
 
+func TestMarshalUnmarshalLoginProof(t *testing.T) {
+	lp1 := &LoginProof{Proof: randomBytes(64)}
+
+	lp2 := &LoginProof{}
+	if err := TestMarshalUnmarshal(lp1, lp2); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
 func TestMarshalUnmarshalCredentialResponse(t *testing.T) {
 	oprfData := make([]byte, 32)
 	_, _ = rand.Read(oprfData)
@@ -58,15 +68,31 @@ func TestMarshalUnmarshalCredentialResponse(t *testing.T) {
 		return
 	}
 
-	cr1 := &CredentialResponse{
-		OprfData:        oprfData,
-		Envelope:        getDummyEnvelope(),
-		serverPublicKey: signer.Public(),
-	}
+	challenge := make([]byte, LoginChallengeLength)
+	_, _ = rand.Read(challenge)
 
-	cr2 := &CredentialResponse{}
-	if err := TestMarshalUnmarshal(cr1, cr2); err != nil {
-		t.Error(err)
-		return
+	// An upgrade policy with no types is still an upgrade.
+	for _, policy := range []*CredentialEncodingPolicy{
+		nil,
+		{Version: 2, SecretTypes: []CredentialType{}, CleartextTypes: []CredentialType{}},
+		{
+			Version:        3,
+			SecretTypes:    []CredentialType{CredentialTypeUserPrivateKey},
+			CleartextTypes: []CredentialType{CredentialTypeServerPublicKey},
+		},
+	} {
+		cr1 := &CredentialResponse{
+			OprfData:        oprfData,
+			Envelope:        getDummyEnvelope(),
+			Challenge:       challenge,
+			serverPublicKey: signer.Public(),
+			UpgradePolicy:   policy,
+		}
+
+		cr2 := &CredentialResponse{}
+		if err := TestMarshalUnmarshal(cr1, cr2); err != nil {
+			t.Errorf("policy %v: %v", policy, err)
+			return
+		}
 	}
 }
@@ -26,42 +26,88 @@
 package opaque
 
 import (
+	"context"
 	"crypto"
+	"io"
+	"time"
 
 	"github.com/cloudflare/circl/oprf"
 	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
 )
 
 // Server holds state for an instance of the server role in OPAQUE.
 type Server struct {
 	Config     *ServerConfig
 	UserRecord *UserRecord
+
+	// ClientKey identifies the client to the AttemptLimiter, e.g. by its
+	// IP address. Optional.
+	ClientKey string
+
+	// Context is the parent of tracing spans. Optional.
+	Context context.Context
+
+	// AllowKeyChange lets UpgradeUserRecord replace the user public key of a
+	// record whose key is not derived from the password. Optional.
+	AllowKeyChange bool
+
+	state      serverState
+	policy     *CredentialEncodingPolicy // policy sent in the registration response
+	transcript []byte                    // login transcript of the credential response sent
+	traceCtx   context.Context           // context of the open span, if any
 }
 
 // ServerConfig holds long term state for the server.
 type ServerConfig struct {
 	ServerID                 string
-	Signer                   crypto.Signer
+	Signer                   PrivateKey   // ECDSA, Ed25519 or X25519 server key
+	PreviousSigners          []PrivateKey // optional, rotated out keys still answering the users registered with them
 	RecordTable              UserRecordTable
 	Suite                    oprf.SuiteID
 	CredentialEncodingPolicy *CredentialEncodingPolicy
+	AttemptLimiter           AttemptLimiter // optional
+	EventSink                EventSink      // optional, receives audit events
+	Metrics                  Metrics        // optional
+	Tracer                   Tracer         // optional
+	OPRFSeed                 []byte         // optional, derives per-user OPRF keys
+	Rand                     io.Reader      // optional, source of OPRF keys and login challenges, crypto/rand if nil
 }
 
 // CredentialEncodingPolicy indicates which user credentials are stored,
-// and whether they are held encrypted or in cleartext.
+// and whether they are held encrypted or in cleartext. Records are stored with
+// the version of the policy they follow; records of another version are
+// upgraded with UpgradeUserRecord once a login to them is proven, as the
+// transports do.
 type CredentialEncodingPolicy struct {
+	Version        uint16
 	SecretTypes    []CredentialType
 	CleartextTypes []CredentialType
 }
 
 // Client holds state for the client role in OPAQUE.
 type Client struct {
-	UserID    []byte
-	ServerID  []byte
-	oprf1     *oprf.ClientRequest
-	oprfState *oprf.Client
-	signer    crypto.Signer
-	suite     oprf.SuiteID
+	UserID      []byte
+	ServerID    []byte
+	oprf1       *oprfRequest
+	oprfSuite   *oprfSuite
+	signer      PrivateKey // nil for internal mode envelopes
+	suite       oprf.SuiteID
+	state       clientState
+	prevState   clientState                    // state to return to if the current flow fails
+	credentials map[CredentialType]interface{} // application-defined credentials
+	upgrade     *recordUpgrade                 // pending upgrade of the record after login
+	login       *loginSession                  // last login, to prove with ProveLogin
+	traceCtx    context.Context                // context of the open span, if any
+
+	Metrics        Metrics         // optional
+	Tracer         Tracer          // optional
+	Context        context.Context // parent of tracing spans, optional
+	Rand           io.Reader       // optional, source of blinds and nonces, crypto/rand if nil
+	EnvelopeMode   EnvelopeMode    // optional, external with a key and internal without if zero
+	PolicyAcceptor PolicyAcceptor  // optional, checks the server's credential encoding policy
+	ServerKeys     ServerKeyStore  // optional, pins server public keys on first use
+	KeyStretcher   KeyStretcher    // optional, hardens the OPRF output, DefaultKeyStretcher if nil
 }
 
 // NewServer returns a new OPAQUE server with the RECOMMENDED credential
@@ -84,7 +130,10 @@ func NewServer(cfg *ServerConfig) (*Server, error) {
 
 // SetUserID sets the User ID for the Server's User Record.
 func (s *Server) SetUserID(username []byte) error {
+	start := time.Now()
 	_, err := s.Config.RecordTable.LookupUserRecord(string(username))
+	observe(s.Config.Metrics, OpTableLookup, start)
+
 	if err == nil {
 		return common.ErrorUserAlreadyRegistered
 	}
@@ -98,11 +147,18 @@ func (s *Server) SetUserID(username []byte) error {
 // given username, and uses it to set the server's user record.
 // Errors if no user record can be found, or there is no LookupUserRecord set.
 func (s *Server) GetUserRecordFromUsername(username []byte) (*UserRecord, error) {
+	sp := s.startSpan("GetUserRecordFromUsername")
+
 	if s.Config.RecordTable == nil {
+		sp.end(common.ErrorNoPasswordTable)
 		return nil, common.ErrorNoPasswordTable
 	}
 
+	start := time.Now()
 	userRecord, err := s.Config.RecordTable.LookupUserRecord(string(username))
+	observe(s.Config.Metrics, OpTableLookup, start)
+	sp.end(err)
+
 	if err != nil {
 		return nil, err
 	}
@@ -118,7 +174,11 @@ func (s *Server) InsertNewUserRecord(userPublicKey crypto.PublicKey, envelope *E
 	record.UserPublicKey = userPublicKey
 
 	if s.Config.RecordTable != nil {
-		if err := s.Config.RecordTable.InsertUserRecord(string(record.UserID), record); err != nil {
+		start := time.Now()
+		err := s.Config.RecordTable.InsertUserRecord(string(record.UserID), record)
+		observe(s.Config.Metrics, OpTableInsert, start)
+
+		if err != nil {
 			return nil, err
 		}
 	}
@@ -126,9 +186,44 @@ func (s *Server) InsertNewUserRecord(userPublicKey crypto.PublicKey, envelope *E
 	return record, nil
 }
 
-// NewClient returns a new OPAQUE client.
-func NewClient(userID, serverID string, suite oprf.SuiteID, signerKey crypto.Signer) (*Client, error) {
-	oprfClient, err := oprf.NewClient(suite)
+// serverKey returns the server key the current user registered with: the
+// Signer, or the one of PreviousSigners whose public key the record holds.
+// Errors wrapping common.ErrorServerKeyMismatch if that key is not configured.
+func (s *Server) serverKey() (PrivateKey, error) {
+	if s.UserRecord.ServerPublicKey == nil {
+		return s.Config.Signer, nil
+	}
+
+	der, err := MarshalPublicKey(s.UserRecord.ServerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if samePublicKey(der, s.Config.Signer.Public()) {
+		return s.Config.Signer, nil
+	}
+
+	for _, key := range s.Config.PreviousSigners {
+		if samePublicKey(der, key.Public()) {
+			return key, nil
+		}
+	}
+
+	return nil, errors.Wrap(common.ErrorServerKeyMismatch, "record registered with a server key that is not configured")
+}
+
+// NewClient returns a new OPAQUE client with the private key signerKey,
+// which may be an ECDSA, Ed25519 or X25519 key. With a nil signerKey the client
+// registers with an internal mode envelope, deriving its key pair from the
+// password instead.
+func NewClient(userID, serverID string, suite oprf.SuiteID, signerKey PrivateKey) (*Client, error) {
+	return NewClientWithRand(userID, serverID, suite, signerKey, nil)
+}
+
+// NewClientWithRand returns a new OPAQUE client reading its blinds and nonces
+// from r, or from crypto/rand if r is nil.
+func NewClientWithRand(userID, serverID string, suite oprf.SuiteID, signerKey PrivateKey, r io.Reader) (*Client, error) {
+	oprfSuite, err := getOPRFSuite(suite)
 	if err != nil {
 		return nil, err
 	}
@@ -136,8 +231,9 @@ func NewClient(userID, serverID string, suite oprf.SuiteID, signerKey crypto.Sig
 	return &Client{
 		UserID:    []byte(userID),
 		ServerID:  []byte(serverID),
-		oprfState: oprfClient,
+		oprfSuite: oprfSuite,
 		signer:    signerKey,
 		suite:     suite,
+		Rand:      r,
 	}, nil
 }
@@ -0,0 +1,134 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto"
+	"sync"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+// A ServerKeyStore pins the public keys of servers on first use, by server
+// ID. LookupServerKey returns an error wrapping common.ErrorNotFound for
+// servers not seen before.
+type ServerKeyStore interface {
+	LookupServerKey(serverID string) (crypto.PublicKey, error)
+	StoreServerKey(serverID string, key crypto.PublicKey) error
+}
+
+// InMemoryServerKeyStore is a ServerKeyStore safe for concurrent use.
+type InMemoryServerKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]crypto.PublicKey
+}
+
+// NewInMemoryServerKeyStore returns a new empty in-memory server key store.
+func NewInMemoryServerKeyStore() *InMemoryServerKeyStore {
+	return &InMemoryServerKeyStore{keys: make(map[string]crypto.PublicKey)}
+}
+
+// LookupServerKey returns the key pinned for serverID.
+func (s *InMemoryServerKeyStore) LookupServerKey(serverID string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[serverID]
+	if !ok {
+		return nil, errors.Wrapf(common.ErrorNotFound, "server %q", serverID)
+	}
+
+	return key, nil
+}
+
+// StoreServerKey pins key for serverID, replacing any key pinned before.
+func (s *InMemoryServerKeyStore) StoreServerKey(serverID string, key crypto.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[serverID] = key
+
+	return nil
+}
+
+// verifyServer checks the server public key of a credential response against
+// the one recovered from the envelope and the one pinned in the client's
+// ServerKeys, and the recovered server identity against ServerID. Pins the
+// key if none was. Returns an error wrapping common.ErrorServerNotTrusted on
+// mismatch.
+func (c *Client) verifyServer(creds *Credentials, response *CredentialResponse) error {
+	serverPublicKey := response.ServerPublicKey()
+
+	if ext, err := creds.extension(CredentialTypeServerPublicKey); err == nil {
+		if serverPublicKey == nil {
+			if serverPublicKey, err = ParsePublicKey(ext.CredentialData); err != nil {
+				return common.ErrorBadEnvelope.Wrap(err)
+			}
+		} else if !samePublicKey(ext.CredentialData, serverPublicKey) {
+			return errors.Wrap(common.ErrorServerNotTrusted, "server public key is not the one registered")
+		}
+	}
+
+	if ext, err := creds.extension(CredentialTypeServerIdentity); err == nil {
+		if !bytes.Equal(ext.CredentialData, c.ServerID) {
+			return errors.Wrapf(common.ErrorServerNotTrusted, "registered with %q, not %q", ext.CredentialData, c.ServerID)
+		}
+	}
+
+	if c.ServerKeys == nil || serverPublicKey == nil {
+		return nil
+	}
+
+	pinned, err := c.ServerKeys.LookupServerKey(string(c.ServerID))
+	if errors.Is(err, common.ErrorNotFound) {
+		return c.ServerKeys.StoreServerKey(string(c.ServerID), serverPublicKey)
+	} else if err != nil {
+		return err
+	}
+
+	data, err := MarshalPublicKey(pinned)
+	if err != nil {
+		return err
+	}
+
+	if !samePublicKey(data, serverPublicKey) {
+		return errors.Wrapf(common.ErrorServerNotTrusted, "server public key is not the one pinned for %q", c.ServerID)
+	}
+
+	return nil
+}
+
+// samePublicKey reports whether der is the encoding of key.
+func samePublicKey(der []byte, key crypto.PublicKey) bool {
+	expected, err := MarshalPublicKey(key)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(der, expected)
+}
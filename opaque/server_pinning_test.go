@@ -0,0 +1,190 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint"
+)
+
+func TestVerifyServer(t *testing.T) {
+	signer, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	other, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg := &ServerConfig{
+		ServerID:    "example.com",
+		Signer:      signer,
+		RecordTable: make(InMemoryUserRecordTable),
+		Suite:       oprf.OPRFP256,
+	}
+
+	clientKey, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// An external mode envelope stores the server public key and identity
+	// for the client to check. An internal mode one would not open at all.
+	c, err := NewClient("user", cfg.ServerID, cfg.Suite, clientKey)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := registerWith(cfg, c, "password"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	store := NewInMemoryServerKeyStore()
+
+	cases := []struct {
+		name     string
+		serverID string
+		tamper   func(*CredentialResponse)
+		err      error
+	}{
+		{"first use", "example.com", nil, nil},
+		{"pinned", "example.com", nil, nil},
+		{"other identity", "example.org", nil, common.ErrorServerNotTrusted},
+		{"other key", "example.com", func(r *CredentialResponse) { r.serverPublicKey = other.Public() }, common.ErrorServerNotTrusted},
+	}
+
+	for _, tc := range cases {
+		if err := loginTo(cfg, tc.serverID, store, tc.tamper); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected err %v to contain %v", tc.name, err, tc.err)
+		}
+	}
+
+	if _, err := store.LookupServerKey("example.com"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := store.LookupServerKey("example.org"); !errors.Is(err, common.ErrorNotFound) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorNotFound)
+	}
+}
+
+func TestServerKeyPinning(t *testing.T) {
+	signer, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	other, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The envelope does not hold the server public key, so only the pinned
+	// key protects the client from a server with another key.
+	cfg := &ServerConfig{
+		ServerID:    "example.com",
+		Signer:      signer,
+		RecordTable: make(InMemoryUserRecordTable),
+		Suite:       oprf.OPRFP256,
+		CredentialEncodingPolicy: &CredentialEncodingPolicy{
+			SecretTypes:    []CredentialType{CredentialTypeUserPrivateKey},
+			CleartextTypes: []CredentialType{CredentialTypeServerIdentity},
+		},
+	}
+
+	c, err := NewClient("user", cfg.ServerID, cfg.Suite, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := registerWith(cfg, c, "password"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	store := NewInMemoryServerKeyStore()
+	if err := store.StoreServerKey(cfg.ServerID, other.Public()); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := loginTo(cfg, cfg.ServerID, nil, nil); err != nil {
+		t.Errorf("without store: %v", err)
+	}
+
+	if err := loginTo(cfg, cfg.ServerID, store, nil); !errors.Is(err, common.ErrorServerNotTrusted) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorServerNotTrusted)
+	}
+}
+
+// loginTo logs in as "user" to a new server for cfg, as a client expecting
+// serverID and pinning keys in store. tamper, if not nil, modifies the
+// credential response.
+func loginTo(cfg *ServerConfig, serverID string, store ServerKeyStore, tamper func(*CredentialResponse)) error {
+	s, err := NewServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	c, err := NewClient("user", serverID, cfg.Suite, nil)
+	if err != nil {
+		return err
+	}
+
+	c.ServerKeys = store
+
+	request, err := c.CreateCredentialRequest([]byte("password"))
+	if err != nil {
+		return err
+	}
+
+	response, err := s.CreateCredentialResponse(request)
+	if err != nil {
+		return err
+	}
+
+	if tamper != nil {
+		tamper(response)
+	}
+
+	_, _, err = c.RecoverCredentials(response)
+
+	return err
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"fmt"
+
+	"github.com/cloudflare/opaque-core/common"
+)
+
+// clientState is the position of a Client in the protocol.
+//
+// A Client runs at most one registration followed by at most one login:
+//
+//	start -> registration requested -> registered -> credential requested -> done
+//	start -> credential requested -> done
+//
+// If the second step of a flow fails, the Client returns to the state it was
+// in before the first step, so that the flow can be restarted.
+type clientState int
+
+const (
+	clientStateStart clientState = iota
+	clientStateRegistrationRequested
+	clientStateRegistered
+	clientStateCredentialRequested
+	clientStateDone
+)
+
+var clientStateToString = map[clientState]string{
+	clientStateStart:                 "start",
+	clientStateRegistrationRequested: "registration requested",
+	clientStateRegistered:            "registered",
+	clientStateCredentialRequested:   "credential requested",
+	clientStateDone:                  "done",
+}
+
+func (s clientState) String() string {
+	return clientStateToString[s]
+}
+
+// serverState is the position of a Server in the protocol.
+//
+// A Server answers at most one registration followed by at most one login:
+//
+//	start -> registration responded -> registered -> credential responded
+//	start -> credential responded
+//
+// A login proven with VerifyLoginProof moves on to login succeeded, from which
+// UpgradeUserRecord may replace the user's record once:
+//
+//	credential responded -> login succeeded -> record upgraded
+//
+// If a step fails, the Server stays in or returns to the state it was in
+// before the flow started.
+type serverState int
+
+const (
+	serverStateStart serverState = iota
+	serverStateRegistrationResponded
+	serverStateRegistered
+	serverStateCredentialResponded
+	serverStateLoginSucceeded
+	serverStateRecordUpgraded
+)
+
+var serverStateToString = map[serverState]string{
+	serverStateStart:                 "start",
+	serverStateRegistrationResponded: "registration responded",
+	serverStateRegistered:            "registered",
+	serverStateCredentialResponded:   "credential responded",
+	serverStateLoginSucceeded:        "login succeeded",
+	serverStateRecordUpgraded:        "record upgraded",
+}
+
+func (s serverState) String() string {
+	return serverStateToString[s]
+}
+
+// StateError is returned when a protocol step is called out of order, or
+// called again after it has completed.
+type StateError struct {
+	Step  string // the protocol step that was called
+	State string // the state the Client or Server was in
+}
+
+// Error returns the string associated with the error.
+func (e *StateError) Error() string {
+	return fmt.Sprintf("%s: %s called in state %q", common.ErrorInvalidState, e.Step, e.State)
+}
+
+// Unwrap returns common.ErrorInvalidState.
+func (e *StateError) Unwrap() error {
+	return common.ErrorInvalidState
+}
+
+// resetFlow abandons the current flow, returning the client to the state it
+// was in before the flow started.
+func (c *Client) resetFlow() {
+	c.oprf1 = nil
+	c.state = c.prevState
+}
+
+// checkState errors if the client is not in one of the given states.
+func (c *Client) checkState(step string, states ...clientState) error {
+	for _, s := range states {
+		if c.state == s {
+			return nil
+		}
+	}
+
+	return &StateError{Step: step, State: c.state.String()}
+}
+
+// checkState errors if the server is not in one of the given states.
+func (s *Server) checkState(step string, states ...serverState) error {
+	for _, state := range states {
+		if s.state == state {
+			return nil
+		}
+	}
+
+	return &StateError{Step: step, State: s.state.String()}
+}
@@ -0,0 +1,523 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint"
+)
+
+// stateModel describes the legal protocol steps in each state of a role.
+type stateModel map[int]map[string]int
+
+// paths returns every sequence of legal steps starting from state 0, in
+// lexicographic order, including the empty sequence.
+func (m stateModel) paths(state int, prefix []string) [][]string {
+	paths := [][]string{prefix}
+
+	for _, step := range sortedSteps(m[state]) {
+		path := append(append([]string{}, prefix...), step)
+		paths = append(paths, m.paths(m[state][step], path)...)
+	}
+
+	return paths
+}
+
+// state returns the state reached after the given path.
+func (m stateModel) state(path []string) int {
+	state := 0
+	for _, step := range path {
+		state = m[state][step]
+	}
+
+	return state
+}
+
+func sortedSteps(steps map[string]int) []string {
+	var sorted []string
+	for step := range steps {
+		sorted = append(sorted, step)
+	}
+
+	sort.Strings(sorted)
+
+	return sorted
+}
+
+var clientModel = stateModel{
+	int(clientStateStart): {
+		"CreateRegistrationRequest": int(clientStateRegistrationRequested),
+		"CreateCredentialRequest":   int(clientStateCredentialRequested),
+	},
+	int(clientStateRegistrationRequested): {
+		"FinalizeRegistrationRequest": int(clientStateRegistered),
+	},
+	int(clientStateRegistered): {
+		"CreateCredentialRequest": int(clientStateCredentialRequested),
+	},
+	int(clientStateCredentialRequested): {
+		"RecoverCredentials": int(clientStateDone),
+	},
+}
+
+var serverModel = stateModel{
+	int(serverStateStart): {
+		"CreateRegistrationResponse": int(serverStateRegistrationResponded),
+		"CreateCredentialResponse":   int(serverStateCredentialResponded),
+	},
+	int(serverStateRegistrationResponded): {
+		"StoreUserRecord": int(serverStateRegistered),
+	},
+	int(serverStateRegistered): {
+		"CreateCredentialResponse": int(serverStateCredentialResponded),
+	},
+	int(serverStateCredentialResponded): {
+		"VerifyLoginProof": int(serverStateLoginSucceeded),
+	},
+	int(serverStateLoginSucceeded): {
+		"UpgradeUserRecord": int(serverStateRecordUpgraded),
+	},
+}
+
+// clientCalls call each client step with dummy arguments; the state check
+// must happen before the arguments are used.
+var clientCalls = map[string]func(c *Client) error{
+	"CreateRegistrationRequest": func(c *Client) error {
+		_, err := c.CreateRegistrationRequest("password")
+		return err
+	},
+	"FinalizeRegistrationRequest": func(c *Client) error {
+		_, _, err := c.FinalizeRegistrationRequest(nil)
+		return err
+	},
+	"CreateCredentialRequest": func(c *Client) error {
+		_, err := c.CreateCredentialRequest([]byte("password"))
+		return err
+	},
+	"RecoverCredentials": func(c *Client) error {
+		_, _, err := c.RecoverCredentials(nil)
+		return err
+	},
+}
+
+var serverCalls = map[string]func(s *Server) error{
+	"CreateRegistrationResponse": func(s *Server) error {
+		_, err := s.CreateRegistrationResponse(nil)
+		return err
+	},
+	"StoreUserRecord": func(s *Server) error {
+		return s.StoreUserRecord(nil)
+	},
+	"CreateCredentialResponse": func(s *Server) error {
+		_, err := s.CreateCredentialResponse(nil)
+		return err
+	},
+	"VerifyLoginProof": func(s *Server) error {
+		return s.VerifyLoginProof(nil)
+	},
+	"UpgradeUserRecord": func(s *Server) error {
+		return s.UpgradeUserRecord(nil)
+	},
+}
+
+// stateHarness runs legal protocol steps for real between a client and a
+// server.
+type stateHarness struct {
+	cfg          *ServerConfig
+	username     string
+	password     string
+	client       *Client
+	server       *Server
+	loginClient  *Client // client of the login answered by runServerStep
+	upgrade      bool    // whether to change the policy before answering a login
+	regResponse  *RegistrationResponse
+	credResponse *CredentialResponse
+}
+
+func newStateHarness(cfg *ServerConfig, username, password string) (*stateHarness, error) {
+	signer, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &stateHarness{cfg: cfg, username: username, password: password}
+
+	h.client, err = NewClient(username, cfg.ServerID, cfg.Suite, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	h.server, err = NewServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// runClientStep runs a client step, with a fresh server answering.
+func (h *stateHarness) runClientStep(step string) error {
+	switch step {
+	case "CreateRegistrationRequest":
+		request, err := h.client.CreateRegistrationRequest(h.password)
+		if err != nil {
+			return err
+		}
+
+		h.regResponse, err = h.server.CreateRegistrationResponse(request)
+
+		return err
+	case "FinalizeRegistrationRequest":
+		upload, _, err := h.client.FinalizeRegistrationRequest(h.regResponse)
+		if err != nil {
+			return err
+		}
+
+		return h.server.StoreUserRecord(upload)
+	case "CreateCredentialRequest":
+		request, err := h.client.CreateCredentialRequest([]byte(h.password))
+		if err != nil {
+			return err
+		}
+
+		s, err := NewServer(h.cfg)
+		if err != nil {
+			return err
+		}
+
+		h.credResponse, err = s.CreateCredentialResponse(request)
+
+		return err
+	case "RecoverCredentials":
+		_, _, err := h.client.RecoverCredentials(h.credResponse)
+		return err
+	}
+
+	return errors.Errorf("unknown step %s", step)
+}
+
+// runServerStep runs a server step, with the harness client sending the
+// request. Logins use a fresh client.
+func (h *stateHarness) runServerStep(step string) error {
+	switch step {
+	case "CreateRegistrationResponse":
+		request, err := h.client.CreateRegistrationRequest(h.password)
+		if err != nil {
+			return err
+		}
+
+		h.regResponse, err = h.server.CreateRegistrationResponse(request)
+
+		return err
+	case "StoreUserRecord":
+		upload, _, err := h.client.FinalizeRegistrationRequest(h.regResponse)
+		if err != nil {
+			return err
+		}
+
+		return h.server.StoreUserRecord(upload)
+	case "CreateCredentialResponse":
+		c, err := NewClient(h.username, h.cfg.ServerID, h.cfg.Suite, nil)
+		if err != nil {
+			return err
+		}
+
+		request, err := c.CreateCredentialRequest([]byte(h.password))
+		if err != nil {
+			return err
+		}
+
+		if h.upgrade {
+			policy := *h.cfg.CredentialEncodingPolicy
+			policy.Version++
+			h.cfg.CredentialEncodingPolicy = &policy
+		}
+
+		h.loginClient = c
+		h.credResponse, err = h.server.CreateCredentialResponse(request)
+
+		return err
+	case "VerifyLoginProof":
+		if _, _, err := h.loginClient.RecoverCredentials(h.credResponse); err != nil {
+			return err
+		}
+
+		proof, err := h.loginClient.ProveLogin()
+		if err != nil {
+			return err
+		}
+
+		return h.server.VerifyLoginProof(proof)
+	case "UpgradeUserRecord":
+		upload, err := h.loginClient.UpgradeRegistration()
+		if err != nil {
+			return err
+		}
+
+		return h.server.UpgradeUserRecord(upload)
+	}
+
+	return errors.Errorf("unknown step %s", step)
+}
+
+// newPathHarness returns a harness for the given path. Paths which register
+// use a new user, others log in as an existing test user. Paths which upgrade
+// the user's record use their own config, whose policy changes before the
+// login.
+func newPathHarness(cfg *ServerConfig, path []string, i int) (*stateHarness, error) {
+	upgrade := len(path) > 0 && path[len(path)-1] == "UpgradeUserRecord"
+	if upgrade {
+		var err error
+		if cfg, err = NewTestServerConfig(cfg.ServerID, cfg.Suite); err != nil {
+			return nil, err
+		}
+	}
+
+	username, password := "user1", "password1"
+	if len(path) > 0 && (path[0] == "CreateRegistrationRequest" || path[0] == "CreateRegistrationResponse") {
+		username, password = fmt.Sprintf("new user %v", i), "password"
+	}
+
+	h, err := newStateHarness(cfg, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	h.upgrade = upgrade
+
+	return h, nil
+}
+
+func checkStateError(err error) error {
+	var stateErr *StateError
+	if !errors.As(err, &stateErr) {
+		return errors.Errorf("expected a StateError, got %v", err)
+	}
+
+	if !errors.Is(err, common.ErrorInvalidState) {
+		return errors.Errorf("expected err %v to contain %v", err, common.ErrorInvalidState)
+	}
+
+	return nil
+}
+
+func TestClientIllegalTransitions(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i, path := range clientModel.paths(0, nil) {
+		h, err := newPathHarness(cfg, path, i)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, step := range path {
+			if err := h.runClientStep(step); err != nil {
+				t.Errorf("%v: legal step %s failed: %v", path, step, err)
+				return
+			}
+		}
+
+		state := clientState(clientModel.state(path))
+		if h.client.state != state {
+			t.Errorf("%v: in state %v, expected %v", path, h.client.state, state)
+			return
+		}
+
+		for step, call := range clientCalls {
+			if _, legal := clientModel[int(state)][step]; legal {
+				continue
+			}
+
+			if err := checkStateError(call(h.client)); err != nil {
+				t.Errorf("%v: illegal step %s: %v", path, step, err)
+			}
+
+			if h.client.state != state {
+				t.Errorf("%v: illegal step %s changed state to %v", path, step, h.client.state)
+			}
+		}
+	}
+}
+
+func TestServerIllegalTransitions(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i, path := range serverModel.paths(0, nil) {
+		h, err := newPathHarness(cfg, path, i)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, step := range path {
+			if err := h.runServerStep(step); err != nil {
+				t.Errorf("%v: legal step %s failed: %v", path, step, err)
+				return
+			}
+		}
+
+		state := serverState(serverModel.state(path))
+		if h.server.state != state {
+			t.Errorf("%v: in state %v, expected %v", path, h.server.state, state)
+			return
+		}
+
+		for step, call := range serverCalls {
+			if _, legal := serverModel[int(state)][step]; legal {
+				continue
+			}
+
+			if err := checkStateError(call(h.server)); err != nil {
+				t.Errorf("%v: illegal step %s: %v", path, step, err)
+			}
+
+			if h.server.state != state {
+				t.Errorf("%v: illegal step %s changed state to %v", path, step, h.server.state)
+			}
+		}
+	}
+}
+
+// nilClientCalls are the client steps whose clientCalls pass a nil message.
+var nilClientCalls = []string{"FinalizeRegistrationRequest", "RecoverCredentials"}
+
+func TestNilMessages(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Each legal step gets its own harness, numbered for the registering
+	// paths to use a new user each.
+	n := 0
+
+	for _, path := range clientModel.paths(0, nil) {
+		for _, step := range nilClientCalls {
+			if _, legal := clientModel[clientModel.state(path)][step]; !legal {
+				continue
+			}
+
+			n++
+
+			h, err := newPathHarness(cfg, path, n)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			for _, prev := range path {
+				if err := h.runClientStep(prev); err != nil {
+					t.Errorf("%v: legal step %s failed: %v", path, prev, err)
+					return
+				}
+			}
+
+			if err := clientCalls[step](h.client); !errors.Is(err, common.ErrorUnexpectedData) {
+				t.Errorf("%v: %s: expected err %v to contain %v", path, step, err, common.ErrorUnexpectedData)
+			}
+		}
+	}
+
+	for _, path := range serverModel.paths(0, nil) {
+		for _, step := range sortedSteps(serverModel[serverModel.state(path)]) {
+			n++
+
+			// The harness needs the whole path to see upgrades coming.
+			full := append(append([]string(nil), path...), step)
+
+			h, err := newPathHarness(cfg, full, n)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			for _, prev := range path {
+				if err := h.runServerStep(prev); err != nil {
+					t.Errorf("%v: legal step %s failed: %v", path, prev, err)
+					return
+				}
+			}
+
+			if err := serverCalls[step](h.server); !errors.Is(err, common.ErrorUnexpectedData) {
+				t.Errorf("%v: %s: expected err %v to contain %v", path, step, err, common.ErrorUnexpectedData)
+			}
+		}
+	}
+}
+
+func TestClientRestartAfterFailedLogin(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	h, err := newStateHarness(cfg, "user1", "not the password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := h.runClientStep("CreateCredentialRequest"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = h.runClientStep("RecoverCredentials")
+	if !errors.Is(err, common.ErrorBadEnvelope) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorBadEnvelope)
+		return
+	}
+
+	if h.client.state != clientStateStart {
+		t.Errorf("in state %v, expected %v", h.client.state, clientStateStart)
+		return
+	}
+
+	h.password = "password1"
+	for _, step := range []string{"CreateCredentialRequest", "RecoverCredentials"} {
+		if err := h.runClientStep(step); err != nil {
+			t.Errorf("%s: %v", step, err)
+			return
+		}
+	}
+}
@@ -26,7 +26,9 @@
 package opaque
 
 import (
+	"context"
 	"reflect"
+	"sync"
 
 	"github.com/cloudflare/opaque-core/common"
 	"github.com/pkg/errors"
@@ -56,3 +58,89 @@ func TestMarshalUnmarshal(data, empty common.MarshalUnmarshaler) error {
 
 	return nil
 }
+
+// TestEventSink is an EventSink for tests which keeps the events it receives
+// in memory.
+type TestEventSink struct {
+	mu     sync.Mutex
+	events []*Event
+}
+
+// Event records e.
+func (s *TestEventSink) Event(e *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, e)
+}
+
+// Events returns the events received so far, and forgets them.
+func (s *TestEventSink) Events() []*Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := s.events
+	s.events = nil
+
+	return events
+}
+
+// RecordedSpan is a span recorded by a RecordingTracer.
+type RecordedSpan struct {
+	Name   string
+	Parent *RecordedSpan // nil for a root span
+	Err    error         // last error recorded
+	Ended  bool
+}
+
+type recordedSpanKey struct{}
+
+// RecordingTracer is a Tracer for tests which keeps the spans it opens in
+// memory.
+type RecordingTracer struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+// Start records a new span, child of the span in ctx opened by this tracer if
+// any.
+func (t *RecordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(recordedSpanKey{}).(*RecordedSpan)
+	rs := &RecordedSpan{Name: name, Parent: parent}
+
+	t.mu.Lock()
+	t.spans = append(t.spans, rs)
+	t.mu.Unlock()
+
+	return context.WithValue(ctx, recordedSpanKey{}, rs), &recordingSpan{t: t, rs: rs}
+}
+
+// Spans returns the spans opened so far, in order, and forgets them.
+func (t *RecordingTracer) Spans() []*RecordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	spans := t.spans
+	t.spans = nil
+
+	return spans
+}
+
+type recordingSpan struct {
+	t  *RecordingTracer
+	rs *RecordedSpan
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	s.rs.Err = err
+}
+
+func (s *recordingSpan) End() {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	s.rs.Ended = true
+}
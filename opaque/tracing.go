@@ -0,0 +1,113 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"context"
+)
+
+// Tracer opens tracing spans around protocol steps and the operations inside
+// them. Its methods mirror those of OpenTelemetry, so that an OpenTelemetry
+// tracer can be used through a thin adapter.
+type Tracer interface {
+	// Start opens a span named name, as a child of the span in ctx if any.
+	// Returns a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is an open tracing span.
+type Span interface {
+	// RecordError records that the traced operation failed with err.
+	RecordError(err error)
+
+	// End closes the span.
+	End()
+}
+
+// NoopTracer is a Tracer which does nothing. It is used when no Tracer is
+// set.
+type NoopTracer struct{}
+
+// Start returns ctx and a span which does nothing.
+func (NoopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) RecordError(err error) {}
+
+func (noopSpan) End() {}
+
+// span is a Span opened by a Client or Server, which restores the parent
+// context of the role when it ends.
+type span struct {
+	Span
+	ctx    *context.Context
+	parent context.Context
+}
+
+// startSpan opens a span named name with tracer t. The parent is the span in
+// *ctx, or in root if *ctx is nil. *ctx holds the new span until it ends.
+func startSpan(t Tracer, root context.Context, ctx *context.Context, name string) *span {
+	if t == nil {
+		t = NoopTracer{}
+	}
+
+	parent := *ctx
+	if parent == nil {
+		parent = root
+	}
+
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	sp := &span{ctx: ctx, parent: *ctx}
+	*ctx, sp.Span = t.Start(parent, name)
+
+	return sp
+}
+
+// end records err, if any, and closes the span.
+func (sp *span) end(err error) {
+	if err != nil {
+		sp.RecordError(err)
+	}
+
+	sp.End()
+	*sp.ctx = sp.parent
+}
+
+// startSpan opens a span for a server step or operation.
+func (s *Server) startSpan(name string) *span {
+	return startSpan(s.Config.Tracer, s.Context, &s.traceCtx, name)
+}
+
+// startSpan opens a span for a client step or operation.
+func (c *Client) startSpan(name string) *span {
+	return startSpan(c.Tracer, c.Context, &c.traceCtx, name)
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+)
+
+type expectedSpan struct {
+	name   string
+	parent string // "" for a root span
+	err    common.Error
+}
+
+func checkSpans(spans []*RecordedSpan, expected []expectedSpan) error {
+	if len(spans) != len(expected) {
+		var names []string
+		for _, s := range spans {
+			names = append(names, s.Name)
+		}
+
+		return errors.Errorf("got spans %v, expected %v", names, expected)
+	}
+
+	for i, s := range spans {
+		x := expected[i]
+
+		parent := ""
+		if s.Parent != nil {
+			parent = s.Parent.Name
+		}
+
+		if s.Name != x.name || parent != x.parent {
+			return errors.Errorf("span %v: got %s (parent %q), expected %s (parent %q)", i, s.Name, parent, x.name, x.parent)
+		}
+
+		if code := common.ErrorCode(s.Err); code != x.err {
+			return errors.Errorf("span %s: got error %v, expected %v", s.Name, code, x.err)
+		}
+
+		if !s.Ended {
+			return errors.Errorf("span %s not ended", s.Name)
+		}
+	}
+
+	return nil
+}
+
+func TestLoginSpans(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	serverTracer := &RecordingTracer{}
+	clientTracer := &RecordingTracer{}
+	cfg.Tracer = serverTracer
+
+	for _, test := range []struct {
+		password   string
+		err        common.Error
+		decryptErr common.Error
+	}{
+		{"password1", common.ErrorNoError, common.ErrorNoError},
+		{"wrong password", common.ErrorBadEnvelope, common.ErrorHmacTagInvalid},
+	} {
+		h, err := newStateHarness(cfg, "user1", test.password)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		h.client.Tracer = clientTracer
+
+		if err := h.runClientStep("CreateCredentialRequest"); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err := h.runClientStep("RecoverCredentials"); common.ErrorCode(err) != test.err {
+			t.Errorf("expected error %v, got %v", test.err, err)
+			return
+		}
+
+		err = checkSpans(clientTracer.Spans(), []expectedSpan{
+			{"CreateCredentialRequest", "", common.ErrorNoError},
+			{"RecoverCredentials", "", test.err},
+			{"finalizeHarden", "RecoverCredentials", common.ErrorNoError},
+			{"DecryptCredentials", "RecoverCredentials", test.decryptErr},
+		})
+		if err != nil {
+			t.Errorf("client: %v", err)
+			return
+		}
+
+		err = checkSpans(serverTracer.Spans(), []expectedSpan{
+			{"CreateCredentialResponse", "", common.ErrorNoError},
+			{"GetUserRecordFromUsername", "CreateCredentialResponse", common.ErrorNoError},
+			{"evaluate", "CreateCredentialResponse", common.ErrorNoError},
+		})
+		if err != nil {
+			t.Errorf("server: %v", err)
+			return
+		}
+	}
+}
+
+func TestSpanParentContext(t *testing.T) {
+	cfg, err := NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tracer := &RecordingTracer{}
+	cfg.Tracer = tracer
+
+	ctx, root := tracer.Start(context.Background(), "request")
+
+	h, err := newStateHarness(cfg, "not a user", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	h.server.Context = ctx
+
+	err = h.runServerStep("CreateCredentialResponse")
+	if !errors.Is(err, common.ErrorUserNotRegistered) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUserNotRegistered)
+		return
+	}
+
+	root.End()
+
+	err = checkSpans(tracer.Spans(), []expectedSpan{
+		{"request", "", common.ErrorNoError},
+		{"CreateCredentialResponse", "request", common.ErrorUserNotRegistered},
+		{"GetUserRecordFromUsername", "CreateCredentialResponse", common.ErrorUserNotRegistered},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// All spans are closed, so the next step is a child of the parent
+	// context again.
+	if h.server.traceCtx != nil {
+		t.Error("open span context left on the server")
+		return
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint/syntax"
+)
+
+// authTagLength is the length of the auth tag of envelopes of each mode.
+var authTagLength = map[EnvelopeMode]int{
+	EnvelopeModeInternal:         sha256.Size,
+	EnvelopeModeExternal:         sha256.Size,
+	EnvelopeModeAESGCM:           16,
+	EnvelopeModeChaCha20Poly1305: 16,
+}
+
+// validateUpload checks that msg is a well formed registration upload whose
+// cleartext credentials are those of policy, with the server's public key
+// and identity and the user's identity and public key. Internal mode
+// envelopes leave out the server's public key and identity.
+func (s *Server) validateUpload(msg *RegistrationUpload, policy *CredentialEncodingPolicy) error {
+	if msg == nil {
+		return errors.Wrap(common.ErrorUnexpectedData, "no registration upload")
+	}
+
+	if msg.ClientPublicKey == nil {
+		return errors.Wrap(common.ErrorMalformedEnvelope, "no user public key")
+	}
+
+	env := msg.Envelope
+	if env == nil {
+		return errors.Wrap(common.ErrorMalformedEnvelope, "no envelope")
+	}
+
+	tagLength, ok := authTagLength[env.Mode]
+	if !ok {
+		return errors.Wrapf(common.ErrorMalformedEnvelope, "unknown envelope mode %d", env.Mode)
+	}
+
+	if len(env.AuthTag) != tagLength {
+		return errors.Wrapf(common.ErrorMalformedEnvelope, "auth tag of %d bytes", len(env.AuthTag))
+	}
+
+	if len(env.Nonce) != EnvelopeNonceLength {
+		return errors.Wrapf(common.ErrorMalformedEnvelope, "nonce of %d bytes", len(env.Nonce))
+	}
+
+	// The secret credentials list has at least its length.
+	if len(env.EncryptedCreds) < 2 {
+		return errors.Wrap(common.ErrorMalformedEnvelope, "no encrypted credentials")
+	}
+
+	var cleartext credentialExtensionListInner
+	if n, err := syntax.Unmarshal(env.AuthenticatedCreds, &cleartext); err != nil || n != len(env.AuthenticatedCreds) {
+		return errors.Wrap(common.ErrorMalformedEnvelope, "cleartext credentials do not decode")
+	}
+
+	expected := policy.CleartextTypes
+	if env.Mode == EnvelopeModeInternal {
+		expected = nil
+
+		for _, t := range policy.CleartextTypes {
+			if internalStoredType(t) {
+				expected = append(expected, t)
+			}
+		}
+	}
+
+	if len(cleartext.List) != len(expected) {
+		return errors.Wrapf(common.ErrorPolicyMismatch, "%d cleartext credentials, expected %d",
+			len(cleartext.List), len(expected))
+	}
+
+	for i, ext := range cleartext.List {
+		if ext.CredentialType != expected[i] {
+			return errors.Wrapf(common.ErrorPolicyMismatch, "cleartext credential %v, expected %v",
+				ext.CredentialType, expected[i])
+		}
+
+		if err := s.validateCredential(ext, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateCredential checks a cleartext credential of msg against the server
+// and user it should be for.
+func (s *Server) validateCredential(ext *CredentialExtension, msg *RegistrationUpload) error {
+	switch ext.CredentialType {
+	case CredentialTypeServerPublicKey:
+		serverKey, err := s.serverKey()
+		if err != nil {
+			return err
+		}
+
+		expected, err := MarshalPublicKey(serverKey.Public())
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(ext.CredentialData, expected) {
+			return common.ErrorServerKeyMismatch
+		}
+	case CredentialTypeUserPublicKey:
+		expected, err := MarshalPublicKey(msg.ClientPublicKey)
+		if err != nil {
+			return common.ErrorMalformedEnvelope.Wrap(err)
+		}
+
+		if !bytes.Equal(ext.CredentialData, expected) {
+			return common.ErrorClientKeyMismatch
+		}
+	case CredentialTypeServerIdentity:
+		if !bytes.Equal(ext.CredentialData, []byte(s.Config.ServerID)) {
+			return errors.Wrap(common.ErrorIdentityMismatch, "server identity")
+		}
+	case CredentialTypeUserIdentity:
+		if !bytes.Equal(ext.CredentialData, s.UserRecord.UserID) {
+			return errors.Wrap(common.ErrorIdentityMismatch, "user identity")
+		}
+	default:
+		if _, err := ext.parseToValue(ext.CredentialType); err != nil {
+			return common.ErrorMalformedEnvelope.Wrap(errors.Wrapf(err, "%v", ext.CredentialType))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/tatianab/mint"
+)
+
+// newTestUpload runs a registration up to the upload, returning the server
+// to store it with.
+func newTestUpload(cfg *ServerConfig, userKey PrivateKey) (*Server, *RegistrationUpload, error) {
+	s, err := NewServer(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := NewClient("user", cfg.ServerID, cfg.Suite, userKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request, err := c.CreateRegistrationRequest("password")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, err := s.CreateRegistrationResponse(request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	upload, _, err := c.FinalizeRegistrationRequest(response)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s, upload, nil
+}
+
+// setCleartext replaces the cleartext credentials of the upload.
+func setCleartext(u *RegistrationUpload, exts ...*CredentialExtension) {
+	data, err := CredentialExtensionList(exts).Marshal()
+	if err != nil {
+		panic(err)
+	}
+
+	u.Envelope.AuthenticatedCreds = data
+}
+
+func mustCredential(t CredentialType, val interface{}) *CredentialExtension {
+	ext, err := newCredentialExtension(t, val)
+	if err != nil {
+		panic(err)
+	}
+
+	return ext
+}
+
+func TestUploadValidation(t *testing.T) {
+	serverKey, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	userKey, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	otherKey, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg := &ServerConfig{
+		ServerID:    "example.com",
+		Signer:      serverKey,
+		RecordTable: make(InMemoryUserRecordTable),
+		Suite:       oprf.OPRFP256,
+		CredentialEncodingPolicy: &CredentialEncodingPolicy{
+			SecretTypes: []CredentialType{CredentialTypeUserPrivateKey},
+			CleartextTypes: []CredentialType{
+				CredentialTypeServerPublicKey,
+				CredentialTypeServerIdentity,
+				CredentialTypeUserPublicKey,
+				CredentialTypeUserIdentity,
+			},
+		},
+	}
+
+	pkS := mustCredential(CredentialTypeServerPublicKey, serverKey.Public())
+	idS := mustCredential(CredentialTypeServerIdentity, []byte(cfg.ServerID))
+	pkU := mustCredential(CredentialTypeUserPublicKey, userKey.Public())
+	idU := mustCredential(CredentialTypeUserIdentity, []byte("user"))
+
+	for _, test := range []struct {
+		name     string
+		tamper   func(u *RegistrationUpload)
+		expected common.Error
+	}{
+		{"valid", func(u *RegistrationUpload) {}, common.ErrorNoError},
+		{"no envelope", func(u *RegistrationUpload) { u.Envelope = nil }, common.ErrorMalformedEnvelope},
+		{"no user key", func(u *RegistrationUpload) { u.ClientPublicKey = nil }, common.ErrorMalformedEnvelope},
+		{"unknown mode", func(u *RegistrationUpload) { u.Envelope.Mode = 9 }, common.ErrorMalformedEnvelope},
+		{"short nonce", func(u *RegistrationUpload) { u.Envelope.Nonce = u.Envelope.Nonce[1:] }, common.ErrorMalformedEnvelope},
+		{"short tag", func(u *RegistrationUpload) { u.Envelope.AuthTag = u.Envelope.AuthTag[1:] }, common.ErrorMalformedEnvelope},
+		{"no ciphertext", func(u *RegistrationUpload) { u.Envelope.EncryptedCreds = nil }, common.ErrorMalformedEnvelope},
+		{"bad cleartext", func(u *RegistrationUpload) { u.Envelope.AuthenticatedCreds = []byte{0, 9, 1} }, common.ErrorMalformedEnvelope},
+		{"bad key", func(u *RegistrationUpload) {
+			setCleartext(u, &CredentialExtension{CredentialType: CredentialTypeServerPublicKey, CredentialData: []byte{1}}, idS, pkU, idU)
+		}, common.ErrorServerKeyMismatch},
+		{"missing", func(u *RegistrationUpload) { setCleartext(u, pkS, idS, pkU) }, common.ErrorPolicyMismatch},
+		{"extra", func(u *RegistrationUpload) { setCleartext(u, pkS, idS, pkU, idU, idU) }, common.ErrorPolicyMismatch},
+		{"reordered", func(u *RegistrationUpload) { setCleartext(u, idS, pkS, pkU, idU) }, common.ErrorPolicyMismatch},
+		{"secret in cleartext", func(u *RegistrationUpload) {
+			setCleartext(u, pkS, idS, pkU, mustCredential(CredentialTypeUserPrivateKey, userKey))
+		}, common.ErrorPolicyMismatch},
+		{"server key", func(u *RegistrationUpload) {
+			setCleartext(u, mustCredential(CredentialTypeServerPublicKey, otherKey.Public()), idS, pkU, idU)
+		}, common.ErrorServerKeyMismatch},
+		{"server identity", func(u *RegistrationUpload) {
+			setCleartext(u, pkS, mustCredential(CredentialTypeServerIdentity, []byte("example.net")), pkU, idU)
+		}, common.ErrorIdentityMismatch},
+		{"user key", func(u *RegistrationUpload) { u.ClientPublicKey = otherKey.Public() }, common.ErrorClientKeyMismatch},
+		{"user identity", func(u *RegistrationUpload) {
+			setCleartext(u, pkS, idS, pkU, mustCredential(CredentialTypeUserIdentity, []byte("mallory")))
+		}, common.ErrorIdentityMismatch},
+	} {
+		cfg.RecordTable = make(InMemoryUserRecordTable)
+
+		s, upload, err := newTestUpload(cfg, userKey)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			return
+		}
+
+		test.tamper(upload)
+
+		if code := common.ErrorCode(s.StoreUserRecord(upload)); code != test.expected {
+			t.Errorf("%s: got error %v, expected %v", test.name, code, test.expected)
+		}
+	}
+}
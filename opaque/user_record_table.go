@@ -27,12 +27,13 @@ package opaque
 
 import (
 	"crypto"
+	"io"
 	"strings"
+	"sync"
 
 	"github.com/cloudflare/circl/oprf"
 	"github.com/cloudflare/opaque-core/common"
 	"github.com/pkg/errors"
-	"github.com/tatianab/mint"
 )
 
 // UserRecord holds the data stored by the server about the user.
@@ -42,6 +43,11 @@ type UserRecord struct {
 	UserPublicKey crypto.PublicKey
 	OprfServer    *oprf.Server
 	Envelope      *Envelope
+	PolicyVersion uint16 // version of the credential encoding policy of the envelope
+
+	// ServerPublicKey is the server key the user registered with. Records
+	// without one were registered with the current Signer.
+	ServerPublicKey crypto.PublicKey
 }
 
 // UserRecordTable is an interface for password storage and lookup.
@@ -57,7 +63,14 @@ type InMemoryUserRecordTable map[string]*UserRecord
 // NewServerConfig returns a ServerConfig struct containing
 // a fresh signing key and an empty lookup table
 func NewServerConfig(domain string, suite oprf.SuiteID) (cfg *ServerConfig, err error) {
-	signer, err := mint.NewSigningKey(mint.ECDSA_P521_SHA512)
+	return NewServerConfigWithRand(domain, suite, nil)
+}
+
+// NewServerConfigWithRand is NewServerConfig with the signing key read from r,
+// which is also kept as the Rand of the config. If r is nil, crypto/rand is
+// used.
+func NewServerConfigWithRand(domain string, suite oprf.SuiteID, r io.Reader) (cfg *ServerConfig, err error) {
+	signer, err := GeneratePrivateKey(r, KeyAlgorithmP521)
 	if err != nil {
 		return nil, err
 	}
@@ -69,6 +82,7 @@ func NewServerConfig(domain string, suite oprf.SuiteID) (cfg *ServerConfig, err
 		Signer:      signer,
 		RecordTable: t,
 		Suite:       suite,
+		Rand:        r,
 	}, nil
 }
 
@@ -110,6 +124,18 @@ func (t InMemoryUserRecordTable) InsertUserRecord(username string, record *UserR
 	return nil
 }
 
+// UpdateUserRecord replaces the record of a registered user in the in-memory
+// user record table.
+func (t InMemoryUserRecordTable) UpdateUserRecord(username string, record *UserRecord) error {
+	if _, in := map[string]*UserRecord(t)[username]; !in {
+		return errors.Wrapf(common.ErrorUserNotRegistered, username)
+	}
+
+	map[string]*UserRecord(t)[username] = record
+
+	return nil
+}
+
 // BulkAdd adds the given records to the in-memory user record table.
 func (t InMemoryUserRecordTable) BulkAdd(records []*UserRecord) error {
 	for _, record := range records {
@@ -121,3 +147,46 @@ func (t InMemoryUserRecordTable) BulkAdd(records []*UserRecord) error {
 
 	return nil
 }
+
+// LockedUserRecordTable makes a UserRecordTable, such as an
+// InMemoryUserRecordTable, safe for concurrent use by serializing calls to
+// it. Implements UserRecordTable and UserRecordUpdater.
+type LockedUserRecordTable struct {
+	mu    sync.Mutex
+	table UserRecordTable
+}
+
+// NewLockedUserRecordTable returns a LockedUserRecordTable wrapping t.
+func NewLockedUserRecordTable(t UserRecordTable) *LockedUserRecordTable {
+	return &LockedUserRecordTable{table: t}
+}
+
+// InsertUserRecord adds a record to the wrapped table.
+func (t *LockedUserRecordTable) InsertUserRecord(username string, record *UserRecord) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.table.InsertUserRecord(username, record)
+}
+
+// UpdateUserRecord replaces a record in the wrapped table.
+// Errors if the wrapped table is not a UserRecordUpdater.
+func (t *LockedUserRecordTable) UpdateUserRecord(username string, record *UserRecord) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	updater, ok := t.table.(UserRecordUpdater)
+	if !ok {
+		return errors.Wrap(common.ErrorNoPasswordTable, "record table cannot update records")
+	}
+
+	return updater.UpdateUserRecord(username, record)
+}
+
+// LookupUserRecord returns a record from the wrapped table.
+func (t *LockedUserRecordTable) LookupUserRecord(username string) (*UserRecord, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.table.LookupUserRecord(username)
+}
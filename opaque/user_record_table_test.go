@@ -26,6 +26,8 @@
 package opaque
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/cloudflare/circl/oprf"
@@ -78,3 +80,51 @@ func TestInMemoryUserRecordTable(t *testing.T) {
 		return
 	}
 }
+
+// insertOnlyTable is a UserRecordTable which cannot update records.
+type insertOnlyTable struct {
+	UserRecordTable
+}
+
+func TestLockedUserRecordTable(t *testing.T) {
+	table := NewLockedUserRecordTable(NewInMemoryUserRecordTable())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			username := fmt.Sprintf("user%d", i)
+			if err := table.InsertUserRecord(username, &UserRecord{}); err != nil {
+				errs <- err
+				return
+			}
+
+			if err := table.UpdateUserRecord(username, &UserRecord{UserID: []byte(username)}); err != nil {
+				errs <- err
+				return
+			}
+
+			_, err := table.LookupUserRecord(username)
+			errs <- err
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	table = NewLockedUserRecordTable(insertOnlyTable{NewInMemoryUserRecordTable()})
+	if err := table.UpdateUserRecord("user0", &UserRecord{}); !errors.Is(err, common.ErrorNoPasswordTable) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorNoPasswordTable)
+	}
+}
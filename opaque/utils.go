@@ -92,7 +92,7 @@ func GetTestUserRecord(s *Server, username, password string) (*UserRecord, error
 		return nil, errors.Wrap(err, "new test creds")
 	}
 
-	envelope, exportedKey, err := EncryptCredentials(rwd, creds)
+	envelope, exportedKey, err := EncryptCredentialsWithRand(rwd, creds, s.Config.Rand)
 	if err != nil {
 		return nil, errors.Wrap(err, "encrypt credentials")
 	}
@@ -0,0 +1,477 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+var updateVectors = flag.Bool("update-vectors", false, "regenerate testdata/vectors.json")
+
+var vectorsPath = filepath.Join("testdata", "vectors.json")
+
+// hexBytes is encoded in JSON as a hex string.
+type hexBytes []byte
+
+func (b hexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func (b *hexBytes) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+
+	*b = data
+
+	return nil
+}
+
+// testVector is a registration followed by a login. The random values are
+// listed in the order they are read: the client reads the registration
+// blind, the envelope nonce and the login blind, and the server reads the
+// OPRF key and the login challenge. Blinds and keys are derived from their random bytes as by
+// randomScalar. Vectors without a client private key use an internal mode
+// envelope, and the others the envelope mode given, or the one-time pad.
+type testVector struct {
+	Suite    string `json:"suite"`
+	UserID   string `json:"user_id"`
+	ServerID string `json:"server_id"`
+	Password string `json:"password"`
+
+	EnvelopeMode EnvelopeMode `json:"envelope_mode,omitempty"`
+
+	// PKCS#8 private keys
+	ClientPrivateKey hexBytes `json:"client_private_key,omitempty"`
+	ServerPrivateKey hexBytes `json:"server_private_key"`
+
+	RegistrationBlindRandom hexBytes `json:"registration_blind_random"`
+	OPRFKeyRandom           hexBytes `json:"oprf_key_random"`
+	EnvelopeNonce           hexBytes `json:"envelope_nonce"`
+	LoginBlindRandom        hexBytes `json:"login_blind_random"`
+	LoginChallenge          hexBytes `json:"login_challenge"`
+
+	// Intermediate values
+	RegistrationBlind hexBytes `json:"registration_blind"`
+	OPRFKey           hexBytes `json:"oprf_key"`
+	LoginBlind        hexBytes `json:"login_blind"`
+	Rwd               hexBytes `json:"rwd"`
+	ExporterKey       hexBytes `json:"exporter_key"`
+	DerivedClientKey  hexBytes `json:"derived_client_key,omitempty"` // PKCS#8, internal mode only
+
+	// Messages, in their TLS presentation language encoding
+	RegistrationRequest  hexBytes `json:"registration_request"`
+	RegistrationResponse hexBytes `json:"registration_response"`
+	RegistrationUpload   hexBytes `json:"registration_upload"`
+	CredentialRequest    hexBytes `json:"credential_request"`
+	CredentialResponse   hexBytes `json:"credential_response"`
+}
+
+// runVector runs the protocol with the inputs and randomness of v, and
+// returns a copy of v with the intermediate values and messages filled in.
+func runVector(v *testVector) (*testVector, error) {
+	out := &testVector{
+		Suite:                   v.Suite,
+		UserID:                  v.UserID,
+		ServerID:                v.ServerID,
+		Password:                v.Password,
+		EnvelopeMode:            v.EnvelopeMode,
+		ClientPrivateKey:        v.ClientPrivateKey,
+		ServerPrivateKey:        v.ServerPrivateKey,
+		RegistrationBlindRandom: v.RegistrationBlindRandom,
+		OPRFKeyRandom:           v.OPRFKeyRandom,
+		EnvelopeNonce:           v.EnvelopeNonce,
+		LoginBlindRandom:        v.LoginBlindRandom,
+		LoginChallenge:          v.LoginChallenge,
+	}
+
+	suite, err := SuiteByName(v.Suite)
+	if err != nil {
+		return nil, err
+	}
+
+	var clientKey PrivateKey
+	if len(v.ClientPrivateKey) > 0 {
+		if clientKey, err = parseVectorKey(v.ClientPrivateKey); err != nil {
+			return nil, errors.Wrap(err, "client key")
+		}
+	}
+
+	serverKey, err := parseVectorKey(v.ServerPrivateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "server key")
+	}
+
+	cfg := &ServerConfig{
+		ServerID:    v.ServerID,
+		Signer:      serverKey,
+		RecordTable: NewInMemoryUserRecordTable(),
+		Suite:       suite,
+		Rand:        io.MultiReader(bytes.NewReader(v.OPRFKeyRandom), bytes.NewReader(v.LoginChallenge)),
+	}
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := NewClientWithRand(v.UserID, v.ServerID, suite, clientKey, io.MultiReader(
+		bytes.NewReader(v.RegistrationBlindRandom),
+		bytes.NewReader(v.EnvelopeNonce),
+		bytes.NewReader(v.LoginBlindRandom),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	c.EnvelopeMode = v.EnvelopeMode
+
+	// Registration
+	regRequest, err := c.CreateRegistrationRequest(v.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	if out.RegistrationBlind, err = c.oprf1.blind.MarshalBinary(); err != nil {
+		return nil, err
+	}
+
+	key, err := randomOPRFKey(suite, bytes.NewReader(v.OPRFKeyRandom))
+	if err != nil {
+		return nil, err
+	}
+
+	if out.OPRFKey, err = key.Serialize(); err != nil {
+		return nil, err
+	}
+
+	regResponse, err := s.CreateRegistrationResponse(regRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if out.Rwd, err = c.finalizeHarden(regResponse.OprfData); err != nil {
+		return nil, err
+	}
+
+	upload, exporterKey, err := c.FinalizeRegistrationRequest(regResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	out.ExporterKey = hexBytes(exporterKey)
+
+	if clientKey == nil {
+		derived, err := deriveClientKey(c.oprfSuite, out.Rwd, v.EnvelopeNonce)
+		if err != nil {
+			return nil, err
+		}
+
+		if out.DerivedClientKey, err = x509.MarshalPKCS8PrivateKey(derived); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.StoreUserRecord(upload); err != nil {
+		return nil, err
+	}
+
+	// Login
+	s, err = NewServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	credRequest, err := c.CreateCredentialRequest([]byte(v.Password))
+	if err != nil {
+		return nil, err
+	}
+
+	if out.LoginBlind, err = c.oprf1.blind.MarshalBinary(); err != nil {
+		return nil, err
+	}
+
+	credResponse, err := s.CreateCredentialResponse(credRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	rwd, err := c.finalizeHarden(credResponse.OprfData)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(rwd, out.Rwd) {
+		return nil, errors.New("login rwd differs from registration rwd")
+	}
+
+	_, exportKey, err := c.RecoverCredentials(credResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(exportKey, out.ExporterKey) {
+		return nil, errors.New("login export key differs from registration export key")
+	}
+
+	for _, m := range []struct {
+		msg interface{ Marshal() ([]byte, error) }
+		out *hexBytes
+	}{
+		{regRequest, &out.RegistrationRequest},
+		{regResponse, &out.RegistrationResponse},
+		{upload, &out.RegistrationUpload},
+		{credRequest, &out.CredentialRequest},
+		{credResponse, &out.CredentialResponse},
+	} {
+		if *m.out, err = m.msg.Marshal(); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+func parseVectorKey(der []byte) (*ecdsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("unexpected key type %T", key)
+	}
+
+	return ecKey, nil
+}
+
+// newVectorInputs returns the inputs of the vector for suite, read from a
+// stream derived from the suite name so that regenerating is reproducible.
+func newVectorInputs(suite string, mode EnvelopeMode) (*testVector, error) {
+	info := suite
+	internal := mode == EnvelopeModeInternal
+
+	switch mode {
+	case EnvelopeModeInternal:
+		info += " internal"
+	case EnvelopeModeAESGCM, EnvelopeModeChaCha20Poly1305:
+		info += " " + mode.String()
+	}
+
+	r := hkdf.New(sha256.New, []byte("opaque-core test vectors"), nil, []byte(info))
+
+	read := func(n int) (hexBytes, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+
+		return b, err
+	}
+
+	id, err := SuiteByName(suite)
+	if err != nil {
+		return nil, err
+	}
+
+	oprfSuite, err := getOPRFSuite(id)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &testVector{
+		Suite:    suite,
+		UserID:   "alice",
+		ServerID: "example.com",
+		Password: "correct horse battery staple",
+	}
+
+	if mode != EnvelopeModeInternal && mode != EnvelopeModeExternal {
+		v.EnvelopeMode = mode
+	}
+
+	keys := []*hexBytes{&v.ClientPrivateKey, &v.ServerPrivateKey}
+	if internal {
+		keys = keys[1:]
+	}
+
+	for _, k := range keys {
+		key, err := deterministicECDSAKey(oprfSuite.curve, r)
+		if err != nil {
+			return nil, err
+		}
+
+		if *k, err = x509.MarshalPKCS8PrivateKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	n := oprfSuite.scalarLength()
+	for _, f := range []struct {
+		out    *hexBytes
+		length int
+	}{
+		{&v.RegistrationBlindRandom, n},
+		{&v.OPRFKeyRandom, n},
+		{&v.EnvelopeNonce, EnvelopeNonceLength},
+		{&v.LoginBlindRandom, n},
+		{&v.LoginChallenge, LoginChallengeLength},
+	} {
+		if *f.out, err = read(f.length); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// deterministicECDSAKey returns a key read from r. ecdsa.GenerateKey is not
+// deterministic for a given reader.
+func deterministicECDSAKey(curve elliptic.Curve, r io.Reader) (*ecdsa.PrivateKey, error) {
+	n := curve.Params().N
+
+	b := make([]byte, (n.BitLen()+7)/8+16)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	d := new(big.Int).SetBytes(b)
+	d.Mod(d, new(big.Int).Sub(n, big.NewInt(1)))
+	d.Add(d, big.NewInt(1))
+
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(d.Bytes())
+
+	return key, nil
+}
+
+// vectorModes are the suites and envelope modes of the vectors: every suite
+// with the one-time pad in external and internal mode, and the AEAD modes.
+var vectorModes = []struct {
+	suite string
+	mode  EnvelopeMode
+}{
+	{"P256", EnvelopeModeExternal},
+	{"P384", EnvelopeModeExternal},
+	{"P521", EnvelopeModeExternal},
+	{"P256", EnvelopeModeInternal},
+	{"P384", EnvelopeModeInternal},
+	{"P521", EnvelopeModeInternal},
+	{"P256", EnvelopeModeAESGCM},
+	{"P256", EnvelopeModeChaCha20Poly1305},
+}
+
+// readVectors returns the vectors in testdata.
+func readVectors() ([]*testVector, error) {
+	data, err := ioutil.ReadFile(vectorsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var vectors []*testVector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		return nil, err
+	}
+
+	return vectors, nil
+}
+
+func TestVectors(t *testing.T) {
+	if *updateVectors {
+		var vectors []*testVector
+
+		for _, mode := range vectorModes {
+			v, err := newVectorInputs(mode.suite, mode.mode)
+			if err != nil {
+				t.Errorf("%s: %v", mode.suite, err)
+				return
+			}
+
+			if v, err = runVector(v); err != nil {
+				t.Errorf("%s: %v", mode.suite, err)
+				return
+			}
+
+			vectors = append(vectors, v)
+		}
+
+		data, err := json.MarshalIndent(vectors, "", "  ")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err := ioutil.WriteFile(vectorsPath, append(data, '\n'), 0644); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	vectors, err := readVectors()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(vectors) != len(vectorModes) {
+		t.Errorf("expected %d vectors, got %d", len(vectorModes), len(vectors))
+	}
+
+	for _, v := range vectors {
+		out, err := runVector(v)
+		if err != nil {
+			t.Errorf("%s: %v", v.Suite, err)
+			continue
+		}
+
+		expected := reflect.ValueOf(v).Elem()
+		got := reflect.ValueOf(out).Elem()
+
+		for i := 0; i < expected.NumField(); i++ {
+			if !reflect.DeepEqual(expected.Field(i).Interface(), got.Field(i).Interface()) {
+				t.Errorf("%s: %s: got %x, expected %x", v.Suite, expected.Type().Field(i).Name,
+					got.Field(i).Interface(), expected.Field(i).Interface())
+			}
+		}
+	}
+}
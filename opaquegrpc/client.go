@@ -0,0 +1,207 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaquegrpc
+
+import (
+	"context"
+	"io"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+// Client runs registration and login against the OPAQUE service.
+type Client struct {
+	rpc OPAQUEClient
+}
+
+// NewClient returns a new Client using the given connection.
+func NewClient(cc grpc.ClientConnInterface) *Client {
+	return &Client{rpc: NewOPAQUEClient(cc)}
+}
+
+// Register runs the registration flow for oc with the given password.
+// Returns the export key.
+func (c *Client) Register(ctx context.Context, oc *opaque.Client, password []byte) (opaque.ExportKey, error) {
+	stream, err := c.rpc.Register(ctx)
+	if err != nil {
+		return nil, errorFromStatus(err)
+	}
+
+	request, err := oc.CreateRegistrationRequest(string(password))
+	if err != nil {
+		return nil, errors.Wrap(err, "create registration request")
+	}
+
+	data, err := request.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stream.Send(&RegisterRequest{Step: &RegisterRequest_Request{Request: &RegistrationRequest{Data: data}}})
+	if err != nil {
+		return nil, recvError(stream, new(RegistrationResponse))
+	}
+
+	msg, err := stream.Recv()
+	if err != nil {
+		return nil, errorFromStatus(err)
+	}
+
+	response, err := decode(opaque.ProtocolMessageTypeRegistrationResponse, msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	upload, exporterKey, err := oc.FinalizeRegistrationRequest(response.(*opaque.RegistrationResponse))
+	if err != nil {
+		return nil, errors.Wrap(err, "finalize registration request")
+	}
+
+	data, err = upload.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stream.Send(&RegisterRequest{Step: &RegisterRequest_Upload{Upload: &RegistrationUpload{Data: data}}})
+	if err != nil {
+		return nil, recvError(stream, new(RegistrationResponse))
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	if err := recvError(stream, new(RegistrationResponse)); err != nil {
+		return nil, err
+	}
+
+	return exporterKey, nil
+}
+
+// Login runs the login flow for oc with the given password, proving the login
+// to the server. If the record was stored under an older policy, it is
+// upgraded to the server's current one. Returns the credentials recovered from
+// the envelope and the export key.
+func (c *Client) Login(ctx context.Context, oc *opaque.Client, password []byte) (*opaque.Credentials, opaque.ExportKey, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := c.rpc.Login(ctx)
+	if err != nil {
+		return nil, nil, errorFromStatus(err)
+	}
+
+	request, err := oc.CreateCredentialRequest(password)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create credential request")
+	}
+
+	data, err := request.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = stream.Send(&LoginRequest{Step: &LoginRequest_Request{Request: &CredentialRequest{Data: data}}})
+	if err != nil {
+		return nil, nil, recvError(stream, new(CredentialResponse))
+	}
+
+	msg, err := stream.Recv()
+	if err != nil {
+		return nil, nil, errorFromStatus(err)
+	}
+
+	response, err := decode(opaque.ProtocolMessageTypeCredentialResponse, msg.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	creds, exportKey, err := oc.RecoverCredentials(response.(*opaque.CredentialResponse))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "recover credentials")
+	}
+
+	proof, err := oc.ProveLogin()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "prove login")
+	}
+
+	data, err = proof.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = stream.Send(&LoginRequest{Step: &LoginRequest_Proof{Proof: &LoginProof{Data: data}}})
+	if err != nil {
+		return nil, nil, recvError(stream, new(CredentialResponse))
+	}
+
+	if oc.NeedsUpgrade() {
+		upload, err := oc.UpgradeRegistration()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "upgrade registration")
+		}
+
+		data, err = upload.Marshal()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = stream.Send(&LoginRequest{Step: &LoginRequest_Upgrade{Upgrade: &RegistrationUpload{Data: data}}})
+		if err != nil {
+			return nil, nil, recvError(stream, new(CredentialResponse))
+		}
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		return nil, nil, err
+	}
+
+	if err := recvError(stream, new(CredentialResponse)); err != nil {
+		return nil, nil, err
+	}
+
+	return creds, exportKey, nil
+}
+
+// recvError waits for the end of a stream, receiving any further message into
+// m. Returns nil if the server closed it successfully, and the status error
+// otherwise.
+func recvError(stream grpc.ClientStream, m interface{}) error {
+	err := stream.RecvMsg(m)
+	if err == io.EOF {
+		return nil
+	}
+
+	if err == nil {
+		return errors.Wrap(common.ErrorUnexpectedData, "unexpected message")
+	}
+
+	return errorFromStatus(err)
+}
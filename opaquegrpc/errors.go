@@ -0,0 +1,109 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaquegrpc
+
+import (
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// statusCodes maps library errors to gRPC status codes.
+var statusCodes = map[common.Error]codes.Code{
+	common.ErrorUnrecognizedMessage:   codes.InvalidArgument,
+	common.ErrorNoPasswordTable:       codes.FailedPrecondition,
+	common.ErrorUserNotRegistered:     codes.Unauthenticated,
+	common.ErrorUserAlreadyRegistered: codes.AlreadyExists,
+	common.ErrorHmacTagInvalid:        codes.InvalidArgument,
+	common.ErrorForbiddenPolicy:       codes.PermissionDenied,
+	common.ErrorUnexpectedData:        codes.InvalidArgument,
+	common.ErrorBadEnvelope:           codes.InvalidArgument,
+	common.ErrorNotFound:              codes.NotFound,
+	common.ErrorInvalidState:          codes.FailedPrecondition,
+	common.ErrorRateLimited:           codes.ResourceExhausted,
+	common.ErrorMalformedEnvelope:     codes.InvalidArgument,
+	common.ErrorPolicyMismatch:        codes.PermissionDenied,
+	common.ErrorServerKeyMismatch:     codes.InvalidArgument,
+	common.ErrorClientKeyMismatch:     codes.InvalidArgument,
+	common.ErrorIdentityMismatch:      codes.InvalidArgument,
+	common.ErrorServerNotTrusted:      codes.PermissionDenied,
+}
+
+// statusError converts err to a gRPC status error carrying its library
+// error code. Errors that already are status errors are returned as is.
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	e := common.ErrorCode(err)
+
+	code, ok := statusCodes[e]
+	if !ok {
+		code = codes.Internal
+	}
+
+	st, detailsErr := status.New(code, e.Error()).WithDetails(&Error{Code: uint32(e)})
+	if detailsErr != nil {
+		return status.Error(code, e.Error())
+	}
+
+	return st.Err()
+}
+
+// loginStatusError converts err like statusError, except that unknown users
+// and failed login proofs both get an Unauthenticated status with no library
+// error code, so that the status does not tell which of the two happened.
+func loginStatusError(err error) error {
+	switch common.ErrorCode(err) {
+	case common.ErrorUserNotRegistered, common.ErrorClientKeyMismatch:
+		return status.Error(codes.Unauthenticated, "login failed")
+	}
+
+	return statusError(err)
+}
+
+// errorFromStatus returns the library error carried by a status error, or
+// err itself if there is none.
+func errorFromStatus(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	for _, detail := range st.Details() {
+		if e, ok := detail.(*Error); ok {
+			return errors.WithStack(common.Error(e.Code))
+		}
+	}
+
+	return err
+}
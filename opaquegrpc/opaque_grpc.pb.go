@@ -0,0 +1,217 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package opaquegrpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// OPAQUEClient is the client API for OPAQUE service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type OPAQUEClient interface {
+	// Register runs a registration. The client sends a RegistrationRequest and
+	// receives a RegistrationResponse, then sends a RegistrationUpload. The
+	// server closes the stream once the user record is stored.
+	Register(ctx context.Context, opts ...grpc.CallOption) (OPAQUE_RegisterClient, error)
+	// Login runs a login. The client sends a CredentialRequest and receives a
+	// CredentialResponse, then sends a LoginProof. If the response carried an
+	// upgrade policy, the client then sends a RegistrationUpload replacing its
+	// record. The server closes the stream once the proof is verified and any
+	// upgrade is stored.
+	Login(ctx context.Context, opts ...grpc.CallOption) (OPAQUE_LoginClient, error)
+}
+
+type oPAQUEClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewOPAQUEClient(cc grpc.ClientConnInterface) OPAQUEClient {
+	return &oPAQUEClient{cc}
+}
+
+func (c *oPAQUEClient) Register(ctx context.Context, opts ...grpc.CallOption) (OPAQUE_RegisterClient, error) {
+	stream, err := c.cc.NewStream(ctx, &OPAQUE_ServiceDesc.Streams[0], "/opaque.OPAQUE/Register", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &oPAQUERegisterClient{stream}
+	return x, nil
+}
+
+type OPAQUE_RegisterClient interface {
+	Send(*RegisterRequest) error
+	Recv() (*RegistrationResponse, error)
+	grpc.ClientStream
+}
+
+type oPAQUERegisterClient struct {
+	grpc.ClientStream
+}
+
+func (x *oPAQUERegisterClient) Send(m *RegisterRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *oPAQUERegisterClient) Recv() (*RegistrationResponse, error) {
+	m := new(RegistrationResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *oPAQUEClient) Login(ctx context.Context, opts ...grpc.CallOption) (OPAQUE_LoginClient, error) {
+	stream, err := c.cc.NewStream(ctx, &OPAQUE_ServiceDesc.Streams[1], "/opaque.OPAQUE/Login", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &oPAQUELoginClient{stream}
+	return x, nil
+}
+
+type OPAQUE_LoginClient interface {
+	Send(*LoginRequest) error
+	Recv() (*CredentialResponse, error)
+	grpc.ClientStream
+}
+
+type oPAQUELoginClient struct {
+	grpc.ClientStream
+}
+
+func (x *oPAQUELoginClient) Send(m *LoginRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *oPAQUELoginClient) Recv() (*CredentialResponse, error) {
+	m := new(CredentialResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OPAQUEServer is the server API for OPAQUE service.
+// All implementations must embed UnimplementedOPAQUEServer
+// for forward compatibility
+type OPAQUEServer interface {
+	// Register runs a registration. The client sends a RegistrationRequest and
+	// receives a RegistrationResponse, then sends a RegistrationUpload. The
+	// server closes the stream once the user record is stored.
+	Register(OPAQUE_RegisterServer) error
+	// Login runs a login. The client sends a CredentialRequest and receives a
+	// CredentialResponse, then sends a LoginProof. If the response carried an
+	// upgrade policy, the client then sends a RegistrationUpload replacing its
+	// record. The server closes the stream once the proof is verified and any
+	// upgrade is stored.
+	Login(OPAQUE_LoginServer) error
+	mustEmbedUnimplementedOPAQUEServer()
+}
+
+// UnimplementedOPAQUEServer must be embedded to have forward compatible implementations.
+type UnimplementedOPAQUEServer struct {
+}
+
+func (UnimplementedOPAQUEServer) Register(OPAQUE_RegisterServer) error {
+	return status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
+func (UnimplementedOPAQUEServer) Login(OPAQUE_LoginServer) error {
+	return status.Errorf(codes.Unimplemented, "method Login not implemented")
+}
+func (UnimplementedOPAQUEServer) mustEmbedUnimplementedOPAQUEServer() {}
+
+// UnsafeOPAQUEServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to OPAQUEServer will
+// result in compilation errors.
+type UnsafeOPAQUEServer interface {
+	mustEmbedUnimplementedOPAQUEServer()
+}
+
+func RegisterOPAQUEServer(s grpc.ServiceRegistrar, srv OPAQUEServer) {
+	s.RegisterService(&OPAQUE_ServiceDesc, srv)
+}
+
+func _OPAQUE_Register_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(OPAQUEServer).Register(&oPAQUERegisterServer{stream})
+}
+
+type OPAQUE_RegisterServer interface {
+	Send(*RegistrationResponse) error
+	Recv() (*RegisterRequest, error)
+	grpc.ServerStream
+}
+
+type oPAQUERegisterServer struct {
+	grpc.ServerStream
+}
+
+func (x *oPAQUERegisterServer) Send(m *RegistrationResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *oPAQUERegisterServer) Recv() (*RegisterRequest, error) {
+	m := new(RegisterRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _OPAQUE_Login_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(OPAQUEServer).Login(&oPAQUELoginServer{stream})
+}
+
+type OPAQUE_LoginServer interface {
+	Send(*CredentialResponse) error
+	Recv() (*LoginRequest, error)
+	grpc.ServerStream
+}
+
+type oPAQUELoginServer struct {
+	grpc.ServerStream
+}
+
+func (x *oPAQUELoginServer) Send(m *CredentialResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *oPAQUELoginServer) Recv() (*LoginRequest, error) {
+	m := new(LoginRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OPAQUE_ServiceDesc is the grpc.ServiceDesc for OPAQUE service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var OPAQUE_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "opaque.OPAQUE",
+	HandlerType: (*OPAQUEServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Register",
+			Handler:       _OPAQUE_Register_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Login",
+			Handler:       _OPAQUE_Login_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "opaque.proto",
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package opaquegrpc provides a gRPC service for OPAQUE registration and
+// login, with a server driving opaque.Server and a client driving
+// opaque.Client.
+//
+// The service is defined in opaque.proto. To regenerate the Go code, run
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//		--go-grpc_out=. --go-grpc_opt=paths=source_relative opaque.proto
+package opaquegrpc
+
+import (
+	"context"
+	"io"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/peer"
+)
+
+// Server implements the OPAQUE service.
+// The RecordTable of the ServerConfig must be safe for concurrent use, e.g. a
+// LockedUserRecordTable.
+type Server struct {
+	UnimplementedOPAQUEServer
+	Config *opaque.ServerConfig
+}
+
+var _ OPAQUEServer = (*Server)(nil)
+
+// NewServer returns a new Server for the given config.
+// Errors if the config has no record table.
+func NewServer(cfg *opaque.ServerConfig) (*Server, error) {
+	if cfg.RecordTable == nil {
+		return nil, common.ErrorNoPasswordTable
+	}
+
+	// NewServer fills in the default credential encoding policy. Do it once
+	// here so that concurrent calls do not race on the shared config.
+	if _, err := opaque.NewServer(cfg); err != nil {
+		return nil, err
+	}
+
+	return &Server{Config: cfg}, nil
+}
+
+// Register runs a registration on the stream.
+func (srv *Server) Register(stream OPAQUE_RegisterServer) error {
+	return statusError(srv.register(stream))
+}
+
+func (srv *Server) register(stream OPAQUE_RegisterServer) error {
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	if msg.GetRequest() == nil {
+		return errors.Wrap(common.ErrorUnexpectedData, "expected registration request")
+	}
+
+	request, err := decode(opaque.ProtocolMessageTypeRegistrationRequest, msg.GetRequest().Data)
+	if err != nil {
+		return err
+	}
+
+	s, err := opaque.NewServer(srv.Config)
+	if err != nil {
+		return err
+	}
+
+	s.Context = stream.Context()
+
+	response, err := s.CreateRegistrationResponse(request.(*opaque.RegistrationRequest))
+	if err != nil {
+		return err
+	}
+
+	data, err := response.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if err := stream.Send(&RegistrationResponse{Data: data}); err != nil {
+		return err
+	}
+
+	msg, err = stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	if msg.GetUpload() == nil {
+		return errors.Wrap(common.ErrorUnexpectedData, "expected registration upload")
+	}
+
+	upload, err := decode(opaque.ProtocolMessageTypeRegistrationUpload, msg.GetUpload().Data)
+	if err != nil {
+		return err
+	}
+
+	return s.StoreUserRecord(upload.(*opaque.RegistrationUpload))
+}
+
+// Login runs a login on the stream. A login succeeds once the client proves
+// it, which is recorded with the AttemptLimiter of the ServerConfig. Unknown
+// users and failed proofs both end the stream with the same Unauthenticated
+// status.
+func (srv *Server) Login(stream OPAQUE_LoginServer) error {
+	return loginStatusError(srv.login(stream))
+}
+
+func (srv *Server) login(stream OPAQUE_LoginServer) error {
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	if msg.GetRequest() == nil {
+		return errors.Wrap(common.ErrorUnexpectedData, "expected credential request")
+	}
+
+	request, err := decode(opaque.ProtocolMessageTypeCredentialRequest, msg.GetRequest().Data)
+	if err != nil {
+		return err
+	}
+
+	s, err := opaque.NewServer(srv.Config)
+	if err != nil {
+		return err
+	}
+
+	s.ClientKey = clientKey(stream.Context())
+	s.Context = stream.Context()
+
+	response, err := s.CreateCredentialResponse(request.(*opaque.CredentialRequest))
+	if err != nil {
+		return err
+	}
+
+	data, err := response.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if err := stream.Send(&CredentialResponse{Data: data}); err != nil {
+		return err
+	}
+
+	msg, err = stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	if msg.GetProof() == nil {
+		return errors.Wrap(common.ErrorUnexpectedData, "expected login proof")
+	}
+
+	proof, err := decode(opaque.ProtocolMessageTypeLoginProof, msg.GetProof().Data)
+	if err != nil {
+		return err
+	}
+
+	if err := s.VerifyLoginProof(proof.(*opaque.LoginProof)); err != nil {
+		return err
+	}
+
+	if err := s.RecordLoginSuccess(); err != nil {
+		return err
+	}
+
+	msg, err = stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if msg.GetUpgrade() == nil {
+		return errors.Wrap(common.ErrorUnexpectedData, "expected record upgrade")
+	}
+
+	upload, err := decode(opaque.ProtocolMessageTypeRegistrationUpload, msg.GetUpgrade().Data)
+	if err != nil {
+		return err
+	}
+
+	// The login is proven, so an upgrade error is reported as it is.
+	return statusError(s.UpgradeUserRecord(upload.(*opaque.RegistrationUpload)))
+}
+
+// clientKey returns the host of the peer of ctx, identifying the client to
+// the AttemptLimiter of the ServerConfig as opaquehttp.RemoteHost does.
+// Returns "" if ctx has no peer address.
+func clientKey(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	return common.RemoteHost(p.Addr.String())
+}
+
+// decode decodes data as the body of a message of type t.
+func decode(t opaque.ProtocolMessageType, data []byte) (opaque.ProtocolMessageBody, error) {
+	msg := &opaque.ProtocolMessage{
+		MessageType:    t,
+		MessageBodyRaw: data,
+	}
+
+	return msg.Body()
+}
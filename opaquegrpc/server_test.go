@@ -0,0 +1,439 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaquegrpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient starts a Server on an in-memory listener and returns a
+// Client connected to it, and a function to stop both.
+func newTestClient() (*Client, *opaque.ServerConfig, func(), error) {
+	cfg, err := opaque.NewServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	cfg.RecordTable = opaque.NewLockedUserRecordTable(cfg.RecordTable)
+
+	srv, err := NewServer(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	l := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	RegisterOPAQUEServer(gs, srv)
+
+	go func() { _ = gs.Serve(l) }()
+
+	dialer := func(context.Context, string) (net.Conn, error) { return l.Dial() }
+	cc, err := grpc.Dial("bufnet", grpc.WithContextDialer(dialer), grpc.WithInsecure())
+	if err != nil {
+		gs.Stop()
+		return nil, nil, nil, err
+	}
+
+	stop := func() {
+		cc.Close()
+		gs.Stop()
+	}
+
+	return NewClient(cc), cfg, stop, nil
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	c, cfg, stop, err := newTestClient()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer stop()
+
+	signer, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx := context.Background()
+
+	oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, signer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	exporterKey, err := c.Register(ctx, oc, []byte("password"))
+	if err != nil {
+		t.Error(errors.Wrap(err, "register"))
+		return
+	}
+
+	if len(exporterKey) == 0 {
+		t.Error("exporter key not set")
+		return
+	}
+
+	oc, err = opaque.NewClient("user", cfg.ServerID, cfg.Suite, signer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	creds, exportKey, err := c.Login(ctx, oc, []byte("password"))
+	if err != nil {
+		t.Error(errors.Wrap(err, "login"))
+		return
+	}
+
+	if !bytes.Equal(exportKey, exporterKey) {
+		t.Error("login export key differs from registration export key")
+		return
+	}
+
+	serverPublicKey, ok := creds.Find(opaque.CredentialTypeServerPublicKey)
+	if !ok || !reflect.DeepEqual(serverPublicKey, cfg.Signer.Public()) {
+		t.Error("server public key not recovered")
+		return
+	}
+
+	oc, err = opaque.NewClient("user", cfg.ServerID, cfg.Suite, signer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Register twice
+	_, err = c.Register(ctx, oc, []byte("password"))
+	if !errors.Is(err, common.ErrorUserAlreadyRegistered) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUserAlreadyRegistered)
+	}
+
+	oc, err = opaque.NewClient("user", cfg.ServerID, cfg.Suite, signer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Wrong password
+	_, _, err = c.Login(ctx, oc, []byte("not the password"))
+	if !errors.Is(err, common.ErrorBadEnvelope) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorBadEnvelope)
+	}
+}
+
+func TestLoginsWithBackoffLimiter(t *testing.T) {
+	c, cfg, stop, err := newTestClient()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer stop()
+
+	// Logins count as failures until they are proven, so unproven logins
+	// would be locked out after the first free one.
+	limiter, err := opaque.NewBackoffLimiter(1, time.Hour, time.Hour)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg.AttemptLimiter = limiter
+	ctx := context.Background()
+
+	oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := c.Register(ctx, oc, []byte("password")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 5; i++ {
+		oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if _, _, err := c.Login(ctx, oc, []byte("password")); err != nil {
+			t.Errorf("login %d: %v", i, err)
+			return
+		}
+	}
+}
+
+func TestLoginUpgradesRecord(t *testing.T) {
+	c, cfg, stop, err := newTestClient()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer stop()
+
+	ctx := context.Background()
+
+	oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := c.Register(ctx, oc, []byte("password")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg.CredentialEncodingPolicy = &opaque.CredentialEncodingPolicy{
+		Version:        cfg.CredentialEncodingPolicy.Version + 1,
+		SecretTypes:    []opaque.CredentialType{opaque.CredentialTypeUserPrivateKey, opaque.CredentialTypeUserIdentity},
+		CleartextTypes: []opaque.CredentialType{opaque.CredentialTypeServerPublicKey},
+	}
+
+	for i := 0; i < 2; i++ {
+		oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if _, _, err := c.Login(ctx, oc, []byte("password")); err != nil {
+			t.Errorf("login %d: %v", i, err)
+			return
+		}
+
+		record, err := cfg.RecordTable.LookupUserRecord("user")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if record.PolicyVersion != cfg.CredentialEncodingPolicy.Version {
+			t.Errorf("login %d: got policy version %d", i, record.PolicyVersion)
+			return
+		}
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		err  common.Error
+		code codes.Code
+	}{
+		{common.ErrorUserNotRegistered, codes.Unauthenticated},
+		{common.ErrorRateLimited, codes.ResourceExhausted},
+		{common.ErrorMalformedEnvelope, codes.InvalidArgument},
+		{common.ErrorPolicyMismatch, codes.PermissionDenied},
+		{common.ErrorServerKeyMismatch, codes.InvalidArgument},
+		{common.ErrorClientKeyMismatch, codes.InvalidArgument},
+		{common.ErrorIdentityMismatch, codes.InvalidArgument},
+		{common.ErrorServerNotTrusted, codes.PermissionDenied},
+	}
+
+	for _, test := range tests {
+		err := statusError(errors.Wrap(test.err, "test"))
+
+		if code := status.Code(err); code != test.code {
+			t.Errorf("%v: expected code %v, got %v", test.err, test.code, code)
+		}
+
+		if !errors.Is(errorFromStatus(err), test.err) {
+			t.Errorf("%v: expected err %v to contain %v", test.err, errorFromStatus(err), test.err)
+		}
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	c, cfg, stop, err := newTestClient()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer stop()
+
+	ctx := context.Background()
+
+	oc, err := opaque.NewClient("not a user", "example.com", oprf.OPRFP256, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, _, err = c.Login(ctx, oc, []byte("password"))
+	if status.Code(err) != codes.Unauthenticated || common.ErrorCode(errorFromStatus(err)) != common.ErrorOtherError {
+		t.Errorf("unknown user: got err %v", err)
+	}
+
+	// A failed login proof looks the same as an unknown user.
+	unknown := status.Convert(err)
+
+	oc, err = opaque.NewClient("user", cfg.ServerID, cfg.Suite, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := c.Register(ctx, oc, []byte("password")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	oc, err = opaque.NewClient("user", cfg.ServerID, cfg.Suite, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	request, err := oc.CreateCredentialRequest([]byte("password"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := request.Marshal()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	login, err := c.rpc.Login(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := login.Send(&LoginRequest{Step: &LoginRequest_Request{Request: &CredentialRequest{Data: data}}}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := login.Recv(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	proof, err := (&opaque.LoginProof{Proof: []byte("not a signature")}).Marshal()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := login.Send(&LoginRequest{Step: &LoginRequest_Proof{Proof: &LoginProof{Data: proof}}}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	failed := status.Convert(recvError(login, new(CredentialResponse)))
+	if failed.Code() != unknown.Code() || failed.Message() != unknown.Message() {
+		t.Errorf("unknown user got %v, failed proof got %v", unknown, failed)
+	}
+
+	for _, test := range []struct {
+		name string
+		msg  *LoginRequest
+		err  common.Error
+	}{
+		{"malformed request", &LoginRequest{Step: &LoginRequest_Request{Request: &CredentialRequest{Data: []byte{1, 2, 3}}}},
+			common.ErrorUnrecognizedMessage},
+		{"proof without a request", &LoginRequest{Step: &LoginRequest_Proof{Proof: &LoginProof{Data: []byte{0, 1, 0}}}},
+			common.ErrorUnexpectedData},
+	} {
+		login, err := c.rpc.Login(ctx)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err := login.Send(test.msg); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err := recvError(login, new(CredentialResponse)); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected err %v to contain %v", test.name, err, test.err)
+		}
+	}
+
+	// Upload without a registration request
+	stream, err := c.rpc.Register(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = stream.Send(&RegisterRequest{Step: &RegisterRequest_Upload{Upload: &RegistrationUpload{}}})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := recvError(stream, new(RegistrationResponse)); !errors.Is(err, common.ErrorUnexpectedData) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUnexpectedData)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	tests := []struct {
+		addr     net.Addr
+		expected string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, "2001:db8::1"},
+		{&net.UnixAddr{Name: "/run/opaque.sock", Net: "unix"}, "/run/opaque.sock"},
+		{nil, ""},
+	}
+
+	for _, test := range tests {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: test.addr})
+		if key := clientKey(ctx); key != test.expected {
+			t.Errorf("%v: got %q, expected %q", test.addr, key, test.expected)
+		}
+	}
+
+	if key := clientKey(context.Background()); key != "" {
+		t.Errorf("no peer: got %q", key)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaquehttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+)
+
+// Client runs the OPAQUE registration and login flows against a Handler.
+type Client struct {
+	BaseURL     string       // URL the Handler is mounted at
+	HTTPClient  *http.Client // client used for requests
+	ContentType string       // encoding of messages, ContentTypeBinary or ContentTypeJSON
+}
+
+// NewClient returns a new Client for the Handler at baseURL, using the binary
+// message encoding.
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:     strings.TrimSuffix(baseURL, "/"),
+		HTTPClient:  http.DefaultClient,
+		ContentType: ContentTypeBinary,
+	}
+}
+
+// Register runs the registration flow for oc with the given password.
+// Returns the export key.
+func (c *Client) Register(ctx context.Context, oc *opaque.Client, password []byte) (opaque.ExportKey, error) {
+	request, err := oc.CreateRegistrationRequest(string(password))
+	if err != nil {
+		return nil, errors.Wrap(err, "create registration request")
+	}
+
+	msg, header, err := c.post(ctx, RegistrationRequestPath, nil, request,
+		opaque.ProtocolMessageTypeRegistrationResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	upload, exporterKey, err := oc.FinalizeRegistrationRequest(msg.(*opaque.RegistrationResponse))
+	if err != nil {
+		return nil, errors.Wrap(err, "finalize registration request")
+	}
+
+	_, _, err = c.post(ctx, RegistrationUploadPath,
+		sessionHeader(SessionHeader, header), upload, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return exporterKey, nil
+}
+
+// Login runs the login flow for oc with the given password, proving the login
+// to the server. If the record was stored under an older policy, it is
+// upgraded to the server's current one. Returns the credentials recovered from
+// the envelope and the export key.
+func (c *Client) Login(ctx context.Context, oc *opaque.Client, password []byte) (*opaque.Credentials, opaque.ExportKey, error) {
+	request, err := oc.CreateCredentialRequest(password)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create credential request")
+	}
+
+	msg, header, err := c.post(ctx, CredentialRequestPath, nil, request,
+		opaque.ProtocolMessageTypeCredentialResponse)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	creds, exportKey, err := oc.RecoverCredentials(msg.(*opaque.CredentialResponse))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "recover credentials")
+	}
+
+	proof, err := oc.ProveLogin()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "prove login")
+	}
+
+	_, header, err = c.post(ctx, LoginProofPath,
+		sessionHeader(LoginSessionHeader, header), proof, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !oc.NeedsUpgrade() {
+		return creds, exportKey, nil
+	}
+
+	upload, err := oc.UpgradeRegistration()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "upgrade registration")
+	}
+
+	_, _, err = c.post(ctx, RecordUpgradePath,
+		sessionHeader(LoginSessionHeader, header), upload, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return creds, exportKey, nil
+}
+
+// sessionHeader returns a request header echoing the session named by key in
+// the response header.
+func sessionHeader(key string, response http.Header) http.Header {
+	return http.Header{key: []string{response.Get(key)}}
+}
+
+// post sends body to path with the extra request header and decodes the
+// response as a message of type t. A zero t expects an empty response.
+func (c *Client) post(ctx context.Context, path string, header http.Header, body opaque.ProtocolMessageBody,
+	t opaque.ProtocolMessageType) (opaque.ProtocolMessageBody, http.Header, error) {
+	data, err := encodeMessage(body, c.ContentType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.BaseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", c.ContentType)
+	req.Header.Set("Accept", c.ContentType)
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, nil, errors.Wrapf(responseError(data), "%s: %s", path, resp.Status)
+	}
+
+	if t == 0 {
+		return nil, resp.Header, nil
+	}
+
+	contentType, err := mediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, common.ErrorUnrecognizedMessage.Wrap(err)
+	}
+
+	msg, err := decodeMessage(data, contentType, t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return msg, resp.Header, nil
+}
+
+// responseError decodes the library error from an error response body.
+func responseError(data []byte) error {
+	var e common.Error
+	if err := json.Unmarshal(data, &e); err != nil || e == common.ErrorNoError {
+		return common.ErrorOtherError
+	}
+
+	return e
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaquehttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint"
+)
+
+func newTestServer() (*httptest.Server, *opaque.ServerConfig, error) {
+	cfg, err := opaque.NewServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg.RecordTable = opaque.NewLockedUserRecordTable(cfg.RecordTable)
+
+	h, err := NewHandler(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return httptest.NewServer(h), cfg, nil
+}
+
+func TestClientRegisterAndLogin(t *testing.T) {
+	for _, contentType := range []string{ContentTypeBinary, ContentTypeJSON} {
+		if err := registerAndLogin(contentType); err != nil {
+			t.Errorf("%s: %v", contentType, err)
+		}
+	}
+}
+
+func registerAndLogin(contentType string) error {
+	ts, cfg, err := newTestServer()
+	if err != nil {
+		return err
+	}
+	defer ts.Close()
+
+	signer, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		return err
+	}
+
+	c := NewClient(ts.URL)
+	c.ContentType = contentType
+	ctx := context.Background()
+
+	oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, signer)
+	if err != nil {
+		return err
+	}
+
+	exporterKey, err := c.Register(ctx, oc, []byte("password"))
+	if err != nil {
+		return errors.Wrap(err, "register")
+	}
+
+	if len(exporterKey) == 0 {
+		return errors.New("exporter key not set")
+	}
+
+	oc, err = opaque.NewClient("user", cfg.ServerID, cfg.Suite, signer)
+	if err != nil {
+		return err
+	}
+
+	creds, exportKey, err := c.Login(ctx, oc, []byte("password"))
+	if err != nil {
+		return errors.Wrap(err, "login")
+	}
+
+	if !bytes.Equal(exportKey, exporterKey) {
+		return errors.New("login export key differs from registration export key")
+	}
+
+	serverPublicKey, ok := creds.Find(opaque.CredentialTypeServerPublicKey)
+	if !ok || !reflect.DeepEqual(serverPublicKey, cfg.Signer.Public()) {
+		return errors.New("server public key not recovered")
+	}
+
+	return nil
+}
+
+func TestClientLoginsWithBackoffLimiter(t *testing.T) {
+	ts, cfg, err := newTestServer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ts.Close()
+
+	// Logins count as failures until they are proven, so unproven logins
+	// would be locked out after the first free one.
+	limiter, err := opaque.NewBackoffLimiter(1, time.Hour, time.Hour)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg.AttemptLimiter = limiter
+	c := NewClient(ts.URL)
+	ctx := context.Background()
+
+	oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := c.Register(ctx, oc, []byte("password")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 5; i++ {
+		oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if _, _, err := c.Login(ctx, oc, []byte("password")); err != nil {
+			t.Errorf("login %d: %v", i, err)
+			return
+		}
+	}
+}
+
+func TestClientLoginUpgradesRecord(t *testing.T) {
+	ts, cfg, err := newTestServer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ts.Close()
+
+	c := NewClient(ts.URL)
+	ctx := context.Background()
+
+	oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := c.Register(ctx, oc, []byte("password")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	cfg.CredentialEncodingPolicy = &opaque.CredentialEncodingPolicy{
+		Version:        cfg.CredentialEncodingPolicy.Version + 1,
+		SecretTypes:    []opaque.CredentialType{opaque.CredentialTypeUserPrivateKey, opaque.CredentialTypeUserIdentity},
+		CleartextTypes: []opaque.CredentialType{opaque.CredentialTypeServerPublicKey},
+	}
+
+	for i := 0; i < 2; i++ {
+		oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if _, _, err := c.Login(ctx, oc, []byte("password")); err != nil {
+			t.Errorf("login %d: %v", i, err)
+			return
+		}
+
+		record, err := cfg.RecordTable.LookupUserRecord("user")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if record.PolicyVersion != cfg.CredentialEncodingPolicy.Version {
+			t.Errorf("login %d: got policy version %d", i, record.PolicyVersion)
+			return
+		}
+	}
+}
+
+func TestClientConcurrentLogins(t *testing.T) {
+	ts, cfg, err := newTestServer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ts.Close()
+
+	c := NewClient(ts.URL)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+
+		go func(username string) {
+			defer wg.Done()
+
+			signer, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			oc, err := opaque.NewClient(username, cfg.ServerID, cfg.Suite, signer)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if _, err := c.Register(ctx, oc, []byte("password")); err != nil {
+				errs <- errors.Wrapf(err, "register %s", username)
+				return
+			}
+
+			oc, err = opaque.NewClient(username, cfg.ServerID, cfg.Suite, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			_, _, err = c.Login(ctx, oc, []byte("password"))
+			errs <- errors.Wrapf(err, "login %s", username)
+		}(fmt.Sprintf("user%d", i))
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	ts, cfg, err := newTestServer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ts.Close()
+
+	signer, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	c := NewClient(ts.URL)
+	ctx := context.Background()
+
+	// Each flow needs a fresh opaque.Client
+	steps := []struct {
+		name     string
+		register bool
+		password string
+		err      error
+	}{
+		{"login before registering", false, "password", common.ErrorOtherError},
+		{"register", true, "password", nil},
+		{"register twice", true, "password", common.ErrorUserAlreadyRegistered},
+		{"wrong password", false, "not the password", common.ErrorBadEnvelope},
+	}
+
+	for _, step := range steps {
+		oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, signer)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if step.register {
+			_, err = c.Register(ctx, oc, []byte(step.password))
+		} else {
+			_, _, err = c.Login(ctx, oc, []byte(step.password))
+		}
+
+		if step.err == nil && err != nil {
+			t.Errorf("%s: %v", step.name, err)
+			return
+		}
+
+		if step.err != nil && !errors.Is(err, step.err) {
+			t.Errorf("%s: expected err %v to contain %v", step.name, err, step.err)
+			return
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package opaquehttp provides net/http handlers and a matching client for
+// running OPAQUE registration and login over HTTP.
+package opaquehttp
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+)
+
+// Supported content types for OPAQUE messages.
+const (
+	// ContentTypeBinary is the TLS presentation language encoding of a
+	// ProtocolMessage, including its type and length header.
+	ContentTypeBinary = "application/opaque"
+	// ContentTypeJSON is the JSON encoding of the message body.
+	ContentTypeJSON = "application/json"
+)
+
+// encodeMessage returns the encoding of body in the given content type.
+func encodeMessage(body opaque.ProtocolMessageBody, contentType string) ([]byte, error) {
+	switch contentType {
+	case ContentTypeBinary:
+		msg, err := opaque.ProtocolMessageFromBody(body)
+		if err != nil {
+			return nil, err
+		}
+
+		return msg.Marshal()
+	case ContentTypeJSON:
+		return json.Marshal(body)
+	}
+
+	return nil, errors.Errorf("unsupported content type %q", contentType)
+}
+
+// decodeMessage decodes data in the given content type into a message body,
+// which must be of type t.
+func decodeMessage(data []byte, contentType string, t opaque.ProtocolMessageType) (opaque.ProtocolMessageBody, error) {
+	switch contentType {
+	case ContentTypeBinary:
+		return decodeBinaryMessage(data, t)
+	case ContentTypeJSON:
+		return decodeJSONMessage(data, t)
+	}
+
+	return nil, errors.Wrapf(common.ErrorUnrecognizedMessage, "content type %q", contentType)
+}
+
+func decodeBinaryMessage(data []byte, t opaque.ProtocolMessageType) (opaque.ProtocolMessageBody, error) {
+	msg := &opaque.ProtocolMessage{}
+
+	bytesRead, err := msg.Unmarshal(data)
+	if err != nil {
+		return nil, common.ErrorUnrecognizedMessage.Wrap(err)
+	}
+
+	if bytesRead != len(data) {
+		return nil, errors.Wrapf(common.ErrorUnexpectedData, "%d trailing bytes", len(data)-bytesRead)
+	}
+
+	if msg.MessageType != t {
+		return nil, errors.Wrapf(common.ErrorUnexpectedData, "got %v, expected %v", msg.MessageType, t)
+	}
+
+	return msg.Body()
+}
+
+func decodeJSONMessage(data []byte, t opaque.ProtocolMessageType) (opaque.ProtocolMessageBody, error) {
+	var body opaque.ProtocolMessageBody
+	var err error
+
+	switch t {
+	case opaque.ProtocolMessageTypeRegistrationRequest:
+		body, err = opaque.UnmarshalRegistrationRequestJSON(data)
+	case opaque.ProtocolMessageTypeRegistrationResponse:
+		body, err = opaque.UnmarshalRegistrationResponseJSON(data)
+	case opaque.ProtocolMessageTypeRegistrationUpload:
+		body, err = opaque.UnmarshalRegistrationUploadJSON(data)
+	case opaque.ProtocolMessageTypeCredentialRequest:
+		body, err = opaque.UnmarshalCredentialRequestJSON(data)
+	case opaque.ProtocolMessageTypeCredentialResponse:
+		body, err = opaque.UnmarshalCredentialResponseJSON(data)
+	case opaque.ProtocolMessageTypeLoginProof:
+		body, err = opaque.UnmarshalLoginProofJSON(data)
+	default:
+		return nil, errors.Wrapf(common.ErrorUnrecognizedMessage, "message type %v", t)
+	}
+
+	if err != nil {
+		return nil, common.ErrorUnrecognizedMessage.Wrap(err)
+	}
+
+	return body, nil
+}
+
+// mediaType returns the media type of a Content-Type header value, without
+// parameters. Returns the binary content type if the header is empty.
+func mediaType(header string) (string, error) {
+	if header == "" {
+		return ContentTypeBinary, nil
+	}
+
+	mt, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", err
+	}
+
+	if mt != ContentTypeBinary && mt != ContentTypeJSON {
+		return "", errors.Errorf("unsupported content type %q", mt)
+	}
+
+	return mt, nil
+}
+
+// negotiate picks the response content type from an Accept header value.
+// The first supported media range wins; the request content type is used if
+// the header is empty or only contains wildcards.
+func negotiate(accept, requestType string) (string, bool) {
+	if accept == "" {
+		return requestType, true
+	}
+
+	for _, r := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(r))
+		if err != nil {
+			continue
+		}
+
+		switch mt {
+		case ContentTypeBinary, ContentTypeJSON:
+			return mt, true
+		case "*/*", "application/*":
+			return requestType, true
+		}
+	}
+
+	return "", false
+}
+
+// statusCodes maps library errors to HTTP status codes.
+var statusCodes = map[common.Error]int{
+	common.ErrorUnrecognizedMessage:   http.StatusBadRequest,
+	common.ErrorNoPasswordTable:       http.StatusInternalServerError,
+	common.ErrorUserNotRegistered:     http.StatusUnauthorized,
+	common.ErrorUserAlreadyRegistered: http.StatusConflict,
+	common.ErrorHmacTagInvalid:        http.StatusBadRequest,
+	common.ErrorForbiddenPolicy:       http.StatusForbidden,
+	common.ErrorUnexpectedData:        http.StatusBadRequest,
+	common.ErrorBadEnvelope:           http.StatusBadRequest,
+	common.ErrorNotFound:              http.StatusNotFound,
+	common.ErrorInvalidState:          http.StatusConflict,
+	common.ErrorRateLimited:           http.StatusTooManyRequests,
+	common.ErrorMalformedEnvelope:     http.StatusBadRequest,
+	common.ErrorPolicyMismatch:        http.StatusForbidden,
+	common.ErrorServerKeyMismatch:     http.StatusBadRequest,
+	common.ErrorClientKeyMismatch:     http.StatusBadRequest,
+	common.ErrorIdentityMismatch:      http.StatusBadRequest,
+	common.ErrorServerNotTrusted:      http.StatusForbidden,
+}
+
+// StatusCode returns the HTTP status code corresponding to err.
+func StatusCode(err error) int {
+	if status, ok := statusCodes[common.ErrorCode(err)]; ok {
+		return status
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,430 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaquehttp
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+)
+
+// Paths served by Handler.
+const (
+	RegistrationRequestPath = "/registration/request"
+	RegistrationUploadPath  = "/registration/upload"
+	CredentialRequestPath   = "/login/request"
+	LoginProofPath          = "/login/proof"
+	RecordUpgradePath       = "/login/upgrade"
+)
+
+// SessionHeader carries the identifier tying a RegistrationUpload to the
+// RegistrationRequest that started it.
+const SessionHeader = "Opaque-Registration-Session"
+
+// LoginSessionHeader carries the identifier tying a LoginProof to the
+// CredentialRequest that started the login, and a record upgrade to the
+// LoginProof preceding it.
+const LoginSessionHeader = "Opaque-Login-Session"
+
+// Defaults for Handler.
+const (
+	DefaultSessionTTL  = 5 * time.Minute
+	DefaultMaxBodySize = 1 << 20
+	DefaultMaxSessions = 10000
+)
+
+// Handler serves the OPAQUE registration and login flows over HTTP.
+// The RecordTable of the ServerConfig must be safe for concurrent use, e.g. a
+// LockedUserRecordTable.
+type Handler struct {
+	Config      *opaque.ServerConfig
+	SessionTTL  time.Duration // lifetime of a pending registration or login
+	MaxBodySize int64         // maximum size of a request body
+	MaxSessions int           // maximum number of pending registrations and logins
+
+	// ClientKey returns the key identifying the client of a login to the
+	// AttemptLimiter of the ServerConfig. Defaults to RemoteHost; replace it
+	// when running behind a proxy.
+	ClientKey func(r *http.Request) string
+
+	mux      *http.ServeMux
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// session holds the server state between the request starting a flow and the
+// one finishing it: a registration request and the matching upload, or a
+// credential request and the matching login proof.
+type session struct {
+	server  *opaque.Server
+	expires time.Time
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+// NewHandler returns a new Handler serving the given config.
+// Errors if the config has no record table.
+func NewHandler(cfg *opaque.ServerConfig) (*Handler, error) {
+	if cfg.RecordTable == nil {
+		return nil, common.ErrorNoPasswordTable
+	}
+
+	// NewServer fills in the default credential encoding policy. Do it once
+	// here so that concurrent requests do not race on the shared config.
+	if _, err := opaque.NewServer(cfg); err != nil {
+		return nil, err
+	}
+
+	h := &Handler{
+		Config:      cfg,
+		SessionTTL:  DefaultSessionTTL,
+		MaxBodySize: DefaultMaxBodySize,
+		MaxSessions: DefaultMaxSessions,
+		ClientKey:   RemoteHost,
+		mux:         http.NewServeMux(),
+		sessions:    make(map[string]*session),
+	}
+
+	h.mux.HandleFunc(RegistrationRequestPath, h.ServeRegistrationRequest)
+	h.mux.HandleFunc(RegistrationUploadPath, h.ServeRegistrationUpload)
+	h.mux.HandleFunc(CredentialRequestPath, h.ServeCredentialRequest)
+	h.mux.HandleFunc(LoginProofPath, h.ServeLoginProof)
+	h.mux.HandleFunc(RecordUpgradePath, h.ServeRecordUpgrade)
+
+	return h, nil
+}
+
+// ServeHTTP dispatches the request to the handler for its path.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// ServeRegistrationRequest handles a RegistrationRequest and responds with a
+// RegistrationResponse. The response carries a session identifier in
+// SessionHeader which must be sent back with the RegistrationUpload.
+func (h *Handler) ServeRegistrationRequest(w http.ResponseWriter, r *http.Request) {
+	msg, responseType, ok := h.readMessage(w, r, opaque.ProtocolMessageTypeRegistrationRequest)
+	if !ok {
+		return
+	}
+
+	s, err := opaque.NewServer(h.Config)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.Context = r.Context()
+
+	response, err := s.CreateRegistrationResponse(msg.(*opaque.RegistrationRequest))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	session, err := h.newSession(s)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set(SessionHeader, session)
+	writeMessage(w, responseType, response)
+}
+
+// ServeRegistrationUpload handles a RegistrationUpload for the session named
+// in SessionHeader, storing the new user record.
+// Responds with no content on success.
+func (h *Handler) ServeRegistrationUpload(w http.ResponseWriter, r *http.Request) {
+	msg, _, ok := h.readMessage(w, r, opaque.ProtocolMessageTypeRegistrationUpload)
+	if !ok {
+		return
+	}
+
+	s, ok := h.takeSession(r.Header.Get(SessionHeader))
+	if !ok {
+		writeError(w, errors.Wrap(common.ErrorNotFound, "registration session"))
+		return
+	}
+
+	if err := s.StoreUserRecord(msg.(*opaque.RegistrationUpload)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeCredentialRequest handles a CredentialRequest and responds with a
+// CredentialResponse. The response carries a session identifier in
+// LoginSessionHeader which must be sent back with the LoginProof.
+func (h *Handler) ServeCredentialRequest(w http.ResponseWriter, r *http.Request) {
+	msg, responseType, ok := h.readMessage(w, r, opaque.ProtocolMessageTypeCredentialRequest)
+	if !ok {
+		return
+	}
+
+	s, err := opaque.NewServer(h.Config)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.Context = r.Context()
+
+	if h.ClientKey != nil {
+		s.ClientKey = h.ClientKey(r)
+	}
+
+	response, err := s.CreateCredentialResponse(msg.(*opaque.CredentialRequest))
+	if err != nil {
+		writeLoginError(w, err)
+		return
+	}
+
+	session, err := h.newSession(s)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set(LoginSessionHeader, session)
+	writeMessage(w, responseType, response)
+}
+
+// ServeLoginProof handles a LoginProof for the session named in
+// LoginSessionHeader, finishing the login. Proven logins are recorded with the
+// AttemptLimiter of the ServerConfig.
+// Responds with no content on success. If the record of the user was stored
+// under an older policy, the response carries a new session identifier in
+// LoginSessionHeader which must be sent with the upgrade of the record.
+func (h *Handler) ServeLoginProof(w http.ResponseWriter, r *http.Request) {
+	msg, _, ok := h.readMessage(w, r, opaque.ProtocolMessageTypeLoginProof)
+	if !ok {
+		return
+	}
+
+	s, ok := h.takeSession(r.Header.Get(LoginSessionHeader))
+	if !ok {
+		writeError(w, errors.Wrap(common.ErrorNotFound, "login session"))
+		return
+	}
+
+	s.Context = r.Context()
+
+	if err := s.VerifyLoginProof(msg.(*opaque.LoginProof)); err != nil {
+		writeLoginError(w, err)
+		return
+	}
+
+	if err := s.RecordLoginSuccess(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if s.NeedsUpgrade() {
+		session, err := h.newSession(s)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set(LoginSessionHeader, session)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeRecordUpgrade handles a RegistrationUpload for the session named in
+// LoginSessionHeader, replacing the record of a user who just proved their
+// login with one encoded under the current policy.
+// Responds with no content on success.
+func (h *Handler) ServeRecordUpgrade(w http.ResponseWriter, r *http.Request) {
+	msg, _, ok := h.readMessage(w, r, opaque.ProtocolMessageTypeRegistrationUpload)
+	if !ok {
+		return
+	}
+
+	s, ok := h.takeSession(r.Header.Get(LoginSessionHeader))
+	if !ok {
+		writeError(w, errors.Wrap(common.ErrorNotFound, "login session"))
+		return
+	}
+
+	s.Context = r.Context()
+
+	if err := s.UpgradeUserRecord(msg.(*opaque.RegistrationUpload)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoteHost returns the host part of the remote address of r.
+func RemoteHost(r *http.Request) string {
+	return common.RemoteHost(r.RemoteAddr)
+}
+
+// readMessage checks the method and content types of r and decodes its body
+// as a message of type t. Returns the content type to respond with.
+// On failure an error response has already been written.
+func (h *Handler) readMessage(w http.ResponseWriter, r *http.Request,
+	t opaque.ProtocolMessageType) (opaque.ProtocolMessageBody, string, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeErrorStatus(w, http.StatusMethodNotAllowed, common.ErrorUnrecognizedMessage)
+		return nil, "", false
+	}
+
+	requestType, err := mediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeErrorStatus(w, http.StatusUnsupportedMediaType, common.ErrorUnrecognizedMessage)
+		return nil, "", false
+	}
+
+	responseType, ok := negotiate(r.Header.Get("Accept"), requestType)
+	if !ok {
+		writeErrorStatus(w, http.StatusNotAcceptable, common.ErrorUnrecognizedMessage)
+		return nil, "", false
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, h.MaxBodySize))
+	if err != nil {
+		writeErrorStatus(w, http.StatusRequestEntityTooLarge, common.ErrorUnexpectedData)
+		return nil, "", false
+	}
+
+	msg, err := decodeMessage(data, requestType, t)
+	if err != nil {
+		writeError(w, err)
+		return nil, "", false
+	}
+
+	return msg, responseType, true
+}
+
+// newSession stores s under a fresh random identifier and returns it.
+// Expired sessions are dropped. Identifiers always come from crypto/rand, as
+// they must not be guessable even if the protocol randomness is fixed.
+// Errors wrapping common.ErrorRateLimited if MaxSessions are pending.
+func (h *Handler) newSession(s *opaque.Server) (string, error) {
+	b, err := common.GetRandomBytes(nil, 32)
+	if err != nil {
+		return "", err
+	}
+
+	id := hex.EncodeToString(b)
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for k, v := range h.sessions {
+		if now.After(v.expires) {
+			delete(h.sessions, k)
+		}
+	}
+
+	if len(h.sessions) >= h.MaxSessions {
+		return "", errors.Wrap(common.ErrorRateLimited, "too many pending sessions")
+	}
+
+	h.sessions[id] = &session{server: s, expires: now.Add(h.SessionTTL)}
+
+	return id, nil
+}
+
+// takeSession removes and returns the server state stored under id.
+// Returns false if there is no such session or it has expired.
+func (h *Handler) takeSession(id string) (*opaque.Server, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	session, ok := h.sessions[id]
+	if !ok {
+		return nil, false
+	}
+
+	delete(h.sessions, id)
+
+	if time.Now().After(session.expires) {
+		return nil, false
+	}
+
+	return session.server, true
+}
+
+func writeMessage(w http.ResponseWriter, contentType string, body opaque.ProtocolMessageBody) {
+	data, err := encodeMessage(body, contentType)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(data)
+}
+
+// writeError writes the library error carried by err, with the status code
+// given by StatusCode.
+func writeError(w http.ResponseWriter, err error) {
+	writeErrorStatus(w, StatusCode(err), err)
+}
+
+// writeLoginError writes err like writeError, except that unknown users and
+// failed login proofs both get an Unauthorized response with no library error
+// code, so that the error does not tell which of the two happened. A
+// registered user still gets a credential response whatever the password, as
+// only the client can check it.
+func writeLoginError(w http.ResponseWriter, err error) {
+	switch common.ErrorCode(err) {
+	case common.ErrorUserNotRegistered, common.ErrorClientKeyMismatch:
+		writeErrorStatus(w, http.StatusUnauthorized, common.ErrorOtherError)
+	default:
+		writeError(w, err)
+	}
+}
+
+// writeErrorStatus writes the library error carried by err as a JSON error
+// code. The cause is not included so as not to leak server details.
+func writeErrorStatus(w http.ResponseWriter, status int, err error) {
+	data, jsonErr := common.MarshalErrorAsJSON(common.ErrorCode(err))
+	if jsonErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
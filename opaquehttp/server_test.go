@@ -0,0 +1,586 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaquehttp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+)
+
+func newTestHandler() (*Handler, error) {
+	cfg, err := opaque.NewTestServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.RecordTable = opaque.NewLockedUserRecordTable(cfg.RecordTable)
+
+	return NewHandler(cfg)
+}
+
+func newCredentialRequest(username string) (*opaque.CredentialRequest, error) {
+	c, err := opaque.NewClient(username, "example.com", oprf.OPRFP256, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.CreateCredentialRequest([]byte("password1"))
+}
+
+func serve(h http.Handler, method, path, contentType, accept string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	return w
+}
+
+func checkError(w *httptest.ResponseRecorder, status int, expected common.Error) error {
+	if w.Code != status {
+		return errors.Errorf("incorrect status: got %v, expected %v", w.Code, status)
+	}
+
+	var e common.Error
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		return errors.Wrap(err, "decode error")
+	}
+
+	if e != expected {
+		return errors.Errorf("incorrect error: got %v, expected %v", e, expected)
+	}
+
+	return nil
+}
+
+func TestServeCredentialRequestContentNegotiation(t *testing.T) {
+	h, err := newTestHandler()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	request, err := newCredentialRequest("user1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tests := []struct {
+		contentType string
+		accept      string
+		expected    string
+	}{
+		{ContentTypeBinary, "", ContentTypeBinary},
+		{ContentTypeJSON, "", ContentTypeJSON},
+		{ContentTypeBinary, ContentTypeJSON, ContentTypeJSON},
+		{ContentTypeJSON, "text/html, " + ContentTypeBinary, ContentTypeBinary},
+		{ContentTypeJSON, "*/*", ContentTypeJSON},
+	}
+
+	for _, test := range tests {
+		body, err := encodeMessage(request, test.contentType)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		w := serve(h, http.MethodPost, CredentialRequestPath, test.contentType, test.accept, body)
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: incorrect status %v", test, w.Code)
+			continue
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != test.expected {
+			t.Errorf("%v: incorrect content type %v", test, ct)
+			continue
+		}
+
+		if _, err := decodeMessage(w.Body.Bytes(), test.expected, opaque.ProtocolMessageTypeCredentialResponse); err != nil {
+			t.Errorf("%v: %v", test, err)
+		}
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	h, err := newTestHandler()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	request, err := newCredentialRequest("user1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	body, err := encodeMessage(request, ContentTypeBinary)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	unknown, err := newCredentialRequest("not a user")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	unknownBody, err := encodeMessage(unknown, ContentTypeBinary)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	garbage := make([]byte, 64)
+	_, _ = rand.Read(garbage)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		accept      string
+		body        []byte
+		status      int
+		err         common.Error
+	}{
+		{"method", http.MethodGet, CredentialRequestPath, ContentTypeBinary, "", body,
+			http.StatusMethodNotAllowed, common.ErrorUnrecognizedMessage},
+		{"content type", http.MethodPost, CredentialRequestPath, "text/plain", "", body,
+			http.StatusUnsupportedMediaType, common.ErrorUnrecognizedMessage},
+		{"accept", http.MethodPost, CredentialRequestPath, ContentTypeBinary, "text/plain", body,
+			http.StatusNotAcceptable, common.ErrorUnrecognizedMessage},
+		{"garbage", http.MethodPost, CredentialRequestPath, ContentTypeBinary, "", garbage,
+			http.StatusBadRequest, common.ErrorUnrecognizedMessage},
+		{"wrong message", http.MethodPost, RegistrationRequestPath, ContentTypeBinary, "", body,
+			http.StatusBadRequest, common.ErrorUnexpectedData},
+		{"trailing data", http.MethodPost, CredentialRequestPath, ContentTypeBinary, "", append(body, 0),
+			http.StatusBadRequest, common.ErrorUnexpectedData},
+		{"unknown user", http.MethodPost, CredentialRequestPath, ContentTypeBinary, "", unknownBody,
+			http.StatusUnauthorized, common.ErrorOtherError},
+		{"bad upload", http.MethodPost, RegistrationUploadPath, ContentTypeJSON, "",
+			[]byte(`{"UserPublicKey":null}`), http.StatusBadRequest, common.ErrorUnrecognizedMessage},
+	}
+
+	for _, test := range tests {
+		w := serve(h, test.method, test.path, test.contentType, test.accept, test.body)
+		if err := checkError(w, test.status, test.err); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{common.ErrorUserNotRegistered, http.StatusUnauthorized},
+		{common.ErrorRateLimited, http.StatusTooManyRequests},
+		{common.ErrorMalformedEnvelope, http.StatusBadRequest},
+		{common.ErrorPolicyMismatch, http.StatusForbidden},
+		{common.ErrorServerKeyMismatch, http.StatusBadRequest},
+		{common.ErrorClientKeyMismatch, http.StatusBadRequest},
+		{errors.Wrap(common.ErrorIdentityMismatch, "server identity"), http.StatusBadRequest},
+		{errors.Wrap(common.ErrorServerNotTrusted, "server key"), http.StatusForbidden},
+		{errors.New("unknown"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		if status := StatusCode(test.err); status != test.status {
+			t.Errorf("%v: expected status %v, got %v", test.err, test.status, status)
+		}
+	}
+}
+
+func TestServeRegistrationUploadSession(t *testing.T) {
+	h, err := newTestHandler()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	c, err := opaque.NewClient("new user", "example.com", oprf.OPRFP256, h.Config.Signer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	request, err := c.CreateRegistrationRequest("password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	body, err := encodeMessage(request, ContentTypeBinary)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	w := serve(h, http.MethodPost, RegistrationRequestPath, ContentTypeBinary, "", body)
+	if w.Code != http.StatusOK {
+		t.Errorf("incorrect status %v", w.Code)
+		return
+	}
+
+	session := w.Header().Get(SessionHeader)
+	if session == "" {
+		t.Error("session not set")
+		return
+	}
+
+	msg, err := decodeMessage(w.Body.Bytes(), ContentTypeBinary, opaque.ProtocolMessageTypeRegistrationResponse)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	upload, _, err := c.FinalizeRegistrationRequest(msg.(*opaque.RegistrationResponse))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	body, err = encodeMessage(upload, ContentTypeBinary)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Unknown session
+	w = serve(h, http.MethodPost, RegistrationUploadPath, ContentTypeBinary, "", body)
+	if err := checkError(w, http.StatusNotFound, common.ErrorNotFound); err != nil {
+		t.Error(err)
+		return
+	}
+
+	req := httptest.NewRequest(http.MethodPost, RegistrationUploadPath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", ContentTypeBinary)
+	req.Header.Set(SessionHeader, session)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("incorrect status %v", w.Code)
+		return
+	}
+
+	if _, err := h.Config.RecordTable.LookupUserRecord("new user"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Sessions are single use
+	req = httptest.NewRequest(http.MethodPost, RegistrationUploadPath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", ContentTypeBinary)
+	req.Header.Set(SessionHeader, session)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if err := checkError(w, http.StatusNotFound, common.ErrorNotFound); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeLoginProofSession(t *testing.T) {
+	h, err := newTestHandler()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	c, err := opaque.NewClient("user1", "example.com", oprf.OPRFP256, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	request, err := c.CreateCredentialRequest([]byte("password1"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	body, err := encodeMessage(request, ContentTypeBinary)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	w := serve(h, http.MethodPost, CredentialRequestPath, ContentTypeBinary, "", body)
+	if w.Code != http.StatusOK {
+		t.Errorf("incorrect status %v", w.Code)
+		return
+	}
+
+	session := w.Header().Get(LoginSessionHeader)
+	if session == "" {
+		t.Error("session not set")
+		return
+	}
+
+	msg, err := decodeMessage(w.Body.Bytes(), ContentTypeBinary, opaque.ProtocolMessageTypeCredentialResponse)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, _, err := c.RecoverCredentials(msg.(*opaque.CredentialResponse)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	proof, err := c.ProveLogin()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	body, err = encodeMessage(proof, ContentTypeBinary)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Unknown session
+	w = serve(h, http.MethodPost, LoginProofPath, ContentTypeBinary, "", body)
+	if err := checkError(w, http.StatusNotFound, common.ErrorNotFound); err != nil {
+		t.Error(err)
+		return
+	}
+
+	prove := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, LoginProofPath, bytes.NewReader(body))
+		req.Header.Set("Content-Type", ContentTypeBinary)
+		req.Header.Set(LoginSessionHeader, session)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w = prove()
+	if w.Code != http.StatusNoContent {
+		t.Errorf("incorrect status %v", w.Code)
+		return
+	}
+
+	// The record is current, so no session is kept for an upgrade.
+	if w.Header().Get(LoginSessionHeader) != "" {
+		t.Error("upgrade session set")
+		return
+	}
+
+	// Sessions are single use
+	if err := checkError(prove(), http.StatusNotFound, common.ErrorNotFound); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeLoginFailuresLookAlike(t *testing.T) {
+	h, err := newTestHandler()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	login := func(username string) (*httptest.ResponseRecorder, error) {
+		request, err := newCredentialRequest(username)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := encodeMessage(request, ContentTypeBinary)
+		if err != nil {
+			return nil, err
+		}
+
+		return serve(h, http.MethodPost, CredentialRequestPath, ContentTypeBinary, "", body), nil
+	}
+
+	unknown, err := login("unknown user")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	w, err := login("user1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	body, err := encodeMessage(&opaque.LoginProof{Proof: []byte("not a signature")}, ContentTypeBinary)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	req := httptest.NewRequest(http.MethodPost, LoginProofPath, bytes.NewReader(body))
+	req.Header.Set("Content-Type", ContentTypeBinary)
+	req.Header.Set(LoginSessionHeader, w.Header().Get(LoginSessionHeader))
+	failed := httptest.NewRecorder()
+	h.ServeHTTP(failed, req)
+
+	if err := checkError(failed, http.StatusUnauthorized, common.ErrorOtherError); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if unknown.Code != failed.Code || !bytes.Equal(unknown.Body.Bytes(), failed.Body.Bytes()) {
+		t.Errorf("unknown user got %v %q, failed proof got %v %q",
+			unknown.Code, unknown.Body.Bytes(), failed.Code, failed.Body.Bytes())
+	}
+}
+
+func TestServeMaxSessions(t *testing.T) {
+	h, err := newTestHandler()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	h.MaxSessions = 1
+
+	request, err := newCredentialRequest("user1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	body, err := encodeMessage(request, ContentTypeBinary)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	w := serve(h, http.MethodPost, CredentialRequestPath, ContentTypeBinary, "", body)
+	if w.Code != http.StatusOK {
+		t.Errorf("incorrect status %v", w.Code)
+		return
+	}
+
+	w = serve(h, http.MethodPost, CredentialRequestPath, ContentTypeBinary, "", body)
+	if err := checkError(w, http.StatusTooManyRequests, common.ErrorRateLimited); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Expired sessions make room for new ones.
+	h.SessionTTL = 0
+	h.sessions = make(map[string]*session)
+
+	for i := 0; i < 2; i++ {
+		w = serve(h, http.MethodPost, CredentialRequestPath, ContentTypeBinary, "", body)
+		if w.Code != http.StatusOK {
+			t.Errorf("%d: incorrect status %v", i, w.Code)
+			return
+		}
+	}
+}
+
+func TestServeCredentialRequestRateLimited(t *testing.T) {
+	h, err := newTestHandler()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	limiter, err := opaque.NewTokenBucketLimiter(0.001, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	h.Config.AttemptLimiter = limiter
+
+	login := func(username string) (*httptest.ResponseRecorder, error) {
+		request, err := newCredentialRequest(username)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := encodeMessage(request, ContentTypeBinary)
+		if err != nil {
+			return nil, err
+		}
+
+		return serve(h, http.MethodPost, CredentialRequestPath, ContentTypeBinary, "", body), nil
+	}
+
+	w, err := login("user1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if w.Code != http.StatusOK {
+		t.Errorf("incorrect status %v", w.Code)
+		return
+	}
+
+	// The same client is limited even for another user.
+	w, err = login("user2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := checkError(w, http.StatusTooManyRequests, common.ErrorRateLimited); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// A different client key is not.
+	h.ClientKey = func(r *http.Request) string { return "another client" }
+
+	w, err = login("user2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if w.Code != http.StatusOK {
+		t.Errorf("incorrect status %v", w.Code)
+		return
+	}
+}
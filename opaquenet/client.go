@@ -0,0 +1,121 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaquenet
+
+import (
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+)
+
+// Register runs the registration flow for oc with the given password on c.
+// Returns the export key.
+func (c *Conn) Register(oc *opaque.Client, password []byte) (opaque.ExportKey, error) {
+	request, err := oc.CreateRegistrationRequest(string(password))
+	if err != nil {
+		return nil, errors.Wrap(err, "create registration request")
+	}
+
+	if err := c.WriteMessage(request); err != nil {
+		return nil, err
+	}
+
+	response, err := c.ReadBody(opaque.ProtocolMessageTypeRegistrationResponse)
+	if err != nil {
+		return nil, errors.Wrap(err, "read registration response")
+	}
+
+	upload, exporterKey, err := oc.FinalizeRegistrationRequest(response.(*opaque.RegistrationResponse))
+	if err != nil {
+		return nil, errors.Wrap(err, "finalize registration request")
+	}
+
+	if err := c.WriteMessage(upload); err != nil {
+		return nil, err
+	}
+
+	if err := c.ReadAlert(); err != nil {
+		return nil, errors.Wrap(err, "store user record")
+	}
+
+	return exporterKey, nil
+}
+
+// Login runs the login flow for oc with the given password on c, proving the
+// login to the server. If the record was stored under an older policy, it is
+// upgraded to the server's current one. Returns the credentials recovered from
+// the envelope and the export key.
+func (c *Conn) Login(oc *opaque.Client, password []byte) (*opaque.Credentials, opaque.ExportKey, error) {
+	request, err := oc.CreateCredentialRequest(password)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create credential request")
+	}
+
+	if err := c.WriteMessage(request); err != nil {
+		return nil, nil, err
+	}
+
+	response, err := c.ReadBody(opaque.ProtocolMessageTypeCredentialResponse)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read credential response")
+	}
+
+	creds, exportKey, err := oc.RecoverCredentials(response.(*opaque.CredentialResponse))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "recover credentials")
+	}
+
+	proof, err := oc.ProveLogin()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "prove login")
+	}
+
+	if err := c.WriteMessage(proof); err != nil {
+		return nil, nil, err
+	}
+
+	if err := c.ReadAlert(); err != nil {
+		return nil, nil, errors.Wrap(err, "verify login proof")
+	}
+
+	if !oc.NeedsUpgrade() {
+		return creds, exportKey, nil
+	}
+
+	upload, err := oc.UpgradeRegistration()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "upgrade registration")
+	}
+
+	if err := c.WriteMessage(upload); err != nil {
+		return nil, nil, err
+	}
+
+	if err := c.ReadAlert(); err != nil {
+		return nil, nil, errors.Wrap(err, "upgrade user record")
+	}
+
+	return creds, exportKey, nil
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package opaquenet runs OPAQUE registration and login over a byte stream
+// such as a net.Conn.
+//
+// Each ProtocolMessage is written in its TLS presentation language encoding:
+// a 1-byte message type and a 3-byte length, followed by the message body.
+// In addition to the OPAQUE message types, the server sends an alert
+// (message type 255) holding a 1-byte common.Error to report the outcome of
+// a registration, or to report an error before closing the connection.
+package opaquenet
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+)
+
+// ProtocolMessageTypeAlert is the message type of an alert.
+const ProtocolMessageTypeAlert opaque.ProtocolMessageType = 255
+
+const (
+	headerLength = 4
+
+	// MaxMessageLength is the largest body length that fits in the header.
+	MaxMessageLength = 1<<24 - 1
+	// DefaultMaxMessageSize is the default limit on the body length of a
+	// received message.
+	DefaultMaxMessageSize = 1 << 16
+)
+
+// Conn reads and writes framed OPAQUE protocol messages on a net.Conn.
+type Conn struct {
+	net.Conn
+	MaxMessageSize int           // maximum body length of a received message
+	ReadTimeout    time.Duration // if non-zero, deadline for reading each message
+	WriteTimeout   time.Duration // if non-zero, deadline for writing each message
+
+	// MessageHook, if set, is called with every message body written by
+	// WriteMessage or read by ReadBody, e.g. to log the exchange.
+	MessageHook func(sent bool, body opaque.ProtocolMessageBody)
+}
+
+// NewConn returns a new Conn wrapping c, with the default maximum message
+// size and no timeouts.
+func NewConn(c net.Conn) *Conn {
+	return &Conn{
+		Conn:           c,
+		MaxMessageSize: DefaultMaxMessageSize,
+	}
+}
+
+// Dial connects to the OPAQUE server at the given address.
+func Dial(network, address string) (*Conn, error) {
+	c, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewConn(c), nil
+}
+
+// ReadMessage reads the next framed message, which may be an alert.
+// Returns io.EOF if the connection was closed before a new message started.
+// Errors if the message body is longer than MaxMessageSize.
+func (c *Conn) ReadMessage() (*opaque.ProtocolMessage, error) {
+	if c.ReadTimeout != 0 {
+		if err := c.SetReadDeadline(time.Now().Add(c.ReadTimeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	var header [headerLength]byte
+	if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+		return nil, err
+	}
+
+	msgType := opaque.ProtocolMessageType(header[0])
+	length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+
+	if length > c.MaxMessageSize {
+		return nil, errors.Wrapf(common.ErrorUnexpectedData, "message length %d exceeds %d", length, c.MaxMessageSize)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.Conn, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return &opaque.ProtocolMessage{
+		MessageType:    msgType,
+		MessageBodyRaw: body,
+	}, nil
+}
+
+// ReadBody reads the next framed message and decodes its body.
+// Returns the carried error if the message is an alert.
+// Errors if the message is not of type t.
+func (c *Conn) ReadBody(t opaque.ProtocolMessageType) (opaque.ProtocolMessageBody, error) {
+	msg, err := c.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.MessageType == ProtocolMessageTypeAlert {
+		if err := alertError(msg.MessageBodyRaw); err != nil {
+			return nil, err
+		}
+	}
+
+	if msg.MessageType != t {
+		return nil, errors.Wrapf(common.ErrorUnexpectedData, "got %v, expected %v", msg.MessageType, t)
+	}
+
+	body, err := msg.Body()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.MessageHook != nil {
+		c.MessageHook(false, body)
+	}
+
+	return body, nil
+}
+
+// ReadAlert reads the next framed message, which must be an alert.
+// Returns the carried error, or nil if the alert reports success.
+func (c *Conn) ReadAlert() error {
+	msg, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	if msg.MessageType != ProtocolMessageTypeAlert {
+		return errors.Wrapf(common.ErrorUnexpectedData, "got %v, expected alert", msg.MessageType)
+	}
+
+	return alertError(msg.MessageBodyRaw)
+}
+
+// WriteMessage frames and writes the given message body.
+func (c *Conn) WriteMessage(body opaque.ProtocolMessageBody) error {
+	msg, err := opaque.ProtocolMessageFromBody(body)
+	if err != nil {
+		return err
+	}
+
+	if c.MessageHook != nil {
+		c.MessageHook(true, body)
+	}
+
+	return c.writeFrame(msg.MessageType, msg.MessageBodyRaw)
+}
+
+// WriteAlert writes an alert carrying the library error of err.
+// A nil err reports success.
+func (c *Conn) WriteAlert(err error) error {
+	return c.writeFrame(ProtocolMessageTypeAlert, []byte{byte(common.ErrorCode(err))})
+}
+
+func (c *Conn) writeFrame(t opaque.ProtocolMessageType, body []byte) error {
+	if len(body) > MaxMessageLength {
+		return errors.Wrapf(common.ErrorUnexpectedData, "message length %d exceeds %d", len(body), MaxMessageLength)
+	}
+
+	if c.WriteTimeout != 0 {
+		if err := c.SetWriteDeadline(time.Now().Add(c.WriteTimeout)); err != nil {
+			return err
+		}
+	}
+
+	frame := make([]byte, headerLength+len(body))
+	frame[0] = byte(t)
+	frame[1] = byte(len(body) >> 16)
+	frame[2] = byte(len(body) >> 8)
+	frame[3] = byte(len(body))
+	copy(frame[headerLength:], body)
+
+	_, err := c.Conn.Write(frame)
+
+	return err
+}
+
+// alertError returns the error carried by an alert body, or nil for success.
+func alertError(body []byte) error {
+	if len(body) != 1 {
+		return errors.Wrapf(common.ErrorUnexpectedData, "alert length %d", len(body))
+	}
+
+	if e := common.Error(body[0]); e != common.ErrorNoError {
+		return e
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaquenet
+
+import (
+	"crypto/rand"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+)
+
+func newPipe() (*Conn, *Conn) {
+	c1, c2 := net.Pipe()
+	return NewConn(c1), NewConn(c2)
+}
+
+func TestConnReadWriteMessage(t *testing.T) {
+	c1, c2 := newPipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	oprfData := make([]byte, 32)
+	_, _ = rand.Read(oprfData)
+
+	cr1 := &opaque.CredentialRequest{
+		UserID:   []byte("username"),
+		OprfData: oprfData,
+	}
+
+	var sent, received []opaque.ProtocolMessageBody
+
+	c1.MessageHook = func(isSent bool, body opaque.ProtocolMessageBody) {
+		if isSent {
+			sent = append(sent, body)
+		}
+	}
+	c2.MessageHook = func(isSent bool, body opaque.ProtocolMessageBody) {
+		if !isSent {
+			received = append(received, body)
+		}
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- c1.WriteMessage(cr1) }()
+
+	cr2, err := c2.ReadBody(opaque.ProtocolMessageTypeCredentialRequest)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := <-errs; err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !reflect.DeepEqual(cr1, cr2) {
+		t.Errorf("messages not equal: %v, %v", cr1, cr2)
+	}
+
+	if len(sent) != 1 || sent[0] != cr1 || len(received) != 1 || received[0] != cr2 {
+		t.Errorf("incorrect hook calls: sent %v, received %v", sent, received)
+	}
+
+	// A message of another type
+	go func() { errs <- c1.WriteMessage(cr1) }()
+
+	_, err = c2.ReadBody(opaque.ProtocolMessageTypeRegistrationRequest)
+	if !errors.Is(err, common.ErrorUnexpectedData) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUnexpectedData)
+	}
+
+	// Rejected messages are not passed to the hook.
+	if len(received) != 1 {
+		t.Errorf("incorrect hook calls: received %v", received)
+	}
+}
+
+func TestConnMaxMessageSize(t *testing.T) {
+	c1, c2 := newPipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	c2.MaxMessageSize = 16
+
+	go func() { _ = c1.writeFrame(opaque.ProtocolMessageTypeCredentialRequest, make([]byte, 17)) }()
+
+	_, err := c2.ReadMessage()
+	if !errors.Is(err, common.ErrorUnexpectedData) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUnexpectedData)
+	}
+
+	if err := c1.writeFrame(ProtocolMessageTypeAlert, make([]byte, MaxMessageLength+1)); !errors.Is(err, common.ErrorUnexpectedData) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUnexpectedData)
+	}
+}
+
+func TestConnReadTimeout(t *testing.T) {
+	c1, c2 := newPipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	c2.ReadTimeout = 10 * time.Millisecond
+
+	_, err := c2.ReadMessage()
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("expected timeout, got %v", err)
+	}
+}
+
+func TestConnAlert(t *testing.T) {
+	c1, c2 := newPipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() { _ = c1.WriteAlert(errors.Wrap(common.ErrorUserNotRegistered, "user")) }()
+
+	_, err := c2.ReadBody(opaque.ProtocolMessageTypeCredentialResponse)
+	if !errors.Is(err, common.ErrorUserNotRegistered) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUserNotRegistered)
+	}
+
+	go func() { _ = c1.WriteAlert(nil) }()
+
+	if err := c2.ReadAlert(); err != nil {
+		t.Error(err)
+	}
+}
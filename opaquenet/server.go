@@ -0,0 +1,253 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaquenet
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+)
+
+// Server serves OPAQUE registration and login on stream connections.
+// The RecordTable of the ServerConfig must be safe for concurrent use, e.g. a
+// LockedUserRecordTable.
+type Server struct {
+	Config         *opaque.ServerConfig
+	MaxMessageSize int           // maximum body length of a received message
+	ReadTimeout    time.Duration // if non-zero, deadline for reading each message
+	WriteTimeout   time.Duration // if non-zero, deadline for writing each message
+}
+
+// serverState is the state of a connection on the server.
+type serverState int
+
+const (
+	// stateIdle waits for a RegistrationRequest or CredentialRequest.
+	stateIdle serverState = iota
+	// stateAwaitUpload waits for the RegistrationUpload finishing a
+	// registration.
+	stateAwaitUpload
+	// stateAwaitProof waits for the LoginProof finishing a login.
+	stateAwaitProof
+	// stateAwaitUpgrade waits for a RegistrationUpload upgrading the record
+	// of a proven login. The client may also start over instead.
+	stateAwaitUpgrade
+)
+
+// NewServer returns a new Server for the given config.
+// Errors if the config has no record table.
+func NewServer(cfg *opaque.ServerConfig) (*Server, error) {
+	if cfg.RecordTable == nil {
+		return nil, common.ErrorNoPasswordTable
+	}
+
+	// NewServer fills in the default credential encoding policy. Do it once
+	// here so that concurrent connections do not race on the shared config.
+	if _, err := opaque.NewServer(cfg); err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		Config:         cfg,
+		MaxMessageSize: DefaultMaxMessageSize,
+	}, nil
+}
+
+// Serve accepts connections on l and serves each in its own goroutine.
+// Returns the error that stopped the listener.
+func (srv *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer c.Close()
+			_ = srv.ServeConn(c)
+		}()
+	}
+}
+
+// ServeConn runs registrations and logins on c until the client closes it.
+// A registration, the proof finishing a login, or the upgrade of an outdated
+// record following the proof, is answered with an alert reporting its
+// outcome. Proven logins are recorded with the AttemptLimiter of the
+// ServerConfig.
+// On error, an alert is sent to the client and the error is returned; the
+// caller is responsible for closing c.
+func (srv *Server) ServeConn(c net.Conn) error {
+	conn := &Conn{
+		Conn:           c,
+		MaxMessageSize: srv.MaxMessageSize,
+		ReadTimeout:    srv.ReadTimeout,
+		WriteTimeout:   srv.WriteTimeout,
+	}
+
+	state := stateIdle
+	var s *opaque.Server
+
+	for {
+		msg, err := conn.ReadMessage()
+		if err == io.EOF && state == stateAwaitProof {
+			// The client gave up on the login, e.g. after a wrong password.
+			return s.RecordLoginFailure()
+		}
+
+		if err == io.EOF && (state == stateIdle || state == stateAwaitUpgrade) {
+			return nil
+		}
+
+		if err != nil {
+			return srv.fail(conn, err)
+		}
+
+		body, err := msg.Body()
+		if err != nil {
+			return srv.fail(conn, err)
+		}
+
+		if _, ok := body.(*opaque.LoginProof); state == stateAwaitProof && !ok {
+			// The client started over without proving its login.
+			if err := s.RecordLoginFailure(); err != nil {
+				return srv.fail(conn, err)
+			}
+
+			state = stateIdle
+		}
+
+		if _, ok := body.(*opaque.RegistrationUpload); state == stateAwaitUpgrade && !ok {
+			// The client started over without upgrading its record.
+			state = stateIdle
+		}
+
+		switch state {
+		case stateIdle:
+			s, err = opaque.NewServer(srv.Config)
+			if err != nil {
+				return srv.fail(conn, err)
+			}
+
+			s.ClientKey = remoteHost(c)
+
+			switch body := body.(type) {
+			case *opaque.RegistrationRequest:
+				response, err := s.CreateRegistrationResponse(body)
+				if err != nil {
+					return srv.fail(conn, err)
+				}
+
+				if err := conn.WriteMessage(response); err != nil {
+					return err
+				}
+
+				state = stateAwaitUpload
+			case *opaque.CredentialRequest:
+				response, err := s.CreateCredentialResponse(body)
+				if err != nil {
+					return srv.fail(conn, err)
+				}
+
+				if err := conn.WriteMessage(response); err != nil {
+					return err
+				}
+
+				state = stateAwaitProof
+			default:
+				return srv.fail(conn, errors.Wrapf(common.ErrorUnexpectedData, "unexpected %v", msg.MessageType))
+			}
+		case stateAwaitUpload:
+			upload, ok := body.(*opaque.RegistrationUpload)
+			if !ok {
+				return srv.fail(conn, errors.Wrapf(common.ErrorUnexpectedData, "unexpected %v", msg.MessageType))
+			}
+
+			if err := s.StoreUserRecord(upload); err != nil {
+				return srv.fail(conn, err)
+			}
+
+			if err := conn.WriteAlert(nil); err != nil {
+				return err
+			}
+
+			state = stateIdle
+		case stateAwaitProof:
+			proof, ok := body.(*opaque.LoginProof)
+			if !ok {
+				return srv.fail(conn, errors.Wrapf(common.ErrorUnexpectedData, "unexpected %v", msg.MessageType))
+			}
+
+			if err := s.VerifyLoginProof(proof); err != nil {
+				return srv.fail(conn, err)
+			}
+
+			if err := s.RecordLoginSuccess(); err != nil {
+				return srv.fail(conn, err)
+			}
+
+			if err := conn.WriteAlert(nil); err != nil {
+				return err
+			}
+
+			state = stateIdle
+			if s.NeedsUpgrade() {
+				state = stateAwaitUpgrade
+			}
+		case stateAwaitUpgrade:
+			if err := s.UpgradeUserRecord(body.(*opaque.RegistrationUpload)); err != nil {
+				return srv.fail(conn, err)
+			}
+
+			if err := conn.WriteAlert(nil); err != nil {
+				return err
+			}
+
+			state = stateIdle
+		}
+	}
+}
+
+// remoteHost returns the host of the remote address of c, identifying the
+// client to the AttemptLimiter of the ServerConfig as opaquehttp.RemoteHost
+// does. Returns "" if c has no remote address.
+func remoteHost(c net.Conn) string {
+	addr := c.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+
+	return common.RemoteHost(addr.String())
+}
+
+// fail reports err to the client in an alert, and returns it.
+func (srv *Server) fail(conn *Conn, err error) error {
+	_ = conn.WriteAlert(err)
+	return err
+}
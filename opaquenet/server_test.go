@@ -0,0 +1,356 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package opaquenet
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+	"github.com/tatianab/mint"
+)
+
+func newTestServer() (*Server, error) {
+	cfg, err := opaque.NewServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.RecordTable = opaque.NewLockedUserRecordTable(cfg.RecordTable)
+
+	return NewServer(cfg)
+}
+
+func registerAndLogin(c *Conn, cfg *opaque.ServerConfig) error {
+	signer, err := mint.NewSigningKey(mint.ECDSA_P256_SHA256)
+	if err != nil {
+		return err
+	}
+
+	oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, signer)
+	if err != nil {
+		return err
+	}
+
+	exporterKey, err := c.Register(oc, []byte("password"))
+	if err != nil {
+		return errors.Wrap(err, "register")
+	}
+
+	if len(exporterKey) == 0 {
+		return errors.New("exporter key not set")
+	}
+
+	oc, err = opaque.NewClient("user", cfg.ServerID, cfg.Suite, signer)
+	if err != nil {
+		return err
+	}
+
+	creds, exportKey, err := c.Login(oc, []byte("password"))
+	if err != nil {
+		return errors.Wrap(err, "login")
+	}
+
+	if !bytes.Equal(exportKey, exporterKey) {
+		return errors.New("login export key differs from registration export key")
+	}
+
+	serverPublicKey, ok := creds.Find(opaque.CredentialTypeServerPublicKey)
+	if !ok || !reflect.DeepEqual(serverPublicKey, cfg.Signer.Public()) {
+		return errors.New("server public key not recovered")
+	}
+
+	oc, err = opaque.NewClient("user", cfg.ServerID, cfg.Suite, signer)
+	if err != nil {
+		return err
+	}
+
+	// Registering again on the same connection fails
+	_, err = c.Register(oc, []byte("password"))
+	if !errors.Is(err, common.ErrorUserAlreadyRegistered) {
+		return errors.Errorf("expected err %v to contain %v", err, common.ErrorUserAlreadyRegistered)
+	}
+
+	return nil
+}
+
+func TestRegisterAndLoginPipe(t *testing.T) {
+	srv, err := newTestServer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		defer c2.Close()
+		errs <- srv.ServeConn(c2)
+	}()
+
+	if err := registerAndLogin(NewConn(c1), srv.Config); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The server stops on the failed registration
+	if err := <-errs; !errors.Is(err, common.ErrorUserAlreadyRegistered) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUserAlreadyRegistered)
+	}
+}
+
+func TestRegisterAndLoginTCP(t *testing.T) {
+	srv, err := newTestServer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer l.Close()
+
+	go func() { _ = srv.Serve(l) }()
+
+	c, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+
+	if err := registerAndLogin(c, srv.Config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoginsWithBackoffLimiter(t *testing.T) {
+	srv, err := newTestServer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Logins count as failures until they are proven, so unproven logins
+	// would be locked out after the first free one.
+	limiter, err := opaque.NewBackoffLimiter(1, time.Hour, time.Hour)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	srv.Config.AttemptLimiter = limiter
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		defer c2.Close()
+		errs <- srv.ServeConn(c2)
+	}()
+
+	c := NewConn(c1)
+
+	oc, err := opaque.NewClient("user", srv.Config.ServerID, srv.Config.Suite, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := c.Register(oc, []byte("password")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// A wrong password abandons the login, and the connection can be used
+	// again.
+	for i, password := range []string{"not the password", "password", "password", "password", "password"} {
+		oc, err := opaque.NewClient("user", srv.Config.ServerID, srv.Config.Suite, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, _, err = c.Login(oc, []byte(password))
+		if i == 0 && !errors.Is(err, common.ErrorBadEnvelope) {
+			t.Errorf("expected err %v to contain %v", err, common.ErrorBadEnvelope)
+			return
+		}
+
+		if i > 0 && err != nil {
+			t.Errorf("login %d: %v", i, err)
+			return
+		}
+	}
+
+	c1.Close()
+
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoginUpgradesRecord(t *testing.T) {
+	srv, err := newTestServer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		defer c2.Close()
+		errs <- srv.ServeConn(c2)
+	}()
+
+	c := NewConn(c1)
+	cfg := srv.Config
+
+	oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := c.Register(oc, []byte("password")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	version := cfg.CredentialEncodingPolicy.Version
+	cfg.CredentialEncodingPolicy = &opaque.CredentialEncodingPolicy{
+		Version:        version + 1,
+		SecretTypes:    []opaque.CredentialType{opaque.CredentialTypeUserPrivateKey, opaque.CredentialTypeUserIdentity},
+		CleartextTypes: []opaque.CredentialType{opaque.CredentialTypeServerPublicKey},
+	}
+
+	// A client refusing the new policy leaves the record as it is, and the
+	// connection can be used again.
+	for i, acceptor := range []opaque.PolicyAcceptor{&opaque.PolicyRequirements{MinVersion: version + 2}, nil, nil} {
+		oc, err := opaque.NewClient("user", cfg.ServerID, cfg.Suite, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		oc.PolicyAcceptor = acceptor
+
+		_, _, err = c.Login(oc, []byte("password"))
+		if i == 0 && !errors.Is(err, common.ErrorForbiddenPolicy) {
+			t.Errorf("expected err %v to contain %v", err, common.ErrorForbiddenPolicy)
+			return
+		}
+
+		if i > 0 && err != nil {
+			t.Errorf("login %d: %v", i, err)
+			return
+		}
+
+		record, err := cfg.RecordTable.LookupUserRecord("user")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		expected := version + 1
+		if i == 0 {
+			expected = version
+		}
+
+		if record.PolicyVersion != expected {
+			t.Errorf("login %d: got policy version %d, expected %d", i, record.PolicyVersion, expected)
+			return
+		}
+	}
+
+	c1.Close()
+
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeConnErrors(t *testing.T) {
+	srv, err := newTestServer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	oc, err := opaque.NewClient("user", "example.com", oprf.OPRFP256, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Unknown user
+	c1, c2 := newPipe()
+	go func() { _ = srv.ServeConn(c2) }()
+
+	_, _, err = c1.Login(oc, []byte("password"))
+	if !errors.Is(err, common.ErrorUserNotRegistered) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUserNotRegistered)
+	}
+
+	c1.Close()
+	c2.Close()
+
+	// Upload without a registration request
+	c1, c2 = newPipe()
+	go func() { _ = srv.ServeConn(c2) }()
+
+	upload := &opaque.RegistrationUpload{
+		Envelope:        &opaque.Envelope{EncryptedCreds: []byte{1}, AuthTag: []byte{1}},
+		ClientPublicKey: srv.Config.Signer.Public(),
+	}
+
+	if err := c1.WriteMessage(upload); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := c1.ReadAlert(); !errors.Is(err, common.ErrorUnexpectedData) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorUnexpectedData)
+	}
+
+	c1.Close()
+	c2.Close()
+}
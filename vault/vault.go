@@ -0,0 +1,258 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package vault encrypts client data under the OPAQUE export key, so that it
+// unlocks only with the user's password and a server storing it only ever
+// holds ciphertext.
+//
+// Each blob starts with a header naming the format version and the key it is
+// encrypted under, followed by a random nonce and the AES-256-GCM ciphertext:
+//
+//	     4         1         8        12
+//	| "OPQV" | version | keyID | nonce | ciphertext |
+//
+// The header is authenticated with the ciphertext. The key and key ID are
+// derived from the export key, so a password change, which changes the export
+// key, gives a new vault key. To rotate, the client logs in with the old
+// password, registers the new one, and re-encrypts its blobs with Rotate on
+// a vault with the new key as current and the old one as previous.
+package vault
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+)
+
+// Version1 is the format of blobs encrypted with AES-256-GCM.
+const Version1 = 1
+
+// Lengths of the parts of a blob header.
+const (
+	KeyIDLength  = 8
+	NonceLength  = 12
+	HeaderLength = len(magic) + 1 + KeyIDLength + NonceLength
+)
+
+const magic = "OPQV"
+
+// Export labels of the vault key and its ID.
+const (
+	keyLabel   = "OPAQUE-Vault key"
+	keyIDLabel = "OPAQUE-Vault key ID"
+)
+
+// A Header is the cleartext start of a blob.
+type Header struct {
+	Version uint8
+	KeyID   []byte
+	Nonce   []byte
+}
+
+// ParseHeader returns the header of blob, which shares its memory.
+// Errors wrapping common.ErrorUnrecognizedMessage if blob is not a vault blob
+// of a known version.
+func ParseHeader(blob []byte) (*Header, error) {
+	if len(blob) < HeaderLength || !bytes.HasPrefix(blob, []byte(magic)) {
+		return nil, errors.Wrap(common.ErrorUnrecognizedMessage, "not a vault blob")
+	}
+
+	h := &Header{
+		Version: blob[len(magic)],
+		KeyID:   blob[len(magic)+1 : len(magic)+1+KeyIDLength],
+		Nonce:   blob[len(magic)+1+KeyIDLength : HeaderLength],
+	}
+
+	if h.Version != Version1 {
+		return nil, errors.Wrapf(common.ErrorUnrecognizedMessage, "vault version %d", h.Version)
+	}
+
+	return h, nil
+}
+
+// marshal returns the encoding of the header.
+func (h *Header) marshal() []byte {
+	out := make([]byte, 0, HeaderLength)
+	out = append(out, magic...)
+	out = append(out, h.Version)
+	out = append(out, h.KeyID...)
+
+	return append(out, h.Nonce...)
+}
+
+// A Key encrypts and decrypts blobs. It is derived from an export key, and
+// optionally the name of a vault, so that one export key can key several
+// independent vaults.
+type Key struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// NewKey returns the key for the vault called name of the user with the given
+// export key.
+func NewKey(exportKey opaque.ExportKey, name string) (*Key, error) {
+	key, err := exportKey.Export(keyLabel, []byte(name), 32)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := exportKey.Export(keyIDLabel, []byte(name), KeyIDLength)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{id: id, aead: aead}, nil
+}
+
+// ID returns the key ID written in the headers of blobs encrypted under k.
+func (k *Key) ID() []byte {
+	return append([]byte{}, k.id...)
+}
+
+// Vault encrypts blobs under its current key, and decrypts blobs under its
+// current or previous keys.
+type Vault struct {
+	current  *Key
+	previous []*Key
+
+	Rand io.Reader // optional, source of nonces, crypto/rand if nil
+}
+
+// New returns a vault encrypting under current, which also decrypts blobs
+// encrypted under the previous keys, e.g. those of the export keys of earlier
+// passwords.
+func New(current *Key, previous ...*Key) *Vault {
+	return &Vault{current: current, previous: previous}
+}
+
+// FromExportKey returns a vault encrypting under the key for the vault called
+// name of the user with the given export key.
+func FromExportKey(exportKey opaque.ExportKey, name string) (*Vault, error) {
+	key, err := NewKey(exportKey, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(key), nil
+}
+
+// Seal encrypts plaintext under the current key, authenticating
+// additionalData with it. The same additionalData must be given to Open.
+func (v *Vault) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	nonce, err := common.GetRandomBytes(v.Rand, NonceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: Version1, KeyID: v.current.id, Nonce: nonce}
+	header := h.marshal()
+
+	return v.current.aead.Seal(header, nonce, plaintext, aad(header, additionalData)), nil
+}
+
+// Open returns the plaintext of blob.
+// Errors wrapping common.ErrorNotFound if the blob is under none of the
+// vault's keys, and common.ErrorHmacTagInvalid if it fails to authenticate.
+func (v *Vault) Open(blob, additionalData []byte) ([]byte, error) {
+	h, err := ParseHeader(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	key := v.key(h.KeyID)
+	if key == nil {
+		return nil, errors.Wrapf(common.ErrorNotFound, "vault key %x", h.KeyID)
+	}
+
+	plaintext, err := key.aead.Open(nil, h.Nonce, blob[HeaderLength:], aad(blob[:HeaderLength], additionalData))
+	if err != nil {
+		return nil, common.ErrorHmacTagInvalid.Wrap(err)
+	}
+
+	return plaintext, nil
+}
+
+// NeedsRotation reports whether blob is encrypted under a key other than the
+// current one.
+func (v *Vault) NeedsRotation(blob []byte) (bool, error) {
+	h, err := ParseHeader(blob)
+	if err != nil {
+		return false, err
+	}
+
+	return !bytes.Equal(h.KeyID, v.current.id), nil
+}
+
+// Rotate returns blob encrypted under the current key. Blobs already under it
+// are returned unchanged.
+func (v *Vault) Rotate(blob, additionalData []byte) ([]byte, error) {
+	rotate, err := v.NeedsRotation(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	if !rotate {
+		return blob, nil
+	}
+
+	plaintext, err := v.Open(blob, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.Seal(plaintext, additionalData)
+}
+
+// key returns the key of the vault with the given ID, or nil.
+func (v *Vault) key(id []byte) *Key {
+	for _, k := range append([]*Key{v.current}, v.previous...) {
+		if bytes.Equal(k.id, id) {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// aad returns the additional data authenticated with a blob: its header, and
+// the caller's additional data.
+func aad(header, additionalData []byte) []byte {
+	return append(append([]byte{}, header...), additionalData...)
+}
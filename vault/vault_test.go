@@ -0,0 +1,314 @@
+// Copyright (c) 2020, Cloudflare. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+// 3. Neither the name of the copyright holder nor the names of its contributors
+// may be used to endorse or promote products derived from this software without
+// specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/opaque-core/common"
+	"github.com/cloudflare/opaque-core/opaque"
+	"github.com/pkg/errors"
+)
+
+func randomExportKey(t *testing.T) opaque.ExportKey {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	v, err := FromExportKey(randomExportKey(t), "backups")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	plaintext := []byte("end-to-end encrypted")
+	ad := []byte("backup 1")
+
+	blob, err := v.Seal(plaintext, ad)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	h, err := ParseHeader(blob)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if h.Version != Version1 || !bytes.Equal(h.KeyID, v.current.ID()) {
+		t.Errorf("incorrect header %+v", h)
+	}
+
+	if bytes.Contains(blob, plaintext) {
+		t.Error("plaintext in blob")
+	}
+
+	out, err := v.Open(blob, ad)
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(out, plaintext) {
+		t.Errorf("got %q, expected %q", out, plaintext)
+	}
+
+	// Flipping any bit of the blob, including its header, fails to open it.
+	for i := range blob {
+		tampered := append([]byte{}, blob...)
+		tampered[i] ^= 1
+
+		if _, err := v.Open(tampered, ad); err == nil {
+			t.Errorf("opened blob with byte %d modified", i)
+		}
+	}
+
+	if _, err := v.Open(blob, []byte("backup 2")); !errors.Is(err, common.ErrorHmacTagInvalid) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorHmacTagInvalid)
+	}
+
+	other, err := FromExportKey(randomExportKey(t), "backups")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := other.Open(blob, ad); !errors.Is(err, common.ErrorNotFound) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorNotFound)
+	}
+
+	for _, bad := range [][]byte{nil, blob[:HeaderLength-1], append([]byte("OPQW"), blob[4:]...)} {
+		if _, err := v.Open(bad, ad); !errors.Is(err, common.ErrorUnrecognizedMessage) {
+			t.Errorf("expected err %v to contain %v", err, common.ErrorUnrecognizedMessage)
+		}
+	}
+}
+
+func TestVaultNames(t *testing.T) {
+	exportKey := randomExportKey(t)
+
+	backups, err := NewKey(exportKey, "backups")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	notes, err := NewKey(exportKey, "notes")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if bytes.Equal(backups.ID(), notes.ID()) {
+		t.Error("vaults of different names have the same key")
+	}
+
+	blob, err := New(backups).Seal([]byte("data"), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := New(notes).Open(blob, nil); err == nil {
+		t.Error("opened blob of another vault")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	oldKey, err := NewKey(randomExportKey(t), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	newKey, err := NewKey(randomExportKey(t), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	blob, err := New(oldKey).Seal([]byte("data"), []byte("ad"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	v := New(newKey, oldKey)
+
+	if rotate, err := v.NeedsRotation(blob); err != nil || !rotate {
+		t.Errorf("old blob needs no rotation: %v", err)
+	}
+
+	if _, err := v.Open(blob, []byte("ad")); err != nil {
+		t.Errorf("open old blob: %v", err)
+	}
+
+	rotated, err := v.Rotate(blob, []byte("ad"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if rotate, err := v.NeedsRotation(rotated); err != nil || rotate {
+		t.Errorf("rotated blob needs rotation: %v", err)
+	}
+
+	again, err := v.Rotate(rotated, []byte("ad"))
+	if err != nil || !bytes.Equal(again, rotated) {
+		t.Errorf("rotated blob changed: %v", err)
+	}
+
+	// Once the old key is dropped, only the rotated blob opens.
+	if _, err := New(newKey).Open(rotated, []byte("ad")); err != nil {
+		t.Errorf("open rotated blob: %v", err)
+	}
+
+	if _, err := New(newKey).Open(blob, []byte("ad")); !errors.Is(err, common.ErrorNotFound) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorNotFound)
+	}
+
+	if _, err := v.Rotate(blob, []byte("other")); !errors.Is(err, common.ErrorHmacTagInvalid) {
+		t.Errorf("expected err %v to contain %v", err, common.ErrorHmacTagInvalid)
+	}
+}
+
+func TestVaultWithLogin(t *testing.T) {
+	cfg, err := opaque.NewServerConfig("example.com", oprf.OPRFP256)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	register := func(username, password string) (opaque.ExportKey, error) {
+		s, err := opaque.NewServer(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := opaque.NewClient(username, cfg.ServerID, cfg.Suite, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		request, err := c.CreateRegistrationRequest(password)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := s.CreateRegistrationResponse(request)
+		if err != nil {
+			return nil, err
+		}
+
+		upload, exportKey, err := c.FinalizeRegistrationRequest(response)
+		if err != nil {
+			return nil, err
+		}
+
+		return exportKey, s.StoreUserRecord(upload)
+	}
+
+	login := func(username, password string) (opaque.ExportKey, error) {
+		s, err := opaque.NewServer(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := opaque.NewClient(username, cfg.ServerID, cfg.Suite, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		request, err := c.CreateCredentialRequest([]byte(password))
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := s.CreateCredentialResponse(request)
+		if err != nil {
+			return nil, err
+		}
+
+		_, exportKey, err := c.RecoverCredentials(response)
+
+		return exportKey, err
+	}
+
+	exportKey, err := register("alice", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	v, err := FromExportKey(exportKey, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	blob, err := v.Seal([]byte("secret"), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	exportKey, err = login("alice", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if v, err = FromExportKey(exportKey, ""); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if out, err := v.Open(blob, nil); err != nil || !bytes.Equal(out, []byte("secret")) {
+		t.Errorf("open after login: %q, %v", out, err)
+	}
+
+	// A user with another password gets another vault key.
+	exportKey, err = register("bob", "other password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if v, err = FromExportKey(exportKey, ""); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := v.Open(blob, nil); err == nil {
+		t.Error("opened blob with another export key")
+	}
+}